@@ -1,144 +1,201 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/queue"
 )
 
 const (
-	downloadTimeout = 90 * time.Second // Timeout for downloading PDFs
-	maxRetries      = 5                // Maximum number of retries for failed downloads
-	initialDelay    = 10 * time.Second  // Initial delay for retries
-	maxDelay        = 50 * time.Second // Maximum delay for retries
+	maxRetries   = 5                // Maximum number of retries for failed downloads
+	initialDelay = 10 * time.Second // Initial delay for retries
+	maxDelay     = 50 * time.Second // Maximum delay for retries
 )
 
 var (
 	delayedQueue = make(chan string, 10000) // Increased buffer size for delayed requests
 	wg           sync.WaitGroup             // WaitGroup to wait for all downloads to complete
+
+	downloadTimeout = 90 * time.Second // Timeout for downloading PDFs
+	tlsPolicy       = crawlkit.TLSPolicy{}
+	shutdown        *crawlkit.Shutdown      // Cancels downloads on Ctrl+C
+	canon           *crawlkit.Canonicalizer // Turns URLs into dedup keys (url_rules)
+	polite          *crawlkit.Politeness    // Per-host rate limits with adaptive backoff
+	classifier      *crawlkit.Classifier    // Decides which links are documents
+	namer           *crawlkit.Namer         // Names saved files (name_template, on_collision)
+	scope           *crawlkit.Scope         // Which pages may be crawled (excluded_domains, scope_file)
+	archive         *crawlkit.WARCWriter    // Archives pages and downloads as WARC (warc_dir)
+	budget          *crawlkit.Budget        // Page, byte and time limits (max_pages, max_mb, max_time, host_max_*)
+	ftpClient       *crawlkit.FTPClient     // Passive-mode FTP for ftp:// documents and directories
+	proxies         *crawlkit.Proxies       // Rotating proxy pool and per-rule proxies (proxies, scope rule proxy)
 )
 
 func main() {
-	// Prompt for network interface
-	interfaces, err := net.Interfaces()
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+		Workers:         8,
+		DownloadTimeout: crawlkit.Duration{Duration: downloadTimeout},
+		TLS:             tlsPolicy,
+	})
 	if err != nil {
-		log.Fatalf("Error listing network interfaces: %s", err)
+		log.Fatalf("Error loading configuration: %s", err)
 	}
+	downloadTimeout = cfg.DownloadTimeout.Duration
+	tlsPolicy = cfg.TLS
 
-	fmt.Println("Available network interfaces:")
-	for i, iface := range interfaces {
-		fmt.Printf("%d: %s\n", i+1, iface.Name)
+	// Resolve the network interface (prompts only when run from a terminal)
+	localIP, err := cfg.ResolveLocalIP()
+	if err != nil {
+		log.Fatalf("Error selecting network interface: %s", err)
 	}
 
-	var selectedIndex int
-	fmt.Println("Select the network interface to use (enter the number): ")
-	fmt.Scanln(&selectedIndex)
-
-	if selectedIndex < 1 || selectedIndex > len(interfaces) {
-		log.Fatalf("Invalid network interface selection")
+	// Route requests through the -proxy pool and the scope rules' proxies
+	proxies, err = cfg.Proxies()
+	if err != nil {
+		log.Fatalf("Error setting up proxies: %s", err)
 	}
 
-	selectedInterface := interfaces[selectedIndex-1]
-
 	// Set up HTTP transport to use the selected interface
-	transport := &http.Transport{
-		Dial: (&net.Dialer{
-			LocalAddr: &net.TCPAddr{
-				IP: getInterfaceIP(selectedInterface),
-			},
-		}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
+	transport := proxies.Transport(tlsPolicy.Apply(&http.Transport{
+		Dial:            crawlkit.Dialer(localIP).Dial,
+		TLSClientConfig: tlsPolicy.ClientConfig(),
+	}))
+
+	selectedDir, err := cfg.ResolveOutputDir("pdf-scrape")
+	if err != nil {
+		log.Fatalf("Error selecting download directory: %s", err)
 	}
 
-	// Prompt for download directory
-	dirs, err := os.ReadDir(".")
+	startURLs, err := cfg.ResolveStartURLs()
 	if err != nil {
-		log.Fatalf("Error reading current directory: %s", err)
+		log.Fatalf("Error reading starting URL: %s", err)
 	}
 
-	dirList := []os.DirEntry{}
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			dirList = append(dirList, dir)
+	// Canonical URLs are the dedup keys colly checks before revisiting
+	canon = cfg.Canonicalizer()
+
+	var startingURLs []string
+	for _, startingURL := range startURLs {
+		startingURL, err = canon.Canonicalize(startingURL)
+		if err != nil {
+			log.Fatalf("Error canonicalizing starting URL: %s", err)
 		}
+		if err := validateURL(startingURL); err != nil {
+			log.Fatalf("Error validating starting URL: %s", err)
+		}
+		startingURLs = append(startingURLs, startingURL)
 	}
 
-	fmt.Println("Available directories:")
-	for i, dir := range dirList {
-		fmt.Printf("%d: %s\n", i+1, dir.Name())
+	// Links are followed only where the scope rules (excluded_domains,
+	// scope_file) allow
+	scope, err = cfg.Scope(startingURLs)
+	if err != nil {
+		log.Fatalf("Error loading crawl scope: %s", err)
 	}
+	proxies.Route(scope) // Scope rules may name their own proxy
 
-	fmt.Println("0: Create a new directory named 'pdf-scrape-<timestamp>'")
+	// Archive every page and document exchange as WARC/1.1 when -warc is set
+	archive, err = cfg.OpenWARC("qcrawl11")
+	if err != nil {
+		log.Fatalf("Error opening WARC output: %s", err)
+	}
 
-	var selectedDirIndex int
-	fmt.Println("Select the directory to store downloaded PDFs (enter the number or hit enter for default): ")
-	_, err = fmt.Scanln(&selectedDirIndex)
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget = cfg.Budget()
 
-	var selectedDir string
-	if err != nil || selectedDirIndex == 0 {
-		// Create a new directory with timestamp
-		timestamp := time.Now().Format("20060102150405")
-		selectedDir = fmt.Sprintf("pdf-scrape-%s", timestamp)
-		if err := os.Mkdir(selectedDir, 0755); err != nil {
-			log.Fatalf("Error creating directory: %s", err)
-		}
-		fmt.Printf("Created new directory: %s\n", selectedDir)
-	} else if selectedDirIndex < 1 || selectedDirIndex > len(dirList) {
-		log.Fatalf("Invalid directory selection")
-	} else {
-		selectedDir = dirList[selectedDirIndex-1].Name()
+	// ftp:// links leave from the same interface and count against the budget
+	ftpClient = &crawlkit.FTPClient{
+		Dialer:   crawlkit.Dialer(localIP),
+		Timeout:  downloadTimeout,
+		Budget:   budget,
+		MaxDepth: cfg.MaxDepth,
 	}
 
-	// Prompt for starting URL
-	var startingURL string
-	fmt.Println("Enter the starting URL to crawl: ")
-	fmt.Scanln(&startingURL)
+	c := colly.NewCollector(colly.MaxDepth(cfg.MaxDepth))
+	c.WithTransport(budget.Transport(archive.Transport(transport))) // Set the transport directly on the collector
 
-	// Sanitize and validate the starting URL
-	startingURL, err = sanitizeURL(startingURL)
-	if err != nil {
-		log.Fatalf("Error sanitizing starting URL: %s", err)
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
 	}
 
-	err = validateURL(startingURL)
+	// Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+	var robots *crawlkit.Robots
+	if !cfg.IgnoreRobots {
+		robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+	}
+
+	// Create a request queue with one consumer thread per configured worker,
+	// backed by an on-disk frontier that survives restarts
+	frontier := cfg.QueueStorage()
+	q, err := queue.New(cfg.Workers, frontier)
 	if err != nil {
-		log.Fatalf("Error validating starting URL: %s", err)
+		log.Fatalf("Error creating queue: %s", err)
 	}
 
-	c := colly.NewCollector()
-	c.WithTransport(transport) // Set the transport directly on the collector
+	// Ctrl+C stops taking requests off the frontier and cancels downloads in
+	// flight; a second Ctrl+C exits at once
+	shutdown = crawlkit.NewShutdown()
+	go func() {
+		<-shutdown.Done()
+		frontier.Stop()
+	}()
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
+
+	// robots.txt is consulted after the callbacks that may abort a
+	// request and before politeness, so that only requests that are sent
+	// wait out Crawl-delay or take a host token
+	if robots != nil {
+		robots.Context = shutdown.Context()
+		robots.Attach(c)
+	}
+
+	// Space requests to each host and slow down for hosts that answer
+	// 429/503 or reset connections; downloads share the same buckets
+	polite = cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+
+	// Links are downloaded when the server says they serve a document
+	// (collect, doc_sets, doc_types), not because they end in .pdf
+	classifier, err = cfg.Classifier(c.UserAgent, &http.Client{Transport: budget.Transport(polite.Transport(transport)), Timeout: 30 * time.Second})
+	if err != nil {
+		log.Fatalf("Error configuring document sets: %s", err)
+	}
+	classifier.Context = shutdown.Context()
+	classifier.Robots = robots
+	classifier.Budget = budget
 
-	// Create a request queue with 16 consumer threads (to utilize the 16-core CPU)
-	q, err := queue.New(8, &queue.InMemoryQueueStorage{MaxSize: 10000})
+	// Saved files are laid out by name_template and never overwrite each
+	// other unless on_collision says so; each document is stored once in
+	// store_dir and linked under every name it is saved as
+	namer, err = cfg.Namer()
 	if err != nil {
-		log.Fatalf("Error creating queue: %s", err)
+		log.Fatalf("Error configuring file names: %s", err)
 	}
 
 	c.OnRequest(func(r *colly.Request) {
-		log.Println("Visiting", r.URL.String())
-	})
-
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-		absoluteURL := e.Request.AbsoluteURL(link)
-		log.Printf("Found link: %s", absoluteURL)
-		q.AddURL(absoluteURL)
+		log.Printf("Visiting %s (%d queued)", r.URL.String(), frontier.Len())
 	})
 
-	c.OnHTML("a[href$='.pdf']", func(e *colly.HTMLElement) {
-		pdfURL := e.Request.AbsoluteURL(e.Attr("href"))
+	// downloadPDF fetches one document; anchors and sitemap entries both feed it
+	downloadPDF := func(pdfURL string) {
+		if u, err := url.Parse(pdfURL); err == nil && !robots.Check(u) {
+			log.Printf("Skipping %s: disallowed by robots.txt", pdfURL)
+			return
+		}
 		log.Printf("Found PDF URL: %s", pdfURL)
 		wg.Add(1)
 		go func() {
@@ -148,15 +205,83 @@ func main() {
 				log.Printf("Error downloading file: %s", err)
 			}
 		}()
+	}
+
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+		for _, link := range crawlkit.ExtractLinks(e) {
+			u, err := url.Parse(link.URL)
+			if err != nil {
+				continue
+			}
+			if ok, _ := scope.Check(u, e.Request.Depth+1); !ok {
+				continue
+			}
+			// Documents are downloaded wherever they were found; other links
+			// are pages to queue only when Link.Page says so
+			if classifier.IsDocument(link.URL) || crawlkit.IsFTPDirectory(link.URL) {
+				downloadPDF(link.URL)
+				continue
+			}
+			if !link.Page() {
+				continue
+			}
+			absoluteURL, err := canon.CanonicalizeURL(u)
+			if err != nil {
+				continue
+			}
+			log.Printf("Found link: %s", absoluteURL)
+			crawlkit.EnqueueLink(q, e.Request, crawlkit.Link{URL: absoluteURL, Source: link.Source})
+		}
 	})
 
-	log.Printf("Adding starting URL to queue: %s", startingURL)
-	q.AddURL(startingURL)
+	for _, startingURL := range startingURLs {
+		log.Printf("Adding starting URL to queue: %s", startingURL)
+		q.AddURL(startingURL)
+	}
+
+	// Seed from sitemaps: listed PDFs go straight to download, pages join the queue
+	var sitemapDocs []crawlkit.SitemapEntry
+	if !cfg.NoSitemaps {
+		sitemaps := crawlkit.NewSitemaps(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second}, robots)
+		sitemaps.Scope = scope
+		sitemapDocs = sitemaps.Seed(startingURLs, classifier.IsDocument, func(e crawlkit.SitemapEntry) {
+			crawlkit.EnqueueSitemapEntry(q, e)
+		})
+	}
+	sitemapDone := make(chan struct{})
+	go func() {
+		defer close(sitemapDone)
+		for _, doc := range sitemapDocs {
+			if shutdown.Stopping() {
+				return
+			}
+			downloadPDF(doc.Loc)
+		}
+	}()
+
 	go processDelayedQueue(selectedDir)
 	log.Println("Starting the crawler...")
 	q.Run(c)
+	<-sitemapDone
+	frontier.Close()
+	if shutdown.Stopping() {
+		log.Printf("Interrupted: %d requests left in %s for the next run.", frontier.Len(), frontier.Dir)
+	}
 	wg.Wait()
-	log.Println("Crawler finished.")
+	log.Printf("Crawler finished. %d URLs blocked by robots.txt.", robots.Blocked())
+	log.Printf("Budget: %s", budget.Summary())
+	log.Printf("Proxies: %s", proxies.Summary())
+	log.Printf("TLS: %s", tlsPolicy.Report().Summary())
+	log.Printf("Out of scope: %s", scope.Summary())
+	log.Printf("Per-host politeness: %s", polite.Summary(10))
+	if err := namer.Store.Close(); err != nil {
+		log.Printf("Error closing document store: %s", err)
+	}
+	log.Printf("Document store: %s", namer.Store.Summary())
+	if err := archive.Close(); err != nil {
+		log.Printf("Error closing WARC output: %s", err)
+	}
+	log.Printf("WARC archive: %s", archive.Summary())
 }
 
 func downloadFileWithRetry(URL, dir string, maxRetries int, initialDelay time.Duration) error {
@@ -166,17 +291,23 @@ func downloadFileWithRetry(URL, dir string, maxRetries int, initialDelay time.Du
 			return nil
 		}
 		log.Printf("Attempt %d failed for URL %s: %s", i+1, URL, err)
+		if errors.Is(err, crawlkit.ErrBudget) {
+			return err // Retrying cannot help once the budget is spent
+		}
 		delay := time.Duration(int(initialDelay) * (1 << uint(i))) // Exponential backoff
 		if delay > maxDelay {
 			delay = maxDelay
 		}
-		time.Sleep(delay)
+		if !shutdown.Sleep(delay) {
+			return err
+		}
 	}
 	return fmt.Errorf("failed to download file after %d retries", maxRetries)
 }
 
 func downloadFileWithTimeout(URL, dir string) error {
 	log.Printf("Downloading file from URL: %s", URL)
+	dir = classifier.Dir(dir, URL) // Each document set has its own subfolder
 	u, err := url.Parse(URL)
 	if err != nil {
 		return err
@@ -196,13 +327,13 @@ func downloadHTTPFileWithTimeout(URL, dir string) error {
 	log.Printf("Downloading file from URL: %s", URL)
 	client := &http.Client{
 		Timeout: downloadTimeout,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
-		},
+		Transport: budget.Transport(polite.Transport(archive.Transport(proxies.Transport(tlsPolicy.Apply(&http.Transport{
+			TLSClientConfig: tlsPolicy.ClientConfig(),
+		}))))),
 	}
 
 	// Create a new request
-	req, err := http.NewRequest("GET", URL, nil)
+	req, err := http.NewRequestWithContext(shutdown.Context(), "GET", URL, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -210,73 +341,51 @@ func downloadHTTPFileWithTimeout(URL, dir string) error {
 	// Set a custom User-Agent header
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		// Categorize the error
-		if urlErr, ok := err.(*url.Error); ok {
-			switch {
-			case urlErr.Timeout():
-				log.Printf("Request timed out for URL %s: %s", URL, err)
-			case strings.Contains(urlErr.Error(), "no such host"):
-				log.Printf("DNS error for URL %s: %s", URL, err)
-				return fmt.Errorf("DNS error: %w", err) // Skip retries for DNS errors
-			case strings.Contains(urlErr.Error(), "connection refused"):
-				log.Printf("Connection refused for URL %s: %s", URL, err)
-			case strings.Contains(urlErr.Error(), "network is unreachable"):
-				log.Printf("Network unreachable for URL %s: %s", URL, err)
-			default:
-				log.Printf("HTTP request failed for URL %s: %s", URL, err)
-				return fmt.Errorf("HTTP request failed: %w", err)
-			}
-		} else {
-			log.Printf("Unexpected error for URL %s: %s", URL, err)
-			return fmt.Errorf("unexpected error: %w", err)
+	// Resumes the .part file of an earlier attempt with Range/If-Range
+	filePath, _, err := crawlkit.DownloadFile(shutdown.Context(), client, req, dir, namer, nil)
+	var statusErr *crawlkit.StatusError
+	var urlErr *url.Error
+	switch {
+	case err == nil:
+		log.Printf("Successfully downloaded file: %s", filePath)
+		return nil
+	case errors.As(err, &statusErr):
+		log.Printf("Unexpected status code: %d for URL: %s", statusErr.Code, URL)
+		if statusErr.Code == http.StatusNotFound || statusErr.Code == http.StatusForbidden {
+			return fmt.Errorf("file not accessible (status code: %d)", statusErr.Code) // Skip retries for 404 and 403 errors
 		}
-
-		// Retry with timeout
-		select {
-		case delayedQueue <- URL:
-			log.Printf("Added URL to retry queue: %s", URL)
-		case <-time.After(1 * time.Second): // Timeout after 1 second
-			log.Printf("Failed to add URL to retry queue (channel full): %s", URL)
+		err = fmt.Errorf("unexpected status code: %d", statusErr.Code)
+	case errors.As(err, &urlErr):
+		// Categorize the error
+		switch {
+		case urlErr.Timeout():
+			log.Printf("Request timed out for URL %s: %s", URL, err)
+		case strings.Contains(urlErr.Error(), "no such host"):
+			log.Printf("DNS error for URL %s: %s", URL, err)
+			return fmt.Errorf("DNS error: %w", err) // Skip retries for DNS errors
+		case strings.Contains(urlErr.Error(), "connection refused"):
+			log.Printf("Connection refused for URL %s: %s", URL, err)
+		case strings.Contains(urlErr.Error(), "network is unreachable"):
+			log.Printf("Network unreachable for URL %s: %s", URL, err)
+		default:
+			log.Printf("HTTP request failed for URL %s: %s", URL, err)
+			return fmt.Errorf("HTTP request failed: %w", err)
 		}
-		return err
+	default:
+		// Cut off mid-body: the retry picks up where this attempt stopped
+		log.Printf("Download interrupted for URL %s: %s", URL, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Unexpected status code: %d for URL: %s", resp.StatusCode, URL)
-		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden {
-			return fmt.Errorf("file not accessible (status code: %d)", resp.StatusCode) // Skip retries for 404 and 403 errors
-		}
-
-		// Retry with timeout
+	// Retry with timeout, unless we are shutting down
+	if !shutdown.Stopping() {
 		select {
 		case delayedQueue <- URL:
 			log.Printf("Added URL to retry queue: %s", URL)
 		case <-time.After(1 * time.Second): // Timeout after 1 second
 			log.Printf("Failed to add URL to retry queue (channel full): %s", URL)
 		}
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-
-	segments := strings.Split(URL, "/")
-	fileName := segments[len(segments)-1]
-	filePath := filepath.Join(dir, fileName)
-
-	out, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
 	}
-
-	log.Printf("Successfully downloaded file: %s", filePath)
-	return nil
+	return err
 }
 
 func downloadFTPFile(URL, dir string) error {
@@ -285,51 +394,45 @@ func downloadFTPFile(URL, dir string) error {
 		return err
 	}
 
-	segments := strings.Split(u.Path, "/")
-	fileName := segments[len(segments)-1]
-	filePath := filepath.Join(dir, fileName)
-
-	out, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer out.Close()
-
-	conn, err := net.DialTimeout("tcp", u.Host, downloadTimeout)
-	if err != nil {
-		log.Printf("FTP connection failed for URL %s: %s", URL, err)
-
-		// Retry with timeout
-		select {
-		case delayedQueue <- URL:
-			log.Printf("Added URL to retry queue: %s", URL)
-		case <-time.After(1 * time.Second): // Timeout after 1 second
-			log.Printf("Failed to add URL to retry queue (channel full): %s", URL)
-		}
+	// Directories are mirrored, keeping the documents the classifier wants
+	if crawlkit.IsFTPDirectory(URL) {
+		n, err := ftpClient.Mirror(shutdown.Context(), u, namer, func(link string) string {
+			if !classifier.IsDocument(link) {
+				return ""
+			}
+			return classifier.Dir(dir, link)
+		})
+		log.Printf("Mirrored %d files from %s", n, URL)
 		return err
 	}
-	defer conn.Close()
 
-	_, err = conn.Write([]byte(fmt.Sprintf("USER anonymous\r\n")))
+	res, err := ftpClient.Download(shutdown.Context(), u, dir, namer, nil)
 	if err != nil {
-		return fmt.Errorf("FTP USER command failed: %w", err)
-	}
-	_, err = conn.Write([]byte(fmt.Sprintf("PASS \r\n")))
-	if err != nil {
-		return fmt.Errorf("FTP PASS command failed: %w", err)
-	}
-	_, err = conn.Write([]byte(fmt.Sprintf("RETR %s\r\n", u.Path)))
-	if err != nil {
-		return fmt.Errorf("FTP RETR command failed: %w", err)
+		log.Printf("FTP download failed for URL %s: %s", URL, err)
+
+		// Retry with timeout, unless the server refused for good
+		if !shutdown.Stopping() && retryFTP(err) {
+			select {
+			case delayedQueue <- URL:
+				log.Printf("Added URL to retry queue: %s", URL)
+			case <-time.After(1 * time.Second): // Timeout after 1 second
+				log.Printf("Failed to add URL to retry queue (channel full): %s", URL)
+			}
+		}
+		return fmt.Errorf("FTP download failed: %w", err)
 	}
+	log.Printf("Successfully downloaded file: %s", res.Path)
+	return nil
+}
 
-	_, err = io.Copy(out, conn)
-	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+// retryFTP reports whether an FTP download that failed with err may work
+// later: not when the server refused for good or the budget ran out
+func retryFTP(err error) bool {
+	var ftpErr *crawlkit.FTPError
+	if errors.As(err, &ftpErr) {
+		return ftpErr.Temporary()
 	}
-
-	log.Printf("Successfully downloaded file: %s", filePath)
-	return nil
+	return !errors.Is(err, crawlkit.ErrBudget)
 }
 
 func processDelayedQueue(selectedDir string) {
@@ -345,52 +448,14 @@ func processDelayedQueue(selectedDir string) {
 					log.Printf("Error retrying download for URL %s: %s", url, err)
 				}
 			}()
+		case <-shutdown.Done():
+			return
 		case <-time.After(1 * time.Minute):
 			log.Println("No delayed requests to process")
 		}
 	}
 }
 
-func getInterfaceIP(iface net.Interface) net.IP {
-	addrs, err := iface.Addrs()
-	if err != nil {
-		log.Fatalf("Error getting addresses for interface %s: %s", iface.Name, err)
-	}
-
-	for _, addr := range addrs {
-		var ip net.IP
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
-		}
-		if ip == nil || ip.IsLoopback() {
-			continue
-		}
-		if ip.To4() != nil {
-			return ip
-		}
-	}
-
-	log.Fatalf("No valid IP address found for interface %s", iface.Name)
-	return nil
-}
-
-func sanitizeURL(urlStr string) (string, error) {
-	u, err := url.Parse(urlStr)
-	if err != nil {
-		return "", err
-	}
-
-	// Encode the path to handle invalid characters
-	u.Path = strings.ReplaceAll(u.Path, " ", "%20") // Replace spaces with %20
-	u.Path = strings.ReplaceAll(u.Path, ":", "%3A") // Replace colons with %3A
-
-	log.Printf("Sanitized URL: %s", u.String())
-	return u.String(), nil
-}
-
 func validateURL(urlStr string) error {
 	u, err := url.Parse(urlStr)
 	if err != nil {
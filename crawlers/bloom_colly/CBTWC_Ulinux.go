@@ -1,48 +1,111 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
-	"github.com/willf/bloom"
 )
 
-const filterSize = 100000 // The size of the Bloom filter
+// canon turns URLs into dedup keys; main applies the url_rules config
+var canon = crawlkit.DefaultCanonicalizer
 
 func main() {
-	// Initialize the Bloom filter
-	filter := bloom.New(filterSize, 5)
-
 	// Variables for telemetry
 	var linksProcessed, uniqueLinks int
 	var memStats runtime.MemStats
 
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{MaxDepth: 12, Workers: 12})
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	canon = cfg.Canonicalizer()
+
+	// Load the Bloom filter from the last run, or size a new one from
+	// -expected-urls and -bloom-fp
+	filter, err := cfg.LoadBloom()
+	if err != nil {
+		log.Fatalf("Error loading Bloom filter: %v", err)
+	}
+
+	// Archive every page exchange as WARC/1.1 when -warc is set
+	archive, err := cfg.OpenWARC("CBTWC_Ulinux")
+	if err != nil {
+		log.Fatalf("Error opening WARC output: %v", err)
+	}
+
+	// Serve pages, links and per-host latency for Prometheus when -metrics is set
+	metrics, err := cfg.Metrics("CBTWC_Ulinux")
+	if err != nil {
+		log.Fatalf("Error starting metrics endpoint: %v", err)
+	}
+
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget := cfg.Budget()
+
+	// Requests go through the -proxy pool, or the proxy of the scope rule
+	// they match
+	proxies, err := cfg.Proxies()
+	if err != nil {
+		log.Fatalf("Error setting up proxies: %v", err)
+	}
+	if err := metrics.AddProxies(proxies); err != nil {
+		log.Printf("Error adding proxy metrics: %v", err)
+	}
+
 	// Create a new collector
 	c := colly.NewCollector(
-		colly.MaxDepth(12), // Set the maximum depth to 12
-		colly.Async(true),  // Enable asynchronous network requests
+		colly.MaxDepth(cfg.MaxDepth), // Set the maximum depth (12 by default)
+		colly.Async(true),            // Enable asynchronous network requests
 	)
+	c.WithTransport(budget.Transport(metrics.Transport(archive.Transport(proxies.Transport(cfg.TLS.Transport())))))
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
+	}
+
+	// Limit the maximum parallelism (12 by default)
+	c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Workers})
 
-	// Limit the maximum parallelism to 12
-	c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 12})
+	// Ctrl+C stops new requests so the filter is still saved; a second
+	// Ctrl+C exits at once
+	shutdown := crawlkit.NewShutdown()
+	shutdown.Attach(c)
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
+
+	// Space requests to each host and slow down for hosts that answer
+	// 429/503 or reset connections
+	polite := cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+	metrics.Attach(c)
 
 	// Create a wait group to wait for all requests to finish
 	var wg sync.WaitGroup
 
-	// Read the starting URL from the user
-	fmt.Print("Enter the starting URL: ")
-	reader := bufio.NewReader(os.Stdin)
-	startURL, _ := reader.ReadString('\n')
-	startURL = strings.TrimSpace(startURL)
-	startURL = preprocessURL(startURL)
+	// Take the starting URL from -url, or ask for it on a terminal
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		log.Fatalf("Error reading starting URL: %v", err)
+	}
+	startURL := preprocessURL(startURLs[0])
+
+	// Links are followed only where the scope rules (excluded_domains,
+	// scope_file) allow
+	scope, err := cfg.Scope([]string{startURL})
+	if err != nil {
+		log.Fatalf("Error loading crawl scope: %v", err)
+	}
+	proxies.Route(scope) // Scope rules may name their own proxy
 
 	// Generate a file name based on the current system date/time and the initial URL
 	fileName := fmt.Sprintf("%s_%s.txt", time.Now().Format("2006-01-02T150405"), urlToFileName(startURL))
@@ -61,34 +124,37 @@ func main() {
 	go func() {
 		for range ticker.C {
 			runtime.ReadMemStats(&memStats)
-			fmt.Printf("Links processed: %d, Unique links: %d, Cache misses: %d\n", linksProcessed, uniqueLinks, memStats.Mallocs-memStats.Frees)
+			fmt.Printf("Links processed: %d, Unique links: %d, Cache misses: %d, Bloom FP rate: %.4g (%d stages), Politeness: %s\n", linksProcessed, uniqueLinks, memStats.Mallocs-memStats.Frees, filter.EstimatedFPRate(), filter.Stages(), polite.Summary(3))
 		}
 	}()
 
-	// On every a element which has href attribute call callback
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+	// On every page, follow the links in anchors, frames, embeds, refreshes, srcset and scripts
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
 		wg.Add(1) // Increment the wait group counter
 		defer wg.Done() // Decrement the wait group counter when the goroutine is done
 
-		link := e.Attr("href")
-		// Preprocess the URL to handle variations
-		link = preprocessURL(link)
-		if link == "" {
-			return
-		}
+		for _, found := range crawlkit.ExtractLinks(e) {
+			// Preprocess the URL to handle variations, skipping resource links and links outside the crawl scope
+			link := preprocessURL(found.URL)
+			if link == "" || !found.Page() || !scope.Allows(link, e.Request.Depth+1) {
+				continue
+			}
 
-		linksProcessed++ // Increment total links processed
-
-		// Check if the URL is already visited
-		if !filter.TestAndAdd([]byte(link)) {
-			uniqueLinks++ // Increment unique links count
-			output := fmt.Sprintf("Visiting: %s\n", link)
-			fmt.Print(output)        // Output to console
-			file.WriteString(output) // Write the same output to the file
-			// Add the link to the collector to be visited
-			err := e.Request.Visit(link)
-			if err != nil {
-				log.Printf("Error visiting link: %s, error: %v\n", link, err)
+			linksProcessed++ // Increment total links processed
+
+			// Check if the URL is already visited
+			isNew := !filter.TestAndAdd([]byte(link))
+			metrics.Link(isNew)
+			if isNew {
+				uniqueLinks++ // Increment unique links count
+				output := fmt.Sprintf("Visiting: %s (from %s)\n", link, found.Source)
+				fmt.Print(output)        // Output to console
+				file.WriteString(output) // Write the same output to the file
+				// Add the link to the collector to be visited
+				err := e.Request.Visit(link)
+				if err != nil {
+					log.Printf("Error visiting link: %s, error: %v\n", link, err)
+				}
 			}
 		}
 	})
@@ -101,34 +167,41 @@ func main() {
 	ticker.Stop()
 
 	// Log the telemetry data
-	telemetryOutput := fmt.Sprintf("Crawl finished.\nTotal links processed: %d\nUnique links found: %d\n",
-		linksProcessed, uniqueLinks)
+	status := "Crawl finished."
+	if reason := budget.Exhausted(); reason != "" {
+		status = fmt.Sprintf("Crawl stopped: %s budget ran out.", reason)
+	} else if shutdown.Stopping() {
+		status = "Crawl interrupted."
+	}
+	telemetryOutput := fmt.Sprintf("%s\nTotal links processed: %d\nUnique links found: %d\nOut of scope: %s\nBudget: %s\nProxies: %s\nTLS: %s\nBloom filter: %d URLs in %d stage(s), estimated FP rate %.4g\nPoliteness: %s\n",
+		status, linksProcessed, uniqueLinks, scope.Summary(), budget.Summary(), proxies.Summary(), cfg.TLS.Report().Summary(), filter.Count(), filter.Stages(), filter.EstimatedFPRate(), polite.Summary(10))
 	fmt.Print(telemetryOutput)
 	file.WriteString(telemetryOutput)
-}
 
-// preprocessURL preprocesses the input URL to handle variations
-func preprocessURL(inputURL string) string {
-	parsedURL, err := url.Parse(inputURL)
-	if err != nil {
-		return ""
+	// Keep the final telemetry with the crawl's WARC records
+	if err := archive.WriteMetadata(startURL, "text/plain", []byte(telemetryOutput)); err != nil {
+		log.Printf("Error writing WARC metadata: %v", err)
 	}
-
-	if parsedURL.Scheme == "" {
-		parsedURL.Scheme = "http"
+	if err := archive.Close(); err != nil {
+		log.Printf("Error closing WARC output: %v", err)
 	}
+	fmt.Printf("WARC archive: %s\n", archive.Summary())
+	metrics.Close()
 
-	if parsedURL.Host == "" {
-		return ""
+	// Keep the filter so the next run skips these URLs
+	if err := filter.Save(cfg.BloomFile); err != nil {
+		log.Printf("Error saving Bloom filter: %v", err)
 	}
+}
 
-	hostname := strings.ToLower(parsedURL.Hostname())
-	if strings.HasPrefix(hostname, "www.") {
-		hostname = strings.TrimPrefix(hostname, "www.")
+// preprocessURL returns the canonical form of an http(s) URL, which is also
+// its dedup key, or "" if the URL cannot be crawled
+func preprocessURL(inputURL string) string {
+	key, err := canon.Canonicalize(inputURL)
+	if err != nil || !(strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")) {
+		return ""
 	}
-	parsedURL.Host = hostname
-
-	return parsedURL.String()
+	return key
 }
 
 // urlToFileName sanitizes the URL to be used in a file name
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"net/url"
 	"os"
@@ -9,39 +8,55 @@ import (
 	"sync"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
-	"github.com/willf/bloom"
-)
-
-const (
-	filterSize = 100000 // The size of the Bloom filter
 )
 
 func main() {
-	// Initialize the Bloom filter
-	filter := bloom.New(filterSize, 5)
-
 	// Variables for telemetry
 	var linksProcessed, uniqueLinks int
 
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{MaxDepth: 12, Workers: 12})
+	if err != nil {
+		fmt.Println("Error loading configuration:", err)
+		return
+	}
+
+	// Load the Bloom filter from the last run, or size a new one from
+	// -expected-urls and -bloom-fp
+	filter, err := cfg.LoadBloom()
+	if err != nil {
+		fmt.Println("Error loading Bloom filter:", err)
+		return
+	}
+
 	// Create a new collector
 	c := colly.NewCollector(
-		colly.MaxDepth(12), // Set the maximum depth to 12
-		colly.Async(true),  // Enable asynchronous network requests
+		colly.MaxDepth(cfg.MaxDepth), // Set the maximum depth (12 by default)
+		colly.Async(true),            // Enable asynchronous network requests
 	)
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
+	}
+
+	// Limit the maximum parallelism (12 by default)
+	c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Workers})
 
-	// Limit the maximum parallelism to 12
-	c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 12})
+	// Ctrl+C stops new requests so the filter is still saved; a second
+	// Ctrl+C exits at once
+	shutdown := crawlkit.NewShutdown()
+	shutdown.Attach(c)
 
 	// Create a wait group to wait for all requests to finish
 	var wg sync.WaitGroup
 
-	// Read the starting URL from the user
-	fmt.Print("Enter the starting URL: ")
-	reader := bufio.NewReader(os.Stdin)
-	startURL, _ := reader.ReadString('\n')
-	startURL = strings.TrimSpace(startURL)
-	startURL = preprocessURL(startURL)
+	// Take the starting URL from -url, or ask for it on a terminal
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		fmt.Println("Error reading starting URL:", err)
+		return
+	}
+	startURL := preprocessURL(startURLs[0])
 
 	// Generate a file name based on the current system date/time and the initial URL
 	fileName := fmt.Sprintf("%s_%s.txt", time.Now().Format("2006-01-02T150405"), urlToFileName(startURL))
@@ -60,7 +75,7 @@ func main() {
 	ticker := time.NewTicker(5 * time.Second) // Adjust the interval as needed
 	go func() {
 		for range ticker.C {
-			fmt.Printf("Links processed: %d, Unique links: %d\n", linksProcessed, uniqueLinks)
+			fmt.Printf("Links processed: %d, Unique links: %d, Bloom FP rate: %.4g (%d stages)\n", linksProcessed, uniqueLinks, filter.EstimatedFPRate(), filter.Stages())
 		}
 	}()
 
@@ -97,10 +112,19 @@ func main() {
 	ticker.Stop()
 
 	// Log the telemetry data
-	telemetryOutput := fmt.Sprintf("Crawl finished.\nTotal links processed: %d\nUnique links found: %d\n",
-		linksProcessed, uniqueLinks)
+	status := "Crawl finished."
+	if shutdown.Stopping() {
+		status = "Crawl interrupted."
+	}
+	telemetryOutput := fmt.Sprintf("%s\nTotal links processed: %d\nUnique links found: %d\nBloom filter: %d URLs in %d stage(s), estimated FP rate %.4g\n",
+		status, linksProcessed, uniqueLinks, filter.Count(), filter.Stages(), filter.EstimatedFPRate())
 	fmt.Print(telemetryOutput)
 	file.WriteString(telemetryOutput)
+
+	// Keep the filter so the next run skips these URLs
+	if err := filter.Save(cfg.BloomFile); err != nil {
+		fmt.Println("Error saving Bloom filter:", err)
+	}
 }
 
 // preprocessURL preprocesses the input URL to handle variations
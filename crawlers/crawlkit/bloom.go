@@ -0,0 +1,261 @@
+package crawlkit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/willf/bloom"
+)
+
+const (
+	bloomMagic     = "CKBF"
+	bloomVersion   = 1
+	bloomGrowth    = 2   // Each new stage holds this many times more URLs
+	bloomTightness = 0.8 // Each new stage gets this fraction of the previous FP rate
+
+	defaultBloomFile    = "visited.bloom"
+	defaultExpectedURLs = 1000000
+	defaultBloomFPRate  = 0.001
+)
+
+// ScalableBloom is a URL filter that grows instead of saturating. It is a
+// scalable Bloom filter (Almeida et al., 2007): a chain of fixed-size
+// filters, each sized for more items and a tighter false-positive rate than
+// the last, so the overall rate stays below FPRate however many URLs are
+// added. It is safe for concurrent use.
+type ScalableBloom struct {
+	FPRate float64 // Target false-positive rate for the whole chain
+
+	mu     sync.Mutex
+	stages []*bloomStage
+}
+
+type bloomStage struct {
+	filter   *bloom.BloomFilter
+	capacity uint64  // Items the stage was sized for
+	count    uint64  // Items added to it
+	fpRate   float64 // False-positive rate it was sized for
+}
+
+// NewScalableBloom returns an empty filter whose first stage is sized for
+// expected URLs.
+func NewScalableBloom(expected uint, fpRate float64) *ScalableBloom {
+	s := &ScalableBloom{FPRate: fpRate}
+	// The stage rates form a geometric series summing to fpRate.
+	s.addStage(uint64(expected), fpRate*(1-bloomTightness))
+	return s
+}
+
+func (s *ScalableBloom) addStage(capacity uint64, fpRate float64) {
+	if capacity == 0 {
+		capacity = 1
+	}
+	s.stages = append(s.stages, &bloomStage{
+		filter:   bloom.NewWithEstimates(uint(capacity), fpRate),
+		capacity: capacity,
+		fpRate:   fpRate,
+	})
+}
+
+// TestAndAdd reports whether data was probably added before, and adds it
+// if not.
+func (s *ScalableBloom) TestAndAdd(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.stages {
+		if st.filter.Test(data) {
+			return true
+		}
+	}
+
+	last := s.stages[len(s.stages)-1]
+	if last.count >= last.capacity {
+		s.addStage(last.capacity*bloomGrowth, last.fpRate*bloomTightness)
+		last = s.stages[len(s.stages)-1]
+	}
+	last.filter.Add(data)
+	last.count++
+	return false
+}
+
+// Test reports whether data was probably added before.
+func (s *ScalableBloom) Test(data []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.stages {
+		if st.filter.Test(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds data to the filter.
+func (s *ScalableBloom) Add(data []byte) {
+	s.TestAndAdd(data)
+}
+
+// Count returns how many distinct items have been added.
+func (s *ScalableBloom) Count() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n uint64
+	for _, st := range s.stages {
+		n += st.count
+	}
+	return n
+}
+
+// Stages returns how many filters the chain has grown to.
+func (s *ScalableBloom) Stages() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.stages)
+}
+
+// EstimatedFPRate returns the current probability that a new URL is wrongly
+// reported as seen, from each stage's fill: (1 - e^(-kn/m))^k.
+func (s *ScalableBloom) EstimatedFPRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pass := 1.0
+	for _, st := range s.stages {
+		k, m := float64(st.filter.K()), float64(st.filter.Cap())
+		p := math.Pow(1-math.Exp(-k*float64(st.count)/m), k)
+		pass *= 1 - p
+	}
+	return 1 - pass
+}
+
+// Save writes the filter to path, replacing any previous file atomically.
+func (s *ScalableBloom) Save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.writeTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *ScalableBloom) writeTo(w io.Writer) error {
+	header := []interface{}{[]byte(bloomMagic), uint32(bloomVersion), s.FPRate, uint32(len(s.stages))}
+	for _, v := range header {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	for _, st := range s.stages {
+		for _, v := range []interface{}{st.capacity, st.count, st.fpRate} {
+			if err := binary.Write(w, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+		if _, err := st.filter.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadScalableBloom reads a filter written by Save. A missing file gives a
+// new filter sized for expected URLs at fpRate.
+func LoadScalableBloom(path string, expected uint, fpRate float64) (*ScalableBloom, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewScalableBloom(expected, fpRate), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := readScalableBloom(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func readScalableBloom(r io.Reader) (*ScalableBloom, error) {
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != bloomMagic {
+		return nil, errors.New("not a crawlkit Bloom filter")
+	}
+	var (
+		version uint32
+		nStages uint32
+		s       ScalableBloom
+	)
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != bloomVersion {
+		return nil, fmt.Errorf("unsupported Bloom filter version %d", version)
+	}
+	if err := binary.Read(r, binary.BigEndian, &s.FPRate); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &nStages); err != nil {
+		return nil, err
+	}
+	if nStages == 0 {
+		return nil, errors.New("Bloom filter has no stages")
+	}
+
+	for i := uint32(0); i < nStages; i++ {
+		st := &bloomStage{filter: &bloom.BloomFilter{}}
+		for _, v := range []interface{}{&st.capacity, &st.count, &st.fpRate} {
+			if err := binary.Read(r, binary.BigEndian, v); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := st.filter.ReadFrom(r); err != nil {
+			return nil, err
+		}
+		s.stages = append(s.stages, st)
+	}
+	return &s, nil
+}
+
+// LoadBloom opens the crawl's URL filter from BloomFile, or creates one sized
+// for ExpectedURLs at BloomFPRate when the file does not exist yet. Unset
+// fields are filled with their defaults, so BloomFile can be passed to Save.
+func (c *Config) LoadBloom() (*ScalableBloom, error) {
+	if c.BloomFile == "" {
+		c.BloomFile = defaultBloomFile
+	}
+	if c.ExpectedURLs <= 0 {
+		c.ExpectedURLs = defaultExpectedURLs
+	}
+	if c.BloomFPRate <= 0 || c.BloomFPRate >= 1 {
+		c.BloomFPRate = defaultBloomFPRate
+	}
+	return LoadScalableBloom(c.BloomFile, uint(c.ExpectedURLs), c.BloomFPRate)
+}
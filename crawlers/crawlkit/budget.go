@@ -0,0 +1,285 @@
+package crawlkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// ErrBudget is returned by a Budget's Transport for a host whose budget has
+// run out, and for every request once the crawl's has.
+var ErrBudget = errors.New("crawl budget exhausted")
+
+// Budget stops a crawl, or one host of it, once it has used what it was
+// given: pages fetched, bytes received by pages and downloads, and
+// wall-clock time. Crawl-wide limits stop the crawl through Shutdown, as a
+// first Ctrl+C would, so frontiers and checkpoints are kept for the next
+// run; per-host limits only turn that host's requests away. Zero means no
+// limit. It is safe for concurrent use; a nil Budget never runs out.
+type Budget struct {
+	MaxPages     int64
+	MaxBytes     int64
+	MaxTime      time.Duration
+	HostMaxPages int64
+	HostMaxBytes int64
+
+	started  time.Time
+	pages    int64 // Atomic
+	bytes    int64 // Atomic
+	shutdown *Shutdown
+
+	mu     sync.Mutex
+	hosts  map[string]*hostBudget
+	capped map[string]int // Hosts capped, by limit
+	reason string         // The crawl-wide limit that ran out, if any
+	spent  time.Duration  // When it ran out
+	timer  *time.Timer
+}
+
+type hostBudget struct {
+	pages  int64
+	bytes  int64
+	capped string // The limit that ran out, if any
+}
+
+// Budget returns the limits set by max_pages, max_mb, max_time,
+// host_max_pages and host_max_mb, or nil when none is set. The clock
+// starts now.
+func (c *Config) Budget() *Budget {
+	b := &Budget{
+		MaxPages:     int64(c.MaxPages),
+		MaxBytes:     int64(c.MaxMB) << 20,
+		MaxTime:      c.MaxTime.Duration,
+		HostMaxPages: int64(c.HostMaxPages),
+		HostMaxBytes: int64(c.HostMaxMB) << 20,
+	}
+	if b.MaxPages <= 0 && b.MaxBytes <= 0 && b.MaxTime <= 0 && b.HostMaxPages <= 0 && b.HostMaxBytes <= 0 {
+		return nil
+	}
+	b.started = time.Now()
+	b.hosts = make(map[string]*hostBudget)
+	b.capped = make(map[string]int)
+	return b
+}
+
+// Enforce stops s when a crawl-wide limit runs out, including max_time.
+func (b *Budget) Enforce(s *Shutdown) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.shutdown = s
+	if b.MaxTime > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.MaxTime-time.Since(b.started), func() { b.exhaust("max_time") })
+	}
+	b.mu.Unlock()
+}
+
+// Allowed reports whether host may still be fetched from.
+func (b *Budget) Allowed(host string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reason != "" {
+		return false
+	}
+	h := b.hosts[strings.ToLower(host)]
+	return h == nil || h.capped == ""
+}
+
+// Page counts a page fetched from host.
+func (b *Budget) Page(host string) {
+	if b == nil {
+		return
+	}
+	if n := atomic.AddInt64(&b.pages, 1); b.MaxPages > 0 && n >= b.MaxPages {
+		b.exhaust("max_pages")
+	}
+	if b.HostMaxPages > 0 {
+		b.mu.Lock()
+		h := b.host(host)
+		h.pages++
+		if h.pages >= b.HostMaxPages {
+			b.cap(host, h, "host_max_pages")
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Bytes counts n bytes received from host.
+func (b *Budget) Bytes(host string, n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	if total := atomic.AddInt64(&b.bytes, n); b.MaxBytes > 0 && total >= b.MaxBytes {
+		b.exhaust("max_mb")
+	}
+	if b.HostMaxBytes > 0 {
+		b.mu.Lock()
+		h := b.host(host)
+		h.bytes += n
+		if h.bytes >= b.HostMaxBytes {
+			b.cap(host, h, "host_max_mb")
+		}
+		b.mu.Unlock()
+	}
+}
+
+// host returns host's usage, creating it. b.mu is held.
+func (b *Budget) host(host string) *hostBudget {
+	host = strings.ToLower(host)
+	h := b.hosts[host]
+	if h == nil {
+		h = &hostBudget{}
+		b.hosts[host] = h
+	}
+	return h
+}
+
+// cap marks host as done once. b.mu is held.
+func (b *Budget) cap(host string, h *hostBudget, limit string) {
+	if h.capped != "" {
+		return
+	}
+	h.capped = limit
+	b.capped[limit]++
+	log.Printf("Budget: %s reached for %s, skipping the host from now on", limit, host)
+}
+
+// exhaust stops the crawl the first time a crawl-wide limit runs out.
+func (b *Budget) exhaust(limit string) {
+	b.mu.Lock()
+	if b.reason != "" {
+		b.mu.Unlock()
+		return
+	}
+	b.reason = limit
+	b.spent = time.Since(b.started)
+	s := b.shutdown
+	b.mu.Unlock()
+	log.Printf("Budget: %s reached, stopping the crawl", limit)
+	if s != nil {
+		s.Stop()
+	}
+}
+
+// Exhausted returns the crawl-wide limit that ran out, or "".
+func (b *Budget) Exhausted() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reason
+}
+
+// Attach counts c's pages, and aborts its requests to hosts that are out of
+// budget.
+func (b *Budget) Attach(c *colly.Collector) {
+	if b == nil {
+		return
+	}
+	c.OnRequest(func(r *colly.Request) {
+		if !b.Allowed(r.URL.Hostname()) {
+			Abort(r)
+		}
+	})
+	c.OnResponse(func(r *colly.Response) {
+		b.Page(r.Request.URL.Hostname())
+	})
+}
+
+// Transport wraps rt, or http.DefaultTransport when nil, so that response
+// bodies count against the byte limits and requests to hosts out of budget
+// fail with ErrBudget. Wrap it outside Politeness's Transport, so that
+// refused requests do not wait for a turn.
+func (b *Budget) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if b == nil {
+		return rt
+	}
+	return &budgetTransport{b: b, rt: rt}
+}
+
+type budgetTransport struct {
+	b  *Budget
+	rt http.RoundTripper
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if !t.b.Allowed(host) {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%s: %w", host, ErrBudget)
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &budgetBody{ReadCloser: resp.Body, b: t.b, host: host}
+	return resp, nil
+}
+
+type budgetBody struct {
+	io.ReadCloser
+	b    *Budget
+	host string
+}
+
+func (r *budgetBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.b.Bytes(r.host, int64(n))
+	return n, err
+}
+
+// Summary describes what was used, and which limits ran out, for a
+// crawler's final report.
+func (b *Budget) Summary() string {
+	if b == nil {
+		return "unlimited"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	used := fmt.Sprintf("%d pages, %s in %s", atomic.LoadInt64(&b.pages),
+		formatBytes(atomic.LoadInt64(&b.bytes)), time.Since(b.started).Round(time.Second))
+	var out []string
+	if b.reason != "" {
+		out = append(out, fmt.Sprintf("stopped by %s after %s (%s)", b.reason, b.spent.Round(time.Second), used))
+	} else {
+		out = append(out, "within budget ("+used+")")
+	}
+	limits := make([]string, 0, len(b.capped))
+	for limit := range b.capped {
+		limits = append(limits, limit)
+	}
+	sort.Strings(limits)
+	for _, limit := range limits {
+		var hosts []string
+		for host, h := range b.hosts {
+			if h.capped == limit {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		if len(hosts) > 5 {
+			hosts = append(hosts[:5], fmt.Sprintf("and %d more", len(hosts)-5))
+		}
+		out = append(out, fmt.Sprintf("%d hosts capped by %s: %s", b.capped[limit], limit, strings.Join(hosts, ", ")))
+	}
+	return strings.Join(out, "; ")
+}
@@ -0,0 +1,320 @@
+package crawlkit
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// CanonicalRules selects the optional steps of URL canonicalization. The
+// zero value is the recommended set: fragments and tracking parameters are
+// dropped, query parameters are sorted and scheme-less input is taken as
+// https.
+type CanonicalRules struct {
+	DefaultScheme  string   `yaml:"default_scheme" toml:"default_scheme"`     // for input without one; "" means https
+	StripWWW       bool     `yaml:"strip_www" toml:"strip_www"`               // treat www.example.org as example.org
+	DropQuery      bool     `yaml:"drop_query" toml:"drop_query"`             // remove the whole query string
+	KeepQueryOrder bool     `yaml:"keep_query_order" toml:"keep_query_order"` // don't sort query parameters
+	KeepTracking   bool     `yaml:"keep_tracking" toml:"keep_tracking"`       // don't strip utm_*, fbclid and friends
+	KeepFragment   bool     `yaml:"keep_fragment" toml:"keep_fragment"`       // keep #fragments
+	TrackingParams []string `yaml:"tracking_params" toml:"tracking_params"`   // more names to strip; "x_*" strips a prefix
+}
+
+// defaultTrackingParams are stripped unless KeepTracking is set.
+var defaultTrackingParams = []string{
+	"utm_*", "fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid",
+	"mc_cid", "mc_eid", "yclid", "igshid", "_ga", "_gl",
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ftp": "21"}
+
+// Canonicalizer turns URLs into the form used as the dedup key. Two URLs
+// that RFC 3986 (section 6.2.2) considers equivalent always give the same
+// key: scheme and host are lowercased (paths are left alone), default ports
+// are removed, "." and ".." segments are resolved, percent-encodings of
+// unreserved characters are decoded and the rest are uppercased, and
+// internationalized host names are converted to punycode. CanonicalRules
+// adds the optional steps on top.
+type Canonicalizer struct {
+	rules    CanonicalRules
+	exact    map[string]bool
+	prefixes []string
+}
+
+// NewCanonicalizer returns a Canonicalizer applying rules.
+func NewCanonicalizer(rules CanonicalRules) *Canonicalizer {
+	c := &Canonicalizer{rules: rules, exact: make(map[string]bool)}
+	if rules.DefaultScheme == "" {
+		c.rules.DefaultScheme = "https"
+	}
+	names := rules.TrackingParams
+	if !rules.KeepTracking {
+		names = append(append([]string(nil), defaultTrackingParams...), names...)
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if strings.HasSuffix(name, "*") {
+			c.prefixes = append(c.prefixes, strings.TrimSuffix(name, "*"))
+		} else {
+			c.exact[name] = true
+		}
+	}
+	return c
+}
+
+// DefaultCanonicalizer applies the zero CanonicalRules.
+var DefaultCanonicalizer = NewCanonicalizer(CanonicalRules{})
+
+// Canonicalize parses raw and returns its canonical form.
+func (c *Canonicalizer) Canonicalize(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("empty URL")
+	}
+	if strings.HasPrefix(raw, "//") {
+		raw = c.rules.DefaultScheme + ":" + raw
+	} else if !strings.Contains(raw, "://") && !hasScheme(raw) {
+		raw = c.rules.DefaultScheme + "://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return c.CanonicalizeURL(u)
+}
+
+// CanonicalizeURL returns the canonical form of an absolute URL. u is not
+// modified.
+func (c *Canonicalizer) CanonicalizeURL(u *url.URL) (string, error) {
+	if u.Scheme == "" {
+		return "", fmt.Errorf("missing scheme in URL: %s", u)
+	}
+	if u.Opaque != "" {
+		return "", fmt.Errorf("not a hierarchical URL: %s", u)
+	}
+	scheme := strings.ToLower(u.Scheme)
+
+	host, err := c.host(u.Hostname())
+	if err != nil {
+		return "", fmt.Errorf("bad host in URL %s: %w", u, err)
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host in URL: %s", u)
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(normalizePercent(u.User.String()))
+		b.WriteByte('@')
+	}
+	if strings.Contains(host, ":") {
+		b.WriteString("[" + host + "]") // IPv6 literal
+	} else {
+		b.WriteString(host)
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+		b.WriteByte(':')
+		b.WriteString(port)
+	}
+
+	path := removeDotSegments(normalizePercent(u.EscapedPath()))
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if !c.rules.DropQuery {
+		if q := c.query(u.RawQuery); q != "" {
+			b.WriteByte('?')
+			b.WriteString(q)
+		}
+	}
+	if c.rules.KeepFragment && u.Fragment != "" {
+		b.WriteByte('#')
+		b.WriteString(normalizePercent(u.EscapedFragment()))
+	}
+	return b.String(), nil
+}
+
+// hasScheme reports whether raw starts with "scheme:" rather than with a
+// bare "host:port".
+func hasScheme(raw string) bool {
+	i := strings.IndexAny(raw, ":/?#")
+	if i <= 0 || raw[i] != ':' {
+		return false
+	}
+	rest := raw[i+1:]
+	return rest == "" || rest[0] < '0' || rest[0] > '9'
+}
+
+func (c *Canonicalizer) host(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || strings.Contains(host, ":") {
+		return host, nil
+	}
+	if isASCII(host) {
+		if strings.Contains(host, "%") {
+			return "", errors.New("percent-encoded host")
+		}
+	} else {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			// Lookup rejects some names browsers accept; fall back to a
+			// plain conversion so those still get a stable key.
+			if ascii, err = idna.Punycode.ToASCII(host); err != nil {
+				return "", err
+			}
+		}
+		host = ascii
+	}
+	if c.rules.StripWWW {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	return host, nil
+}
+
+// query normalizes the encoding of each parameter, drops tracking
+// parameters and sorts the rest by name (keeping the order of repeated
+// names).
+func (c *Canonicalizer) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	var params []string
+	for _, p := range strings.Split(raw, "&") {
+		if p == "" {
+			continue
+		}
+		p = normalizePercent(p)
+		if c.tracking(paramName(p)) {
+			continue
+		}
+		params = append(params, p)
+	}
+	if !c.rules.KeepQueryOrder {
+		sort.SliceStable(params, func(i, j int) bool {
+			return paramName(params[i]) < paramName(params[j])
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func paramName(p string) string {
+	if i := strings.IndexByte(p, '='); i >= 0 {
+		return p[:i]
+	}
+	return p
+}
+
+func (c *Canonicalizer) tracking(name string) bool {
+	if n, err := url.QueryUnescape(name); err == nil {
+		name = n
+	}
+	name = strings.ToLower(name)
+	if c.exact[name] {
+		return true
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePercent decodes percent-encoded unreserved characters and
+// uppercases the hex digits of the remaining escapes (RFC 3986 6.2.2.1-2).
+func normalizePercent(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+// removeDotSegments implements RFC 3986 section 5.2.4.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	var out []string
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	result := strings.Join(out, "/")
+	if strings.HasPrefix(path, "/") && !strings.HasPrefix(result, "/") {
+		result = "/" + result
+	}
+	return result
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Canonicalizer returns the Canonicalizer for the crawl's url_rules.
+func (c *Config) Canonicalizer() *Canonicalizer {
+	return NewCanonicalizer(c.URLRules)
+}
@@ -0,0 +1,489 @@
+package crawlkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	classifySniffLen  = 1024 // Bytes fetched by the ranged GET fallback
+	classifyCacheSize = 1 << 16
+	classifyTimeout   = 30 * time.Second
+)
+
+// documentExtensions maps the document types the crawlers usually collect to
+// their file extensions; mime.ExtensionsByType covers the rest.
+var documentExtensions = map[string][]string{
+	"application/pdf":      {".pdf"},
+	"application/epub+zip": {".epub"},
+	"application/msword":   {".doc"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {".docx"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {".xlsx"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {".pptx"},
+	"application/vnd.ms-excel":      {".xls"},
+	"application/vnd.ms-powerpoint": {".ppt"},
+	"application/rtf":               {".rtf"},
+	"application/postscript":        {".ps", ".eps"},
+	"application/zip":               {".zip"},
+	"application/gzip":              {".gz", ".tgz"},
+	"image/vnd.djvu":                {".djvu", ".djv"},
+	"text/csv":                      {".csv"},
+	"text/plain":                    {".txt"},
+}
+
+// genericTypes say nothing about what a response holds.
+var genericTypes = map[string]bool{
+	"":                           true,
+	"application/octet-stream":   true,
+	"binary/octet-stream":        true,
+	"application/download":       true,
+	"application/force-download": true,
+	"application/x-download":     true,
+	"application/unknown":        true,
+}
+
+// dynamicExtensions are path extensions of scripts that may serve anything.
+var dynamicExtensions = map[string]bool{
+	"": true, ".php": true, ".asp": true, ".aspx": true, ".jsp": true,
+	".cgi": true, ".pl": true, ".do": true, ".action": true, ".ashx": true,
+}
+
+// downloadHints in a dynamic URL suggest it serves a file. They match
+// whole words of the URL (see hinted), and their plurals.
+var downloadHints = []string{
+	"download", "attachment", "getfile", "get_file", "file", "fetch",
+	"document", "bitstream", "blob", "export", "pdf", "paper",
+}
+
+// Verdict is what a Classifier decided about one URL.
+type Verdict struct {
+	Document bool   // Serves one of the wanted types
+	MIMEType string // Type it was found to serve, "" if unknown
+	By       string // What decided: "content-type", "disposition", "extension", "sniff" or "status"
+}
+
+// Classifier decides whether a link serves a document by asking the server
+// rather than trusting the URL. It sends a HEAD request, falling back to a
+// ranged GET of the first kilobyte when HEAD is refused or the type is
+// generic (application/octet-stream and friends), and looks at
+// Content-Type, the Content-Disposition filename and the body's magic bytes.
+// HTML answers, such as error pages at a .pdf URL, are never documents.
+// Links robots.txt disallows, or on hosts out of budget, are refused without
+// asking. Verdicts are cached per URL. It is safe for concurrent use.
+type Classifier struct {
+	UserAgent string
+	Client    *http.Client
+	Context   context.Context // Cancels requests (e.g. Shutdown.Context); nil never does
+	Hints     []string        // Download-endpoint words besides downloadHints
+	Robots    *Robots         // Refuses disallowed links; nil allows all
+	Budget    *Budget         // Refuses hosts out of budget; nil never does
+
+	sets  []DocSet
+	types map[string]int    // Wanted MIME types, mapped to their set
+	exts  map[string]string // Their extensions, mapped back to the type
+
+	mu    sync.Mutex
+	cache map[string]Verdict
+}
+
+// NewClassifier returns a Classifier collecting the types of sets (PDFs when
+// there are none). When sets share a type, the first one gets it. A nil
+// client gets a plain http.Client with a 30s timeout.
+func NewClassifier(userAgent string, client *http.Client, sets []DocSet) *Classifier {
+	if client == nil {
+		client = &http.Client{Timeout: classifyTimeout}
+	}
+	if len(sets) == 0 {
+		sets = defaultDocSets
+	}
+	c := &Classifier{
+		UserAgent: userAgent,
+		Client:    client,
+		sets:      sets,
+		types:     make(map[string]int),
+		exts:      make(map[string]string),
+		cache:     make(map[string]Verdict),
+	}
+	for i, set := range sets {
+		for _, t := range set.Types {
+			t = mediaType(t)
+			if _, ok := c.types[t]; !ok {
+				c.types[t] = i
+			}
+			exts := documentExtensions[t]
+			if more, err := mime.ExtensionsByType(t); err == nil {
+				exts = append(exts, more...)
+			}
+			for _, ext := range exts {
+				c.addExtension(ext, t)
+			}
+		}
+		for _, ext := range set.Extensions {
+			c.addExtension(ext, mediaType(set.Types[0]))
+		}
+	}
+	return c
+}
+
+func (c *Classifier) addExtension(ext, mimeType string) {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	if _, ok := c.exts[ext]; !ok {
+		c.exts[ext] = mimeType
+	}
+}
+
+// Sets returns the document sets the Classifier collects.
+func (c *Classifier) Sets() []DocSet {
+	return c.sets
+}
+
+// Candidate reports whether u is worth classifying: its path ends in the
+// extension of a wanted type, or it is a script or extension-less URL that
+// looks like a download endpoint (/download?id=123, /papers/12345). Other
+// links are taken to be pages without asking. ftp:// URLs only have their
+// extension to go by.
+func (c *Classifier) Candidate(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ftp" {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if _, ok := c.exts[ext]; ok {
+		return true
+	}
+	if u.Scheme == "ftp" {
+		return false
+	}
+	if !dynamicExtensions[ext] {
+		return false
+	}
+	for _, word := range urlWords(u) {
+		if c.hinted(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// hinted reports whether word is a download hint or the plural of one.
+func (c *Classifier) hinted(word string) bool {
+	for _, hints := range [][]string{downloadHints, c.Hints} {
+		for _, hint := range hints {
+			hint = strings.ToLower(hint)
+			if word == hint || word == hint+"s" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// urlWords returns the lowercased path segments of u, each also split at
+// hyphens and dots (so /download-all/ and getfile.php give their hints),
+// and its query keys and values. Matching whole words keeps "file" from
+// matching /profile.
+func urlWords(u *url.URL) []string {
+	var words []string
+	split := func(r rune) bool { return r == '-' || r == '.' }
+	for _, seg := range strings.Split(strings.ToLower(u.Path), "/") {
+		if seg != "" {
+			words = append(words, seg)
+			words = append(words, strings.FieldsFunc(seg, split)...)
+		}
+	}
+	for key, values := range u.Query() {
+		words = append(words, strings.ToLower(key))
+		for _, v := range values {
+			words = append(words, strings.ToLower(v))
+		}
+	}
+	return words
+}
+
+// IsDocument reports whether link is a candidate confirmed to serve a wanted
+// type. It fits Sitemaps.Seed.
+func (c *Classifier) IsDocument(link string) bool {
+	_, ok := c.Match(link)
+	return ok
+}
+
+// Match returns the document set link belongs to, if it is a candidate
+// confirmed to serve one of the wanted types. When the server cannot be
+// asked, as over FTP, the link's extension decides. Candidates that
+// robots.txt disallows, or whose host is out of budget, are refused before
+// the server is asked; robots.txt refusals count in Robots.Blocked.
+func (c *Classifier) Match(link string) (DocSet, bool) {
+	u, err := url.Parse(link)
+	if err != nil || !c.Candidate(u) {
+		return DocSet{}, false
+	}
+	if !c.Budget.Allowed(u.Hostname()) || !c.Robots.Check(u) {
+		return DocSet{}, false
+	}
+	mimeType := c.exts[strings.ToLower(path.Ext(u.Path))]
+	if u.Scheme != "ftp" {
+		v, err := c.Classify(c.ctx(), link)
+		if err != nil {
+			log.Printf("Error classifying %s: %s", link, err)
+		} else if v.Document {
+			mimeType = v.MIMEType
+		} else {
+			return DocSet{}, false
+		}
+	}
+	i, ok := c.types[mimeType]
+	if !ok {
+		return DocSet{}, false
+	}
+	return c.sets[i], true
+}
+
+// Dir returns the directory under root that link's document set is saved
+// to, creating it if needed. Links outside every set, and sets whose
+// directory cannot be created, get root itself.
+func (c *Classifier) Dir(root, link string) string {
+	set, ok := c.Match(link)
+	if !ok {
+		return root
+	}
+	sub := set.Dir
+	if sub == "" {
+		sub = set.Name
+	}
+	dir := filepath.Join(root, filepath.Clean("/"+sub)) // Keep sub inside root
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating %s: %s", dir, err)
+		return root
+	}
+	return dir
+}
+
+func (c *Classifier) ctx() context.Context {
+	if c.Context != nil {
+		return c.Context
+	}
+	return context.Background()
+}
+
+// Classify asks the server what link serves. Network errors and 429/5xx
+// answers are returned as errors and not cached.
+func (c *Classifier) Classify(ctx context.Context, link string) (Verdict, error) {
+	c.mu.Lock()
+	v, ok := c.cache[link]
+	c.mu.Unlock()
+	if ok {
+		return v, nil
+	}
+
+	v, decided := c.head(ctx, link)
+	if !decided {
+		var err error
+		if v, err = c.sniff(ctx, link); err != nil {
+			return Verdict{}, err
+		}
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= classifyCacheSize {
+		for k := range c.cache {
+			delete(c.cache, k) // Evict an arbitrary entry
+			break
+		}
+	}
+	c.cache[link] = v
+	c.mu.Unlock()
+	return v, nil
+}
+
+// head classifies link from a HEAD response when its Content-Type is
+// conclusive. It reports false when the body has to be looked at.
+func (c *Classifier) head(ctx context.Context, link string) (Verdict, bool) {
+	resp, err := c.do(ctx, "HEAD", link, nil)
+	if err != nil {
+		return Verdict{}, false
+	}
+	resp.Body.Close()
+
+	ct := mediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return Verdict{By: "status"}, true
+	case resp.StatusCode/100 != 2 || genericTypes[ct]:
+		return Verdict{}, false
+	case isWanted(c.types, ct):
+		return Verdict{Document: true, MIMEType: ct, By: "content-type"}, true
+	default:
+		// A definite other type: a page, an image, an HTML error page
+		return Verdict{MIMEType: ct, By: "content-type"}, true
+	}
+}
+
+// sniff fetches the start of link's body and classifies it.
+func (c *Classifier) sniff(ctx context.Context, link string) (Verdict, error) {
+	resp, err := c.do(ctx, "GET", link, http.Header{"Range": {fmt.Sprintf("bytes=0-%d", classifySniffLen-1)}})
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return Verdict{}, fmt.Errorf("HTTP %d", resp.StatusCode)
+	case resp.StatusCode/100 != 2:
+		return Verdict{By: "status"}, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(resp.Body, classifySniffLen))
+	if err != nil && len(head) == 0 {
+		return Verdict{}, err
+	}
+	return c.judge(link, resp.Header, head), nil
+}
+
+// judge weighs what the server claims against the magic bytes in head.
+func (c *Classifier) judge(link string, header http.Header, head []byte) Verdict {
+	sniffed := sniffType(head)
+	if sniffed == "text/html" {
+		return Verdict{MIMEType: sniffed, By: "sniff"}
+	}
+
+	claims := []struct{ mimeType, by string }{
+		{mediaType(header.Get("Content-Type")), "content-type"},
+		{c.dispositionType(header.Get("Content-Disposition")), "disposition"},
+	}
+	if u, err := url.Parse(link); err == nil {
+		claims = append(claims, struct{ mimeType, by string }{c.exts[strings.ToLower(path.Ext(u.Path))], "extension"})
+	}
+	for _, claim := range claims {
+		if isWanted(c.types, claim.mimeType) && (sniffed == "" || sameFamily(claim.mimeType, sniffed)) {
+			return Verdict{Document: true, MIMEType: claim.mimeType, By: claim.by}
+		}
+	}
+	if isWanted(c.types, sniffed) {
+		return Verdict{Document: true, MIMEType: sniffed, By: "sniff"}
+	}
+	if sniffed == "" {
+		sniffed = claims[0].mimeType
+	}
+	return Verdict{MIMEType: sniffed, By: "sniff"}
+}
+
+func isWanted(types map[string]int, mimeType string) bool {
+	_, ok := types[mimeType]
+	return ok
+}
+
+// dispositionType returns the wanted type matching the extension of the
+// filename in a Content-Disposition header, or "".
+func (c *Classifier) dispositionType(v string) string {
+	if v == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+	return c.exts[strings.ToLower(path.Ext(params["filename"]))]
+}
+
+func (c *Classifier) do(ctx context.Context, method, link string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return c.Client.Do(req)
+}
+
+// sniffType identifies head by its magic bytes, or returns "" if it is not
+// recognized.
+func sniffType(head []byte) string {
+	switch {
+	case len(head) == 0:
+		return ""
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return "application/pdf"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		// EPUB stores an uncompressed "mimetype" file first
+		if len(head) >= 58 && string(head[30:38]) == "mimetype" && string(head[38:58]) == "application/epub+zip" {
+			return "application/epub+zip"
+		}
+		return "application/zip"
+	case bytes.HasPrefix(head, []byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1")):
+		return "application/x-ole-storage"
+	case bytes.HasPrefix(head, []byte("AT&TFORM")):
+		return "image/vnd.djvu"
+	case bytes.HasPrefix(head, []byte("%!PS")):
+		return "application/postscript"
+	case bytes.HasPrefix(head, []byte("{\\rtf")):
+		return "application/rtf"
+	}
+	t := mediaType(http.DetectContentType(head))
+	if genericTypes[t] {
+		return ""
+	}
+	return t
+}
+
+// sameFamily reports whether a claimed type is consistent with the sniffed
+// one: the Office Open XML, OpenDocument and EPUB formats are all zip
+// archives, the legacy Office formats are all OLE files, and text formats
+// sniff as text/plain.
+func sameFamily(claimed, sniffed string) bool {
+	if claimed == sniffed {
+		return true
+	}
+	switch sniffed {
+	case "application/zip":
+		return claimed == "application/epub+zip" ||
+			strings.HasPrefix(claimed, "application/vnd.openxmlformats-officedocument.") ||
+			strings.HasPrefix(claimed, "application/vnd.oasis.opendocument.")
+	case "application/x-ole-storage":
+		return claimed == "application/msword" || claimed == "application/vnd.ms-excel" ||
+			claimed == "application/vnd.ms-powerpoint"
+	case "text/plain":
+		return strings.HasPrefix(claimed, "text/") && claimed != "text/html"
+	}
+	return false
+}
+
+// mediaType returns the lowercased type of a Content-Type value, without
+// parameters.
+func mediaType(v string) string {
+	if i := strings.IndexByte(v, ';'); i >= 0 {
+		v = v[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+// Classifier returns a Classifier for the crawl's document sets (collect,
+// doc_sets and doc_types) and download hints (doc_hints). Crawlers set its
+// Robots and Budget, and wrap client's transport in Budget.Transport, so
+// that probes obey the same limits as downloads.
+func (c *Config) Classifier(userAgent string, client *http.Client) (*Classifier, error) {
+	sets, err := c.DocumentSets()
+	if err != nil {
+		return nil, err
+	}
+	classifier := NewClassifier(userAgent, client, sets)
+	classifier.Hints = c.DocHints
+	return classifier, nil
+}
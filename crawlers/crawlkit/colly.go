@@ -0,0 +1,72 @@
+package crawlkit
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/gocolly/colly/queue"
+)
+
+// Enqueue adds link to q one level below parent. queue.AddURL always starts
+// at depth zero, which keeps colly.MaxDepth from ever firing in queue-driven
+// crawls; carrying the depth through the request fixes that.
+func Enqueue(q *queue.Queue, parent *colly.Request, link string) error {
+	u, err := url.Parse(link)
+	if err != nil {
+		return err
+	}
+	return q.AddRequest(&colly.Request{
+		URL:    u,
+		Method: "GET",
+		Depth:  parent.Depth + 1,
+	})
+}
+
+// SitemapContext returns a request context tagging a page as found in a
+// sitemap, with its lastmod (RFC 3339) when the sitemap gave one.
+func SitemapContext(e SitemapEntry) *colly.Context {
+	ctx := colly.NewContext()
+	ctx.Put("source", "sitemap")
+	if !e.LastMod.IsZero() {
+		ctx.Put("lastmod", e.LastMod.Format(time.RFC3339))
+	}
+	return ctx
+}
+
+// EnqueueSitemapEntry adds a sitemap page to q one level below the start
+// URLs, carrying SitemapContext so it survives queue storage.
+func EnqueueSitemapEntry(q *queue.Queue, e SitemapEntry) error {
+	u, err := url.Parse(e.Loc)
+	if err != nil {
+		return err
+	}
+	return q.AddRequest(&colly.Request{
+		URL:    u,
+		Method: "GET",
+		Depth:  1,
+		Ctx:    SitemapContext(e),
+	})
+}
+
+// abortedKey holds, in a request's context, the ID of the request that
+// Abort aborted. Children visited with Request.Visit share their parent's
+// context, so the ID tells the aborted one from its siblings.
+const abortedKey = "crawlkit.aborted"
+
+// Abort aborts r from an OnRequest callback, and records it for the later
+// callbacks that skip aborted requests: colly runs them anyway and keeps its
+// own flag unexported.
+func Abort(r *colly.Request) {
+	r.Abort()
+	if r.Ctx != nil {
+		r.Ctx.Put(abortedKey, strconv.FormatUint(uint64(r.ID), 10))
+	}
+}
+
+// aborted reports whether r has been aborted with Abort by an earlier
+// OnRequest callback.
+func aborted(r *colly.Request) bool {
+	return r.Ctx != nil && r.Ctx.Get(abortedKey) == strconv.FormatUint(uint64(r.ID), 10)
+}
@@ -0,0 +1,305 @@
+// Package crawlkit holds the plumbing shared by the qcrawl crawlers, the
+// feb21 PDF downloaders and hellmouth, so that each program only has to keep
+// the parts that make it different.
+package crawlkit
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes one crawl run. Values are layered: the defaults passed to
+// Load, then an optional YAML or TOML file, then any flags given explicitly.
+type Config struct {
+	StartURLs       []string       `yaml:"start_urls" toml:"start_urls"`
+	Interface       string         `yaml:"interface" toml:"interface"` // name, IP or CIDR; comma-separated or "all" where supported
+	OutputDir       string         `yaml:"output_dir" toml:"output_dir"`
+	MaxDepth        int            `yaml:"max_depth" toml:"max_depth"`           // 0 means unlimited
+	MaxPages        int            `yaml:"max_pages" toml:"max_pages"`           // stop the crawl after this many pages
+	MaxMB           int            `yaml:"max_mb" toml:"max_mb"`                 // stop the crawl after receiving this much
+	MaxTime         Duration       `yaml:"max_time" toml:"max_time"`             // stop the crawl after this long
+	HostMaxPages    int            `yaml:"host_max_pages" toml:"host_max_pages"` // skip a host after this many pages
+	HostMaxMB       int            `yaml:"host_max_mb" toml:"host_max_mb"`       // skip a host after receiving this much from it
+	Workers         int            `yaml:"workers" toml:"workers"`
+	DownloadWorkers int            `yaml:"download_workers" toml:"download_workers"`
+	RequestTimeout  Duration       `yaml:"request_timeout" toml:"request_timeout"`
+	DownloadTimeout Duration       `yaml:"download_timeout" toml:"download_timeout"`
+	ExcludedDomains []string       `yaml:"excluded_domains" toml:"excluded_domains"`
+	ScopeFile       string         `yaml:"scope_file" toml:"scope_file"`       // allow/deny rules, replacing scope_rules
+	ScopeRules      []ScopeRule    `yaml:"scope_rules" toml:"scope_rules"`     // allow/deny rules after excluded_domains
+	ScopeDefault    string         `yaml:"scope_default" toml:"scope_default"` // allow or deny URLs no rule matches
+	TLS             TLSPolicy      `yaml:"tls" toml:"tls"`
+	ProxyURLs       []string       `yaml:"proxies" toml:"proxies"`
+	ProxyMaxFails   int            `yaml:"proxy_max_failures" toml:"proxy_max_failures"`
+	UserAgent       string         `yaml:"user_agent" toml:"user_agent"`           // also picks the robots.txt group
+	IgnoreRobots    bool           `yaml:"ignore_robots" toml:"ignore_robots"`     // skip robots.txt and Crawl-delay
+	NoSitemaps      bool           `yaml:"no_sitemaps" toml:"no_sitemaps"`         // don't seed from sitemaps
+	FrontierDir     string         `yaml:"frontier_dir" toml:"frontier_dir"`       // on-disk crawl queue
+	HostFair        bool           `yaml:"host_fair" toml:"host_fair"`             // rotate dequeues between hosts
+	Resume          string         `yaml:"resume" toml:"resume"`                   // run directory of an interrupted crawl
+	BloomFile       string         `yaml:"bloom_file" toml:"bloom_file"`           // saved URL filter for the bloom crawlers
+	ExpectedURLs    int            `yaml:"expected_urls" toml:"expected_urls"`     // sizes the first Bloom stage
+	BloomFPRate     float64        `yaml:"bloom_fp_rate" toml:"bloom_fp_rate"`     // target false-positive rate
+	VisitedFile     string         `yaml:"visited_file" toml:"visited_file"`       // visited-URL journal
+	URLRules        CanonicalRules `yaml:"url_rules" toml:"url_rules"`             // how URLs are canonicalized for dedup
+	HostRate        float64        `yaml:"host_rate" toml:"host_rate"`             // requests per second per host
+	HostBurst       int            `yaml:"host_burst" toml:"host_burst"`           // back-to-back requests per host
+	PerIP           bool           `yaml:"per_ip" toml:"per_ip"`                   // also rate-limit per resolved IP
+	DocTypes        []string       `yaml:"doc_types" toml:"doc_types"`             // extra MIME types, saved at the top level
+	DocHints        []string       `yaml:"doc_hints" toml:"doc_hints"`             // extra words marking download URLs
+	Collect         []string       `yaml:"collect" toml:"collect"`                 // built-in document sets: pdf, epub, docx, csv, zip, ...
+	DocSets         []DocSet       `yaml:"doc_sets" toml:"doc_sets"`               // custom document sets
+	NameTemplate    string         `yaml:"name_template" toml:"name_template"`     // layout of saved files, e.g. {host}/{path}
+	OnCollision     string         `yaml:"on_collision" toml:"on_collision"`       // suffix, hash or overwrite
+	StoreDir        string         `yaml:"store_dir" toml:"store_dir"`             // content-addressed document store
+	NoStore         bool           `yaml:"no_store" toml:"no_store"`               // save plain files, without dedup
+	Manifest        string         `yaml:"manifest" toml:"manifest"`               // JSONL record of every download attempt
+	WARCDir         string         `yaml:"warc_dir" toml:"warc_dir"`               // archive every exchange as WARC/1.1 here
+	WARCMaxMB       int            `yaml:"warc_max_mb" toml:"warc_max_mb"`         // start a new WARC file past this size
+	MetricsAddr     string         `yaml:"metrics_addr" toml:"metrics_addr"`       // serve Prometheus /metrics on this address
+	MetricsDomains  int            `yaml:"metrics_domains" toml:"metrics_domains"` // domains with their own latency series
+	NoDashboard     bool           `yaml:"no_dashboard" toml:"no_dashboard"`       // plain logs even on a terminal
+}
+
+// Duration is a time.Duration that reads "90s" or "2m" style strings from
+// config files.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for YAML and TOML.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// stringList is a flag.Value collecting repeated flags, or comma-separated
+// values, into a slice.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*s = append(*s, part)
+		}
+	}
+	return nil
+}
+
+// Load builds a Config for the program called name from its command-line
+// arguments, starting from defaults. Positional arguments are treated as
+// additional start URLs.
+func Load(name string, args []string, defaults Config) (*Config, error) {
+	cfg := defaults
+	fs := flag.NewFlagSet(filepath.Base(name), flag.ContinueOnError)
+
+	var (
+		urls     stringList
+		excluded stringList
+		docTypes stringList
+		docHints stringList
+		collect  stringList
+		proxies  stringList
+		noVerify stringList
+	)
+	configPath := fs.String("config", "", "YAML or TOML config file")
+	fs.Var(&urls, "url", "starting URL to crawl (repeatable)")
+	iface := fs.String("iface", defaults.Interface, "network interface to bind to, by name, IP or CIDR")
+	outDir := fs.String("out", defaults.OutputDir, "directory to store downloads in")
+	depth := fs.Int("depth", defaults.MaxDepth, "maximum crawl depth (0 = unlimited)")
+	maxPages := fs.Int("max-pages", defaults.MaxPages, "stop the crawl after fetching this many pages (0 = unlimited)")
+	maxMB := fs.Int("max-mb", defaults.MaxMB, "stop the crawl after receiving this many MiB of pages and downloads (0 = unlimited)")
+	maxTime := fs.Duration("max-time", defaults.MaxTime.Duration, "stop the crawl after this long (0 = unlimited)")
+	hostMaxPages := fs.Int("host-max-pages", defaults.HostMaxPages, "skip a host after fetching this many pages from it (0 = unlimited)")
+	hostMaxMB := fs.Int("host-max-mb", defaults.HostMaxMB, "skip a host after receiving this many MiB from it (0 = unlimited)")
+	workers := fs.Int("workers", defaults.Workers, "number of crawl workers")
+	downloadWorkers := fs.Int("download-workers", defaults.DownloadWorkers, "number of download workers")
+	requestTimeout := fs.Duration("timeout", defaults.RequestTimeout.Duration, "page request timeout")
+	downloadTimeout := fs.Duration("download-timeout", defaults.DownloadTimeout.Duration, "document download timeout")
+	fs.Var(&excluded, "exclude", "domain to skip (repeatable or comma-separated)")
+	scopeFile := fs.String("scope", defaults.ScopeFile, "YAML or TOML file of crawl scope rules")
+	insecure := fs.Bool("insecure", defaults.TLS.InsecureSkipVerify, "skip TLS certificate verification for every host (testing only)")
+	caFile := fs.String("ca-file", defaults.TLS.CAFile, "PEM bundle of CA certificates to trust besides the system roots")
+	fs.Var(&noVerify, "insecure-host", "host whose TLS certificate is not verified, with its subdomains (repeatable or comma-separated)")
+	fs.Var(&proxies, "proxy", "proxy to rotate requests through: http://, https:// or socks5://, with user:pass@ if needed (repeatable or comma-separated)")
+	proxyMaxFails := fs.Int("proxy-max-failures", defaults.ProxyMaxFails, "failed requests in a row that evict a proxy until it answers again (default 3)")
+	userAgent := fs.String("user-agent", defaults.UserAgent, "User-Agent header, also used to match robots.txt groups")
+	ignoreRobots := fs.Bool("ignore-robots", defaults.IgnoreRobots, "do not fetch or obey robots.txt")
+	noSitemaps := fs.Bool("no-sitemaps", defaults.NoSitemaps, "do not seed the crawl from sitemaps")
+	frontierDir := fs.String("frontier", defaults.FrontierDir, "directory for the on-disk crawl queue")
+	hostFair := fs.Bool("host-fair", defaults.HostFair, "dequeue round-robin across hosts instead of FIFO")
+	resume := fs.String("resume", defaults.Resume, "run directory of an interrupted crawl to continue")
+	bloomFile := fs.String("bloom-file", defaults.BloomFile, "file the URL Bloom filter is loaded from and saved to")
+	expectedURLs := fs.Int("expected-urls", defaults.ExpectedURLs, "number of URLs the Bloom filter is first sized for")
+	bloomFPRate := fs.Float64("bloom-fp", defaults.BloomFPRate, "target Bloom filter false-positive rate")
+	visitedFile := fs.String("visited", defaults.VisitedFile, "visited-URL journal file")
+	hostRate := fs.Float64("host-rate", defaults.HostRate, "requests per second to each host (0 = default of 2)")
+	hostBurst := fs.Int("host-burst", defaults.HostBurst, "requests a host may receive back to back")
+	fs.Var(&docTypes, "doc-types", "MIME type of documents to download (repeatable or comma-separated)")
+	fs.Var(&docHints, "doc-hints", "word marking extension-less download URLs, like download in /download?id=1 (repeatable or comma-separated)")
+	fs.Var(&collect, "collect", "document set to collect into its own subfolder: pdf, epub, docx, csv, zip, ... (repeatable or comma-separated)")
+	nameTemplate := fs.String("name-template", defaults.NameTemplate, "layout of saved files: {host} {path} {dir} {name} {stem} {ext} {yyyy} {mm} {dd} {sha256} {blake2b} (default {name})")
+	onCollision := fs.String("on-collision", defaults.OnCollision, "when a name is taken: suffix, hash or overwrite (default suffix)")
+	storeDir := fs.String("store", defaults.StoreDir, "directory of the content-addressed document store (default docstore)")
+	noStore := fs.Bool("no-store", defaults.NoStore, "save plain files without the document store")
+	manifest := fs.String("manifest", defaults.Manifest, "JSONL file recording every download attempt")
+	warcDir := fs.String("warc", defaults.WARCDir, "directory to archive every request and response in as WARC/1.1 files")
+	warcMaxMB := fs.Int("warc-max-mb", defaults.WARCMaxMB, "size in MiB at which a new WARC file is started (default 1024)")
+	metricsAddr := fs.String("metrics", defaults.MetricsAddr, "address to serve Prometheus metrics on at /metrics, e.g. :9100")
+	metricsDomains := fs.Int("metrics-domains", defaults.MetricsDomains, "registered domains that get latency histograms of their own; the rest share \"other\" (default 50)")
+	noDashboard := fs.Bool("no-dashboard", defaults.NoDashboard, "print plain logs instead of the terminal dashboard")
+	perIP := fs.Bool("per-ip", defaults.PerIP, "also rate-limit hosts that resolve to the same IP together")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only flags given on the command line override the file.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			cfg.StartURLs = urls
+		case "iface":
+			cfg.Interface = *iface
+		case "out":
+			cfg.OutputDir = *outDir
+		case "depth":
+			cfg.MaxDepth = *depth
+		case "max-pages":
+			cfg.MaxPages = *maxPages
+		case "max-mb":
+			cfg.MaxMB = *maxMB
+		case "max-time":
+			cfg.MaxTime.Duration = *maxTime
+		case "host-max-pages":
+			cfg.HostMaxPages = *hostMaxPages
+		case "host-max-mb":
+			cfg.HostMaxMB = *hostMaxMB
+		case "workers":
+			cfg.Workers = *workers
+		case "download-workers":
+			cfg.DownloadWorkers = *downloadWorkers
+		case "timeout":
+			cfg.RequestTimeout.Duration = *requestTimeout
+		case "download-timeout":
+			cfg.DownloadTimeout.Duration = *downloadTimeout
+		case "exclude":
+			cfg.ExcludedDomains = excluded
+		case "scope":
+			cfg.ScopeFile = *scopeFile
+		case "insecure":
+			cfg.TLS.InsecureSkipVerify = *insecure
+		case "ca-file":
+			cfg.TLS.CAFile = *caFile
+		case "insecure-host":
+			cfg.TLS.InsecureHosts = noVerify
+		case "proxy":
+			cfg.ProxyURLs = proxies
+		case "proxy-max-failures":
+			cfg.ProxyMaxFails = *proxyMaxFails
+		case "user-agent":
+			cfg.UserAgent = *userAgent
+		case "ignore-robots":
+			cfg.IgnoreRobots = *ignoreRobots
+		case "no-sitemaps":
+			cfg.NoSitemaps = *noSitemaps
+		case "frontier":
+			cfg.FrontierDir = *frontierDir
+		case "host-fair":
+			cfg.HostFair = *hostFair
+		case "resume":
+			cfg.Resume = *resume
+		case "bloom-file":
+			cfg.BloomFile = *bloomFile
+		case "expected-urls":
+			cfg.ExpectedURLs = *expectedURLs
+		case "bloom-fp":
+			cfg.BloomFPRate = *bloomFPRate
+		case "visited":
+			cfg.VisitedFile = *visitedFile
+		case "host-rate":
+			cfg.HostRate = *hostRate
+		case "host-burst":
+			cfg.HostBurst = *hostBurst
+		case "per-ip":
+			cfg.PerIP = *perIP
+		case "doc-types":
+			cfg.DocTypes = docTypes
+		case "doc-hints":
+			cfg.DocHints = docHints
+		case "collect":
+			cfg.Collect = collect
+		case "name-template":
+			cfg.NameTemplate = *nameTemplate
+		case "on-collision":
+			cfg.OnCollision = *onCollision
+		case "store":
+			cfg.StoreDir = *storeDir
+		case "no-store":
+			cfg.NoStore = *noStore
+		case "manifest":
+			cfg.Manifest = *manifest
+		case "warc":
+			cfg.WARCDir = *warcDir
+		case "warc-max-mb":
+			cfg.WARCMaxMB = *warcMaxMB
+		case "metrics":
+			cfg.MetricsAddr = *metricsAddr
+		case "metrics-domains":
+			cfg.MetricsDomains = *metricsDomains
+		case "no-dashboard":
+			cfg.NoDashboard = *noDashboard
+		}
+	})
+	cfg.StartURLs = append(cfg.StartURLs, fs.Args()...)
+
+	if err := cfg.TLS.prepare(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// loadFile merges a YAML (.yaml, .yml) or TOML (.toml) file into c.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	case ".toml":
+		err = toml.Unmarshal(data, c)
+	default:
+		return fmt.Errorf("config %s: unknown format, use .yaml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config %s: %w", path, err)
+	}
+	return nil
+}
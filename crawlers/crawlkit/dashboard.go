@@ -0,0 +1,551 @@
+package crawlkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	dashboardInterval = time.Second
+	dashboardHistory  = 120 // Samples kept for the sparklines
+	dashboardLogLines = 200 // Captured output lines kept
+	dashboardErrors   = 50  // Error lines kept
+)
+
+// DashboardStats is a crawler's progress at one moment, as read by a
+// Dashboard on every redraw. Counters are totals since the start; the
+// Dashboard works out the rates.
+type DashboardStats struct {
+	Pages      int64 // Pages fetched
+	Links      int64 // Links found on them
+	Unique     int64 // Links not seen before
+	Downloads  int64 // Successful downloads
+	Failed     int64 // Failed download attempts
+	Bytes      int64 // Bytes downloaded
+	Workers    int64 // Active workers
+	Remaining  int64 // Downloads left (pages for crawlers that download nothing), for the ETA
+	Queues     []QueueFill
+	Interfaces []InterfaceTraffic
+}
+
+// QueueFill is how full one of a crawler's queues is.
+type QueueFill struct {
+	Name string
+	Len  int
+	Cap  int // 0 for unbounded queues, which are shown without a bar
+}
+
+// InterfaceTraffic is the bytes downloaded through one network interface.
+type InterfaceTraffic struct {
+	Name  string
+	Bytes int64
+}
+
+// Dashboard is a full-screen terminal view of a running crawl: throughput
+// sparklines, workers, per-interface bandwidth, queue fill levels, the
+// busiest hosts, recent errors and an ETA. While it runs, everything the
+// crawler prints or logs is captured and shown in its log pane, with lines
+// that look like errors also kept in their own pane. Keys: p pauses
+// requests through Polite, r resumes them, q (or Ctrl+C) stops the crawl
+// through Shutdown, and a second Ctrl+C exits at once. A nil Dashboard
+// does nothing, so crawlers print their plain logs instead.
+type Dashboard struct {
+	Title    string
+	Stats    func() DashboardStats
+	Polite   *Politeness // Busiest hosts; paused and resumed from the keyboard
+	Shutdown *Shutdown   // Stopped from the keyboard
+	Interval time.Duration
+
+	tty      *os.File // The real stdout
+	stdout   *os.File
+	stderr   *os.File
+	pipe     *os.File // Write end that replaces stdout and stderr
+	rawState *term.State
+	started  time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu         sync.Mutex
+	logs       []string
+	errors     []string
+	last       DashboardStats
+	lastAt     time.Time
+	pages      []float64 // Per-second rates, oldest first
+	dls        []float64
+	bw         []float64
+	ifaceBW    map[string]float64
+	interrupts int
+}
+
+// NewDashboard returns a Dashboard for the terminal on stdout, or nil when
+// stdout is not a terminal.
+func NewDashboard(title string, stats func() DashboardStats) *Dashboard {
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return nil
+	}
+	return &Dashboard{Title: title, Stats: stats}
+}
+
+// Dashboard returns a Dashboard unless no_dashboard is set or stdout is
+// not a terminal.
+func (c *Config) Dashboard(title string, stats func() DashboardStats) *Dashboard {
+	if c.NoDashboard {
+		return nil
+	}
+	return NewDashboard(title, stats)
+}
+
+// Start switches the terminal to the dashboard and starts capturing
+// output. Call it before the crawler starts its goroutines, and Stop after
+// they are done, since it swaps os.Stdout and os.Stderr.
+func (d *Dashboard) Start() error {
+	if d == nil {
+		return nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	d.tty, d.stdout, d.stderr, d.pipe = os.Stdout, os.Stdout, os.Stderr, w
+	d.started = time.Now()
+	d.lastAt = d.started
+	d.stop = make(chan struct{})
+	d.ifaceBW = make(map[string]float64)
+	if d.Interval <= 0 {
+		d.Interval = dashboardInterval
+	}
+	if d.Stats != nil {
+		d.last = d.Stats()
+	}
+
+	// Raw mode delivers single key presses, and Ctrl+C as a key
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		if state, err := term.MakeRaw(int(os.Stdin.Fd())); err == nil {
+			d.rawState = state
+			go d.readKeys()
+		}
+	}
+	os.Stdout, os.Stderr = w, w
+	log.SetOutput(w)
+	fmt.Fprint(d.tty, "\x1b[?1049h\x1b[?25l") // Alternate screen, hide cursor
+
+	d.wg.Add(2)
+	go d.capture(r)
+	go d.run()
+	return nil
+}
+
+// Stop restores the terminal and output, then prints the recent errors,
+// which would otherwise leave with the dashboard. Only the first call does
+// anything, so it can also be deferred.
+func (d *Dashboard) Stop() {
+	if d == nil || d.stop == nil {
+		return
+	}
+	d.stopOnce.Do(d.stopNow)
+}
+
+func (d *Dashboard) stopNow() {
+	close(d.stop)
+	os.Stdout, os.Stderr = d.stdout, d.stderr
+	log.SetOutput(d.stderr)
+	d.pipe.Close()
+	d.wg.Wait()
+	fmt.Fprint(d.tty, "\x1b[?25h\x1b[?1049l") // Show cursor, main screen
+	if d.rawState != nil {
+		term.Restore(int(os.Stdin.Fd()), d.rawState)
+	}
+	d.mu.Lock()
+	errors := d.errors
+	d.mu.Unlock()
+	if len(errors) > 0 {
+		fmt.Fprintln(d.tty, "Recent errors:")
+		for _, line := range tail(errors, 10) {
+			fmt.Fprintln(d.tty, "  "+line)
+		}
+	}
+}
+
+// capture keeps the lines written to stdout, stderr and the log.
+func (d *Dashboard) capture(r io.ReadCloser) {
+	defer d.wg.Done()
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		d.mu.Lock()
+		d.logs = appendRing(d.logs, line, dashboardLogLines)
+		if isErrorLine(line) {
+			d.errors = appendRing(d.errors, line, dashboardErrors)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// readKeys handles key presses until stdin closes. It is left running
+// after Stop, since a read cannot be interrupted; keys are ignored then.
+func (d *Dashboard) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		for _, key := range buf[:n] {
+			d.key(key)
+		}
+	}
+}
+
+func (d *Dashboard) key(key byte) {
+	switch key {
+	case 'p', 'P':
+		d.Polite.Pause()
+		log.Printf("Dashboard: paused")
+	case 'r', 'R':
+		d.Polite.Resume()
+		log.Printf("Dashboard: resumed")
+	case 'q', 'Q':
+		d.quit()
+	case 3: // Ctrl+C
+		d.mu.Lock()
+		d.interrupts++
+		again := d.interrupts > 1
+		d.mu.Unlock()
+		if again {
+			d.restore()
+			fmt.Fprintln(d.tty, "Interrupted again, exiting")
+			os.Exit(130)
+		}
+		d.quit()
+	}
+}
+
+// quit starts a graceful stop, resuming first so paused requests can be
+// aborted.
+func (d *Dashboard) quit() {
+	if d.Shutdown == nil {
+		return
+	}
+	d.Polite.Resume()
+	d.Shutdown.Stop()
+	log.Printf("Dashboard: stopping (Ctrl+C again to exit at once)")
+}
+
+// restore puts the terminal back without waiting for the crawler.
+func (d *Dashboard) restore() {
+	fmt.Fprint(d.tty, "\x1b[?25h\x1b[?1049l")
+	if d.rawState != nil {
+		term.Restore(int(os.Stdin.Fd()), d.rawState)
+	}
+}
+
+// run redraws every Interval until Stop.
+func (d *Dashboard) run() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.sample()
+			d.draw()
+		}
+	}
+}
+
+// sample reads the crawler's stats and appends the rates since the last
+// sample to the history.
+func (d *Dashboard) sample() {
+	if d.Stats == nil {
+		return
+	}
+	now := d.Stats()
+	at := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	secs := at.Sub(d.lastAt).Seconds()
+	if secs <= 0 {
+		return
+	}
+	d.pages = appendHistory(d.pages, float64(now.Pages-d.last.Pages)/secs)
+	d.dls = appendHistory(d.dls, float64(now.Downloads-d.last.Downloads)/secs)
+	d.bw = appendHistory(d.bw, float64(now.Bytes-d.last.Bytes)/secs)
+	prev := make(map[string]int64, len(d.last.Interfaces))
+	for _, t := range d.last.Interfaces {
+		prev[t.Name] = t.Bytes
+	}
+	for _, t := range now.Interfaces {
+		d.ifaceBW[t.Name] = float64(t.Bytes-prev[t.Name]) / secs
+	}
+	d.last, d.lastAt = now, at
+}
+
+// draw renders one frame, cut to the terminal's size.
+func (d *Dashboard) draw() {
+	width, height, err := term.GetSize(int(d.tty.Fd()))
+	if err != nil || width < 20 || height < 5 {
+		width, height = 80, 24
+	}
+	spark := width - 46
+	if spark < 0 {
+		spark = 0
+	}
+
+	d.mu.Lock()
+	st := d.last
+	var lines []string
+	add := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	state := "running"
+	if d.Shutdown != nil && d.Shutdown.Stopping() {
+		state = "stopping"
+	} else if d.Polite.Paused() {
+		state = "PAUSED"
+	}
+	add("\x1b[1m%s\x1b[0m  %s %s   [p]ause [r]esume [q]uit", d.Title, state, formatElapsed(time.Since(d.started)))
+	add("")
+	add("Pages      %12d %9.1f/s  %s", st.Pages, last(d.pages), sparkline(d.pages, spark))
+	if st.Links > 0 {
+		add("Links      %12d %9d unique", st.Links, st.Unique)
+	}
+	if st.Downloads+st.Failed > 0 || len(st.Interfaces) > 0 {
+		add("Downloads  %12d %9.1f/s  %s", st.Downloads, last(d.dls), sparkline(d.dls, spark))
+		add("Failed     %12d", st.Failed)
+		add("Bandwidth  %12s %7s/s  %s", formatBytes(st.Bytes), formatBits(last(d.bw)), sparkline(d.bw, spark))
+	}
+	eta := "-"
+	rate := average(d.dls, 10)
+	if st.Downloads+st.Failed == 0 {
+		rate = average(d.pages, 10)
+	}
+	if st.Remaining > 0 && rate > 0 {
+		eta = formatElapsed(time.Duration(float64(st.Remaining) / rate * float64(time.Second)))
+	}
+	add("Workers    %12d   ETA %s (%d left)", st.Workers, eta, st.Remaining)
+
+	if len(st.Queues) > 0 {
+		add("")
+		add("\x1b[1mQueues\x1b[0m")
+		for _, q := range st.Queues {
+			if q.Cap > 0 {
+				add("  %-12s %s %d/%d", q.Name, bar(float64(q.Len)/float64(q.Cap), 30), q.Len, q.Cap)
+			} else {
+				add("  %-12s %d", q.Name, q.Len)
+			}
+		}
+	}
+	if len(st.Interfaces) > 0 {
+		add("")
+		add("\x1b[1mInterfaces\x1b[0m")
+		for _, t := range st.Interfaces {
+			add("  %-12s %9s/s %10s", t.Name, formatBits(d.ifaceBW[t.Name]), formatBytes(t.Bytes))
+		}
+	}
+	logs := d.logs
+	errors := d.errors
+	d.mu.Unlock()
+
+	if hosts := d.Polite.Stats(); len(hosts) > 0 {
+		add("")
+		add("\x1b[1mTop hosts\x1b[0m")
+		for i, h := range hosts {
+			if i == 5 {
+				break
+			}
+			line := fmt.Sprintf("  %-30s %6.2f/s %8d req", h.Host, h.Rate, h.Requests)
+			if h.Backoff > 0 {
+				line += fmt.Sprintf("  backoff %s", h.Backoff)
+			}
+			if h.Throttled+h.Resets > 0 {
+				line += fmt.Sprintf("  %d throttled %d resets", h.Throttled, h.Resets)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(errors) > 0 {
+		add("")
+		add("\x1b[1mRecent errors\x1b[0m")
+		for _, line := range tail(errors, 5) {
+			add("  \x1b[31m%s\x1b[0m", line)
+		}
+	}
+	add("")
+	add("\x1b[1mLog\x1b[0m")
+	if room := height - len(lines); room > 0 {
+		for _, line := range tail(logs, room) {
+			add("  %s", line)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i == height {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(truncate(line, width))
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprint(d.tty, b.String())
+}
+
+// isErrorLine reports whether a captured line looks like an error.
+func isErrorLine(line string) bool {
+	lower := strings.ToLower(line)
+	return strings.Contains(line, "❌") || strings.Contains(line, "⚠️") ||
+		strings.Contains(lower, "error") || strings.Contains(lower, "failed")
+}
+
+func appendRing(lines []string, line string, n int) []string {
+	lines = append(lines, line)
+	if len(lines) > n {
+		lines = append([]string(nil), lines[len(lines)-n:]...)
+	}
+	return lines
+}
+
+func appendHistory(h []float64, v float64) []float64 {
+	if v < 0 {
+		v = 0
+	}
+	h = append(h, v)
+	if len(h) > dashboardHistory {
+		h = h[len(h)-dashboardHistory:]
+	}
+	return h
+}
+
+func tail[T any](s []T, n int) []T {
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
+
+func last(h []float64) float64 {
+	if len(h) == 0 {
+		return 0
+	}
+	return h[len(h)-1]
+}
+
+// average returns the mean of the last n samples of h.
+func average(h []float64, n int) float64 {
+	h = tail(h, n)
+	if len(h) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range h {
+		sum += v
+	}
+	return sum / float64(len(h))
+}
+
+// sparkline draws the last width samples of h, scaled to their maximum.
+func sparkline(h []float64, width int) string {
+	const ticks = "▁▂▃▄▅▆▇█"
+	h = tail(h, width)
+	top := 0.0
+	for _, v := range h {
+		top = math.Max(top, v)
+	}
+	runes := []rune(ticks)
+	var b strings.Builder
+	for _, v := range h {
+		i := 0
+		if top > 0 {
+			i = int(v / top * float64(len(runes)-1))
+		}
+		b.WriteRune(runes[i])
+	}
+	return b.String()
+}
+
+// bar draws a fill level between 0 and 1.
+func bar(fill float64, width int) string {
+	if fill < 0 {
+		fill = 0
+	} else if fill > 1 {
+		fill = 1
+	}
+	n := int(fill*float64(width) + 0.5)
+	return "[" + strings.Repeat("█", n) + strings.Repeat("░", width-n) + "]"
+}
+
+// truncate cuts line to width runes, not counting escape sequences.
+func truncate(line string, width int) string {
+	var b strings.Builder
+	n := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case escape:
+			b.WriteRune(r)
+			if r >= '@' && r <= '~' && r != '[' {
+				escape = false
+			}
+			continue
+		case r == '\x1b':
+			escape = true
+			b.WriteRune(r)
+			continue
+		}
+		if n == width {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	if escape || strings.Contains(line, "\x1b[") {
+		b.WriteString("\x1b[0m")
+	}
+	return b.String()
+}
+
+// formatBits renders a byte rate in bits, as network speeds are quoted.
+func formatBits(bytesPerSec float64) string {
+	bits := bytesPerSec * 8
+	switch {
+	case bits >= 1e9:
+		return fmt.Sprintf("%.1f Gb", bits/1e9)
+	case bits >= 1e6:
+		return fmt.Sprintf("%.1f Mb", bits/1e6)
+	case bits >= 1e3:
+		return fmt.Sprintf("%.1f kb", bits/1e3)
+	}
+	return fmt.Sprintf("%.0f b", bits)
+}
+
+func formatElapsed(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
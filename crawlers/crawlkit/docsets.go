@@ -0,0 +1,89 @@
+package crawlkit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DocSet is one kind of document to collect and the subfolder it goes to.
+type DocSet struct {
+	Name       string   `yaml:"name" toml:"name"`
+	Types      []string `yaml:"types" toml:"types"`           // MIME types
+	Extensions []string `yaml:"extensions" toml:"extensions"` // extra extensions, e.g. ".h5"; the types' usual ones are known
+	Dir        string   `yaml:"dir" toml:"dir"`               // subfolder of the output directory; "" means Name, "." the top level
+}
+
+// builtinDocSets are the sets -collect can name.
+var builtinDocSets = map[string][]string{
+	"pdf":  {"application/pdf"},
+	"epub": {"application/epub+zip"},
+	"doc":  {"application/msword"},
+	"docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	"xls":  {"application/vnd.ms-excel"},
+	"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"ppt":  {"application/vnd.ms-powerpoint"},
+	"pptx": {"application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+	"odt":  {"application/vnd.oasis.opendocument.text"},
+	"rtf":  {"application/rtf", "text/rtf"},
+	"csv":  {"text/csv", "application/csv"},
+	"txt":  {"text/plain"},
+	"zip":  {"application/zip", "application/x-zip-compressed"},
+	"gz":   {"application/gzip", "application/x-gzip"},
+	"ps":   {"application/postscript"},
+	"djvu": {"image/vnd.djvu", "image/x-djvu"},
+}
+
+// defaultDocSets is what crawlers collect when nothing is configured: PDFs,
+// at the top of the output directory as before.
+var defaultDocSets = []DocSet{{Name: "pdf", Types: []string{"application/pdf"}, Dir: "."}}
+
+// NamedDocSets returns the built-in sets with the given names (pdf, epub,
+// docx, csv, zip, ...), each going to a subfolder of the same name.
+func NamedDocSets(names ...string) ([]DocSet, error) {
+	var sets []DocSet
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "."))
+		types, ok := builtinDocSets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown document set %q (known: %s)", name, strings.Join(builtinDocSetNames(), ", "))
+		}
+		sets = append(sets, DocSet{Name: name, Types: types, Dir: name})
+	}
+	return sets, nil
+}
+
+func builtinDocSetNames() []string {
+	names := make([]string, 0, len(builtinDocSets))
+	for name := range builtinDocSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DocumentSets returns the document sets to collect: the built-in ones named
+// by collect, then doc_sets, then one top-level set per doc_types entry.
+// Without any of them, PDFs are collected into the output directory.
+func (c *Config) DocumentSets() ([]DocSet, error) {
+	sets, err := NamedDocSets(c.Collect...)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range c.DocSets {
+		if len(s.Types) == 0 {
+			return nil, fmt.Errorf("document set %q has no types", s.Name)
+		}
+		if s.Dir == "" {
+			s.Dir = s.Name
+		}
+		sets = append(sets, s)
+	}
+	for _, t := range c.DocTypes {
+		sets = append(sets, DocSet{Name: t, Types: []string{t}, Dir: "."})
+	}
+	if len(sets) == 0 {
+		sets = defaultDocSets
+	}
+	return sets, nil
+}
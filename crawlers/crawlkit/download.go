@@ -0,0 +1,485 @@
+package crawlkit
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	partSuffix     = ".part" // Marks a download that has not finished yet
+	partInfoSuffix = ".json" // Sidecar of a resumable .part file
+	partNameMax    = 64      // Bytes of the URL's file name kept in a .part name
+)
+
+// SaveFile streams body into path. The data is written to "<path>.part" and
+// renamed into place only once it is complete, so a failed or interrupted
+// download never leaves a truncated file under the final name; the partial
+// file is removed instead. Copying stops with ctx.Err() once ctx is
+// cancelled; a body that is an io.Closer, such as an FTP data connection, is
+// closed then so that a blocked read returns. buf is used when not nil.
+func SaveFile(ctx context.Context, path string, body io.Reader, buf []byte) (int64, error) {
+	partPath := path + partSuffix
+	out, err := os.Create(partPath)
+	if err != nil {
+		return 0, err
+	}
+
+	if c, ok := body.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { c.Close() })
+		defer stop()
+	}
+
+	n, err := io.CopyBuffer(out, &ctxReader{ctx: ctx, r: body}, buf)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return n, err
+	}
+	if err := os.Rename(partPath, path); err != nil {
+		os.Remove(partPath)
+		return n, err
+	}
+	return n, nil
+}
+
+// SaveNamed is SaveFile for transfers without HTTP headers: body is saved
+// under a temporary name in dir, then named by namer as an HTTP download
+// from u would be. FTPClient.Download also resumes.
+func SaveNamed(ctx context.Context, dir string, u *url.URL, body io.Reader, namer *Namer, buf []byte) (string, int64, error) {
+	tmp := filepath.Join(dir, strings.TrimSuffix(partName(u), partSuffix))
+	content := &fileHash{path: tmp}
+	var h hash.Hash
+	if namer.store() != nil {
+		h = newContentHash()
+		body = io.TeeReader(body, h)
+	}
+	n, err := SaveFile(ctx, tmp, body, buf)
+	if err != nil {
+		return "", n, err
+	}
+	if h != nil {
+		content.digest = hexSum(h)
+	}
+	finalPath, err := namer.place(dir, u, http.Header{}, content)
+	if err != nil {
+		os.Remove(tmp)
+		return "", n, err
+	}
+	return finalPath, n, nil
+}
+
+// ctxReader fails reads once its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// PartInfo is the sidecar kept next to a resumable .part file as
+// "<part>.json". It records what is needed to ask for the rest: the
+// validators of the response the part came from and the expected size.
+type PartInfo struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Length       int64     `json:"length"`  // Size of the complete file, -1 if unknown
+	Written      int64     `json:"written"` // Bytes in the .part file
+	Updated      time.Time `json:"updated"`
+}
+
+// validator returns what If-Range can send for the part, or "" when it
+// cannot be resumed safely. Weak ETags are not allowed in If-Range.
+func (p *PartInfo) validator() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// Errors of downloads cut short, for telling them apart with errors.Is.
+var (
+	ErrIncomplete   = errors.New("incomplete download")
+	ErrContentRange = errors.New("unexpected Content-Range")
+)
+
+// StatusError is a download answered with a status other than 200 or 206.
+// Callers usually retry other errors, but not this one.
+type StatusError struct {
+	URL  string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("HTTP %d for %s", e.Code, e.URL)
+}
+
+// partLocks holds the .part files being written, so that two workers given
+// the same URL do not write into one file.
+var partLocks sync.Map
+
+// DownloadFile fetches req with client into dir and returns the path it was
+// saved to and the number of bytes received. The body streams into a .part
+// file named after the URL, with a PartInfo sidecar. When an earlier attempt
+// left one behind, only the rest is asked for with Range and If-Range, so a
+// timeout on a large document costs only what had not arrived yet; a server
+// that ignores the range or whose copy changed sends the whole file, and the
+// download starts over. The file is renamed into place once its size matches
+// Content-Length (or the total of Content-Range). A failed or interrupted
+// download keeps its .part for the next attempt, in this run or the next,
+// unless the server gave neither an ETag nor a Last-Modified to resume
+// against.
+//
+// namer names the finished file in dir and resolves collisions; nil uses
+// the Content-Disposition filename or the last URL segment, with a numeric
+// suffix when taken. The request is sent with Accept-Encoding: identity,
+// since ranges count stored bytes. buf is used when not nil.
+func DownloadFile(ctx context.Context, client *http.Client, req *http.Request, dir string, namer *Namer, buf []byte) (string, int64, error) {
+	res, err := Download(ctx, client, req, dir, namer, buf)
+	return res.Path, res.Received, err
+}
+
+// DownloadResult describes one download attempt, as far as it got.
+type DownloadResult struct {
+	Path        string  // Where the file was saved; "" on failure
+	FinalURL    string  // URL after redirects
+	Status      int     // HTTP status, 304 when the stored copy was current; 0 when no response arrived
+	ContentType string  // Content-Type of the response
+	Proto       string  // Protocol the response came over: h1, h2 or h3
+	Proxy       string  // Proxy the request went through, if any
+	Received    int64   // Bytes received in this attempt
+	Size        int64   // Size of the saved file, including resumed bytes
+	Resumed     int64   // Bytes an earlier attempt had already written
+	SHA256      string  // Hex SHA-256 of the saved file
+	Stored      bool    // Linked from the document store, unchanged, without downloading
+	Timings     Timings // Where the time went
+}
+
+// Timings break a download's duration down. Phases that did not happen,
+// such as DNS on a reused connection, are zero.
+type Timings struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration // From sending the request to the first response byte
+	Total     time.Duration
+}
+
+// traceTimings returns a ClientTrace timing a request, and a function
+// returning what it measured so far. The hooks may run on other goroutines.
+func traceTimings() (*httptrace.ClientTrace, func() Timings) {
+	var mu sync.Mutex
+	var t Timings
+	var dnsStart, connStart, tlsStart, wrote time.Time
+	set := func(d *time.Duration, since *time.Time) {
+		mu.Lock()
+		if *d == 0 && !since.IsZero() {
+			*d = time.Since(*since)
+		}
+		mu.Unlock()
+	}
+	mark := func(at *time.Time) {
+		mu.Lock()
+		*at = time.Now()
+		mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&t.DNS, &dnsStart) },
+		ConnectStart:         func(string, string) { mark(&connStart) },
+		ConnectDone:          func(string, string, error) { set(&t.Connect, &connStart) },
+		TLSHandshakeStart:    func() { mark(&tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&t.TLS, &tlsStart) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&wrote) },
+		GotFirstResponseByte: func() { set(&t.FirstByte, &wrote) },
+	}
+	return trace, func() Timings {
+		mu.Lock()
+		defer mu.Unlock()
+		return t
+	}
+}
+
+// Download is DownloadFile returning everything known about the attempt,
+// for manifests; the result is filled in as far as the attempt got, also
+// when it fails.
+func Download(ctx context.Context, client *http.Client, req *http.Request, dir string, namer *Namer, buf []byte) (*DownloadResult, error) {
+	res := &DownloadResult{FinalURL: req.URL.String()}
+	started := time.Now()
+	defer func() { res.Timings.Total = time.Since(started) }()
+
+	link := req.URL.String()
+	partPath := filepath.Join(dir, partName(req.URL))
+	if _, busy := partLocks.LoadOrStore(partPath, true); busy {
+		return res, fmt.Errorf("%s is already being downloaded", link)
+	}
+	defer partLocks.Delete(partPath)
+
+	// A URL saved before, in this run or an earlier one, is asked for with
+	// the validators it was saved with, and a 304 links it from the store.
+	// A changed document, or one saved without validators, is downloaded;
+	// the store still links it if its content turns out the same.
+	rec, stored := namer.store().Lookup(link)
+
+	info, offset := loadPart(partPath, link)
+	trace, timings := traceTimings()
+	ctx = context.WithValue(ctx, proxyRecordKey{}, &res.Proxy)
+	req = req.Clone(httptrace.WithClientTrace(ctx, trace))
+	req.Header.Set("Accept-Encoding", "identity")
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", info.validator())
+	} else if stored {
+		if rec.ETag != "" {
+			req.Header.Set("If-None-Match", rec.ETag)
+		}
+		if rec.LastModified != "" {
+			req.Header.Set("If-Modified-Since", rec.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	res.Timings = timings()
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	res.FinalURL = resp.Request.URL.String()
+	res.Status = resp.StatusCode
+	res.ContentType = resp.Header.Get("Content-Type")
+	res.Proto = protoName(resp)
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && stored:
+		if res.Path, err = namer.placeRecord(dir, rec, resp.Header); err != nil {
+			return res, err
+		}
+		res.Stored = true
+		res.fillFile(&fileHash{path: res.Path})
+		return res, nil
+	case resp.StatusCode == http.StatusOK:
+		offset = 0
+		info = newPartInfo(link, resp)
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, total, ok := contentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset || (info.Length >= 0 && total >= 0 && total != info.Length) {
+			removePart(partPath)
+			return res, fmt.Errorf("%w %q for %s", ErrContentRange, resp.Header.Get("Content-Range"), link)
+		}
+		if total >= 0 {
+			info.Length = total
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && offset == info.Length:
+		// The last attempt got everything but stopped before the rename
+		res.Resumed = offset
+		return res, finishPart(res, &fileHash{path: partPath}, dir, namer, resp.Request.URL, resp.Header)
+	default:
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			removePart(partPath)
+		}
+		return res, &StatusError{URL: link, Code: resp.StatusCode}
+	}
+	res.Resumed = offset
+	content, err := receivePart(ctx, partPath, info, offset, resp.Body, namer, buf, &res.Received)
+	if err != nil {
+		return res, err
+	}
+	return res, finishPart(res, content, dir, namer, resp.Request.URL, resp.Header)
+}
+
+// receivePart writes body into partPath after the offset bytes an earlier
+// attempt left there, or into an empty part when offset is 0, hashing all of
+// it. *received counts the bytes that arrived. When the transfer fails, the
+// part and its sidecar are kept for the next attempt if info can resume them,
+// and removed otherwise.
+func receivePart(ctx context.Context, partPath string, info *PartInfo, offset int64, body io.Reader, namer *Namer, buf []byte, received *int64) (*fileHash, error) {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	out, err := os.OpenFile(partPath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	link := info.URL
+	info.Written = offset
+	if err := savePartInfo(partPath, info); err != nil {
+		out.Close()
+		return nil, err
+	}
+
+	// Hash on the way in, starting with what earlier attempts wrote: SHA-256
+	// for names and manifests, BLAKE2b for the store
+	sha := sha256.New()
+	var blake hash.Hash
+	hashes := io.Writer(sha)
+	if namer.store() != nil {
+		blake = newContentHash()
+		hashes = io.MultiWriter(sha, blake)
+	}
+	if err := hashPrefix(hashes, partPath, offset); err != nil {
+		out.Close()
+		removePart(partPath)
+		return nil, err
+	}
+	n, err := io.CopyBuffer(io.MultiWriter(out, hashes), &ctxReader{ctx: ctx, r: body}, buf)
+	*received = n
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	info.Written = offset + n
+	if err == nil && info.Length >= 0 && info.Written != info.Length {
+		err = fmt.Errorf("%w of %s: %d of %d bytes", ErrIncomplete, link, info.Written, info.Length)
+	}
+	if err != nil {
+		if info.validator() != "" && info.Written > 0 && (info.Length < 0 || info.Written < info.Length) {
+			savePartInfo(partPath, info) // Resume from here next time
+		} else {
+			removePart(partPath)
+		}
+		return nil, err
+	}
+	content := &fileHash{path: partPath, hex: hexSum(sha), done: true}
+	if blake != nil {
+		content.digest = hexSum(blake)
+	}
+	return content, nil
+}
+
+// finishPart moves a complete .part file to the name namer gives it for u
+// and header, and drops its sidecar. If that fails, the part stays complete
+// and the next attempt only has to finish it.
+func finishPart(res *DownloadResult, content *fileHash, dir string, namer *Namer, u *url.URL, header http.Header) error {
+	partPath := content.path
+	content.sum() // Hashed before the part moves; free when hashed while streaming
+	finalPath, err := namer.place(dir, u, header, content)
+	if err != nil {
+		return err
+	}
+	os.Remove(partPath + partInfoSuffix)
+	res.Path = finalPath
+	res.fillFile(content)
+	return nil
+}
+
+// fillFile records the size and hash of the saved file.
+func (r *DownloadResult) fillFile(content *fileHash) {
+	if st, err := os.Stat(r.Path); err == nil {
+		r.Size = st.Size()
+	}
+	r.SHA256, _ = content.sum()
+}
+
+// partName returns the .part file name for u: its file name, shortened,
+// plus a hash of the whole URL so that different URLs never share a part.
+func partName(u *url.URL) string {
+	base := path.Base(u.Path)
+	if base == "" || base == "." || base == "/" {
+		base = "download"
+	}
+	if len(base) > partNameMax {
+		base = base[:partNameMax]
+	}
+	sum := sha1.Sum([]byte(u.String()))
+	return fmt.Sprintf("%s.%x%s", base, sum[:4], partSuffix)
+}
+
+// loadPart returns the sidecar of partPath and the size to resume from, or
+// nil and 0 when there is nothing that can be resumed.
+func loadPart(partPath, link string) (*PartInfo, int64) {
+	data, err := os.ReadFile(partPath + partInfoSuffix)
+	if err != nil {
+		return nil, 0
+	}
+	var info PartInfo
+	if json.Unmarshal(data, &info) != nil || info.URL != link || info.validator() == "" {
+		return nil, 0
+	}
+	// The file, not the sidecar, says how much arrived: the sidecar is only
+	// rewritten when an attempt ends, so it lags after a crash
+	st, err := os.Stat(partPath)
+	if err != nil || st.Size() == 0 || (info.Length >= 0 && st.Size() > info.Length) {
+		return nil, 0
+	}
+	return &info, st.Size()
+}
+
+func newPartInfo(link string, resp *http.Response) *PartInfo {
+	return &PartInfo{
+		URL:          link,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Length:       resp.ContentLength,
+	}
+}
+
+func savePartInfo(partPath string, info *PartInfo) error {
+	info.Updated = time.Now().UTC()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(partPath+partInfoSuffix, data, 0644)
+}
+
+func removePart(partPath string) {
+	os.Remove(partPath)
+	os.Remove(partPath + partInfoSuffix)
+}
+
+// contentRange parses "bytes <start>-<end>/<total>"; total is -1 for "*".
+func contentRange(v string) (start, total int64, ok bool) {
+	v, ok = strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	span, size, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	first, _, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if size = strings.TrimSpace(size); size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
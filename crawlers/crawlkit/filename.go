@@ -0,0 +1,526 @@
+package crawlkit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultNameTemplate = "{name}"
+	nameMaxBytes        = 240 // ext4 allows 255 bytes and exFAT 255 UTF-16 units; leaves room for a suffix
+	maxCollisionSuffix  = 10000
+)
+
+// Ways a Namer resolves a name that is already taken.
+const (
+	CollisionSuffix    = "suffix"    // paper.pdf, paper_1.pdf, paper_2.pdf, ...
+	CollisionHash      = "hash"      // paper_<first 8 hex digits of the SHA-256>.pdf
+	CollisionOverwrite = "overwrite" // replace the existing file
+)
+
+// templateFields are the placeholders a name template can use.
+var templateFields = map[string]bool{
+	"host": true, "path": true, "dir": true, "name": true, "stem": true,
+	"ext": true, "yyyy": true, "mm": true, "dd": true, "sha256": true,
+	"blake2b": true,
+}
+
+var templateField = regexp.MustCompile(`\{([a-z0-9]+)\}`)
+
+// Namer decides where a finished download goes. Template is a relative path
+// with placeholders:
+//
+//	{host}    host of the URL, port included ("example.org_8080")
+//	{path}    directories of the URL path, then {name}
+//	{dir}     directories of the URL path
+//	{name}    file name from Content-Disposition, else the last URL segment
+//	{stem}    {name} without its extension
+//	{ext}     extension of {name}, without the dot
+//	{yyyy}    {mm} {dd} date of the download
+//	{sha256}  hash of the content
+//	{blake2b} BLAKE2b-256 of the content, as the Store files it
+//
+// "{name}" (the default) keeps every file at the top of the directory;
+// "{host}/{path}" mirrors the sites; "{yyyy}/{mm}/{sha256}.pdf" stores by
+// date and content. Every path segment is sanitized for ext4 and exFAT.
+// Collision says what happens when the name is taken by a different file: a
+// numeric suffix (the default), a hash suffix, or overwriting. A file with
+// the same content is not saved twice. With a Store, the file goes into the
+// store and the name is a link to its blob. It is safe for concurrent use; a
+// nil Namer uses the defaults.
+type Namer struct {
+	Template  string
+	Collision string
+	Store     *Store // Keeps each document once across URLs and runs; nil saves plain files
+
+	mu sync.Mutex // Serializes checking a name and taking it
+}
+
+var defaultNamer = &Namer{Template: defaultNameTemplate, Collision: CollisionSuffix}
+
+// NewNamer returns a Namer, checking the template's placeholders and the
+// collision mode. Empty values get the defaults.
+func NewNamer(template, collision string) (*Namer, error) {
+	if template == "" {
+		template = defaultNameTemplate
+	}
+	for _, m := range templateField.FindAllStringSubmatch(template, -1) {
+		if !templateFields[m[1]] {
+			return nil, fmt.Errorf("unknown placeholder {%s} in name template %q", m[1], template)
+		}
+	}
+	switch collision {
+	case "":
+		collision = CollisionSuffix
+	case CollisionSuffix, CollisionHash, CollisionOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown collision mode %q (want %s, %s or %s)", collision, CollisionSuffix, CollisionHash, CollisionOverwrite)
+	}
+	return &Namer{Template: template, Collision: collision}, nil
+}
+
+// Namer returns the Namer configured by name_template and on_collision,
+// with the document store of store_dir unless no_store is set.
+func (c *Config) Namer() (*Namer, error) {
+	n, err := NewNamer(c.NameTemplate, c.OnCollision)
+	if err != nil {
+		return nil, err
+	}
+	if n.Store, err = c.OpenStore(); err != nil {
+		return nil, fmt.Errorf("opening document store: %w", err)
+	}
+	return n, nil
+}
+
+// store returns the Namer's Store, nil for a nil Namer.
+func (n *Namer) store() *Store {
+	if n == nil {
+		return nil
+	}
+	return n.Store
+}
+
+// Place moves the finished download at file into dir, under the name the
+// template gives for u and the response header, and returns the path it now
+// has. When a file with the same content is already there, file is removed
+// and that path is returned instead.
+func (n *Namer) Place(dir string, u *url.URL, header http.Header, file string) (string, error) {
+	return n.place(dir, u, header, &fileHash{path: file})
+}
+
+// place is Place for content whose BLAKE2b digest may already be known
+// from streaming it.
+func (n *Namer) place(dir string, u *url.URL, header http.Header, content *fileHash) (string, error) {
+	if n == nil {
+		n = defaultNamer
+	}
+	file := content.path
+	rel, err := n.expand(u, header, content)
+	if err != nil {
+		return "", err
+	}
+	if n.Store == nil {
+		return n.settle(dir, rel, content, func(target string) error {
+			return os.Rename(file, target)
+		})
+	}
+
+	digest, err := content.blake2b()
+	if err != nil {
+		return "", err
+	}
+	blob, _, err := n.Store.put(digest, file)
+	if err != nil {
+		return "", err
+	}
+	content.path = blob // file is gone; the blob has its bytes
+	target, err := n.settle(dir, rel, content, func(target string) error {
+		return linkBlob(blob, target)
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, n.recordPlaced(dir, target, u, header, content, false)
+}
+
+// placeRecord links the blob of rec into dir under its recorded name,
+// without downloading it again; callers first make sure the document has
+// not changed. The validators of fresh, a 304 answer, replace the recorded
+// ones.
+func (n *Namer) placeRecord(dir string, rec StoreRecord, fresh http.Header) (string, error) {
+	u, err := url.Parse(rec.URL)
+	if err != nil {
+		return "", err
+	}
+	blob := n.Store.blobPath(rec.Digest)
+	content := &fileHash{path: blob, digest: rec.Digest}
+	target, err := n.settle(dir, rec.Name, content, func(target string) error {
+		return linkBlob(blob, target)
+	})
+	if err != nil {
+		return "", err
+	}
+	validators := make(http.Header)
+	validators.Set("ETag", rec.ETag)
+	validators.Set("Last-Modified", rec.LastModified)
+	for _, key := range []string{"ETag", "Last-Modified"} {
+		if v := fresh.Get(key); v != "" {
+			validators.Set(key, v)
+		}
+	}
+	return target, n.recordPlaced(dir, target, u, validators, content, true)
+}
+
+// recordPlaced adds the URL, the name its content got and the validators
+// in header to the store's index.
+func (n *Namer) recordPlaced(dir, target string, u *url.URL, header http.Header, content *fileHash, reused bool) error {
+	st, err := os.Stat(content.path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		rel = filepath.Base(target)
+	}
+	return n.Store.record(StoreRecord{
+		URL:          u.String(),
+		Digest:       content.digest,
+		Size:         st.Size(),
+		Name:         rel,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}, reused)
+}
+
+// settle finds the name for rel in dir, resolving collisions, and calls
+// take to put content there. When the name already holds the same content,
+// nothing is taken and that name is returned.
+func (n *Namer) settle(dir, rel string, content *fileHash, take func(target string) error) (string, error) {
+	target := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Collision == CollisionOverwrite {
+		if n.Store != nil {
+			os.Remove(target) // A link cannot be made over an existing file
+		}
+	} else {
+		for i := 1; ; i++ {
+			st, err := os.Lstat(target)
+			if os.IsNotExist(err) {
+				break
+			}
+			if err == nil && sameFile(target, content.path) {
+				return target, nil // Already linked to this blob
+			}
+			if err == nil && st.Mode().IsRegular() && sameContent(target, st.Size(), content) {
+				if n.Store == nil {
+					os.Remove(content.path)
+				}
+				return target, nil
+			}
+			if i > maxCollisionSuffix {
+				return "", fmt.Errorf("no free name for %s", target)
+			}
+			target = n.alternative(filepath.Join(dir, rel), i, content)
+		}
+	}
+	if err := take(target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// alternative returns the i-th name to try after base is taken.
+func (n *Namer) alternative(base string, i int, content *fileHash) string {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if n.Collision == CollisionHash {
+		if sum, err := content.sum(); err == nil {
+			if i == 1 {
+				return stem + "_" + sum[:8] + ext
+			}
+			stem += "_" + sum[:8]
+		}
+	}
+	return stem + "_" + strconv.Itoa(i) + ext
+}
+
+// expand fills in the template and returns a sanitized relative path.
+func (n *Namer) expand(u *url.URL, header http.Header, content *fileHash) (string, error) {
+	name := DispositionFilename(header.Get("Content-Disposition"))
+	if name == "" {
+		name = path.Base(u.Path) // Already unescaped
+	}
+	name = sanitizeSegment(name)
+	if name == "_" || name == "" {
+		name = "download"
+	}
+	if filepath.Ext(name) == "" {
+		name += typeExtension(header.Get("Content-Type"))
+	}
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	dir := path.Dir(u.Path)
+	if dir == "." || dir == "/" {
+		dir = ""
+	}
+	now := time.Now()
+
+	var hashErr error
+	rel := templateField.ReplaceAllStringFunc(n.Template, func(field string) string {
+		switch field[1 : len(field)-1] {
+		case "host":
+			return strings.ReplaceAll(strings.ToLower(u.Host), ":", "_")
+		case "path":
+			return dir + "/" + name
+		case "dir":
+			return dir
+		case "name":
+			return name
+		case "stem":
+			return strings.TrimSuffix(name, filepath.Ext(name))
+		case "ext":
+			return ext
+		case "yyyy":
+			return now.Format("2006")
+		case "mm":
+			return now.Format("01")
+		case "dd":
+			return now.Format("02")
+		case "sha256":
+			sum, err := content.sum()
+			if err != nil {
+				hashErr = err
+			}
+			return sum
+		case "blake2b":
+			sum, err := content.blake2b()
+			if err != nil {
+				hashErr = err
+			}
+			return sum
+		}
+		return field
+	})
+	if hashErr != nil {
+		return "", hashErr
+	}
+
+	var segments []string
+	for _, s := range strings.Split(rel, "/") {
+		if s == "" || s == "." {
+			continue
+		}
+		segments = append(segments, sanitizeSegment(s))
+	}
+	if len(segments) == 0 {
+		segments = []string{name}
+	}
+	return filepath.Join(segments...), nil
+}
+
+// DispositionFilename returns the file name a Content-Disposition header
+// suggests, following RFC 6266: filename*, the RFC 8187 form with a charset
+// and percent-encoded UTF-8, wins over filename, and only the last path
+// element is kept. Headers too malformed for mime.ParseMediaType, such as
+// unquoted names with spaces, are read leniently. It returns "" when there
+// is no name.
+func DispositionFilename(v string) string {
+	if v == "" {
+		return ""
+	}
+	name := ""
+	if _, params, err := mime.ParseMediaType(v); err == nil {
+		name = params["filename"]
+	} else {
+		name = lenientFilename(v)
+	}
+	name = path.Base("/" + strings.ReplaceAll(name, `\`, "/"))
+	if name == "/" {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// lenientFilename digs a name out of a header mime.ParseMediaType rejects.
+func lenientFilename(v string) string {
+	var plain string
+	for _, part := range strings.Split(v, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "filename*":
+			charset, rest, ok := strings.Cut(value, "'")
+			if !ok {
+				continue
+			}
+			_, encoded, ok := strings.Cut(rest, "'")
+			if !ok {
+				continue
+			}
+			decoded, err := url.PathUnescape(encoded)
+			if err == nil && (strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii")) && utf8.ValidString(decoded) {
+				return decoded
+			}
+		case "filename":
+			plain = value
+		}
+	}
+	return plain
+}
+
+// typeExtension returns the usual extension for a Content-Type, or "".
+func typeExtension(contentType string) string {
+	t := mediaType(contentType)
+	if exts := documentExtensions[t]; len(exts) > 0 {
+		return exts[0]
+	}
+	if t == "" || genericTypes[t] {
+		return ""
+	}
+	if exts, err := mime.ExtensionsByType(t); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// windowsReserved are device names Windows refuses as file names, which
+// matters for exFAT drives that end up plugged into one.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeSegment makes s a file name that is valid on ext4 and exFAT:
+// valid UTF-8 without control characters or any of / \ : * ? " < > |, no
+// trailing dots or spaces, not "." or "..", not a reserved device name, and
+// at most nameMaxBytes bytes with the extension kept.
+func sanitizeSegment(s string) string {
+	s = strings.ToValidUTF8(s, "_")
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimLeft(s, " ")
+	s = strings.TrimRight(s, ". ")
+	if s == "" {
+		return "_"
+	}
+	stem := s
+	if i := strings.IndexByte(s, '.'); i > 0 {
+		stem = s[:i]
+	}
+	if windowsReserved[strings.ToUpper(stem)] {
+		s = "_" + s
+	}
+	if len(s) > nameMaxBytes {
+		ext := filepath.Ext(s)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		s = truncateUTF8(s[:len(s)-len(ext)], nameMaxBytes-len(ext)) + ext
+	}
+	return s
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// fileHash computes a file's SHA-256 once, when first needed, and holds
+// its BLAKE2b-256 when a Store needs it.
+type fileHash struct {
+	path   string
+	hex    string
+	err    error
+	done   bool
+	digest string // BLAKE2b-256, hex; set when hashed while streaming
+}
+
+func (h *fileHash) sum() (string, error) {
+	if !h.done {
+		h.done = true
+		h.hex, h.err = hashFile(h.path, sha256.New())
+	}
+	return h.hex, h.err
+}
+
+func (h *fileHash) blake2b() (string, error) {
+	if h.digest == "" {
+		digest, err := hashFile(h.path, newContentHash())
+		if err != nil {
+			return "", err
+		}
+		h.digest = digest
+	}
+	return h.digest, nil
+}
+
+func hashFile(name string, h hash.Hash) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sameFile reports whether a and b are the same file, as hard links or
+// through a symlink.
+func sameFile(a, b string) bool {
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	return err == nil && os.SameFile(sa, sb)
+}
+
+// sameContent reports whether the file at existing, of the given size,
+// holds the same bytes as content.
+func sameContent(existing string, size int64, content *fileHash) bool {
+	st, err := os.Stat(content.path)
+	if err != nil || st.Size() != size {
+		return false
+	}
+	sum, err := content.sum()
+	if err != nil {
+		return false
+	}
+	other, err := hashFile(existing, sha256.New())
+	return err == nil && other == sum
+}
@@ -0,0 +1,491 @@
+package crawlkit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gocolly/colly"
+)
+
+// DequeueOrder selects how DiskQueueStorage picks the next request.
+type DequeueOrder int
+
+const (
+	// FIFO returns requests in the order they were added.
+	FIFO DequeueOrder = iota
+	// HostFair rotates between hosts, FIFO within each host, so one large
+	// site cannot starve the rest of the frontier.
+	HostFair
+)
+
+const (
+	segmentMaxSize   = 64 << 20 // Roll to a new segment file past this size
+	recordHeaderSize = 10       // length (4) + CRC-32 (4) + host length (2)
+	indexEntrySize   = 8        // segment (4) + offset (4)
+	indexFileName    = "index.log"
+)
+
+// ErrQueueEmpty is returned by GetRequest when nothing is queued.
+var ErrQueueEmpty = errors.New("crawlkit: queue is empty")
+
+// ErrQueueClosed is returned by Push and Pop after Close.
+var ErrQueueClosed = errors.New("crawlkit: queue is closed")
+
+// DiskQueueStorage is a colly queue.Storage that keeps the crawl frontier on
+// disk, so it survives restarts and can grow well past available RAM.
+//
+// Requests are appended to segment files; dequeued records are journaled in
+// an index file. On Init the segments are replayed, skipping records the index
+// marks as consumed, and segments with nothing left in them are deleted. Only
+// an 8-byte position per pending request is held in memory.
+type DiskQueueStorage struct {
+	Dir     string       // Directory holding the segments and index
+	Order   DequeueOrder // FIFO or HostFair
+	MaxSize int          // Maximum pending requests, 0 for no limit
+
+	mu       sync.Mutex
+	segments map[uint32]*segment
+	active   *segment
+	index    *os.File
+	hosts    map[string]*hostQueue
+	ring     []string // Hosts with pending requests, in rotation order
+	next     int      // Position in ring for HostFair
+	size     int
+	stopped  bool
+	closed   bool
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+	live int // Records not yet dequeued
+}
+
+type recordRef struct {
+	seg uint32
+	off uint32
+}
+
+type hostQueue struct {
+	refs []recordRef
+	head int
+}
+
+// Init opens or creates the queue in Dir, replaying anything left from an
+// earlier run. Calling it again is a no-op.
+func (s *DiskQueueStorage) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.segments != nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("creating queue directory: %w", err)
+	}
+
+	s.segments = make(map[uint32]*segment)
+	s.hosts = make(map[string]*hostQueue)
+	s.ring, s.next, s.size, s.closed = nil, 0, 0, false
+
+	consumed, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+
+	names, err := filepath.Glob(filepath.Join(s.Dir, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	var lastID uint32
+	for _, name := range names {
+		var id uint32
+		if _, err := fmt.Sscanf(filepath.Base(name), "segment-%08d.log", &id); err != nil {
+			continue
+		}
+		if id > lastID {
+			lastID = id
+		}
+		seg, err := s.replaySegment(name, id, consumed)
+		if err != nil {
+			return err
+		}
+		if seg.live == 0 {
+			seg.f.Close()
+			os.Remove(name)
+			continue
+		}
+		s.segments[id] = seg
+	}
+
+	if err := s.rollSegment(lastID + 1); err != nil {
+		return err
+	}
+	return s.rewriteIndex(consumed)
+}
+
+// QueueStorage returns the on-disk frontier configured by FrontierDir
+// (default "frontier") and HostFair, ready to pass to queue.New.
+func (c *Config) QueueStorage() *DiskQueueStorage {
+	dir := c.FrontierDir
+	if dir == "" {
+		dir = "frontier"
+	}
+	order := FIFO
+	if c.HostFair {
+		order = HostFair
+	}
+	return &DiskQueueStorage{Dir: dir, Order: order}
+}
+
+// AddRequest implements queue.Storage, keying the request by its URL's host.
+func (s *DiskQueueStorage) AddRequest(r []byte) error {
+	return s.Push(requestHost(r), r)
+}
+
+// Push appends data to the queue under host.
+func (s *DiskQueueStorage) Push(host string, data []byte) error {
+	if len(host) > 0xffff {
+		host = host[:0xffff]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrQueueClosed
+	}
+	if s.MaxSize > 0 && s.size >= s.MaxSize {
+		return colly.ErrQueueFull
+	}
+
+	recLen := recordHeaderSize + len(host) + len(data)
+	if s.active.size > 0 && s.active.size+int64(recLen) > segmentMaxSize {
+		if err := s.rollSegment(s.active.id + 1); err != nil {
+			return err
+		}
+	}
+
+	rec := make([]byte, recLen)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(host)+len(data)))
+	binary.LittleEndian.PutUint16(rec[8:], uint16(len(host)))
+	copy(rec[recordHeaderSize:], host)
+	copy(rec[recordHeaderSize+len(host):], data)
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+
+	if _, err := s.active.f.Write(rec); err != nil {
+		return fmt.Errorf("writing queue segment: %w", err)
+	}
+	s.enqueue(host, recordRef{seg: s.active.id, off: uint32(s.active.size)})
+	s.active.size += int64(recLen)
+	s.active.live++
+	return nil
+}
+
+// GetRequest implements queue.Storage.
+func (s *DiskQueueStorage) GetRequest() ([]byte, error) {
+	s.mu.Lock()
+	stopped := s.stopped || s.closed
+	s.mu.Unlock()
+	if stopped {
+		return nil, ErrQueueEmpty
+	}
+	_, data, err := s.Pop()
+	return data, err
+}
+
+// Pop removes and returns the next request and the host it was queued under.
+func (s *DiskQueueStorage) Pop() (string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return "", nil, ErrQueueClosed
+	}
+	if s.size == 0 {
+		return "", nil, ErrQueueEmpty
+	}
+
+	ref := s.dequeue()
+	seg := s.segments[ref.seg]
+	host, data, err := readRecord(seg.f, int64(ref.off))
+	if err != nil {
+		return "", nil, fmt.Errorf("reading queue segment %d: %w", ref.seg, err)
+	}
+
+	var entry [indexEntrySize]byte
+	binary.LittleEndian.PutUint32(entry[0:], ref.seg)
+	binary.LittleEndian.PutUint32(entry[4:], ref.off)
+	if _, err := s.index.Write(entry[:]); err != nil {
+		return "", nil, fmt.Errorf("writing queue index: %w", err)
+	}
+
+	seg.live--
+	if seg.live == 0 && seg != s.active {
+		seg.f.Close()
+		os.Remove(seg.f.Name())
+		delete(s.segments, seg.id)
+		if err := s.rewriteIndex(nil); err != nil {
+			return "", nil, err
+		}
+	}
+	return host, data, nil
+}
+
+// QueueSize implements queue.Storage.
+func (s *DiskQueueStorage) QueueSize() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.closed {
+		return 0, nil
+	}
+	return s.size, nil
+}
+
+// Stop makes the queue look empty to colly, so queue.Run returns once the
+// requests in flight finish. Pending requests stay on disk for the next run
+// and can still be added.
+func (s *DiskQueueStorage) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+}
+
+// Len returns the number of pending requests.
+func (s *DiskQueueStorage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Hosts returns the number of hosts with pending requests.
+func (s *DiskQueueStorage) Hosts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ring)
+}
+
+// Close releases the open files. Pending requests stay on disk for the next
+// Init; until then Push and Pop return ErrQueueClosed, and colly sees an
+// empty queue.
+func (s *DiskQueueStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for _, seg := range s.segments {
+		seg.f.Close()
+	}
+	if s.index != nil {
+		s.index.Close()
+	}
+	s.segments = nil
+	return nil
+}
+
+func (s *DiskQueueStorage) enqueue(host string, ref recordRef) {
+	if s.Order == FIFO {
+		host = ""
+	}
+	hq, ok := s.hosts[host]
+	if !ok {
+		hq = &hostQueue{}
+		s.hosts[host] = hq
+	}
+	if len(hq.refs) == hq.head {
+		s.ring = append(s.ring, host)
+	}
+	hq.refs = append(hq.refs, ref)
+	s.size++
+}
+
+func (s *DiskQueueStorage) dequeue() recordRef {
+	if s.next >= len(s.ring) {
+		s.next = 0
+	}
+	host := s.ring[s.next]
+	hq := s.hosts[host]
+
+	ref := hq.refs[hq.head]
+	hq.head++
+	if hq.head == len(hq.refs) {
+		delete(s.hosts, host)
+		s.ring = append(s.ring[:s.next], s.ring[s.next+1:]...)
+	} else {
+		if hq.head > 1024 && hq.head > len(hq.refs)/2 {
+			hq.refs = append([]recordRef(nil), hq.refs[hq.head:]...)
+			hq.head = 0
+		}
+		if s.Order == HostFair {
+			s.next++
+		}
+	}
+	s.size--
+	return ref
+}
+
+func (s *DiskQueueStorage) rollSegment(id uint32) error {
+	name := filepath.Join(s.Dir, fmt.Sprintf("segment-%08d.log", id))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("creating queue segment: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.active = &segment{id: id, f: f, size: fi.Size()}
+	s.segments[id] = s.active
+	return nil
+}
+
+// replaySegment loads the pending records of one segment, truncating a torn
+// record left by a crash mid-write.
+func (s *DiskQueueStorage) replaySegment(name string, id uint32, consumed map[recordRef]bool) (*segment, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening queue segment: %w", err)
+	}
+	seg := &segment{id: id, f: f}
+
+	r := bufio.NewReader(f)
+	var header [recordHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		n := binary.LittleEndian.Uint32(header[0:])
+		hostLen := int(binary.LittleEndian.Uint16(header[8:]))
+		if int(n) < hostLen || n > segmentMaxSize {
+			break
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		crc := crc32.NewIEEE()
+		crc.Write(header[8:])
+		crc.Write(body)
+		if crc.Sum32() != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+
+		ref := recordRef{seg: id, off: uint32(seg.size)}
+		if !consumed[ref] {
+			s.enqueue(string(body[:hostLen]), ref)
+			seg.live++
+		}
+		seg.size += int64(recordHeaderSize) + int64(n)
+	}
+
+	if err := f.Truncate(seg.size); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("truncating queue segment: %w", err)
+	}
+	return seg, nil
+}
+
+func (s *DiskQueueStorage) readIndex() (map[recordRef]bool, error) {
+	consumed := make(map[recordRef]bool)
+	data, err := os.ReadFile(filepath.Join(s.Dir, indexFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return consumed, nil
+		}
+		return nil, fmt.Errorf("reading queue index: %w", err)
+	}
+	for i := 0; i+indexEntrySize <= len(data); i += indexEntrySize {
+		consumed[recordRef{
+			seg: binary.LittleEndian.Uint32(data[i:]),
+			off: binary.LittleEndian.Uint32(data[i+4:]),
+		}] = true
+	}
+	return consumed, nil
+}
+
+// rewriteIndex replaces the index with the entries that still point into a
+// live segment, then reopens it for appending. A nil consumed set re-reads
+// the current index first.
+func (s *DiskQueueStorage) rewriteIndex(consumed map[recordRef]bool) error {
+	if consumed == nil {
+		if s.index != nil {
+			s.index.Close()
+			s.index = nil
+		}
+		var err error
+		if consumed, err = s.readIndex(); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	var entry [indexEntrySize]byte
+	for ref := range consumed {
+		if _, ok := s.segments[ref.seg]; !ok {
+			continue
+		}
+		binary.LittleEndian.PutUint32(entry[0:], ref.seg)
+		binary.LittleEndian.PutUint32(entry[4:], ref.off)
+		buf = append(buf, entry[:]...)
+	}
+
+	path := filepath.Join(s.Dir, indexFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("writing queue index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replacing queue index: %w", err)
+	}
+
+	if s.index != nil {
+		s.index.Close()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("opening queue index: %w", err)
+	}
+	s.index = f
+	return nil
+}
+
+func readRecord(f *os.File, off int64) (string, []byte, error) {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		return "", nil, err
+	}
+	n := binary.LittleEndian.Uint32(header[0:])
+	hostLen := int(binary.LittleEndian.Uint16(header[8:]))
+	body := make([]byte, n)
+	if _, err := f.ReadAt(body, off+recordHeaderSize); err != nil {
+		return "", nil, err
+	}
+	return string(body[:hostLen]), body[hostLen:], nil
+}
+
+// requestHost pulls the host out of a serialized colly.Request.
+func requestHost(r []byte) string {
+	var req struct{ URL string }
+	if err := json.Unmarshal(r, &req); err != nil {
+		return ""
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
@@ -0,0 +1,635 @@
+package crawlkit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ftpTimeout = 30 * time.Second
+
+// FTPError is an FTP reply that refused a command. 4xx replies are
+// transient and worth retrying later; 5xx replies, such as 550 for a file
+// that does not exist, are not.
+type FTPError struct {
+	Code int
+	Msg  string
+}
+
+func (e *FTPError) Error() string {
+	return fmt.Sprintf("FTP %d %s", e.Code, e.Msg)
+}
+
+// Temporary reports whether the reply was a 4xx one.
+func (e *FTPError) Temporary() bool {
+	return e.Code < 500
+}
+
+// FTPClient fetches ftp:// URLs: passive mode (EPSV, or PASV for servers
+// without it), binary transfers, resumes with REST, and directory listings
+// from MLSD, or LIST on servers without it. Logins are anonymous unless the
+// URL has a user name. Paths are taken as they appear in the URL, from the
+// server's root. The zero value is ready to use, and safe for concurrent
+// use; each call dials a connection of its own.
+type FTPClient struct {
+	Dialer   *net.Dialer   // Binds control and data connections to an interface; nil for the default
+	Timeout  time.Duration // For connecting, each reply and each read of a transfer; 0 means 30s
+	Budget   *Budget       // Counts the bytes received, and refuses hosts out of budget
+	MaxDepth int           // Subdirectory levels Mirror descends; 0 for no limit
+}
+
+func (f *FTPClient) timeout() time.Duration {
+	if f.Timeout > 0 {
+		return f.Timeout
+	}
+	return ftpTimeout
+}
+
+func (f *FTPClient) dialer() *net.Dialer {
+	if f.Dialer != nil {
+		return f.Dialer
+	}
+	return &net.Dialer{}
+}
+
+// FTPConn is a logged-in control connection. Its commands fail with ctx's
+// error once the context it was dialled with is cancelled. It is not safe
+// for concurrent use.
+type FTPConn struct {
+	client *FTPClient
+	ctx    context.Context
+	host   string
+	conn   net.Conn
+	text   *textproto.Conn
+	stop   func() bool
+
+	noEPSV bool // The server refused EPSV, so PASV is used
+	noMLSD bool // The server refused MLSD, so LIST is used
+}
+
+// Dial connects to u's host, port 21 unless u says otherwise, logs in and
+// switches to binary transfers.
+func (f *FTPClient) Dial(ctx context.Context, u *url.URL) (*FTPConn, error) {
+	host := u.Hostname()
+	if !f.Budget.Allowed(host) {
+		return nil, fmt.Errorf("%s: %w", host, ErrBudget)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(host, "21")
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, f.timeout())
+	defer cancel()
+	conn, err := f.dialer().DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &FTPConn{client: f, ctx: ctx, host: host, conn: conn, text: textproto.NewConn(conn)}
+	c.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	if err := c.login(u.User); err != nil {
+		c.stop()
+		conn.Close()
+		return nil, fmt.Errorf("FTP login to %s: %w", addr, err)
+	}
+	return c, nil
+}
+
+func (c *FTPConn) login(user *url.Userinfo) error {
+	code, _, err := c.reply(0)
+	if err == nil && code == 120 { // Ready in a moment
+		code, _, err = c.reply(0)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 220 {
+		return &FTPError{Code: code, Msg: "unexpected greeting"}
+	}
+
+	name, password := "anonymous", "anonymous@"
+	if user != nil {
+		name = user.Username()
+		password, _ = user.Password()
+	}
+	code, msg, err := c.cmd(0, "USER %s", name)
+	switch {
+	case err != nil:
+		return err
+	case code == 331 || code == 332:
+		if _, _, err := c.cmd(2, "PASS %s", password); err != nil {
+			return err
+		}
+	case code/100 != 2:
+		return &FTPError{Code: code, Msg: msg}
+	}
+	_, _, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// Close says goodbye and closes the connection.
+func (c *FTPConn) Close() error {
+	c.cmd(0, "QUIT")
+	c.stop()
+	return c.conn.Close()
+}
+
+// cmd sends a command and reads its reply, whose first digit must be expect
+// unless expect is 0.
+func (c *FTPConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(line, "\r\n") {
+		return 0, "", fmt.Errorf("FTP command %q contains a line break", line)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.client.timeout()))
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		return 0, "", c.err(err)
+	}
+	return c.reply(expect)
+}
+
+// reply reads a reply, which may span several lines.
+func (c *FTPConn) reply(expect int) (int, string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.client.timeout()))
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil {
+		return code, msg, c.err(err)
+	}
+	if expect > 0 && code/100 != expect {
+		return code, msg, &FTPError{Code: code, Msg: msg}
+	}
+	return code, msg, nil
+}
+
+// err prefers the context's error to what closing the connection caused.
+func (c *FTPConn) err(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+var pasvReply = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+
+// passive opens a data connection. It goes to the address of the control
+// connection whatever the server replies, which keeps servers behind NAT
+// working and rules out bounce attacks.
+func (c *FTPConn) passive() (net.Conn, error) {
+	var port int
+	if !c.noEPSV {
+		_, msg, err := c.cmd(2, "EPSV")
+		var ftpErr *FTPError
+		switch {
+		case err == nil:
+			if port, err = parseEPSV(msg); err != nil {
+				return nil, err
+			}
+		case errors.As(err, &ftpErr) && !ftpErr.Temporary():
+			c.noEPSV = true
+		default:
+			return nil, err
+		}
+	}
+	if c.noEPSV {
+		_, msg, err := c.cmd(2, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		if port, err = parsePASV(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, c.client.timeout())
+	defer cancel()
+	data, err := c.client.dialer().DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, c.err(err)
+	}
+	return data, nil
+}
+
+// parseEPSV returns the port of an EPSV reply, such as
+// "229 Entering Extended Passive Mode (|||6446|)".
+func parseEPSV(msg string) (int, error) {
+	var port int
+	_, inner, _ := strings.Cut(msg, "(")
+	inner, _, _ = strings.Cut(inner, ")")
+	if inner != "" {
+		if fields := strings.Split(inner, inner[:1]); len(fields) == 5 {
+			port, _ = strconv.Atoi(fields[3])
+		}
+	}
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("FTP: bad EPSV reply %q", msg)
+	}
+	return port, nil
+}
+
+// parsePASV returns the port of a PASV reply, such as
+// "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)". The address is not
+// returned, since passive ignores it.
+func parsePASV(msg string) (int, error) {
+	m := pasvReply.FindStringSubmatch(msg)
+	if m == nil {
+		return 0, fmt.Errorf("FTP: bad PASV reply %q", msg)
+	}
+	hi, _ := strconv.Atoi(m[5])
+	lo, _ := strconv.Atoi(m[6])
+	if hi > 255 || lo > 255 || hi|lo == 0 {
+		return 0, fmt.Errorf("FTP: bad PASV reply %q", msg)
+	}
+	return hi<<8 | lo, nil
+}
+
+// Size returns the size of the file at path, from SIZE.
+func (c *FTPConn) Size(path string) (int64, error) {
+	_, msg, err := c.cmd(2, "SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// ModTime returns when the file at path was last modified, from MDTM.
+func (c *FTPConn) ModTime(path string) (time.Time, error) {
+	_, msg, err := c.cmd(2, "MDTM %s", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseFTPTime(strings.TrimSpace(msg))
+}
+
+// parseFTPTime parses the YYYYMMDDHHMMSS[.sss] UTC times of MDTM and MLSD.
+func parseFTPTime(v string) (time.Time, error) {
+	v, _, _ = strings.Cut(v, ".")
+	return time.Parse("20060102150405", v)
+}
+
+// Retrieve starts sending the file at path from offset, skipping the start
+// with REST when offset is not 0. Reading the body to the end also reads the
+// server's verdict on the transfer, and fails if it was not a success;
+// closing it early aborts the transfer. Close the body before the next
+// command.
+func (c *FTPConn) Retrieve(path string, offset int64) (io.ReadCloser, error) {
+	return c.transfer(offset, "RETR %s", path)
+}
+
+func (c *FTPConn) transfer(offset int64, format string, args ...any) (*ftpBody, error) {
+	data, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, _, err := c.cmd(3, "REST %d", offset); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &ftpBody{c: c, data: data, stop: context.AfterFunc(c.ctx, func() { data.Close() })}, nil
+}
+
+// ftpBody is the data connection of a transfer.
+type ftpBody struct {
+	c    *FTPConn
+	data net.Conn
+	stop func() bool
+	done bool // The closing reply has been read
+	err  error
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.done {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	b.data.SetReadDeadline(time.Now().Add(b.c.client.timeout()))
+	n, err := b.data.Read(p)
+	b.c.client.Budget.Bytes(b.c.host, int64(n))
+	switch {
+	case err == io.EOF:
+		// The server closes the data connection when it is done or gives up;
+		// only the control connection says which
+		if err = b.finish(); err == nil {
+			err = io.EOF
+		}
+	case err != nil:
+		err = b.c.err(err)
+	}
+	return n, err
+}
+
+func (b *ftpBody) Close() error {
+	return b.finish()
+}
+
+// finish closes the data connection and reads the transfer's closing reply.
+func (b *ftpBody) finish() error {
+	if !b.done {
+		b.done = true
+		b.stop()
+		b.data.Close()
+		_, _, b.err = b.c.reply(2)
+	}
+	return b.err
+}
+
+// FTPEntry is one entry of a directory listing.
+type FTPEntry struct {
+	Name string
+	Dir  bool
+	Size int64     // -1 when the listing does not say
+	Time time.Time // Zero when the listing does not say
+}
+
+// List returns the files and subdirectories of the directory at path.
+// Symbolic links and other special files are left out, as are . and ..
+func (c *FTPConn) List(path string) ([]FTPEntry, error) {
+	if !c.noMLSD {
+		entries, err := c.list(parseMLSD, "MLSD %s", path)
+		var ftpErr *FTPError
+		if !errors.As(err, &ftpErr) || (ftpErr.Code != 500 && ftpErr.Code != 502) {
+			return entries, err
+		}
+		c.noMLSD = true // Not implemented
+	}
+	return c.list(parseLIST, "LIST %s", path)
+}
+
+func (c *FTPConn) list(parse func(string) (FTPEntry, bool), format string, args ...any) ([]FTPEntry, error) {
+	body, err := c.transfer(0, format, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var entries []FTPEntry
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		e, ok := parse(strings.TrimRight(scanner.Text(), "\r"))
+		if ok && e.Name != "." && e.Name != ".." && !strings.Contains(e.Name, "/") {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, body.Close()
+}
+
+// parseMLSD parses a machine-readable listing line, such as
+// "type=file;size=48213;modify=20240117093000; report.pdf".
+func parseMLSD(line string) (FTPEntry, bool) {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok || name == "" {
+		return FTPEntry{}, false
+	}
+	e := FTPEntry{Name: name, Size: -1}
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "file":
+			case "dir":
+				e.Dir = true
+			default: // cdir, pdir, OS.unix=slink:..., ...
+				return FTPEntry{}, false
+			}
+		case "size":
+			e.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "modify":
+			e.Time, _ = parseFTPTime(value)
+		}
+	}
+	return e, true
+}
+
+// parseLIST parses a line of a Unix-style listing, such as
+//
+//	-rw-r--r--   1 ftp ftp  48213 Jan 17 09:30 report.pdf
+//
+// or of a DOS-style one, such as
+//
+//	01-17-24  09:30AM  48213 report.pdf
+//	01-17-24  09:30AM  <DIR> papers
+//
+// Times are not parsed, since Unix listings leave out the year of recent
+// files.
+func parseLIST(line string) (FTPEntry, bool) {
+	if line == "" {
+		return FTPEntry{}, false
+	}
+	if line[0] >= '0' && line[0] <= '9' {
+		fields, name := cutFields(line, 3)
+		if fields == nil || name == "" {
+			return FTPEntry{}, false
+		}
+		if fields[2] == "<DIR>" {
+			return FTPEntry{Name: name, Dir: true, Size: -1}, true
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		return FTPEntry{Name: name, Size: size}, err == nil
+	}
+	fields, name := cutFields(line, 8)
+	if fields == nil || name == "" {
+		return FTPEntry{}, false
+	}
+	switch fields[0][0] {
+	case '-':
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			size = -1
+		}
+		return FTPEntry{Name: name, Size: size}, true
+	case 'd':
+		return FTPEntry{Name: name, Dir: true, Size: -1}, true
+	}
+	return FTPEntry{}, false
+}
+
+// cutFields splits the first n space-separated fields off line, and returns
+// them with the rest, which may contain spaces. It returns nil when line
+// has fewer fields.
+func cutFields(line string, n int) ([]string, string) {
+	fields := make([]string, 0, n)
+	rest := strings.TrimLeft(line, " ")
+	for len(fields) < n {
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			return nil, ""
+		}
+		fields = append(fields, rest[:i])
+		rest = strings.TrimLeft(rest[i:], " ")
+	}
+	return fields, rest
+}
+
+// Download fetches u, an ftp:// URL, into dir over a connection of its own;
+// see FTPConn.Download.
+func (f *FTPClient) Download(ctx context.Context, u *url.URL, dir string, namer *Namer, buf []byte) (*DownloadResult, error) {
+	c, err := f.Dial(ctx, u)
+	if err != nil {
+		return &DownloadResult{FinalURL: u.String()}, err
+	}
+	defer c.Close()
+	return c.Download(u, dir, namer, buf)
+}
+
+// Download fetches the file at u, an ftp:// URL on the connection's server,
+// into dir the way crawlkit.Download does over HTTP: through a .part file
+// with a PartInfo sidecar, named by namer once complete. SIZE and MDTM stand
+// in for Content-Length and Last-Modified. When an earlier attempt left a
+// part of a file whose size and modification time have not changed since,
+// only the rest is retrieved, with REST; a server without MDTM cannot be
+// resumed, and a server without REST sends the whole file again.
+func (c *FTPConn) Download(u *url.URL, dir string, namer *Namer, buf []byte) (*DownloadResult, error) {
+	res := &DownloadResult{FinalURL: u.String()}
+	started := time.Now()
+	defer func() { res.Timings.Total = time.Since(started) }()
+
+	link := u.String()
+	if !c.client.Budget.Allowed(c.host) {
+		return res, fmt.Errorf("%s: %w", c.host, ErrBudget)
+	}
+	partPath := filepath.Join(dir, partName(u))
+	if _, busy := partLocks.LoadOrStore(partPath, true); busy {
+		return res, fmt.Errorf("%s is already being downloaded", link)
+	}
+	defer partLocks.Delete(partPath)
+
+	info := &PartInfo{URL: link, Length: -1}
+	if size, err := c.Size(u.Path); err == nil {
+		info.Length = size
+	}
+	header := http.Header{}
+	if modified, err := c.ModTime(u.Path); err == nil {
+		info.LastModified = modified.UTC().Format(http.TimeFormat)
+		header.Set("Last-Modified", info.LastModified)
+	}
+
+	// A file saved before whose size and modification time have not
+	// changed is linked from the store; if that fails it is downloaded
+	if rec, ok := namer.store().Lookup(link); ok && rec.LastModified != "" && rec.LastModified == info.LastModified && rec.Size == info.Length {
+		if stored, err := namer.placeRecord(dir, rec, nil); err == nil {
+			res.Path, res.Stored = stored, true
+			res.fillFile(&fileHash{path: stored})
+			return res, nil
+		}
+	}
+	var offset int64
+	if old, n := loadPart(partPath, link); old != nil && old.LastModified == info.LastModified && old.Length == info.Length {
+		offset = n
+	}
+	if offset > 0 && offset == info.Length {
+		// The last attempt got everything but stopped before the rename
+		res.Resumed = offset
+		return res, finishPart(res, &fileHash{path: partPath}, dir, namer, u, header)
+	}
+
+	var ftpErr *FTPError
+	firstByte := time.Now()
+	body, err := c.Retrieve(u.Path, offset)
+	if offset > 0 && errors.As(err, &ftpErr) && ftpErr.Code >= 500 && ftpErr.Code <= 504 {
+		offset = 0 // REST is not understood
+		body, err = c.Retrieve(u.Path, 0)
+	}
+	if err != nil {
+		return res, err
+	}
+	defer body.Close()
+	res.Timings.FirstByte = time.Since(firstByte)
+	res.Resumed = offset
+	content, err := receivePart(c.ctx, partPath, info, offset, body, namer, buf, &res.Received)
+	if err != nil {
+		return res, err
+	}
+	return res, finishPart(res, content, dir, namer, u, header)
+}
+
+// Mirror downloads the files under the directory u, an ftp:// URL, over one
+// connection, descending up to MaxDepth levels of subdirectories. save is
+// called with the ftp:// URL of every file found and returns the directory
+// to save it in, or "" to skip it. Files and subdirectories the server
+// refuses are logged and skipped. It returns how many files were saved, and
+// stops at the first error that is not the server's refusal, such as a lost
+// connection or an exhausted budget.
+func (f *FTPClient) Mirror(ctx context.Context, u *url.URL, namer *Namer, save func(link string) string) (int, error) {
+	c, err := f.Dial(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	saved := 0
+	seen := make(map[string]bool)
+	var walk func(dir string, level int) error
+	walk = func(dir string, level int) error {
+		if seen[dir] {
+			return nil
+		}
+		seen[dir] = true
+		entries, err := c.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			var ftpErr *FTPError
+			file := *u
+			file.Path, file.RawPath = path.Join(dir, e.Name), ""
+			if e.Dir {
+				if f.MaxDepth > 0 && level >= f.MaxDepth {
+					continue
+				}
+				if err := walk(file.Path, level+1); errors.As(err, &ftpErr) {
+					log.Printf("Error listing %s: %s", file.String(), err)
+				} else if err != nil {
+					return err
+				}
+				continue
+			}
+			target := save(file.String())
+			if target == "" {
+				continue
+			}
+			if _, err := c.Download(&file, target, namer, nil); errors.As(err, &ftpErr) {
+				log.Printf("Error downloading %s: %s", file.String(), err)
+			} else if err != nil {
+				return err
+			} else {
+				saved++
+			}
+		}
+		return nil
+	}
+	dir := path.Clean("/" + u.Path)
+	return saved, walk(dir, 0)
+}
+
+// IsFTPDirectory reports whether link is an ftp:// URL of a directory,
+// which ends in a slash, for crawlers to Mirror.
+func IsFTPDirectory(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && strings.EqualFold(u.Scheme, "ftp") && u.Host != "" && (u.Path == "" || strings.HasSuffix(u.Path, "/"))
+}
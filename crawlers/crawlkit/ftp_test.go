@@ -0,0 +1,549 @@
+package crawlkit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ftpServer is an in-process FTP server serving files from memory, with
+// switches for the commands some real servers leave out or get wrong.
+type ftpServer struct {
+	files map[string][]byte // By path, such as /pub/report.pdf
+
+	noEPSV  bool              // Refuse EPSV with 502
+	noMLSD  bool              // Refuse MLSD with 500
+	noREST  bool              // Refuse REST with 502
+	cut     int               // Bytes the first RETR sends before a 426; 0 sends all
+	replies map[string]string // Replies replacing a command's own, by verb
+	closing string            // Closing reply of transfers; "" for 226
+
+	mu   sync.Mutex
+	cmds []string
+}
+
+// start serves s on a loopback port until the test ends, and returns its
+// ftp:// URL.
+func (s *ftpServer) start(t *testing.T) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return &url.URL{Scheme: "ftp", Host: ln.Addr().String(), Path: "/"}
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	var data net.Listener // Passive listener for the next transfer
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	var offset int64
+
+	text.PrintfLine("220 ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, line)
+		s.mu.Unlock()
+
+		verb, arg, _ := strings.Cut(line, " ")
+		if reply, ok := s.replies[verb]; ok {
+			text.PrintfLine("%s", reply)
+			continue
+		}
+		switch verb {
+		case "USER":
+			text.PrintfLine("331 password please")
+		case "PASS":
+			text.PrintfLine("230 logged in")
+		case "TYPE":
+			text.PrintfLine("200 type set to %s", arg)
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		case "SIZE", "MDTM":
+			f, ok := s.files[arg]
+			switch {
+			case !ok:
+				text.PrintfLine("550 %s: no such file", arg)
+			case verb == "SIZE":
+				text.PrintfLine("213 %d", len(f))
+			default:
+				text.PrintfLine("213 20240117093000")
+			}
+		case "EPSV", "PASV":
+			if verb == "EPSV" && s.noEPSV {
+				text.PrintfLine("502 EPSV not implemented")
+				continue
+			}
+			if data != nil {
+				data.Close()
+			}
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				text.PrintfLine("425 %s", err)
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if verb == "EPSV" {
+				text.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// A NATed server's private address, which the client must ignore
+				text.PrintfLine("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "REST":
+			if s.noREST {
+				text.PrintfLine("502 REST not implemented")
+				continue
+			}
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			text.PrintfLine("350 restarting at %d", offset)
+		case "RETR":
+			f, ok := s.files[arg]
+			if !ok {
+				text.PrintfLine("550 %s: no such file", arg)
+				continue
+			}
+			body, closing := f[offset:], s.closingReply()
+			offset = 0
+			s.mu.Lock()
+			if s.cut > 0 && len(body) > s.cut {
+				body, closing = body[:s.cut], "426 connection closed; transfer aborted"
+				s.cut = 0
+			}
+			s.mu.Unlock()
+			s.send(text, &data, body, closing)
+		case "MLSD", "LIST":
+			if verb == "MLSD" && s.noMLSD {
+				text.PrintfLine("500 MLSD not understood")
+				continue
+			}
+			s.send(text, &data, s.listing(verb, arg), s.closingReply())
+		default:
+			text.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+func (s *ftpServer) closingReply() string {
+	if s.closing != "" {
+		return s.closing
+	}
+	return "226 transfer complete"
+}
+
+// send answers a transfer command: 150, then body over the passive data
+// connection, then the closing reply.
+func (s *ftpServer) send(text *textproto.Conn, data *net.Listener, body []byte, closing string) {
+	if *data == nil {
+		text.PrintfLine("425 use EPSV or PASV first")
+		return
+	}
+	text.PrintfLine("150 opening data connection")
+	conn, err := (*data).Accept()
+	(*data).Close()
+	*data = nil
+	if err != nil {
+		text.PrintfLine("425 %s", err)
+		return
+	}
+	conn.Write(body)
+	conn.Close()
+	text.PrintfLine("%s", closing)
+}
+
+// listing lists the files and subdirectories of dir the way MLSD or a Unix
+// LIST does, with the lines clients must skip.
+func (s *ftpServer) listing(verb, dir string) []byte {
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	sizes := make(map[string]int) // -1 for directories
+	for p, f := range s.files {
+		rest, ok := strings.CutPrefix(p, dir)
+		if !ok {
+			continue
+		}
+		if name, _, sub := strings.Cut(rest, "/"); sub {
+			sizes[name] = -1
+		} else {
+			sizes[name] = len(f)
+		}
+	}
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	if verb == "MLSD" {
+		b.WriteString("type=cdir;modify=20240117093000; .\r\n")
+		b.WriteString("type=OS.unix=slink:/pub;modify=20240117093000; latest\r\n")
+	} else {
+		fmt.Fprintf(&b, "total %d\r\n", len(names))
+		b.WriteString("lrwxrwxrwx   1 ftp ftp      4 Jan 17 09:30 latest -> /pub\r\n")
+	}
+	for _, name := range names {
+		switch size := sizes[name]; {
+		case verb == "MLSD" && size < 0:
+			fmt.Fprintf(&b, "type=dir;modify=20240117093000; %s\r\n", name)
+		case verb == "MLSD":
+			fmt.Fprintf(&b, "type=file;size=%d;modify=20240117093000; %s\r\n", size, name)
+		case size < 0:
+			fmt.Fprintf(&b, "drwxr-xr-x   2 ftp ftp   4096 Jan 17 09:30 %s\r\n", name)
+		default:
+			fmt.Fprintf(&b, "-rw-r--r--   1 ftp ftp %6d Jan 17 09:30 %s\r\n", size, name)
+		}
+	}
+	return b.Bytes()
+}
+
+// sent returns the commands the server received that start with prefix.
+func (s *ftpServer) sent(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cmds []string
+	for _, cmd := range s.cmds {
+		if strings.HasPrefix(cmd, prefix) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func dialTestFTP(t *testing.T, s *ftpServer) *FTPConn {
+	t.Helper()
+	c, err := (&FTPClient{Timeout: 5 * time.Second}).Dial(context.Background(), s.start(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func retrieve(c *FTPConn, path string, offset int64) ([]byte, error) {
+	body, err := c.Retrieve(path, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func TestFTPPassive(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		noEPSV     bool
+		epsv, pasv int // Commands expected for two transfers
+	}{
+		{"EPSV", false, 2, 0},
+		{"PASV fallback", true, 1, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := []byte("%PDF-1.4 report")
+			srv := &ftpServer{files: map[string][]byte{"/pub/report.pdf": want}, noEPSV: tc.noEPSV}
+			c := dialTestFTP(t, srv)
+			for i := 0; i < 2; i++ {
+				got, err := retrieve(c, "/pub/report.pdf", 0)
+				if err != nil {
+					t.Fatalf("transfer %d: %v", i+1, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("transfer %d: got %q, want %q", i+1, got, want)
+				}
+			}
+			if n := len(srv.sent("EPSV")); n != tc.epsv {
+				t.Errorf("EPSV sent %d times, want %d", n, tc.epsv)
+			}
+			if n := len(srv.sent("PASV")); n != tc.pasv {
+				t.Errorf("PASV sent %d times, want %d", n, tc.pasv)
+			}
+			if types := srv.sent("TYPE"); len(types) != 1 || types[0] != "TYPE I" {
+				t.Errorf("TYPE commands %q, want [TYPE I]", types)
+			}
+		})
+	}
+}
+
+func TestFTPRetrieveOffset(t *testing.T) {
+	srv := &ftpServer{files: map[string][]byte{"/f.txt": []byte("0123456789")}}
+	c := dialTestFTP(t, srv)
+	got, err := retrieve(c, "/f.txt", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "456789" {
+		t.Errorf("got %q, want %q", got, "456789")
+	}
+	if rest := srv.sent("REST"); len(rest) != 1 || rest[0] != "REST 4" {
+		t.Errorf("REST commands %q, want [REST 4]", rest)
+	}
+}
+
+func TestFTPDownloadResume(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		noREST  bool
+		resumed int64
+	}{
+		{"REST", false, 6000},
+		{"REST refused", true, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			want := bytes.Repeat([]byte("0123456789"), 1000)
+			srv := &ftpServer{files: map[string][]byte{"/pub/big.pdf": want}, cut: 6000, noREST: tc.noREST}
+			u := srv.start(t)
+			u.Path = "/pub/big.pdf"
+			dir := t.TempDir()
+			namer, err := NewNamer("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &FTPClient{Timeout: 5 * time.Second}
+
+			_, err = client.Download(context.Background(), u, dir, namer, nil)
+			var ftpErr *FTPError
+			if !errors.As(err, &ftpErr) || ftpErr.Code != 426 || !ftpErr.Temporary() {
+				t.Fatalf("first attempt: %v, want a temporary FTP 426", err)
+			}
+
+			res, err := client.Download(context.Background(), u, dir, namer, nil)
+			if err != nil {
+				t.Fatalf("second attempt: %v", err)
+			}
+			if res.Resumed != tc.resumed {
+				t.Errorf("resumed from %d, want %d", res.Resumed, tc.resumed)
+			}
+			got, err := os.ReadFile(res.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("saved %d bytes, want the %d sent", len(got), len(want))
+			}
+			if rest := srv.sent("REST"); len(rest) != 1 || rest[0] != "REST 6000" {
+				t.Errorf("REST commands %q, want [REST 6000]", rest)
+			}
+		})
+	}
+}
+
+func TestFTPList(t *testing.T) {
+	files := map[string][]byte{
+		"/pub/a.pdf":        []byte("0123456789"),
+		"/pub/c d.txt":      []byte("spaced"),
+		"/pub/papers/b.pdf": []byte("nested"),
+		"/other/x.pdf":      []byte("elsewhere"),
+	}
+	want := []FTPEntry{
+		{Name: "a.pdf", Size: 10},
+		{Name: "c d.txt", Size: 6},
+		{Name: "papers", Dir: true, Size: -1},
+	}
+	for _, tc := range []struct {
+		name       string
+		noMLSD     bool
+		mlsd, list int // Commands expected for two listings
+	}{
+		{"MLSD", false, 2, 0},
+		{"LIST fallback", true, 1, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &ftpServer{files: files, noMLSD: tc.noMLSD}
+			c := dialTestFTP(t, srv)
+			for i := 0; i < 2; i++ {
+				entries, err := c.List("/pub")
+				if err != nil {
+					t.Fatalf("listing %d: %v", i+1, err)
+				}
+				if len(entries) != len(want) {
+					t.Fatalf("listing %d: got %+v, want %+v", i+1, entries, want)
+				}
+				for j, e := range entries {
+					if e.Name != want[j].Name || e.Dir != want[j].Dir || e.Size != want[j].Size {
+						t.Errorf("listing %d, entry %d: got %+v, want %+v", i+1, j, e, want[j])
+					}
+				}
+			}
+			if n := len(srv.sent("MLSD")); n != tc.mlsd {
+				t.Errorf("MLSD sent %d times, want %d", n, tc.mlsd)
+			}
+			if n := len(srv.sent("LIST")); n != tc.list {
+				t.Errorf("LIST sent %d times, want %d", n, tc.list)
+			}
+		})
+	}
+}
+
+func TestFTPErrorTemporary(t *testing.T) {
+	for _, tc := range []struct {
+		reply     string
+		code      int
+		temporary bool
+	}{
+		{"421 too many connections", 421, true},
+		{"450 file busy", 450, true},
+		{"550 permission denied", 550, false},
+		{"553 file name not allowed", 553, false},
+	} {
+		t.Run(tc.reply, func(t *testing.T) {
+			srv := &ftpServer{
+				files:   map[string][]byte{"/f.pdf": []byte("%PDF-")},
+				replies: map[string]string{"RETR": tc.reply},
+			}
+			c := dialTestFTP(t, srv)
+			_, err := retrieve(c, "/f.pdf", 0)
+			var ftpErr *FTPError
+			if !errors.As(err, &ftpErr) {
+				t.Fatalf("got %v, want an FTPError", err)
+			}
+			if ftpErr.Code != tc.code || ftpErr.Temporary() != tc.temporary {
+				t.Errorf("got code %d, temporary %v; want %d, %v", ftpErr.Code, ftpErr.Temporary(), tc.code, tc.temporary)
+			}
+		})
+	}
+}
+
+func TestFTPBodyClosingReply(t *testing.T) {
+	for _, tc := range []struct {
+		closing string
+		code    int // 0 for success
+	}{
+		{"226 transfer complete", 0},
+		{"250 requested file action okay", 0},
+		{"451 local error in processing", 451},
+		{"552 storage exceeded", 552},
+	} {
+		t.Run(tc.closing, func(t *testing.T) {
+			want := []byte("all the data arrived")
+			srv := &ftpServer{files: map[string][]byte{"/f.txt": want}, closing: tc.closing}
+			c := dialTestFTP(t, srv)
+			body, err := c.Retrieve("/f.txt", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			var ftpErr *FTPError
+			switch {
+			case tc.code == 0 && err != nil:
+				t.Errorf("got %v, want success", err)
+			case tc.code != 0 && (!errors.As(err, &ftpErr) || ftpErr.Code != tc.code):
+				t.Errorf("got %v, want FTP %d", err, tc.code)
+			}
+			// Close reports the same verdict without reading another reply
+			if cerr := body.Close(); cerr != err {
+				t.Errorf("Close: %v, want %v", cerr, err)
+			}
+			if _, err := c.Size("/f.txt"); err != nil {
+				t.Errorf("SIZE after the transfer: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseMLSD(t *testing.T) {
+	modified := time.Date(2024, 1, 17, 9, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		line string
+		want FTPEntry
+		ok   bool
+	}{
+		{"type=file;size=48213;modify=20240117093000; report.pdf", FTPEntry{Name: "report.pdf", Size: 48213, Time: modified}, true},
+		{"type=file;size=12;modify=20240117093000.250; two words.pdf", FTPEntry{Name: "two words.pdf", Size: 12, Time: modified}, true},
+		{"Type=DIR;Modify=20240117093000; papers", FTPEntry{Name: "papers", Dir: true, Size: -1, Time: modified}, true},
+		{"type=file; bare.txt", FTPEntry{Name: "bare.txt", Size: -1}, true},
+		{"type=cdir;modify=20240117093000; .", FTPEntry{}, false},
+		{"type=pdir;modify=20240117093000; ..", FTPEntry{}, false},
+		{"type=OS.unix=slink:/pub;modify=20240117093000; latest", FTPEntry{}, false},
+		{"type=file;size=1;", FTPEntry{}, false},
+		{"", FTPEntry{}, false},
+	} {
+		got, ok := parseMLSD(tc.line)
+		if ok != tc.ok || got.Name != tc.want.Name || got.Dir != tc.want.Dir || got.Size != tc.want.Size || !got.Time.Equal(tc.want.Time) {
+			t.Errorf("parseMLSD(%q) = %+v, %v; want %+v, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseLIST(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want FTPEntry
+		ok   bool
+	}{
+		{"-rw-r--r--   1 ftp ftp  48213 Jan 17 09:30 report.pdf", FTPEntry{Name: "report.pdf", Size: 48213}, true},
+		{"-rw-r--r--   1 ftp ftp  48213 Jan 17  2019 old report.pdf", FTPEntry{Name: "old report.pdf", Size: 48213}, true},
+		{"drwxr-xr-x   2 ftp ftp   4096 Jan 17 09:30 papers", FTPEntry{Name: "papers", Dir: true, Size: -1}, true},
+		{"lrwxrwxrwx   1 ftp ftp     11 Jan 17 09:30 latest -> report.pdf", FTPEntry{}, false},
+		{"01-17-24  09:30AM  48213 report.pdf", FTPEntry{Name: "report.pdf", Size: 48213}, true},
+		{"01-17-24  09:30AM  <DIR> my papers", FTPEntry{Name: "my papers", Dir: true, Size: -1}, true},
+		{"01-17-24  09:30AM", FTPEntry{}, false},
+		{"total 12", FTPEntry{}, false},
+		{"", FTPEntry{}, false},
+	} {
+		got, ok := parseLIST(tc.line)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("parseLIST(%q) = %+v, %v; want %+v, %v", tc.line, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParsePassiveReplies(t *testing.T) {
+	for _, tc := range []struct {
+		parse func(string) (int, error)
+		msg   string
+		port  int // 0 for an error
+	}{
+		{parseEPSV, "Entering Extended Passive Mode (|||6446|)", 6446},
+		{parseEPSV, "Entering Extended Passive Mode (!!!6446!)", 6446},
+		{parseEPSV, "Entering Extended Passive Mode (|||0|)", 0},
+		{parseEPSV, "Entering Extended Passive Mode (|||70000|)", 0},
+		{parseEPSV, "Entering Extended Passive Mode (||6446|)", 0},
+		{parseEPSV, "Entering Extended Passive Mode ()", 0},
+		{parseEPSV, "Entering Extended Passive Mode", 0},
+		{parsePASV, "Entering Passive Mode (192,168,1,2,25,46)", 25<<8 | 46},
+		{parsePASV, "Entering Passive Mode 192,168,1,2,25,46", 25<<8 | 46},
+		{parsePASV, "Entering Passive Mode (192,168,1,2,256,1)", 0},
+		{parsePASV, "Entering Passive Mode (192,168,1,2,0,0)", 0},
+		{parsePASV, "Entering Passive Mode (192,168,1,2)", 0},
+	} {
+		port, err := tc.parse(tc.msg)
+		if tc.port == 0 && err == nil {
+			t.Errorf("%q: got port %d, want an error", tc.msg, port)
+		}
+		if tc.port != 0 && (err != nil || port != tc.port) {
+			t.Errorf("%q: got %d, %v; want %d", tc.msg, port, err, tc.port)
+		}
+	}
+}
@@ -0,0 +1,585 @@
+package crawlkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	journalHeader        = "# crawlkit visited journal v1\n"
+	journalFlushInterval = time.Second
+	journalCompactCheck  = time.Minute
+	journalCompactMin    = 4096 // Duplicate records tolerated before compacting
+
+	defaultVisitedFile = "visitedURLs.journal"
+)
+
+var journalTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrJournalShared is returned by Compact while another crawler has the
+// journal open.
+var ErrJournalShared = errors.New("visited journal is open in another crawler")
+
+// VisitedJournal is the set of URLs a crawler has already seen, kept in an
+// append-only file so it survives restarts. Each line is one record:
+//
+//	<crc32c of the URL, 8 hex digits> <URL>
+//
+// Marking a URL appends one record (buffered and flushed every second), so
+// saving is O(1) per URL instead of rewriting the whole set. Loading is a
+// single sequential read; records whose checksum does not match, such as a
+// line torn by a crash, are dropped. A run never appends a URL twice, so
+// duplicates only come from crawlers sharing the file. Each open journal
+// holds a shared flock on it, and the file is only compacted under an
+// exclusive one: when it is opened, if it is damaged or mostly duplicates,
+// and in the background once other crawlers have appended to it and closed
+// it. It is safe for concurrent use.
+type VisitedJournal struct {
+	Path      string
+	ImportKey func(string) (string, error) // Applied to imported URLs when set
+
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	f       *os.File
+	w       *bufio.Writer // Writes to f through journalWriter
+	size    int64         // Bytes of the file loaded or appended by this journal
+	records int           // Records in the file, including duplicates
+	err     error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// journalWriter appends to the journal's current file and counts what it
+// writes, so that records appended by other crawlers show up as the file
+// growing past size.
+type journalWriter struct {
+	j *VisitedJournal
+}
+
+func (w journalWriter) Write(p []byte) (int, error) {
+	n, err := w.j.f.Write(p)
+	w.j.size += int64(n)
+	return n, err
+}
+
+// OpenVisitedJournal loads the journal at path, creating it if needed,
+// compacts it if needed and starts its background flush and compaction.
+func OpenVisitedJournal(path string) (*VisitedJournal, error) {
+	j := &VisitedJournal{
+		Path: path,
+		seen: make(map[string]struct{}),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	j.w = bufio.NewWriter(journalWriter{j})
+
+	alone, err := j.lock()
+	if err != nil {
+		return nil, err
+	}
+	clean, err := j.load()
+	if err == nil {
+		err = j.settle(alone, clean, false)
+	}
+	if err != nil {
+		j.f.Close()
+		return nil, err
+	}
+	if alone && j.size == 0 {
+		j.w.WriteString(journalHeader)
+	}
+
+	go j.background()
+	return j, nil
+}
+
+// lock opens the file for appending and locks it: exclusively if no other
+// crawler has it open, which it reports, and shared otherwise.
+func (j *VisitedJournal) lock() (bool, error) {
+	for {
+		f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return false, err
+		}
+		j.f = f
+		alone, err := tryLockExclusive(f)
+		if err != nil {
+			f.Close()
+			return false, err
+		}
+		if alone {
+			var current bool
+			if current, err = j.current(); err == nil && !current {
+				f.Close() // Replaced by a compaction between open and lock
+				continue
+			}
+		} else {
+			err = j.share()
+		}
+		if err != nil {
+			j.f.Close()
+			return false, err
+		}
+		return alone, nil
+	}
+}
+
+// share takes a shared lock on the file, reopening the journal if another
+// crawler compacted it while this one waited. Any buffered records must
+// have been flushed.
+func (j *VisitedJournal) share() error {
+	for {
+		if err := lockShared(j.f); err != nil {
+			return err
+		}
+		current, err := j.current()
+		if err != nil || current {
+			return err
+		}
+		f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		j.f.Close()
+		j.f = f
+		if fi, err := f.Stat(); err == nil {
+			j.size = fi.Size()
+		}
+		j.records = len(j.seen)
+	}
+}
+
+// current reports whether f is still the file at Path.
+func (j *VisitedJournal) current() (bool, error) {
+	fi, err := j.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pi, err := os.Stat(j.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(fi, pi), nil
+}
+
+// settle compacts a freshly loaded file held exclusively, when it is damaged,
+// mostly duplicates or force is set, and leaves it locked shared. A damaged
+// file that other crawlers have open is appended to from a fresh line
+// instead, so that new records never follow a torn one.
+func (j *VisitedJournal) settle(alone, clean, force bool) error {
+	if !alone {
+		if !clean {
+			j.w.WriteString("\n")
+		}
+		return nil
+	}
+	garbage := j.records - len(j.seen)
+	switch {
+	case !clean:
+		log.Printf("Visited journal %s had damaged records; compacting", j.Path)
+	case garbage > journalCompactMin && garbage > len(j.seen):
+		log.Printf("Visited journal %s had %d duplicate records; compacting", j.Path, garbage)
+	case !force:
+		return lockShared(j.f)
+	}
+	return j.rewrite()
+}
+
+// load reads every record into seen. It reports false if any record was
+// damaged.
+func (j *VisitedJournal) load() (bool, error) {
+	j.records, j.size = 0, 0
+	f, err := os.Open(j.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && len(j.seen) == 0 {
+		// Records average well over 40 bytes; sizing the map up front
+		// avoids rehashing while loading large journals.
+		j.seen = make(map[string]struct{}, fi.Size()/64)
+	}
+
+	clean := true
+	r := bufio.NewReaderSize(f, 1<<20)
+	for {
+		line, err := r.ReadSlice('\n')
+		j.size += int64(len(line))
+		if err == bufio.ErrBufferFull {
+			// Longer than any URL we write: skip the rest of it.
+			for err == bufio.ErrBufferFull {
+				line, err = r.ReadSlice('\n')
+				j.size += int64(len(line))
+			}
+			clean = false
+			continue
+		}
+		if err == io.EOF {
+			if len(line) > 0 {
+				clean = false // Torn final record
+			}
+			return clean, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if line[0] == '#' || line[0] == '\n' {
+			continue
+		}
+		url, ok := parseJournalRecord(line[:len(line)-1])
+		if !ok {
+			clean = false
+			continue
+		}
+		j.records++
+		j.seen[url] = struct{}{}
+	}
+}
+
+func parseJournalRecord(line []byte) (string, bool) {
+	if len(line) < 10 || line[8] != ' ' {
+		return "", false
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return "", false
+	}
+	url := line[9:]
+	if crc32.Checksum(url, journalTable) != uint32(sum) {
+		return "", false
+	}
+	return string(url), true
+}
+
+func appendJournalRecord(w *bufio.Writer, url string) error {
+	fmt.Fprintf(w, "%08x ", crc32.Checksum([]byte(url), journalTable))
+	w.WriteString(url)
+	return w.WriteByte('\n')
+}
+
+// Seen reports whether url has been marked, in this run or an earlier one.
+func (j *VisitedJournal) Seen(url string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.seen[url]
+	return ok
+}
+
+// Mark records url as visited. It reports false if url was already marked.
+func (j *VisitedJournal) Mark(url string) bool {
+	// A newline would split the record; such URLs are kept in memory only.
+	persist := !bytes.ContainsAny([]byte(url), "\r\n")
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.seen[url]; ok {
+		return false
+	}
+	j.seen[url] = struct{}{}
+	if persist {
+		if err := appendJournalRecord(j.w, url); err != nil && j.err == nil {
+			j.err = err
+			log.Printf("Error writing visited journal %s: %s", j.Path, err)
+		}
+		j.records++
+	}
+	return true
+}
+
+// Len returns the number of distinct URLs marked.
+func (j *VisitedJournal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.seen)
+}
+
+// Flush writes buffered records to the file.
+func (j *VisitedJournal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.w.Flush()
+}
+
+// Compact rewrites the journal with one record per distinct URL, after
+// loading what other crawlers have appended to it. It returns
+// ErrJournalShared while one of them still has it open.
+func (j *VisitedJournal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compact(true)
+}
+
+// compact takes the file exclusively, reloads it and rewrites it if force
+// is set or settle finds it worth it. The caller holds mu.
+func (j *VisitedJournal) compact(force bool) error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	// A failed upgrade drops the shared lock, so share takes it again.
+	alone, err := tryLockExclusive(j.f)
+	if err != nil {
+		return err
+	}
+	if !alone {
+		if err := j.share(); err != nil {
+			return err
+		}
+		return ErrJournalShared
+	}
+	clean, err := j.load()
+	if err != nil {
+		lockShared(j.f)
+		return err
+	}
+	return j.settle(true, clean, force)
+}
+
+// rewrite replaces the file, held exclusively, with the contents of seen
+// and leaves the new one locked shared. The caller holds mu (or is
+// OpenVisitedJournal, before the journal is shared).
+func (j *VisitedJournal) rewrite() error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(j.Path), filepath.Base(j.Path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer f.Close()
+	w := bufio.NewWriterSize(f, 1<<20)
+	w.WriteString(journalHeader)
+	records := 0
+	for url := range j.seen {
+		if bytes.ContainsAny([]byte(url), "\r\n") {
+			continue
+		}
+		appendJournalRecord(w, url)
+		records++
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		// Locked before it appears at Path, so that no other crawler can
+		// compact it before it is reopened for appending below.
+		err = lockShared(f)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, j.Path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Other crawlers may append to the new file as soon as it is renamed,
+	// so it is reopened in append mode. Closing the old one releases
+	// crawlers waiting for it, which then reopen the new one.
+	af, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		err = lockShared(af)
+	}
+	if err != nil {
+		if af != nil {
+			af.Close()
+		}
+		return err
+	}
+	j.f.Close()
+	j.f = af
+	j.size, _ = f.Seek(0, io.SeekCurrent)
+	j.records = records
+	return nil
+}
+
+// background flushes the buffer every second, and every minute compacts the
+// file if other crawlers have appended to it and closed it since.
+func (j *VisitedJournal) background() {
+	defer close(j.done)
+	flush := time.NewTicker(journalFlushInterval)
+	defer flush.Stop()
+	compact := time.NewTicker(journalCompactCheck)
+	defer compact.Stop()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-flush.C:
+			if err := j.Flush(); err != nil {
+				log.Printf("Error flushing visited journal %s: %s", j.Path, err)
+			}
+		case <-compact.C:
+			j.mu.Lock()
+			fi, err := os.Stat(j.Path)
+			if err == nil && fi.Size() > j.size {
+				err = j.compact(false)
+			}
+			j.mu.Unlock()
+			if err != nil && err != ErrJournalShared {
+				log.Printf("Error compacting visited journal %s: %s", j.Path, err)
+			}
+		}
+	}
+}
+
+// Close flushes the journal, syncs it to disk, releases its lock and stops
+// the background goroutine.
+func (j *VisitedJournal) Close() error {
+	close(j.stop)
+	<-j.done
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.w.Flush()
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Import marks every URL in a visited-URL file written by the older
+// crawlers: either visitedURLs.xml (<visitedURLs><url>...</url></visitedURLs>)
+// or visitedURLs.txt (one URL per line). It returns the number of URLs that
+// were new to the journal.
+func (j *VisitedJournal) Import(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	first, err := firstNonSpace(r)
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	if first == '<' {
+		dec := xml.NewDecoder(r)
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return added, fmt.Errorf("%s: %w", path, err)
+			}
+			se, ok := tok.(xml.StartElement)
+			if !ok || se.Name.Local != "url" {
+				continue
+			}
+			var url string
+			if err := dec.DecodeElement(&url, &se); err != nil {
+				return added, fmt.Errorf("%s: %w", path, err)
+			}
+			if url != "" && j.Mark(j.importKey(url)) {
+				added++
+			}
+		}
+	} else {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			url := string(bytes.TrimSpace(sc.Bytes()))
+			if url != "" && j.Mark(j.importKey(url)) {
+				added++
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return added, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return added, j.Flush()
+}
+
+func (j *VisitedJournal) importKey(url string) string {
+	if j.ImportKey != nil {
+		if key, err := j.ImportKey(url); err == nil {
+			return key
+		}
+	}
+	return url
+}
+
+// firstNonSpace returns the first byte of r that is not white space, leaving
+// it unread.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, r.UnreadByte()
+	}
+}
+
+// ImportLegacy imports each old visited-URL file that exists and renames it
+// to "<name>.imported", so the import happens only once.
+func (j *VisitedJournal) ImportLegacy(paths ...string) {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		added, err := j.Import(path)
+		if err != nil {
+			log.Printf("Error importing %s into %s: %s", path, j.Path, err)
+			continue
+		}
+		if err := os.Rename(path, path+".imported"); err != nil {
+			log.Printf("Error renaming %s after import: %s", path, err)
+		}
+		log.Printf("Imported %d visited URLs from %s into %s", added, path, j.Path)
+	}
+}
+
+// OpenVisited opens the crawler's visited-URL journal (VisitedFile, or
+// visitedURLs.journal) and imports any of the legacy files given, keyed by
+// their canonical form.
+func (c *Config) OpenVisited(legacy ...string) (*VisitedJournal, error) {
+	if c.VisitedFile == "" {
+		c.VisitedFile = defaultVisitedFile
+	}
+	j, err := OpenVisitedJournal(c.VisitedFile)
+	if err != nil {
+		return nil, err
+	}
+	j.ImportKey = c.Canonicalizer().Canonicalize
+	j.ImportLegacy(legacy...)
+	return j, nil
+}
@@ -0,0 +1,30 @@
+//go:build unix
+
+package crawlkit
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockShared waits for a shared flock on f, converting any lock it holds.
+func lockShared(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// tryLockExclusive takes an exclusive flock on f if no other open file holds
+// a lock on it, and reports whether it did. Converting a shared lock drops
+// it when the conversion fails.
+func tryLockExclusive(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package crawlkit
+
+import "os"
+
+// Without flock, a journal always takes itself to be the file's only
+// writer; crawlers must not share one.
+
+func lockShared(f *os.File) error {
+	return nil
+}
+
+func tryLockExclusive(f *os.File) (bool, error) {
+	return true, nil
+}
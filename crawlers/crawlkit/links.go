@@ -0,0 +1,147 @@
+package crawlkit
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly"
+	"github.com/gocolly/colly/queue"
+)
+
+// Where in a page a link was found. Enqueued requests carry it in their
+// context under "source", next to "sitemap" for sitemap entries.
+const (
+	SourceAnchor    = "a"         // <a href>, <area href>
+	SourceFrame     = "iframe"    // <iframe src>, <frame src>
+	SourceEmbed     = "embed"     // <embed src>
+	SourceObject    = "object"    // <object data>
+	SourceAlternate = "alternate" // <link rel=alternate href>
+	SourceRefresh   = "refresh"   // <meta http-equiv=refresh content="0; url=...">
+	SourceSrcset    = "srcset"    // srcset candidates of <img> and <source>
+	SourceScript    = "script"    // URL-looking strings in inline scripts
+)
+
+// LinkSelector matches each page once; register ExtractLinks under it.
+const LinkSelector = "html"
+
+// Link is a URL found in a page, resolved against the page (or its
+// <base href>), with where it was found.
+type Link struct {
+	URL    string
+	Source string
+}
+
+// Page reports whether the link may lead to a page worth crawling: anchors,
+// frames, alternates and refreshes. srcset, script, embed and object links
+// name resources a page uses, so they are only worth checking as documents.
+func (l Link) Page() bool {
+	switch l.Source {
+	case SourceAnchor, SourceFrame, SourceAlternate, SourceRefresh:
+		return true
+	}
+	return false
+}
+
+// scriptURL matches quoted absolute http(s) URLs, and quoted root-relative
+// paths that end in a file extension, in inline scripts.
+var scriptURL = regexp.MustCompile(`["'](https?://[^"'\s<>\\]+|/[^"'\s<>\\]*\.[A-Za-z0-9]{2,5}(?:\?[^"'\s<>\\]*)?)["']`)
+
+// ExtractLinks returns every link in the page e (matched by LinkSelector),
+// each once, in document order. Relative links resolve against <base href>
+// when the page has one.
+func ExtractLinks(e *colly.HTMLElement) []Link {
+	var links []Link
+	seen := make(map[string]bool)
+	add := func(raw, source string) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || strings.HasPrefix(raw, "javascript:") || strings.HasPrefix(raw, "data:") {
+			return
+		}
+		abs := e.Request.AbsoluteURL(raw)
+		if abs == "" || seen[abs] {
+			return
+		}
+		seen[abs] = true
+		links = append(links, Link{URL: abs, Source: source})
+	}
+	attr := func(selector, name, source string) {
+		e.DOM.Find(selector).Each(func(_ int, s *goquery.Selection) {
+			add(s.AttrOr(name, ""), source)
+		})
+	}
+
+	attr("a[href], area[href]", "href", SourceAnchor)
+	attr("iframe[src], frame[src]", "src", SourceFrame)
+	attr("embed[src]", "src", SourceEmbed)
+	attr("object[data]", "data", SourceObject)
+	e.DOM.Find("link[href]").Each(func(_ int, s *goquery.Selection) {
+		for _, rel := range strings.Fields(strings.ToLower(s.AttrOr("rel", ""))) {
+			if rel == "alternate" {
+				add(s.AttrOr("href", ""), SourceAlternate)
+				return
+			}
+		}
+	})
+	e.DOM.Find("meta[http-equiv][content]").Each(func(_ int, s *goquery.Selection) {
+		if strings.EqualFold(s.AttrOr("http-equiv", ""), "refresh") {
+			add(refreshURL(s.AttrOr("content", "")), SourceRefresh)
+		}
+	})
+	e.DOM.Find("img[srcset], source[srcset]").Each(func(_ int, s *goquery.Selection) {
+		for _, candidate := range strings.Split(s.AttrOr("srcset", ""), ",") {
+			if fields := strings.Fields(candidate); len(fields) > 0 {
+				add(fields[0], SourceSrcset)
+			}
+		}
+	})
+	e.DOM.Find("script:not([src])").Each(func(_ int, s *goquery.Selection) {
+		text := strings.ReplaceAll(s.Text(), `\/`, "/") // JSON-escaped slashes
+		for _, m := range scriptURL.FindAllStringSubmatch(text, -1) {
+			add(m[1], SourceScript)
+		}
+	})
+	return links
+}
+
+// refreshURL returns the URL of a meta refresh content value such as
+// `5; url='/next.html'`, or "".
+func refreshURL(content string) string {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	rest := strings.TrimSpace(content[i+1:])
+	if len(rest) >= 4 && strings.EqualFold(rest[:3], "url") {
+		rest = strings.TrimSpace(rest[3:])
+		if !strings.HasPrefix(rest, "=") {
+			return ""
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	return strings.Trim(rest, `"'`)
+}
+
+// LinkContext returns a request context tagging a page with the source it
+// was found by.
+func LinkContext(source string) *colly.Context {
+	ctx := colly.NewContext()
+	ctx.Put("source", source)
+	return ctx
+}
+
+// EnqueueLink is Enqueue for a link found by ExtractLinks: the request also
+// carries the link's source in its context.
+func EnqueueLink(q *queue.Queue, parent *colly.Request, link Link) error {
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		return err
+	}
+	return q.AddRequest(&colly.Request{
+		URL:    u,
+		Method: "GET",
+		Depth:  parent.Depth + 1,
+		Ctx:    LinkContext(link.Source),
+	})
+}
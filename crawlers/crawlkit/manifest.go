@@ -0,0 +1,246 @@
+package crawlkit
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const manifestBacklog = 4096 // Records waiting for the writer before Record blocks
+
+// ManifestRecord is one download attempt in a Manifest, one JSON object
+// per line.
+type ManifestRecord struct {
+	Time        time.Time `json:"time"` // When the attempt started
+	URL         string    `json:"url"`
+	FinalURL    string    `json:"final_url,omitempty"` // After redirects
+	Referrer    string    `json:"referrer,omitempty"`  // Page the link was found on
+	Depth       int       `json:"depth"`
+	Attempt     int       `json:"attempt"`             // 1 for the first try
+	Interface   string    `json:"interface,omitempty"` // NIC the request went out on
+	LocalIP     string    `json:"local_ip,omitempty"`
+	Worker      string    `json:"worker,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Proto       string    `json:"proto,omitempty"` // h1, h2 or h3
+	Proxy       string    `json:"proxy,omitempty"`
+	Size        int64     `json:"size"`     // Size of the saved file
+	Received    int64     `json:"received"` // Bytes received in this attempt
+	Resumed     int64     `json:"resumed,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Stored      bool      `json:"stored,omitempty"` // Linked from the document store without downloading
+	DNSMs       int64     `json:"dns_ms,omitempty"`
+	ConnectMs   int64     `json:"connect_ms,omitempty"`
+	TLSMs       int64     `json:"tls_ms,omitempty"`
+	FirstByteMs int64     `json:"first_byte_ms,omitempty"`
+	TotalMs     int64     `json:"total_ms"`
+	ErrorClass  string    `json:"error_class,omitempty"` // See ErrorClass
+	Error       string    `json:"error,omitempty"`
+
+	// Cert is the certificate that failed verification, for "tls" errors
+	// that got as far as the certificate.
+	Cert *CertError `json:"cert,omitempty"`
+}
+
+// SetResult fills in the outcome of a download attempt from what Download
+// returned.
+func (r *ManifestRecord) SetResult(res *DownloadResult, err error) {
+	if res != nil {
+		r.FinalURL = res.FinalURL
+		r.Status = res.Status
+		r.ContentType = res.ContentType
+		r.Proto = res.Proto
+		r.Proxy = res.Proxy
+		r.Size = res.Size
+		r.Received = res.Received
+		r.Resumed = res.Resumed
+		r.SHA256 = res.SHA256
+		r.Path = res.Path
+		r.Stored = res.Stored
+		r.DNSMs = res.Timings.DNS.Milliseconds()
+		r.ConnectMs = res.Timings.Connect.Milliseconds()
+		r.TLSMs = res.Timings.TLS.Milliseconds()
+		r.FirstByteMs = res.Timings.FirstByte.Milliseconds()
+		r.TotalMs = res.Timings.Total.Milliseconds()
+	}
+	r.ErrorClass = ErrorClass(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	var certErr *CertError
+	if errors.As(err, &certErr) {
+		r.Cert = certErr
+	}
+}
+
+// ErrorClass sorts a download error into a few classes that are easy to
+// count and filter on: "" for no error, then "budget" (see Budget),
+// "canceled", "proxy" (the proxy failed, or none was left), "timeout",
+// "dns", "refused", "reset", "unreachable", "tls", "status" (see the
+// record's Status), "incomplete", "content_range", "disk" and "other".
+func ErrorClass(err error) string {
+	var statusErr *StatusError
+	var dnsErr *net.DNSError
+	var tlsErr *CertError
+	var certErr *x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var pathErr *os.PathError
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &statusErr):
+		return "status"
+	case errors.Is(err, ErrBudget):
+		return "budget"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrNoProxy),
+		errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks ")):
+		return "proxy"
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.As(err, &tlsErr), errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &invalidErr),
+		strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case errors.Is(err, ErrIncomplete), errors.Is(err, io.ErrUnexpectedEOF):
+		return "incomplete"
+	case errors.Is(err, ErrContentRange):
+		return "content_range"
+	case errors.As(err, &pathErr), errors.Is(err, syscall.ENOSPC):
+		return "disk"
+	}
+	return "other"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Manifest is an append-only JSONL file with one ManifestRecord per
+// download attempt. Record hands records to a single writer goroutine that
+// keeps the file open and flushes whenever it catches up, so any number of
+// workers can record without waiting on the disk or each other. It is safe
+// for concurrent use; a nil Manifest records nothing.
+type Manifest struct {
+	Path string
+
+	records chan ManifestRecord
+	done    chan struct{}
+	once    sync.Once
+	err     error // First write error; set by the writer, read after done
+
+	mu     sync.RWMutex // Held for reading while sending, so Close cannot close records under a sender
+	closed bool
+}
+
+// OpenManifest opens path for appending, creating it if needed, and starts
+// its writer.
+func OpenManifest(path string) (*Manifest, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{
+		Path:    path,
+		records: make(chan ManifestRecord, manifestBacklog),
+		done:    make(chan struct{}),
+	}
+	go m.write(f)
+	return m, nil
+}
+
+// write encodes records until the channel closes, flushing each time the
+// backlog is empty.
+func (m *Manifest) write(f *os.File) {
+	defer close(m.done)
+	w := bufio.NewWriterSize(f, 256*1024)
+	enc := json.NewEncoder(w)
+	for rec := range m.records {
+		if err := enc.Encode(rec); err != nil && m.err == nil {
+			m.err = err
+		}
+		if len(m.records) == 0 {
+			if err := w.Flush(); err != nil && m.err == nil {
+				m.err = err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if err := f.Close(); err != nil && m.err == nil {
+		m.err = err
+	}
+}
+
+// Record queues rec for writing. Records after Close are dropped.
+func (m *Manifest) Record(rec ManifestRecord) {
+	if m == nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.closed {
+		m.records <- rec
+	}
+}
+
+// Close writes the queued records, closes the file and returns the first
+// write error.
+func (m *Manifest) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.once.Do(func() {
+		m.mu.Lock()
+		m.closed = true
+		close(m.records)
+		m.mu.Unlock()
+	})
+	<-m.done
+	return m.err
+}
+
+// ReadManifest calls fn with each record of the manifest at path, in the
+// order they were written. Damaged lines, such as one torn by a crash, are
+// skipped.
+func ReadManifest(path string, fn func(ManifestRecord) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec ManifestRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.URL == "" {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,277 @@
+package crawlkit
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultMetricsDomains is how many registered domains get latency series
+// of their own when MaxDomains is not set.
+const defaultMetricsDomains = 50
+
+// Metrics serves a crawler's telemetry in the Prometheus exposition format
+// at /metrics on Addr: pages fetched, links processed, downloads, latency
+// histograms by registered domain and the Go runtime and process
+// collectors, plus any gauges the crawler adds with GaugeFunc. A crawl
+// reaches far more hosts than Prometheus can keep series for, so only the
+// first MaxDomains domains seen get a histogram of their own, and the rest
+// share "other". It is safe for concurrent use; a nil Metrics records
+// nothing.
+type Metrics struct {
+	Addr       string
+	MaxDomains int // Domains with their own latency series; 0 means 50
+
+	labels     prometheus.Labels // The crawler label
+	registry   *prometheus.Registry
+	server     *http.Server
+	pages      *prometheus.CounterVec // By status class
+	pageErrors prometheus.Counter
+	links      prometheus.Counter
+	unique     prometheus.Counter
+	downloads  *prometheus.CounterVec // By result
+	bytes      prometheus.Counter
+	latency    *prometheus.HistogramVec // By domain
+	protocols  *prometheus.CounterVec   // By protocol
+
+	mu      sync.Mutex
+	domains map[string]bool // Domains with their own latency series
+}
+
+// OpenMetrics starts serving /metrics on addr, such as ":9100". crawler is
+// added to every series as the crawler label.
+func OpenMetrics(addr, crawler string) (*Metrics, error) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	labels := prometheus.Labels{"crawler": crawler}
+	m := &Metrics{
+		Addr:     addr,
+		labels:   labels,
+		registry: registry,
+		domains:  make(map[string]bool),
+		pages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "crawl_pages_fetched_total", Help: "Pages fetched by the collector, by status class.", ConstLabels: labels,
+		}, []string{"code"}),
+		pageErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "crawl_page_errors_total", Help: "Page requests that failed or got an error status.", ConstLabels: labels,
+		}),
+		links: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "crawl_links_processed_total", Help: "Links found on fetched pages.", ConstLabels: labels,
+		}),
+		unique: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "crawl_unique_links_total", Help: "Links not seen before.", ConstLabels: labels,
+		}),
+		downloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "crawl_downloads_total", Help: "Download attempts, by result (success or failure).", ConstLabels: labels,
+		}, []string{"result"}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "crawl_download_bytes_total", Help: "Bytes received by downloads.", ConstLabels: labels,
+		}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "crawl_request_duration_seconds",
+			Help:        "Time from sending a request to its response headers, by registered domain.",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.025, 2, 12), // 25ms to 51s
+		}, []string{"domain"}),
+		protocols: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "crawl_responses_total", Help: "Responses, by the protocol they came over (h1, h2 or h3).", ConstLabels: labels,
+		}, []string{"protocol"}),
+	}
+	registry.MustRegister(m.pages, m.pageErrors, m.links, m.unique, m.downloads, m.bytes, m.latency, m.protocols)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go m.server.Serve(ln)
+	return m, nil
+}
+
+// Metrics starts the endpoint configured by metrics_addr, with
+// metrics_domains latency series, or returns nil when it is empty.
+func (c *Config) Metrics(crawler string) (*Metrics, error) {
+	if c.MetricsAddr == "" {
+		return nil, nil
+	}
+	m, err := OpenMetrics(c.MetricsAddr, crawler)
+	if err != nil {
+		return nil, err
+	}
+	m.MaxDomains = c.MetricsDomains
+	return m, nil
+}
+
+// Attach counts c's pages and page errors.
+func (m *Metrics) Attach(c *colly.Collector) {
+	if m == nil {
+		return
+	}
+	c.OnResponse(func(r *colly.Response) {
+		m.pages.WithLabelValues(statusClass(r.StatusCode)).Inc()
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		m.pageErrors.Inc()
+	})
+}
+
+// Transport wraps rt, or http.DefaultTransport when nil, so that each
+// request's latency is observed in its domain's histogram, and each response
+// is counted by protocol. Wrap it inside
+// Politeness's Transport, so that time spent waiting for a turn is not
+// counted.
+func (m *Metrics) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if m == nil {
+		return rt
+	}
+	return &metricsTransport{m: m, rt: rt}
+}
+
+type metricsTransport struct {
+	m  *Metrics
+	rt http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil || req.Context().Err() == nil { // Aborted requests say nothing about the host
+		t.m.latency.WithLabelValues(t.m.domain(req.URL.Hostname())).Observe(time.Since(start).Seconds())
+	}
+	if err == nil {
+		t.m.protocols.WithLabelValues(protoName(resp)).Inc()
+	}
+	return resp, err
+}
+
+// domain returns the latency label of host: its registered domain if that
+// has a series, or can still get one, and "other" otherwise.
+func (m *Metrics) domain(host string) string {
+	domain := registeredDomain(normalizeHost(host))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.domains[domain] {
+		return domain
+	}
+	max := m.MaxDomains
+	if max <= 0 {
+		max = defaultMetricsDomains
+	}
+	if len(m.domains) >= max {
+		return "other"
+	}
+	m.domains[domain] = true
+	return domain
+}
+
+// Link counts a link found on a page; unique is true if it had not been
+// seen before.
+func (m *Metrics) Link(unique bool) {
+	if m == nil {
+		return
+	}
+	m.links.Inc()
+	if unique {
+		m.unique.Inc()
+	}
+}
+
+// Download counts a download attempt that received n bytes and ended with
+// err.
+func (m *Metrics) Download(n int64, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.downloads.WithLabelValues(result).Inc()
+	m.bytes.Add(float64(n))
+}
+
+// GaugeFunc adds a gauge whose value is read from fn at every scrape, such
+// as a queue's length. Gauges may share a name if their labels differ; the
+// crawler label is added to them.
+func (m *Metrics) GaugeFunc(name, help string, labels prometheus.Labels, fn func() float64) error {
+	if m == nil {
+		return nil
+	}
+	all := prometheus.Labels{}
+	for k, v := range m.labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	return m.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: name, Help: help, ConstLabels: all,
+	}, fn))
+}
+
+// AddProxies reports each of p's proxies at every scrape: requests sent
+// through it, how many failed, and whether it is in use.
+func (m *Metrics) AddProxies(p *Proxies) error {
+	if m == nil || p == nil {
+		return nil
+	}
+	return m.registry.Register(&proxyCollector{
+		p:        p,
+		requests: prometheus.NewDesc("crawl_proxy_requests_total", "Requests sent through a proxy.", []string{"proxy"}, m.labels),
+		failures: prometheus.NewDesc("crawl_proxy_failures_total", "Requests through a proxy that got no response.", []string{"proxy"}, m.labels),
+		up:       prometheus.NewDesc("crawl_proxy_up", "1 while a proxy is in use, 0 while it is evicted.", []string{"proxy"}, m.labels),
+	})
+}
+
+type proxyCollector struct {
+	p                      *Proxies
+	requests, failures, up *prometheus.Desc
+}
+
+func (c *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requests
+	ch <- c.failures
+	ch <- c.up
+}
+
+func (c *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.p.Stats() {
+		up := 1.0
+		if s.Evicted {
+			up = 0
+		}
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(s.Requests), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(s.Failed), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up, s.Name)
+	}
+}
+
+// Close stops serving /metrics.
+func (m *Metrics) Close() error {
+	if m == nil {
+		return nil
+	}
+	return m.server.Close()
+}
+
+// statusClass returns "2xx" and so on for code.
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return string(rune('0'+code/100)) + "xx"
+}
@@ -0,0 +1,83 @@
+package crawlkit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Dialer returns a net.Dialer whose connections leave from localIP, or from
+// whatever address the OS picks when localIP is nil.
+func Dialer(localIP net.IP) *net.Dialer {
+	d := &net.Dialer{}
+	if localIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	return d
+}
+
+// LookupInterfaceIP resolves spec, an interface name, a local IP or a CIDR
+// such as 192.168.1.0/24, to the IPv4 address to bind to.
+func LookupInterfaceIP(spec string) (net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing network interfaces: %w", err)
+	}
+	for _, iface := range interfaces {
+		if iface.Name == spec {
+			return interfaceIP(iface)
+		}
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && MatchInterface(spec, iface.Name, ipnet.IP) {
+				return ipnet.IP, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no network interface matches %q", spec)
+}
+
+// MatchInterface reports whether an interface called name with address ip is
+// selected by spec, which may be the name, the IP itself or a CIDR block.
+func MatchInterface(spec, name string, ip net.IP) bool {
+	spec = strings.TrimSpace(spec)
+	if spec == name {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(spec); err == nil {
+		return network.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(spec))
+}
+
+// interfaceIP returns the first non-loopback IPv4 address of iface.
+func interfaceIP(iface net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("getting addresses for interface %s: %w", iface.Name, err)
+	}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no valid IP address found for interface %s", iface.Name)
+}
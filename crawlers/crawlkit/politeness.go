@@ -0,0 +1,461 @@
+package crawlkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gocolly/colly"
+	"golang.org/x/time/rate"
+)
+
+const (
+	politeMinBackoff    = time.Second
+	politeMaxBackoff    = 5 * time.Minute
+	politeMaxRetryAfter = time.Hour // Longer Retry-After values are capped
+	politeRecoverAfter  = 10        // Healthy responses before easing off one step
+	politeMinRateShare  = 64        // A penalized host keeps at least rate/64
+	politeIPTTL         = 5 * time.Minute
+
+	defaultHostRate  = 2.0
+	defaultHostBurst = 4
+)
+
+// Politeness schedules requests with one token bucket per host, and
+// optionally per resolved IP so that virtual hosts sharing a server share
+// its budget too. A 429 or 503 response, or a connection reset, halves the
+// host's rate and holds it off for an exponentially growing backoff, or for
+// as long as Retry-After asks if that is longer. Every ten healthy responses
+// halve the backoff and raise the rate by a quarter, so a host recovers
+// slowly. Pause holds every request until Resume. It is safe for
+// concurrent use; a nil Politeness never waits.
+type Politeness struct {
+	Rate    rate.Limit      // Requests per second per host when healthy
+	Burst   int             // Requests a host may receive back to back
+	PerIP   bool            // Also limit by the host's resolved IP
+	Context context.Context // Cancels waits (e.g. Shutdown.Context); nil never does
+
+	mu     sync.Mutex
+	hosts  map[string]*hostState
+	ips    map[string]ipEntry
+	resume chan struct{} // Closed by Resume; nil unless paused
+}
+
+type hostState struct {
+	limiter *rate.Limiter
+
+	mu        sync.Mutex
+	rate      rate.Limit
+	backoff   time.Duration
+	until     time.Time // No requests before this
+	healthy   int       // Healthy responses since the last penalty or recovery step
+	requests  int64
+	throttled int64 // 429/503 responses
+	resets    int64 // Connection resets
+}
+
+type ipEntry struct {
+	ip      string
+	expires time.Time
+}
+
+// HostStats is a snapshot of one host's scheduling state.
+type HostStats struct {
+	Host      string
+	Rate      float64       // Current requests per second
+	Backoff   time.Duration // Current backoff; zero when healthy
+	Until     time.Time     // Held off until then
+	Requests  int64
+	Throttled int64
+	Resets    int64
+}
+
+// NewPoliteness returns a scheduler allowing perHost requests per second to
+// each host, with bursts of up to burst.
+func NewPoliteness(perHost rate.Limit, burst int) *Politeness {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Politeness{
+		Rate:  perHost,
+		Burst: burst,
+		hosts: make(map[string]*hostState),
+		ips:   make(map[string]ipEntry),
+	}
+}
+
+// Attach makes c wait for its turn before every request and feeds every
+// response and error back into the schedule. Requests aborted by an earlier
+// callback take no turn; attach it after those callbacks (Shutdown, Budget,
+// Robots). Requests whose wait is cancelled through Context are aborted.
+func (p *Politeness) Attach(c *colly.Collector) {
+	c.OnRequest(func(r *colly.Request) {
+		if aborted(r) {
+			return
+		}
+		if err := p.Wait(p.ctx(), r.URL); err != nil {
+			Abort(r)
+		}
+	})
+	c.OnResponse(func(r *colly.Response) {
+		p.Observe(r.Request.URL, r.StatusCode, *r.Headers, nil)
+	})
+	c.OnError(func(r *colly.Response, err error) {
+		var header http.Header
+		if r.Headers != nil {
+			header = *r.Headers
+		}
+		p.Observe(r.Request.URL, r.StatusCode, header, err)
+	})
+}
+
+// Transport wraps rt, or http.DefaultTransport when nil, so that requests
+// made outside colly, such as document downloads, are scheduled too.
+func (p *Politeness) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if p == nil {
+		return rt
+	}
+	return &politeTransport{p: p, rt: rt}
+}
+
+type politeTransport struct {
+	p  *Politeness
+	rt http.RoundTripper
+}
+
+func (t *politeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.p.Wait(req.Context(), req.URL); err != nil {
+		return nil, err
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		t.p.Observe(req.URL, 0, nil, err)
+		return nil, err
+	}
+	t.p.Observe(req.URL, resp.StatusCode, resp.Header, nil)
+	return resp, nil
+}
+
+func (p *Politeness) ctx() context.Context {
+	if p.Context != nil {
+		return p.Context
+	}
+	return context.Background()
+}
+
+// Wait blocks until a request to u may be sent: the host's backoff has
+// passed and its token bucket (and its IP's, with PerIP) has a token.
+func (p *Politeness) Wait(ctx context.Context, u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	resume := p.resume
+	p.mu.Unlock()
+	if resume != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resume:
+		}
+	}
+
+	h := p.host(hostKey(u))
+	for {
+		h.mu.Lock()
+		delay := time.Until(h.until)
+		h.mu.Unlock()
+		if delay <= 0 {
+			break
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if err := h.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	if p.PerIP {
+		if ip := p.resolve(ctx, u.Hostname()); ip != "" {
+			if err := p.host("ip " + ip).limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.mu.Lock()
+	h.requests++
+	h.mu.Unlock()
+	return nil
+}
+
+// Pause holds every request that has not yet been sent until Resume.
+// Requests already in flight, such as a download being streamed, go on.
+func (p *Politeness) Pause() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+	}
+}
+
+// Resume releases the requests held by Pause.
+func (p *Politeness) Resume() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+// Paused reports whether requests are being held.
+func (p *Politeness) Paused() bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resume != nil
+}
+
+// Observe records the outcome of a request to u: its status code and
+// headers, or the error if it got no response.
+func (p *Politeness) Observe(u *url.URL, status int, header http.Header, err error) {
+	if p == nil {
+		return
+	}
+	h := p.host(hostKey(u))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+		h.throttled++
+		p.penalize(h, retryAfter(header))
+	case status == 0 && isConnReset(err):
+		h.resets++
+		p.penalize(h, 0)
+	case status > 0:
+		h.healthy++
+		if h.healthy >= politeRecoverAfter {
+			h.healthy = 0
+			p.recover(h)
+		}
+	}
+}
+
+// penalize halves h's rate and holds it off; the caller holds h.mu.
+func (p *Politeness) penalize(h *hostState, wait time.Duration) {
+	h.healthy = 0
+	if h.backoff == 0 {
+		h.backoff = politeMinBackoff
+	} else if h.backoff *= 2; h.backoff > politeMaxBackoff {
+		h.backoff = politeMaxBackoff
+	}
+	if wait < h.backoff {
+		wait = h.backoff
+	}
+	if until := time.Now().Add(wait); until.After(h.until) {
+		h.until = until
+	}
+
+	h.rate /= 2
+	if floor := p.Rate / politeMinRateShare; h.rate < floor {
+		h.rate = floor
+	}
+	h.limiter.SetLimit(h.rate)
+}
+
+// recover takes one step back towards full speed; the caller holds h.mu.
+func (p *Politeness) recover(h *hostState) {
+	if h.backoff /= 2; h.backoff < politeMinBackoff {
+		h.backoff = 0
+	}
+	if h.rate < p.Rate {
+		if h.rate *= 1.25; h.rate > p.Rate {
+			h.rate = p.Rate
+		}
+		h.limiter.SetLimit(h.rate)
+	}
+}
+
+func (p *Politeness) host(key string) *hostState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.hosts[key]
+	if !ok {
+		h = &hostState{limiter: rate.NewLimiter(p.Rate, p.Burst), rate: p.Rate}
+		p.hosts[key] = h
+	}
+	return h
+}
+
+// resolve returns host's first IP address, cached for a few minutes, or ""
+// if it cannot be resolved.
+func (p *Politeness) resolve(ctx context.Context, host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	p.mu.Lock()
+	e, ok := p.ips[host]
+	p.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ip
+	}
+
+	e = ipEntry{expires: time.Now().Add(politeIPTTL)}
+	if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host); err == nil && len(addrs) > 0 {
+		e.ip = addrs[0].IP.String()
+	}
+	p.mu.Lock()
+	p.ips[host] = e
+	p.mu.Unlock()
+	return e.ip
+}
+
+func hostKey(u *url.URL) string {
+	return strings.ToLower(u.Host)
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func retryAfter(header http.Header) time.Duration {
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > politeMaxRetryAfter {
+		return politeMaxRetryAfter
+	}
+	return d
+}
+
+func isConnReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// colly flattens transport errors into strings
+	return strings.Contains(err.Error(), "connection reset")
+}
+
+// Stats returns every host's state, busiest first. IP buckets are left out.
+func (p *Politeness) Stats() []HostStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	keys := make([]string, 0, len(p.hosts))
+	states := make([]*hostState, 0, len(p.hosts))
+	for k, h := range p.hosts {
+		if strings.HasPrefix(k, "ip ") {
+			continue
+		}
+		keys = append(keys, k)
+		states = append(states, h)
+	}
+	p.mu.Unlock()
+
+	stats := make([]HostStats, len(states))
+	for i, h := range states {
+		h.mu.Lock()
+		stats[i] = HostStats{
+			Host:      keys[i],
+			Rate:      float64(h.rate),
+			Backoff:   h.backoff,
+			Until:     h.until,
+			Requests:  h.requests,
+			Throttled: h.throttled,
+			Resets:    h.resets,
+		}
+		h.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Requests > stats[j].Requests })
+	return stats
+}
+
+// Summary describes the schedule in one line for telemetry output: the
+// number of hosts, how many are backing off, and the state of up to n hosts,
+// slowed-down ones first.
+func (p *Politeness) Summary(n int) string {
+	stats := p.Stats()
+	if len(stats) == 0 {
+		return "hosts: 0"
+	}
+	slowed := 0
+	for _, s := range stats {
+		if s.Backoff > 0 || s.Rate < float64(p.Rate) {
+			slowed++
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Backoff > stats[j].Backoff })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "hosts: %d (%d slowed)", len(stats), slowed)
+	for i, s := range stats {
+		if i == n {
+			break
+		}
+		fmt.Fprintf(&b, "; %s %.2f/s %d req", s.Host, s.Rate, s.Requests)
+		if s.Backoff > 0 {
+			fmt.Fprintf(&b, " backoff %s", s.Backoff)
+		}
+		if wait := time.Until(s.Until); wait > 0 {
+			fmt.Fprintf(&b, " paused %s", wait.Round(time.Second))
+		}
+		if s.Throttled+s.Resets > 0 {
+			fmt.Fprintf(&b, " %d throttled %d resets", s.Throttled, s.Resets)
+		}
+	}
+	return b.String()
+}
+
+// Politeness returns the per-host scheduler for the crawl's host_rate,
+// host_burst and per_ip settings.
+func (c *Config) Politeness() *Politeness {
+	r, burst := c.HostRate, c.HostBurst
+	if r <= 0 {
+		r = defaultHostRate
+	}
+	if burst <= 0 {
+		burst = defaultHostBurst
+	}
+	p := NewPoliteness(rate.Limit(r), burst)
+	p.PerIP = c.PerIP
+	return p
+}
@@ -0,0 +1,123 @@
+package crawlkit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stdin is shared by every prompt so buffered input is not lost between them.
+var stdin = bufio.NewReader(os.Stdin)
+
+// Interactive reports whether stdin is a terminal. The prompts below are only
+// shown when it is, so the crawlers can run from cron, systemd or CI.
+func Interactive() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Prompt prints label and returns the trimmed line typed in reply.
+func Prompt(label string) string {
+	fmt.Print(label)
+	line, _ := stdin.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// ResolveStartURLs returns the configured start URLs, asking for one when none
+// were given and stdin is a terminal.
+func (c *Config) ResolveStartURLs() ([]string, error) {
+	if len(c.StartURLs) > 0 {
+		return c.StartURLs, nil
+	}
+	if Interactive() {
+		if u := Prompt("Enter the starting URL to crawl: "); u != "" {
+			c.StartURLs = []string{u}
+			return c.StartURLs, nil
+		}
+	}
+	return nil, fmt.Errorf("no starting URL: pass -url or set start_urls in the config file")
+}
+
+// ResolveLocalIP returns the address to bind outgoing connections to. A nil IP
+// means the OS picks the route, which is what happens when no interface is
+// configured and stdin is not a terminal.
+func (c *Config) ResolveLocalIP() (net.IP, error) {
+	if c.Interface != "" {
+		return LookupInterfaceIP(c.Interface)
+	}
+	if !Interactive() {
+		return nil, nil
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("listing network interfaces: %w", err)
+	}
+	fmt.Println("Available network interfaces:")
+	for i, iface := range interfaces {
+		fmt.Printf("%d: %s\n", i+1, iface.Name)
+	}
+	selectedIndex, err := strconv.Atoi(Prompt("Select the network interface to use (enter the number): "))
+	if err != nil || selectedIndex < 1 || selectedIndex > len(interfaces) {
+		return nil, fmt.Errorf("invalid network interface selection")
+	}
+	c.Interface = interfaces[selectedIndex-1].Name
+	return interfaceIP(interfaces[selectedIndex-1])
+}
+
+// ResolveOutputDir returns the download directory, creating it if needed.
+// Without a configured directory it offers the directories under the current
+// one on a terminal, and otherwise creates "<prefix>-<timestamp>".
+func (c *Config) ResolveOutputDir(prefix string) (string, error) {
+	if c.OutputDir != "" {
+		if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
+			return "", fmt.Errorf("creating directory: %w", err)
+		}
+		return c.OutputDir, nil
+	}
+
+	newDir := func() (string, error) {
+		c.OutputDir = fmt.Sprintf("%s-%s", prefix, time.Now().Format("20060102150405"))
+		if err := os.Mkdir(c.OutputDir, 0755); err != nil {
+			return "", fmt.Errorf("creating directory: %w", err)
+		}
+		fmt.Printf("Created new directory: %s\n", c.OutputDir)
+		return c.OutputDir, nil
+	}
+	if !Interactive() {
+		return newDir()
+	}
+
+	dirs, err := os.ReadDir(".")
+	if err != nil {
+		return "", fmt.Errorf("reading current directory: %w", err)
+	}
+	var dirList []os.DirEntry
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			dirList = append(dirList, dir)
+		}
+	}
+	fmt.Println("Available directories:")
+	for i, dir := range dirList {
+		fmt.Printf("%d: %s\n", i+1, dir.Name())
+	}
+	fmt.Printf("0: Create a new directory named '%s-<timestamp>'\n", prefix)
+
+	selectedDirIndex, err := strconv.Atoi(Prompt("Select the directory to store downloaded files (enter the number or hit enter for default): "))
+	if err != nil || selectedDirIndex == 0 {
+		return newDir()
+	}
+	if selectedDirIndex < 1 || selectedDirIndex > len(dirList) {
+		return "", fmt.Errorf("invalid directory selection")
+	}
+	c.OutputDir = dirList[selectedDirIndex-1].Name()
+	return c.OutputDir, nil
+}
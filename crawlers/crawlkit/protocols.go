@@ -0,0 +1,312 @@
+package crawlkit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	altSvcMaxAge = 24 * time.Hour         // Alt-Svc's default ma, and the longest believed
+	h3BrokenFor  = 5 * time.Minute        // How long a host is kept off HTTP/3 after it failed
+	h3RaceDelay  = 300 * time.Millisecond // Head start of HTTP/3 before TCP joins the race
+)
+
+// Protocols is an http.RoundTripper that sends requests over HTTP/3 to the
+// hosts known to speak it, and over HTTP/1.1 or HTTP/2 to the rest. Hosts
+// say they speak HTTP/3 with an Alt-Svc header (h3=":443"), which is
+// remembered per host for its ma, at most MaxAge; "clear" forgets it.
+//
+// A request to such a host goes over HTTP/3, and also over TCP if no
+// response has come after RaceDelay or the HTTP/3 attempt failed. The first
+// response wins and the other attempt is cancelled. When TCP wins, the
+// host is kept off HTTP/3 for BrokenFor, so a host whose QUIC is blocked
+// costs one handshake, not one per request. Requests with a body are never
+// raced; they go over TCP.
+//
+// Responses are counted by protocol for Summary. It is safe for concurrent
+// use.
+type Protocols struct {
+	H3        http.RoundTripper // HTTP/3, such as *http3.RoundTripper; nil sends everything over TCP
+	Base      http.RoundTripper // HTTP/1.1 and HTTP/2; nil for http.DefaultTransport
+	MaxAge    time.Duration     // 0 means 24h
+	BrokenFor time.Duration     // 0 means 5m
+	RaceDelay time.Duration     // 0 means 300ms
+
+	mu        sync.Mutex
+	hosts     map[string]*h3Host // By host:port
+	responses map[string]int64   // By protocol: h1, h2 or h3
+	fallbacks int64              // HTTP/3 attempts answered over TCP instead
+}
+
+type h3Host struct {
+	until  time.Time // Speaks HTTP/3 until then
+	broken time.Time // Not to be sent HTTP/3 until then
+}
+
+func (p *Protocols) base() http.RoundTripper {
+	if p.Base != nil {
+		return p.Base
+	}
+	return http.DefaultTransport
+}
+
+func (p *Protocols) maxAge() time.Duration {
+	if p.MaxAge > 0 {
+		return p.MaxAge
+	}
+	return altSvcMaxAge
+}
+
+// RoundTrip sends req over the protocol its host is known to speak.
+func (p *Protocols) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := h3Key(req.URL)
+	if p.H3 == nil || key == "" || (req.Body != nil && req.Body != http.NoBody) || !p.SpeaksH3(key) {
+		resp, err := p.base().RoundTrip(req)
+		if err == nil {
+			p.learn(key, resp)
+		}
+		return resp, err
+	}
+	return p.race(req, key)
+}
+
+// SpeaksH3 reports whether requests to key, a host:port, go over HTTP/3.
+func (p *Protocols) SpeaksH3(key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.hosts[key]
+	now := time.Now()
+	return h != nil && now.Before(h.until) && !now.Before(h.broken)
+}
+
+type raceResult struct {
+	resp *http.Response
+	err  error
+	h3   bool
+}
+
+// race sends req over HTTP/3, and over TCP once HTTP/3 has had RaceDelay
+// or has failed, and returns the first response.
+func (p *Protocols) race(req *http.Request, key string) (*http.Response, error) {
+	results := make(chan raceResult, 2)
+	cancels := make(map[bool]context.CancelFunc, 2)
+	start := func(h3 bool) {
+		rt := p.base()
+		if h3 {
+			rt = p.H3
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[h3] = cancel
+		go func() {
+			resp, err := rt.RoundTrip(req.WithContext(ctx))
+			results <- raceResult{resp: resp, err: err, h3: h3}
+		}()
+	}
+
+	delay := p.RaceDelay
+	if delay <= 0 {
+		delay = h3RaceDelay
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start(true)
+	pending := 1
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if cancels[false] == nil {
+				start(false)
+				pending++
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if err == nil || !r.h3 {
+					err = r.err // TCP's error says more
+				}
+				if r.h3 && cancels[false] == nil && req.Context().Err() == nil {
+					start(false) // Do not wait for the timer
+					pending++
+				}
+				continue
+			}
+			if cancel := cancels[!r.h3]; cancel != nil {
+				cancel()
+			}
+			if pending > 0 {
+				go func() {
+					if loser := <-results; loser.err == nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			if !r.h3 {
+				p.broken(key)
+			}
+			p.learn(key, r.resp)
+			r.resp.Body = &cancelBody{ReadCloser: r.resp.Body, cancel: cancels[r.h3]}
+			return r.resp, nil
+		}
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, err
+}
+
+// broken keeps key off HTTP/3 for BrokenFor after TCP had to answer.
+func (p *Protocols) broken(key string) {
+	d := p.BrokenFor
+	if d <= 0 {
+		d = h3BrokenFor
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if h := p.hosts[key]; h != nil {
+		h.broken = time.Now().Add(d)
+	}
+	p.fallbacks++
+}
+
+// learn counts resp and remembers what its Alt-Svc header says about key.
+// A response that came over HTTP/3 also counts as an announcement.
+func (p *Protocols) learn(key string, resp *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.responses == nil {
+		p.responses = make(map[string]int64)
+		p.hosts = make(map[string]*h3Host)
+	}
+	p.responses[protoName(resp)]++
+	if key == "" {
+		return
+	}
+	ma, clear := time.Duration(0), false
+	if values := resp.Header.Values("Alt-Svc"); len(values) > 0 {
+		host, port, _ := net.SplitHostPort(key)
+		ma, clear = parseAltSvc(strings.Join(values, ","), host, port)
+	} else if resp.ProtoMajor == 3 {
+		ma = altSvcMaxAge
+	}
+	switch {
+	case clear:
+		delete(p.hosts, key)
+	case ma > 0:
+		h := p.hosts[key]
+		if h == nil {
+			h = &h3Host{}
+			p.hosts[key] = h
+		}
+		h.until = time.Now().Add(min(ma, p.maxAge()))
+	}
+}
+
+// Summary counts responses by protocol, and the hosts that speak HTTP/3,
+// for a crawler's final report.
+func (p *Protocols) Summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.responses) == 0 {
+		return "no responses"
+	}
+	protos := make([]string, 0, len(p.responses))
+	for proto := range p.responses {
+		protos = append(protos, proto)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(protos)))
+	parts := make([]string, len(protos))
+	for i, proto := range protos {
+		parts[i] = fmt.Sprintf("%s %d", proto, p.responses[proto])
+	}
+	now := time.Now()
+	speak, broken := 0, 0
+	for _, h := range p.hosts {
+		if now.Before(h.until) {
+			speak++
+			if now.Before(h.broken) {
+				broken++
+			}
+		}
+	}
+	return fmt.Sprintf("%s; %d hosts speak HTTP/3 (%d kept on TCP for now), %d HTTP/3 attempts fell back to TCP",
+		strings.Join(parts, ", "), speak, broken, p.fallbacks)
+}
+
+// cancelBody cancels the context of a won race when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// h3Key returns the host:port that HTTP/3 support is remembered by, or ""
+// for URLs that cannot use HTTP/3.
+func h3Key(u *url.URL) string {
+	if u.Scheme != "https" || u.Hostname() == "" {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// parseAltSvc returns how long an Alt-Svc header says the origin at host
+// and port speaks HTTP/3 (0 when it does not), and whether it says "clear".
+// Only h3 on the origin's own host and port is taken: the HTTP/3 transport
+// dials the URL's address, not an alternative one.
+func parseAltSvc(v, host, port string) (time.Duration, bool) {
+	if strings.EqualFold(strings.TrimSpace(v), "clear") {
+		return 0, true
+	}
+	var best time.Duration
+	for _, alt := range strings.Split(v, ",") {
+		params := strings.Split(alt, ";")
+		proto, authority, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !ok || proto != "h3" {
+			continue
+		}
+		altHost, altPort, err := net.SplitHostPort(strings.Trim(authority, `"`))
+		if err != nil || altPort != port || (altHost != "" && !strings.EqualFold(altHost, host)) {
+			continue
+		}
+		ma := altSvcMaxAge
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "ma") {
+				if secs, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); err == nil && secs >= 0 {
+					ma = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		best = max(best, ma)
+	}
+	return best, false
+}
+
+// protoName returns h1, h2 or h3 for the protocol resp came over.
+func protoName(resp *http.Response) string {
+	switch resp.ProtoMajor {
+	case 3:
+		return "h3"
+	case 2:
+		return "h2"
+	}
+	return "h1"
+}
@@ -0,0 +1,399 @@
+package crawlkit
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+const (
+	robotsMaxSize  = 500 * 1024     // RFC 9309 parsing limit
+	robotsTTL      = 24 * time.Hour // How long a fetched robots.txt is trusted
+	robotsRetryTTL = time.Hour      // How long an unreachable robots.txt blocks a host
+	robotsTimeout  = 30 * time.Second
+)
+
+// Robots fetches, caches and applies robots.txt files, one per scheme+host.
+// It is safe for concurrent use by every collector goroutine.
+type Robots struct {
+	UserAgent string          // Full User-Agent header; its product token selects the group
+	Client    *http.Client    // Client used to fetch robots.txt files
+	Context   context.Context // Cancelling it ends Crawl-delay waits; nil never does
+
+	mu      sync.Mutex
+	hosts   map[string]*robotsEntry
+	blocked int64
+}
+
+type robotsEntry struct {
+	ready   chan struct{}
+	rules   *robotsRules
+	expires time.Time
+
+	mu   sync.Mutex
+	next time.Time // Earliest start of the next request under Crawl-delay
+}
+
+type robotsRules struct {
+	rules       []robotsRule
+	crawlDelay  time.Duration
+	sitemaps    []string
+	disallowAll bool
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+	hasDelay   bool
+}
+
+// NewRobots returns a Robots for userAgent. A nil client gets a plain
+// http.Client with a 30s timeout.
+func NewRobots(userAgent string, client *http.Client) *Robots {
+	if client == nil {
+		client = &http.Client{Timeout: robotsTimeout}
+	}
+	return &Robots{
+		UserAgent: userAgent,
+		Client:    client,
+		hosts:     make(map[string]*robotsEntry),
+	}
+}
+
+// Attach makes c consult r before every request: URLs disallowed for our user
+// agent are aborted and counted, and requests to each host are spaced by its
+// Crawl-delay. colly runs every OnRequest callback even for aborted
+// requests, so those are skipped here, and r should be attached after the
+// callbacks that may abort (Shutdown, Budget) and before Politeness: only
+// requests that will be sent take a Crawl-delay slot. Requests whose wait is
+// cancelled through Context are aborted. A nil Robots attaches nothing.
+func (r *Robots) Attach(c *colly.Collector) {
+	if r == nil {
+		return
+	}
+	c.OnRequest(func(req *colly.Request) {
+		if aborted(req) {
+			return
+		}
+		if !r.Check(req.URL) {
+			Abort(req)
+			return
+		}
+		if err := r.Wait(r.ctx(), req.URL); err != nil {
+			Abort(req)
+		}
+	})
+}
+
+func (r *Robots) ctx() context.Context {
+	if r.Context != nil {
+		return r.Context
+	}
+	return context.Background()
+}
+
+// Check is Allowed for URLs fetched outside colly, such as document
+// downloads: refusals are counted in Blocked. A nil Robots allows everything,
+// so crawlers run with -ignore-robots can call it unconditionally.
+func (r *Robots) Check(u *url.URL) bool {
+	if r == nil || r.Allowed(u) {
+		return true
+	}
+	atomic.AddInt64(&r.blocked, 1)
+	return false
+}
+
+// Blocked returns how many URLs robots.txt has stopped so far.
+func (r *Robots) Blocked() int64 {
+	if r == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.blocked)
+}
+
+// Allowed reports whether u may be fetched.
+func (r *Robots) Allowed(u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return true
+	}
+	if u.Path == "/robots.txt" {
+		return true
+	}
+	rules := r.entry(u).rules
+	if rules.disallowAll {
+		return false
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	// The longest matching pattern wins; on a tie Allow beats Disallow.
+	allowed, best := true, -1
+	for _, rule := range rules.rules {
+		if len(rule.pattern) < best || !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > best || rule.allow {
+			allowed, best = rule.allow, len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+// CrawlDelay returns the Crawl-delay that applies to u's host, or zero.
+func (r *Robots) CrawlDelay(u *url.URL) time.Duration {
+	return r.entry(u).rules.crawlDelay
+}
+
+// Sitemaps returns the Sitemap URLs listed in u's host's robots.txt.
+func (r *Robots) Sitemaps(u *url.URL) []string {
+	return r.entry(u).rules.sitemaps
+}
+
+// Wait blocks until a request to u's host is allowed under its Crawl-delay,
+// or ctx is done. A cancelled wait gives its slot back when no later
+// request has taken one, and returns ctx's error.
+func (r *Robots) Wait(ctx context.Context, u *url.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e := r.entry(u)
+	delay := e.rules.crawlDelay
+	if delay <= 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	now := time.Now()
+	start := e.next
+	if start.Before(now) {
+		start = now
+	}
+	e.next = start.Add(delay)
+	e.mu.Unlock()
+
+	t := time.NewTimer(start.Sub(now))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		e.mu.Lock()
+		if e.next.Equal(start.Add(delay)) {
+			e.next = start
+		}
+		e.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// entry returns the cached robots.txt for u's host, fetching it on first use
+// or after it expires. Concurrent callers for the same host share one fetch.
+func (r *Robots) entry(u *url.URL) *robotsEntry {
+	key := u.Scheme + "://" + strings.ToLower(u.Host)
+
+	r.mu.Lock()
+	e, ok := r.hosts[key]
+	if ok {
+		select {
+		case <-e.ready:
+			if time.Now().After(e.expires) {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		e = &robotsEntry{ready: make(chan struct{})}
+		r.hosts[key] = e
+		r.mu.Unlock()
+
+		e.rules, e.expires = r.fetch(key)
+		close(e.ready)
+		return e
+	}
+	r.mu.Unlock()
+
+	<-e.ready
+	return e
+}
+
+// fetch downloads and parses base/robots.txt. Following RFC 9309, a missing
+// file (4xx) allows everything and an unreachable one (5xx, network error)
+// disallows everything until it is retried.
+func (r *Robots) fetch(base string) (*robotsRules, time.Time) {
+	req, err := http.NewRequest("GET", base+"/robots.txt", nil)
+	if err != nil {
+		return &robotsRules{}, time.Now().Add(robotsTTL)
+	}
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		log.Printf("Error fetching %s/robots.txt: %s", base, err)
+		return &robotsRules{disallowAll: true}, time.Now().Add(robotsRetryTTL)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return &robotsRules{disallowAll: true}, time.Now().Add(robotsRetryTTL)
+	case resp.StatusCode != http.StatusOK:
+		return &robotsRules{}, time.Now().Add(robotsTTL)
+	}
+
+	rules, err := parseRobots(io.LimitReader(resp.Body, robotsMaxSize), r.UserAgent)
+	if err != nil {
+		log.Printf("Error reading %s/robots.txt: %s", base, err)
+		return &robotsRules{disallowAll: true}, time.Now().Add(robotsRetryTTL)
+	}
+	return rules, time.Now().Add(robotsTTL)
+}
+
+// parseRobots parses a robots.txt body and keeps the rules of the groups that
+// match userAgent's product token, falling back to the "*" groups.
+func parseRobots(body io.Reader, userAgent string) (*robotsRules, error) {
+	var (
+		groups   []*robotsGroup
+		current  *robotsGroup
+		inAgents bool
+		sitemaps []string
+	)
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), robotsMaxSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			inAgents = false
+			if current != nil {
+				if secs, err := strconv.ParseFloat(value, 64); err == nil && secs >= 0 {
+					current.crawlDelay = time.Duration(secs * float64(time.Second))
+					current.hasDelay = true
+				}
+			}
+		case "sitemap":
+			sitemaps = append(sitemaps, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	token := strings.ToLower(productToken(userAgent))
+	selected := matchGroups(groups, func(agent string) bool {
+		return token != "" && agent != "*" && (agent == token || strings.Contains(strings.ToLower(userAgent), agent))
+	})
+	if len(selected) == 0 {
+		selected = matchGroups(groups, func(agent string) bool { return agent == "*" })
+	}
+
+	rules := &robotsRules{sitemaps: sitemaps}
+	for _, g := range selected {
+		rules.rules = append(rules.rules, g.rules...)
+		if g.hasDelay && g.crawlDelay > rules.crawlDelay {
+			rules.crawlDelay = g.crawlDelay
+		}
+	}
+	return rules, nil
+}
+
+func matchGroups(groups []*robotsGroup, match func(agent string) bool) []*robotsGroup {
+	var selected []*robotsGroup
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			if agent != "" && match(agent) {
+				selected = append(selected, g)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// productToken returns the name part of a User-Agent, e.g. "Mozilla" for
+// "Mozilla/5.0 (X11; Linux x86_64)".
+func productToken(userAgent string) string {
+	token := strings.TrimSpace(userAgent)
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	return token
+}
+
+// robotsMatch reports whether path matches a robots.txt pattern, where "*"
+// matches any run of characters and a trailing "$" anchors the end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	if len(parts) == 1 {
+		return !anchored || len(path) == len(parts[0])
+	}
+
+	pos := len(parts[0])
+	last := len(parts) - 1
+	for i := 1; i < last; i++ {
+		idx := strings.Index(path[pos:], parts[i])
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(parts[i])
+	}
+	if anchored {
+		return len(path)-pos >= len(parts[last]) && strings.HasSuffix(path, parts[last])
+	}
+	return strings.Contains(path[pos:], parts[last])
+}
@@ -0,0 +1,326 @@
+package crawlkit
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml/v2"
+	"golang.org/x/net/publicsuffix"
+	"gopkg.in/yaml.v3"
+)
+
+// ScopeRule is one rule of a Scope. It matches a URL when every condition
+// it sets matches; a rule without conditions matches every URL.
+type ScopeRule struct {
+	Name     string   `yaml:"name" toml:"name"`           // reported when the rule rejects a URL
+	Action   string   `yaml:"action" toml:"action"`       // allow or deny
+	Domains  []string `yaml:"domains" toml:"domains"`     // see matchDomain
+	Path     string   `yaml:"path" toml:"path"`           // regexp on the decoded path
+	Query    string   `yaml:"query" toml:"query"`         // regexp on the raw query
+	MaxDepth int      `yaml:"max_depth" toml:"max_depth"` // allow rules only: deeper URLs are rejected
+	Proxy    string   `yaml:"proxy" toml:"proxy"`         // proxy URL or "direct"; "" uses the proxy pool
+
+	path  *regexp.Regexp
+	query *regexp.Regexp
+}
+
+// ScopeFile is the layout of a scope file: the rules in order, and what
+// happens to URLs none of them match.
+type ScopeFile struct {
+	Default string      `yaml:"default" toml:"default"` // allow or deny
+	Rules   []ScopeRule `yaml:"rules" toml:"rules"`
+}
+
+// Scope decides which URLs a crawl may visit. Rules are tried in order and
+// the first that matches decides; URLs no rule matches get the default,
+// which is deny when there are allow rules and allow otherwise. Rejections
+// are counted by rule. It is safe for concurrent use; a nil Scope allows
+// everything.
+type Scope struct {
+	rules []ScopeRule
+	deny  bool // The default
+
+	mu       sync.Mutex
+	rejected map[string]int64
+}
+
+// NewScope compiles rules. def is "allow", "deny" or "" for the usual
+// default. A domains entry of "$start" stands for the registered domains of
+// start, the crawl's starting URLs.
+func NewScope(def string, rules []ScopeRule, start []string) (*Scope, error) {
+	s := &Scope{rejected: make(map[string]int64)}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		r.Action = strings.ToLower(r.Action)
+		if r.Action != "allow" && r.Action != "deny" {
+			return nil, fmt.Errorf("scope rule %s: action must be allow or deny, not %q", r.Name, r.Action)
+		}
+		var err error
+		if r.Proxy != "" && r.Proxy != "direct" {
+			if _, err = parseProxy(r.Proxy); err != nil {
+				return nil, fmt.Errorf("scope rule %s: %w", r.Name, err)
+			}
+		}
+		if r.Path != "" {
+			if r.path, err = regexp.Compile(r.Path); err != nil {
+				return nil, fmt.Errorf("scope rule %s: path: %w", r.Name, err)
+			}
+		}
+		if r.Query != "" {
+			if r.query, err = regexp.Compile(r.Query); err != nil {
+				return nil, fmt.Errorf("scope rule %s: query: %w", r.Name, err)
+			}
+		}
+		var domains []string
+		for _, d := range r.Domains {
+			if d != "$start" {
+				domains = append(domains, normalizeHost(d))
+				continue
+			}
+			for _, raw := range start {
+				if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+					domains = append(domains, registeredDomain(normalizeHost(u.Hostname())))
+				}
+			}
+		}
+		if len(r.Domains) > 0 && len(domains) == 0 {
+			return nil, fmt.Errorf("scope rule %s: no domains (no start URLs for $start?)", r.Name)
+		}
+		r.Domains = domains
+		if r.Action == "allow" {
+			s.deny = true
+		}
+		s.rules = append(s.rules, r)
+	}
+	switch strings.ToLower(def) {
+	case "":
+	case "allow":
+		s.deny = false
+	case "deny":
+		s.deny = true
+	default:
+		return nil, fmt.Errorf("scope default must be allow or deny, not %q", def)
+	}
+	return s, nil
+}
+
+// LoadScope reads a YAML (.yaml, .yml) or TOML (.toml) scope file.
+func LoadScope(path string, start []string) (*Scope, error) {
+	f, err := readScopeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewScope(f.Default, f.Rules, start)
+}
+
+func readScopeFile(path string) (ScopeFile, error) {
+	var f ScopeFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, fmt.Errorf("reading scope %s: %w", path, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &f)
+	case ".toml":
+		err = toml.Unmarshal(data, &f)
+	default:
+		return f, fmt.Errorf("scope %s: unknown format, use .yaml or .toml", path)
+	}
+	if err != nil {
+		return f, fmt.Errorf("parsing scope %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// Scope returns the crawl scope: excluded_domains as a first deny rule,
+// then the rules of scope_file, or scope_rules and scope_default when no
+// file is given.
+func (c *Config) Scope(start []string) (*Scope, error) {
+	var rules []ScopeRule
+	if len(c.ExcludedDomains) > 0 {
+		rules = append(rules, ScopeRule{Name: "excluded_domains", Action: "deny", Domains: c.ExcludedDomains})
+	}
+	def, more := c.ScopeDefault, c.ScopeRules
+	if c.ScopeFile != "" {
+		f, err := readScopeFile(c.ScopeFile)
+		if err != nil {
+			return nil, err
+		}
+		def, more = f.Default, f.Rules
+	}
+	return NewScope(def, append(rules, more...), start)
+}
+
+// Check reports whether u may be visited at depth, and the name of the
+// rule that decided; "default" when no rule matched. Rejections are
+// counted.
+func (s *Scope) Check(u *url.URL, depth int) (bool, string) {
+	if s == nil {
+		return true, ""
+	}
+	host := normalizeHost(u.Hostname())
+	site := registeredDomain(host)
+	for i := range s.rules {
+		r := &s.rules[i]
+		if !r.matches(host, site, u) {
+			continue
+		}
+		if r.Action == "deny" {
+			return s.reject(r.Name)
+		}
+		if r.MaxDepth > 0 && depth > r.MaxDepth {
+			return s.reject(r.Name + " (max_depth)")
+		}
+		return true, r.Name
+	}
+	if s.deny {
+		return s.reject("default")
+	}
+	return true, "default"
+}
+
+// Allows is Check for a URL string, for crawlers that keep links as
+// strings. URLs that do not parse are rejected without being counted.
+func (s *Scope) Allows(raw string, depth int) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	ok, _ := s.Check(u, depth)
+	return ok
+}
+
+// Proxy returns the proxy setting of the first rule matching u, ignoring
+// max_depth, or "" when no rule matches. Nothing is counted.
+func (s *Scope) Proxy(u *url.URL) string {
+	if s == nil {
+		return ""
+	}
+	host := normalizeHost(u.Hostname())
+	site := registeredDomain(host)
+	for i := range s.rules {
+		if s.rules[i].matches(host, site, u) {
+			return s.rules[i].Proxy
+		}
+	}
+	return ""
+}
+
+func (s *Scope) reject(rule string) (bool, string) {
+	s.mu.Lock()
+	s.rejected[rule]++
+	s.mu.Unlock()
+	return false, rule
+}
+
+// Rejected returns how many URLs each rule has rejected so far.
+func (s *Scope) Rejected() map[string]int64 {
+	rejected := make(map[string]int64)
+	if s == nil {
+		return rejected
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rule, n := range s.rejected {
+		rejected[rule] = n
+	}
+	return rejected
+}
+
+// Summary describes the rejections by rule, most first, for a crawler's
+// final report.
+func (s *Scope) Summary() string {
+	if s == nil {
+		return "disabled"
+	}
+	rejected := s.Rejected()
+	if len(rejected) == 0 {
+		return "nothing rejected"
+	}
+	rules := make([]string, 0, len(rejected))
+	var total int64
+	for rule, n := range rejected {
+		rules = append(rules, rule)
+		total += n
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rejected[rules[i]] != rejected[rules[j]] {
+			return rejected[rules[i]] > rejected[rules[j]]
+		}
+		return rules[i] < rules[j]
+	})
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%s %d", rule, rejected[rule])
+	}
+	return fmt.Sprintf("%d rejected: %s", total, strings.Join(parts, ", "))
+}
+
+func (r *ScopeRule) matches(host, site string, u *url.URL) bool {
+	if len(r.Domains) > 0 {
+		found := false
+		for _, d := range r.Domains {
+			if matchDomain(d, host, site) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.path != nil && !r.path.MatchString(u.Path) {
+		return false
+	}
+	if r.query != nil && !r.query.MatchString(u.RawQuery) {
+		return false
+	}
+	return true
+}
+
+// matchDomain reports whether host, whose registered domain is site,
+// matches a domains entry:
+//
+//	example.org      example.org and every subdomain of it
+//	*.example.org    subdomains of example.org, not example.org itself
+//	facebook         any registered domain named facebook: facebook.com,
+//	                 m.facebook.com, facebook.co.uk, ...
+//	*                any host
+func matchDomain(entry, host, site string) bool {
+	switch {
+	case entry == "*":
+		return true
+	case strings.HasPrefix(entry, "*."):
+		return strings.HasSuffix(host, entry[1:])
+	case !strings.Contains(entry, "."):
+		return strings.SplitN(site, ".", 2)[0] == entry
+	}
+	return host == entry || strings.HasSuffix(host, "."+entry)
+}
+
+// registeredDomain returns the eTLD+1 of host, such as example.co.uk for
+// www.example.co.uk, or host itself for IPs and bare names.
+func registeredDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return site
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,82 @@
+package crawlkit
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gocolly/colly"
+)
+
+// Shutdown turns SIGINT/SIGTERM into a graceful stop. The first signal
+// cancels Context, which stops discovery and aborts downloads in flight so
+// the crawler can clean up, flush its logs and print its final stats. A
+// second signal exits immediately.
+type Shutdown struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewShutdown installs the signal handlers.
+func NewShutdown() *Shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Shutdown{ctx: ctx, cancel: cancel}
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, shutting down (send it again to exit immediately)", sig)
+		cancel()
+		sig = <-sigs
+		log.Printf("Received %v again, exiting", sig)
+		os.Exit(130)
+	}()
+	return s
+}
+
+// Context is cancelled when shutdown starts. Downloads should be made with it.
+func (s *Shutdown) Context() context.Context {
+	return s.ctx
+}
+
+// Done is closed when shutdown starts.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Stopping reports whether shutdown has started.
+func (s *Shutdown) Stopping() bool {
+	return s.ctx.Err() != nil
+}
+
+// Stop starts a shutdown without a signal.
+func (s *Shutdown) Stop() {
+	s.cancel()
+}
+
+// Attach makes c abort every request made after shutdown starts, so an async
+// collector's Wait returns once the pages in flight are done.
+func (s *Shutdown) Attach(c *colly.Collector) {
+	c.OnRequest(func(r *colly.Request) {
+		if s.Stopping() {
+			Abort(r)
+		}
+	})
+}
+
+// Sleep waits for d, returning false early if shutdown starts. It is meant
+// for retry backoffs.
+func (s *Shutdown) Sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,234 @@
+package crawlkit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sitemapMaxSize  = 50 * 1024 * 1024 // Uncompressed size limit from sitemaps.org
+	sitemapMaxDepth = 4                // How deep sitemap indexes may nest
+)
+
+// SitemapEntry is one <url> listed in a sitemap.
+type SitemapEntry struct {
+	Loc     string
+	LastMod time.Time // Zero when the sitemap gives none
+}
+
+// Sitemaps discovers a site's sitemaps from robots.txt and /sitemap.xml and
+// walks them, following sitemap indexes and gzipped files.
+type Sitemaps struct {
+	UserAgent string
+	Client    *http.Client
+	Scope     *Scope // Entries it rejects at depth 1 are skipped; nil keeps all
+
+	robots   *Robots // Caller's robots.txt cache; nil when robots.txt is ignored
+	discover *Robots // Where Sitemap: lines are read from
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// NewSitemaps returns a Sitemaps fetching with client. When robots is not nil,
+// entries it disallows are dropped and counted there; otherwise robots.txt is
+// still read, but only for its Sitemap: lines.
+func NewSitemaps(userAgent string, client *http.Client, robots *Robots) *Sitemaps {
+	if client == nil {
+		client = &http.Client{Timeout: robotsTimeout}
+	}
+	discover := robots
+	if discover == nil {
+		discover = NewRobots(userAgent, client)
+	}
+	return &Sitemaps{
+		UserAgent: userAgent,
+		Client:    client,
+		robots:    robots,
+		discover:  discover,
+		seen:      make(map[string]bool),
+	}
+}
+
+// HasExtension returns a document filter matching URLs whose path ends in one
+// of exts, ignoring case and any query string.
+func HasExtension(exts ...string) func(string) bool {
+	return func(link string) bool {
+		u, err := url.Parse(link)
+		if err != nil {
+			return false
+		}
+		ext := strings.ToLower(path.Ext(u.Path))
+		for _, e := range exts {
+			if ext == strings.ToLower(e) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Seed walks the sitemaps of every start URL's site. Entries outside Scope
+// are skipped; those accepted by isDocument are returned for the download
+// pipeline, and every other entry is passed to page, typically to be queued
+// for crawling.
+func (s *Sitemaps) Seed(startURLs []string, isDocument func(string) bool, page func(SitemapEntry)) []SitemapEntry {
+	var docs []SitemapEntry
+	for _, start := range startURLs {
+		var pages, found int
+		err := s.Walk(start, func(e SitemapEntry) {
+			if !s.Scope.Allows(e.Loc, 1) {
+				return
+			}
+			if isDocument(e.Loc) {
+				docs = append(docs, e)
+				found++
+				return
+			}
+			page(e)
+			pages++
+		})
+		if err != nil {
+			log.Printf("Error reading sitemaps for %s: %s", start, err)
+			continue
+		}
+		log.Printf("Sitemaps for %s: %d pages queued, %d documents found", start, pages, found)
+	}
+	return docs
+}
+
+// Walk calls fn for every URL listed in the sitemaps of site's host. Sitemaps
+// already walked by this Sitemaps are skipped.
+func (s *Sitemaps) Walk(site string, fn func(SitemapEntry)) error {
+	u, err := url.Parse(site)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	root := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+
+	sitemaps := append([]string{}, s.discover.Sitemaps(root)...)
+	sitemaps = append(sitemaps, root.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String())
+	for _, sm := range sitemaps {
+		if err := s.walk(sm, 0, fn); err != nil {
+			log.Printf("Skipping sitemap %s: %s", sm, err)
+		}
+	}
+	return nil
+}
+
+// sitemapDoc decodes both <urlset> and <sitemapindex> documents.
+type sitemapDoc struct {
+	XMLName  xml.Name
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+func (s *Sitemaps) walk(sitemapURL string, depth int, fn func(SitemapEntry)) error {
+	s.mu.Lock()
+	if s.seen[sitemapURL] {
+		s.mu.Unlock()
+		return nil
+	}
+	s.seen[sitemapURL] = true
+	s.mu.Unlock()
+
+	if depth > sitemapMaxDepth {
+		return fmt.Errorf("sitemap indexes nested deeper than %d", sitemapMaxDepth)
+	}
+
+	doc, err := s.fetch(sitemapURL)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range doc.Sitemaps {
+		loc := strings.TrimSpace(child.Loc)
+		if loc == "" {
+			continue
+		}
+		if err := s.walk(loc, depth+1, fn); err != nil {
+			log.Printf("Skipping sitemap %s: %s", loc, err)
+		}
+	}
+	for _, entry := range doc.URLs {
+		loc := strings.TrimSpace(entry.Loc)
+		u, err := url.Parse(loc)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if !s.robots.Check(u) {
+			continue
+		}
+		fn(SitemapEntry{Loc: loc, LastMod: parseLastMod(entry.LastMod)})
+	}
+	return nil
+}
+
+// fetch downloads and decodes one sitemap, unwrapping gzip by magic number
+// since servers label .xml.gz files inconsistently.
+func (s *Sitemaps) fetch(sitemapURL string) (*sitemapDoc, error) {
+	req, err := http.NewRequest("GET", sitemapURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserAgent != "" {
+		req.Header.Set("User-Agent", s.UserAgent)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var body io.Reader = bufio.NewReader(resp.Body)
+	if magic, _ := body.(*bufio.Reader).Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var doc sitemapDoc
+	if err := xml.NewDecoder(io.LimitReader(body, sitemapMaxSize)).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing sitemap: %w", err)
+	}
+	if doc.XMLName.Local != "urlset" && doc.XMLName.Local != "sitemapindex" {
+		return nil, fmt.Errorf("not a sitemap: <%s>", doc.XMLName.Local)
+	}
+	return &doc, nil
+}
+
+// parseLastMod reads the W3C datetime subsets allowed in <lastmod>.
+func parseLastMod(v string) time.Time {
+	v = strings.TrimSpace(v)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
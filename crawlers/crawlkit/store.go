@@ -0,0 +1,342 @@
+package crawlkit
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	defaultStoreDir = "docstore"
+	storeIndexFile  = "index.jsonl"
+	storeBlobDir    = "blobs"
+)
+
+// StoreRecord is one line of a Store's index: a URL, the content it served
+// and the validators it was served with, for asking whether it changed.
+type StoreRecord struct {
+	URL          string    `json:"url"`
+	Digest       string    `json:"blake2b"` // BLAKE2b-256, hex
+	Size         int64     `json:"size"`
+	Name         string    `json:"name"` // Path it was saved under, relative to the output directory
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"` // Also the MDTM of FTP files
+	Time         time.Time `json:"time"`
+}
+
+// Store keeps each downloaded document once, by the BLAKE2b-256 digest of
+// its content, under <dir>/blobs/<first 2 hex digits>/<digest>. The files
+// in the output directory are hard links to the blobs (symlinks, or copies
+// on file systems without links, such as exFAT), so the same PDF fetched
+// from a mirror or under another URL takes no extra space. The index,
+// <dir>/index.jsonl, maps every URL ever saved to its digest and
+// validators; a URL found again whose server says it has not changed is
+// linked from the store without downloading it. It is safe for concurrent
+// use; a nil Store stores nothing.
+type Store struct {
+	Dir string
+
+	mu      sync.Mutex
+	index   *os.File
+	urls    map[string]StoreRecord
+	sizes   map[string]int64 // Digest to size of the blobs in the store
+	pairs   map[storePair]bool
+	seen    int64 // Bytes of every distinct URL and digest pair in the index
+	run     storeCounts
+	loadErr int
+}
+
+// storePair is a URL and a digest it served. Re-linking the same document
+// for the same URL, run after run, adds lines to the index but saves
+// nothing, so SavedBytes counts each pair once.
+type storePair struct {
+	url, digest string
+}
+
+type storeCounts struct {
+	blobs, stored   int64 // New blobs and their bytes
+	dups, dupBytes  int64 // Downloads whose content was already stored
+	reused, reBytes int64 // URLs linked from the store without downloading
+}
+
+// OpenStore opens the store in dir, creating it if needed, and loads its
+// index. Damaged index lines, such as one torn by a crash, are skipped.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, storeBlobDir), 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		Dir:   dir,
+		urls:  make(map[string]StoreRecord),
+		sizes: make(map[string]int64),
+		pairs: make(map[storePair]bool),
+	}
+	path := filepath.Join(dir, storeIndexFile)
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec StoreRecord
+			if json.Unmarshal(scanner.Bytes(), &rec) != nil || rec.Digest == "" {
+				s.loadErr++
+				continue
+			}
+			s.urls[rec.URL] = rec
+			s.sizes[rec.Digest] = rec.Size
+			s.sight(rec)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s.loadErr > 0 {
+		log.Printf("Document store %s: skipped %d damaged index lines", dir, s.loadErr)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.index = f
+	return s, nil
+}
+
+// OpenStore opens the document store of store_dir (default "docstore"),
+// or returns nil when no_store is set.
+func (c *Config) OpenStore() (*Store, error) {
+	if c.NoStore {
+		return nil, nil
+	}
+	dir := c.StoreDir
+	if dir == "" {
+		dir = defaultStoreDir
+	}
+	return OpenStore(dir)
+}
+
+// blobPath returns where the blob with digest is kept.
+func (s *Store) blobPath(digest string) string {
+	return filepath.Join(s.Dir, storeBlobDir, digest[:2], digest)
+}
+
+// Lookup returns the last record of link when its blob is still in the
+// store.
+func (s *Store) Lookup(link string) (StoreRecord, bool) {
+	if s == nil {
+		return StoreRecord{}, false
+	}
+	s.mu.Lock()
+	rec, ok := s.urls[link]
+	s.mu.Unlock()
+	if !ok {
+		return StoreRecord{}, false
+	}
+	if _, err := os.Stat(s.blobPath(rec.Digest)); err != nil {
+		return StoreRecord{}, false
+	}
+	return rec, true
+}
+
+// put moves file into the store as the blob of digest and returns the
+// blob's path. When the blob is already there, file is removed instead and
+// dup is true.
+func (s *Store) put(digest, file string) (blob string, dup bool, err error) {
+	blob = s.blobPath(digest)
+	st, err := os.Stat(file)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(blob); err == nil {
+		os.Remove(file)
+		s.run.dups++
+		s.run.dupBytes += st.Size()
+		return blob, true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return "", false, err
+	}
+	if err := os.Rename(file, blob); err != nil {
+		return "", false, err
+	}
+	os.Chmod(blob, 0444) // Blobs are shared by every link; keep them from being edited in place
+	s.sizes[digest] = st.Size()
+	s.run.blobs++
+	s.run.stored += st.Size()
+	return blob, false, nil
+}
+
+// record appends rec to the index.
+func (s *Store) record(rec StoreRecord, reused bool) error {
+	rec.Time = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.urls[rec.URL] = rec
+	s.sight(rec)
+	if reused {
+		s.run.reused++
+		s.run.reBytes += rec.Size
+	}
+	_, err = s.index.Write(append(line, '\n'))
+	return err
+}
+
+// sight counts rec's bytes towards SavedBytes unless its URL has already
+// been recorded with the same digest. The caller holds mu, or is OpenStore.
+func (s *Store) sight(rec StoreRecord) {
+	pair := storePair{rec.URL, rec.Digest}
+	if !s.pairs[pair] {
+		s.pairs[pair] = true
+		s.seen += rec.Size
+	}
+}
+
+// StoreStats are a Store's totals.
+type StoreStats struct {
+	Blobs       int   // Distinct documents stored
+	StoredBytes int64 // Bytes they take
+	SavedBytes  int64 // Bytes of every saved URL beyond those, i.e. what dedup saved
+
+	RunBlobs      int64 // New blobs in this run
+	RunDuplicates int64 // Downloads in this run whose content was already stored
+	RunReused     int64 // URLs linked from the store in this run without downloading
+	RunSavedBytes int64 // Bytes the last two saved
+}
+
+// Stats returns the store's totals across runs and for this run.
+func (s *Store) Stats() StoreStats {
+	if s == nil {
+		return StoreStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := StoreStats{
+		Blobs:         len(s.sizes),
+		RunBlobs:      s.run.blobs,
+		RunDuplicates: s.run.dups,
+		RunReused:     s.run.reused,
+		RunSavedBytes: s.run.dupBytes + s.run.reBytes,
+	}
+	for _, size := range s.sizes {
+		st.StoredBytes += size
+	}
+	if st.SavedBytes = s.seen - st.StoredBytes; st.SavedBytes < 0 {
+		st.SavedBytes = 0
+	}
+	return st
+}
+
+// Summary describes the store for a crawler's final report.
+func (s *Store) Summary() string {
+	if s == nil {
+		return "disabled"
+	}
+	st := s.Stats()
+	return fmt.Sprintf("%d documents in %s, dedup saved %s in all; this run %d new, %d duplicate downloads, %d reused without downloading, saved %s",
+		st.Blobs, formatBytes(st.StoredBytes), formatBytes(st.SavedBytes),
+		st.RunBlobs, st.RunDuplicates, st.RunReused, formatBytes(st.RunSavedBytes))
+}
+
+// Close closes the index.
+func (s *Store) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.Close()
+}
+
+// linkBlob makes target a link to blob: a hard link, else a symlink, else
+// a copy.
+func linkBlob(blob, target string) error {
+	if err := os.Link(blob, target); err == nil {
+		return nil
+	}
+	if abs, err := filepath.Abs(blob); err == nil {
+		if err := os.Symlink(abs, target); err == nil {
+			return nil
+		}
+	}
+	src, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(target)
+		return err
+	}
+	return dst.Close()
+}
+
+// newContentHash returns the hash a Store files content under.
+func newContentHash() hash.Hash {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err) // Only fails for keys longer than 64 bytes
+	}
+	return h
+}
+
+// hashPrefix feeds the first n bytes of file to h, so that a resumed
+// download's digests cover what earlier attempts wrote.
+func hashPrefix(h io.Writer, file string, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, err := io.Copy(h, io.LimitReader(f, n))
+	if err == nil && m != n {
+		err = errors.New("partial file shorter than expected")
+	}
+	return err
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// formatBytes renders n in binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
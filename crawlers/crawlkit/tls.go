@@ -0,0 +1,311 @@
+package crawlkit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoServerName fails the certificates of hosts reached by IP address on
+// connections the policy did not dial (see Apply): no name went out in the
+// handshake, so there is none to check them for.
+var errNoServerName = errors.New("tls: no server name to check the certificate for")
+
+// TLSPolicy controls certificate checking for every transport a crawler
+// builds. Certificates are checked against the system roots and the
+// certificates in CAFile, except for hosts matching an InsecureHosts entry
+// (see matchDomain); InsecureSkipVerify stops checking for every host.
+// Load reads CAFile, and every check is counted in the policy's Report.
+type TLSPolicy struct {
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"` // for testing only
+	CAFile             string   `yaml:"ca_file" toml:"ca_file"`                           // PEM bundle trusted besides the system roots
+	InsecureHosts      []string `yaml:"insecure_hosts" toml:"insecure_hosts"`             // hosts whose certificates are not checked
+
+	roots  *x509.CertPool // nil for the system roots
+	report *TLSReport
+}
+
+// prepare reads CAFile and starts the report.
+func (p *TLSPolicy) prepare() error {
+	p.report = &TLSReport{failed: make(map[string]*tlsFailure)}
+	if p.CAFile == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(p.CAFile)
+	if err != nil {
+		return fmt.Errorf("reading CA bundle: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("CA bundle %s: no PEM certificates in it", p.CAFile)
+	}
+	p.roots = roots
+	return nil
+}
+
+// ClientConfig returns a tls.Config implementing the policy. Go's own check
+// is turned off for VerifyConnection to do the same one, so that it can
+// skip the insecure hosts and record why a certificate failed. It checks
+// certificates for the name sent in the handshake, which a host reached by
+// IP address does not send; transports should dial through Apply, and QUIC
+// through ConfigFor, to check those too.
+func (p TLSPolicy) ClientConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: true, VerifyConnection: p.verify}
+}
+
+// ConfigFor returns a copy of base (ClientConfig when nil) that checks
+// certificates for the host of addr, a "host:port" dial address, IP
+// addresses included.
+func (p TLSPolicy) ConfigFor(addr string, base *tls.Config) *tls.Config {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if base == nil {
+		base = p.ClientConfig()
+	}
+	cfg := base.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		return p.check(host, cs)
+	}
+	return cfg
+}
+
+// Apply has t do its own TLS handshakes, dialling with its DialContext or
+// Dial, so that each connection is checked for the host it was made to, IP
+// addresses included. t keeps its TLSClientConfig (ClientConfig when nil)
+// and its NextProtos; HTTPS requests through a proxy are handshaken by
+// net/http with that config. It returns t.
+func (p TLSPolicy) Apply(t *http.Transport) *http.Transport {
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = p.ClientConfig()
+	}
+	base := t.TLSClientConfig.Clone()
+	if len(base.NextProtos) == 0 {
+		base.NextProtos = []string{"http/1.1"}
+		if t.ForceAttemptHTTP2 {
+			base.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	dial := t.DialContext
+	if dial == nil && t.Dial != nil {
+		dialNoCtx := t.Dial
+		dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return dialNoCtx(network, addr)
+		}
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	timeout := t.TLSHandshakeTimeout
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		tc := tls.Client(conn, p.ConfigFor(addr, base))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return t
+}
+
+// Transport returns a clone of http.DefaultTransport using the policy.
+func (p TLSPolicy) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = p.ClientConfig()
+	return p.Apply(t)
+}
+
+// Report returns the record of the policy's checks, nil before Load.
+func (p TLSPolicy) Report() *TLSReport {
+	return p.report
+}
+
+func (p TLSPolicy) verify(cs tls.ConnectionState) error {
+	return p.check(cs.ServerName, cs)
+}
+
+// check checks the certificates of cs for name, a host name or IP address;
+// "" fails them with errNoServerName.
+func (p TLSPolicy) check(name string, cs tls.ConnectionState) error {
+	host := normalizeHost(name)
+	if p.InsecureSkipVerify || (host != "" && p.insecure(host)) {
+		p.report.skip()
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	err := errNoServerName
+	if host != "" {
+		opts := x509.VerifyOptions{Roots: p.roots, DNSName: host, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = leaf.Verify(opts)
+	}
+	if err != nil {
+		certErr := &CertError{Host: host, Issuer: leaf.Issuer.String(), NotAfter: leaf.NotAfter, SANs: certNames(leaf), Err: err}
+		p.report.fail(certErr)
+		return certErr
+	}
+	p.report.pass()
+	return nil
+}
+
+// insecure reports whether host matches an InsecureHosts entry.
+func (p TLSPolicy) insecure(host string) bool {
+	site := registeredDomain(host)
+	for _, entry := range p.InsecureHosts {
+		if matchDomain(normalizeHost(entry), host, site) {
+			return true
+		}
+	}
+	return false
+}
+
+// certNames returns the DNS names and IP addresses cert is valid for.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// CertError is a certificate that failed the check, with what it takes to
+// tell why: who issued it, until when it is valid and which names it is
+// for. It wraps the x509 error.
+type CertError struct {
+	Host     string    `json:"host"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	SANs     []string  `json:"sans,omitempty"`
+	Err      error     `json:"-"`
+}
+
+func (e *CertError) Error() string {
+	host := e.Host
+	if host == "" {
+		host = "an IP address"
+	}
+	return fmt.Sprintf("certificate of %s (issuer %s, valid until %s, SANs %s): %v",
+		host, e.Issuer, e.NotAfter.Format(time.DateOnly), strings.Join(e.SANs, ", "), e.Err)
+}
+
+func (e *CertError) Unwrap() error { return e.Err }
+
+// TLSReport counts the connections whose certificates a TLSPolicy checked,
+// and keeps the first failure of each host, for a crawler's final report.
+// It is safe for concurrent use; a nil TLSReport records nothing.
+type TLSReport struct {
+	mu       sync.Mutex
+	verified int64
+	skipped  int64                  // Not checked: insecure hosts, or checking is off
+	failed   map[string]*tlsFailure // By host
+}
+
+type tlsFailure struct {
+	first *CertError
+	count int64
+}
+
+func (r *TLSReport) pass() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.verified++
+	r.mu.Unlock()
+}
+
+func (r *TLSReport) skip() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.skipped++
+	r.mu.Unlock()
+}
+
+func (r *TLSReport) fail(e *CertError) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.failed[e.Host]
+	if f == nil {
+		f = &tlsFailure{first: e}
+		r.failed[e.Host] = f
+	}
+	f.count++
+}
+
+// Failures returns the first failure of each host, by host.
+func (r *TLSReport) Failures() []*CertError {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failures := make([]*CertError, 0, len(r.failed))
+	for _, f := range r.failed {
+		failures = append(failures, f.first)
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Host < failures[j].Host })
+	return failures
+}
+
+// Summary counts the checks, and lists each host whose certificate failed
+// with the reason, for a crawler's final report.
+func (r *TLSReport) Summary() string {
+	if r == nil {
+		return "not recorded"
+	}
+	failures := r.Failures()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summary := fmt.Sprintf("%d connections verified, %d not checked", r.verified, r.skipped)
+	if len(failures) == 0 {
+		return summary + ", none failed"
+	}
+	var total int64
+	parts := make([]string, len(failures))
+	for i, e := range failures {
+		n := r.failed[e.Host].count
+		total += n
+		times := "once"
+		if n > 1 {
+			times = fmt.Sprintf("%d times", n)
+		}
+		parts[i] = fmt.Sprintf("%v (failed %s)", e, times)
+	}
+	return fmt.Sprintf("%s, %d failed on %d hosts: %s", summary, total, len(failures), strings.Join(parts, "; "))
+}
@@ -0,0 +1,515 @@
+package crawlkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWARCMaxMB = 1024
+	warcSpoolMemory  = 1 << 20 // Response bodies beyond this are spooled to a temp file
+	warcSoftware     = "crawlkit (github.com/danindiana/gpt_go)"
+	warcConformsTo   = "http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/"
+)
+
+// WARCWriter writes ISO 28500 WARC/1.1 files: a request, a response and a
+// metadata record for every exchange that goes through its Transport, each
+// record compressed as its own gzip member, as archive tools expect of
+// .warc.gz. Files are named <prefix>-<yyyymmddhhmmss>-<serial>.warc.gz and
+// a new one is started once a file passes MaxSize; each file begins with a
+// warcinfo record. It is safe for concurrent use; a nil WARCWriter writes
+// nothing.
+type WARCWriter struct {
+	Dir     string
+	Prefix  string
+	MaxSize int64 // Bytes, compressed
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64 // Bytes in file
+	serial   int
+	infoID   string // Record ID of file's warcinfo
+	records  int64
+	files    int
+	err      error // First write error
+	hostname string
+}
+
+// OpenWARC returns a WARCWriter for dir, creating it if needed. The first
+// file is created with the first record. maxSize <= 0 means 1 GiB.
+func OpenWARC(dir, prefix string, maxSize int64) (*WARCWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultWARCMaxMB << 20
+	}
+	if prefix == "" {
+		prefix = "crawl"
+	}
+	hostname, _ := os.Hostname()
+	return &WARCWriter{Dir: dir, Prefix: prefix, MaxSize: maxSize, hostname: hostname}, nil
+}
+
+// OpenWARC returns the WARCWriter configured by warc_dir and warc_max_mb,
+// or nil when warc_dir is empty. prefix names the files, usually after the
+// crawler.
+func (c *Config) OpenWARC(prefix string) (*WARCWriter, error) {
+	if c.WARCDir == "" {
+		return nil, nil
+	}
+	return OpenWARC(c.WARCDir, prefix, int64(c.WARCMaxMB)<<20)
+}
+
+// Transport wraps rt, or http.DefaultTransport when nil, so that every
+// exchange through it is archived: the request as sent, and the response
+// once its body has been read to the end or closed. A body cut short is
+// archived with WARC-Truncated. Redirects are separate exchanges, as they
+// are on the wire. Transfer and content codings are already undone by the
+// time the response is seen, so the headers written are those that match
+// the body.
+func (w *WARCWriter) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if w == nil {
+		return rt
+	}
+	return &warcTransport{w: w, rt: rt}
+}
+
+type warcTransport struct {
+	w  *WARCWriter
+	rt http.RoundTripper
+}
+
+func (t *warcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var remoteIP string
+	var mu sync.Mutex
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				mu.Lock()
+				remoteIP = hostOnly(addr.String())
+				mu.Unlock()
+			}
+		},
+	}
+	started := time.Now()
+	resp, err := t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	ip := remoteIP
+	mu.Unlock()
+
+	ex := &warcExchange{
+		w:       t.w,
+		req:     req,
+		resp:    resp,
+		ip:      ip,
+		date:    started.UTC(),
+		started: started,
+		body:    resp.Body,
+		payload: sha1.New(),
+		block:   sha1.New(),
+	}
+	ex.head = responseHead(resp)
+	ex.block.Write(ex.head)
+	resp.Body = ex
+	return resp, nil
+}
+
+// warcExchange is a response body being read, recorded as it goes.
+type warcExchange struct {
+	w       *WARCWriter
+	req     *http.Request
+	resp    *http.Response
+	ip      string
+	date    time.Time
+	started time.Time
+	head    []byte // Status line and headers
+
+	body    io.ReadCloser
+	mem     bytes.Buffer
+	spool   *os.File
+	n       int64
+	payload hash.Hash
+	block   hash.Hash
+	once    sync.Once
+}
+
+func (e *warcExchange) Read(p []byte) (int, error) {
+	n, err := e.body.Read(p)
+	if n > 0 {
+		e.keep(p[:n])
+	}
+	if err == io.EOF {
+		e.finish("")
+	} else if err != nil {
+		e.finish("disconnect")
+	}
+	return n, err
+}
+
+func (e *warcExchange) Close() error {
+	if e.resp.ContentLength >= 0 && e.n == e.resp.ContentLength {
+		e.finish("") // Read to its length without waiting for EOF
+	} else {
+		e.finish("unspecified") // Only if the body was not read to the end
+	}
+	return e.body.Close()
+}
+
+// keep appends body bytes to memory, moving to a spool file once they
+// outgrow warcSpoolMemory.
+func (e *warcExchange) keep(p []byte) {
+	e.n += int64(len(p))
+	e.payload.Write(p)
+	e.block.Write(p)
+	if e.spool == nil && e.mem.Len()+len(p) > warcSpoolMemory {
+		f, err := os.CreateTemp(e.w.Dir, ".spool-*")
+		if err == nil {
+			os.Remove(f.Name()) // Gone once closed
+			f.Write(e.mem.Bytes())
+			e.mem = bytes.Buffer{}
+			e.spool = f
+		}
+	}
+	if e.spool != nil {
+		e.spool.Write(p)
+	} else {
+		e.mem.Write(p)
+	}
+}
+
+// finish writes the exchange's records once; truncated is the
+// WARC-Truncated reason, "" for a complete body.
+func (e *warcExchange) finish(truncated string) {
+	e.once.Do(func() {
+		var body io.Reader = &e.mem
+		if e.spool != nil {
+			defer e.spool.Close()
+			if _, err := e.spool.Seek(0, io.SeekStart); err != nil {
+				e.w.mu.Lock()
+				e.w.fail(err)
+				e.w.mu.Unlock()
+				return
+			}
+			body = e.spool
+		}
+		e.w.writeExchange(e, body, truncated)
+	})
+}
+
+// writeExchange writes the response, request and metadata records of e
+// into one file.
+func (w *WARCWriter) writeExchange(e *warcExchange, body io.Reader, truncated string) {
+	uri := e.req.URL.String()
+	respID := newRecordID()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(); err != nil {
+		w.fail(err)
+		return
+	}
+
+	resp := warcHeader{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", respID},
+		{"WARC-Date", warcDate(e.date)},
+		{"WARC-Target-URI", uri},
+		{"WARC-Warcinfo-ID", w.infoID},
+	}
+	if e.ip != "" {
+		resp = append(resp, [2]string{"WARC-IP-Address", e.ip})
+	}
+	resp = append(resp,
+		[2]string{"WARC-Block-Digest", sha1Label(e.block)},
+		[2]string{"WARC-Payload-Digest", sha1Label(e.payload)},
+	)
+	if truncated != "" {
+		resp = append(resp, [2]string{"WARC-Truncated", truncated})
+	}
+	resp = append(resp, [2]string{"Content-Type", "application/http;msgtype=response"})
+	if err := w.writeRecord(resp, int64(len(e.head))+e.n, io.MultiReader(bytes.NewReader(e.head), body)); err != nil {
+		w.fail(err)
+		return
+	}
+
+	reqBlock := requestHead(e.req)
+	req := warcHeader{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(e.date)},
+		{"WARC-Target-URI", uri},
+		{"WARC-Warcinfo-ID", w.infoID},
+		{"WARC-Concurrent-To", respID},
+	}
+	if e.ip != "" {
+		req = append(req, [2]string{"WARC-IP-Address", e.ip})
+	}
+	req = append(req,
+		[2]string{"WARC-Block-Digest", sha1Of(reqBlock)},
+		[2]string{"Content-Type", "application/http;msgtype=request"},
+	)
+	if err := w.writeRecord(req, int64(len(reqBlock)), bytes.NewReader(reqBlock)); err != nil {
+		w.fail(err)
+		return
+	}
+
+	fields := []string{"fetchTimeMs: " + strconv.FormatInt(time.Since(e.started).Milliseconds(), 10)}
+	if via := e.req.Header.Get("Referer"); via != "" {
+		fields = append(fields, "via: "+via)
+	}
+	if !strings.HasPrefix(e.resp.Proto, "HTTP/1.") && e.resp.Proto != "" {
+		fields = append(fields, "protocol: "+e.resp.Proto) // The response record says HTTP/1.1
+	}
+	meta := []byte(strings.Join(fields, "\r\n") + "\r\n")
+	if err := w.writeRecord(warcHeader{
+		{"WARC-Type", "metadata"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(e.date)},
+		{"WARC-Target-URI", uri},
+		{"WARC-Warcinfo-ID", w.infoID},
+		{"WARC-Concurrent-To", respID},
+		{"WARC-Block-Digest", sha1Of(meta)},
+		{"Content-Type", "application/warc-fields"},
+	}, int64(len(meta)), bytes.NewReader(meta)); err != nil {
+		w.fail(err)
+	}
+}
+
+// WriteMetadata writes a metadata record about uri, such as a crawl's
+// final report.
+func (w *WARCWriter) WriteMetadata(uri, contentType string, block []byte) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.rotate(); err != nil {
+		w.fail(err)
+		return err
+	}
+	err := w.writeRecord(warcHeader{
+		{"WARC-Type", "metadata"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Target-URI", uri},
+		{"WARC-Warcinfo-ID", w.infoID},
+		{"WARC-Block-Digest", sha1Of(block)},
+		{"Content-Type", contentType},
+	}, int64(len(block)), bytes.NewReader(block))
+	if err != nil {
+		w.fail(err)
+	}
+	return err
+}
+
+// rotate starts a new file when there is none or the current one is full.
+func (w *WARCWriter) rotate() error {
+	if w.file != nil && w.size < w.MaxSize {
+		return nil
+	}
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.Prefix, time.Now().UTC().Format("20060102150405"), w.serial)
+	f, err := os.OpenFile(filepath.Join(w.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	w.serial++
+	w.files++
+	w.file, w.size = f, 0
+
+	w.infoID = newRecordID()
+	info := []byte(strings.Join([]string{
+		"software: " + warcSoftware,
+		"format: WARC File Format 1.1",
+		"conformsTo: " + warcConformsTo,
+		"hostname: " + w.hostname,
+		"isPartOf: " + w.Prefix,
+	}, "\r\n") + "\r\n")
+	return w.writeRecord(warcHeader{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", w.infoID},
+		{"WARC-Date", warcDate(time.Now())},
+		{"WARC-Filename", name},
+		{"WARC-Block-Digest", sha1Of(info)},
+		{"Content-Type", "application/warc-fields"},
+	}, int64(len(info)), bytes.NewReader(info))
+}
+
+// warcHeader is a record's named fields, in order.
+type warcHeader [][2]string
+
+// writeRecord writes one record as its own gzip member.
+func (w *WARCWriter) writeRecord(h warcHeader, length int64, block io.Reader) error {
+	cw := &countingWriter{w: w.file}
+	gz := gzip.NewWriter(cw)
+	var head strings.Builder
+	head.WriteString("WARC/1.1\r\n")
+	for _, f := range h {
+		head.WriteString(f[0] + ": " + f[1] + "\r\n")
+	}
+	head.WriteString("Content-Length: " + strconv.FormatInt(length, 10) + "\r\n\r\n")
+	_, err := io.WriteString(gz, head.String())
+	if err == nil {
+		_, err = io.CopyN(gz, block, length)
+	}
+	if err == nil {
+		_, err = io.WriteString(gz, "\r\n\r\n")
+	}
+	if cerr := gz.Close(); err == nil {
+		err = cerr
+	}
+	w.size += cw.n
+	w.records++
+	return err
+}
+
+// fail remembers the first write error and logs it; the crawl goes on. w.mu
+// is held.
+func (w *WARCWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+		log.Printf("Error writing WARC in %s: %s", w.Dir, err)
+	}
+}
+
+// Summary describes what was written, for a crawler's final report.
+func (w *WARCWriter) Summary() string {
+	if w == nil {
+		return "disabled"
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return fmt.Sprintf("%d records in %d files in %s", w.records, w.files, w.Dir)
+}
+
+// Close closes the current file and returns the first write error.
+// Exchanges still being read are lost.
+func (w *WARCWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		if err := w.file.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+		w.file = nil
+		w.size = w.MaxSize // Any late record starts a new file
+	}
+	return w.err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// responseHead renders the status line and headers of resp. The status
+// line always says HTTP/1.1, which archive tools read for any protocol.
+func responseHead(resp *http.Response) []byte {
+	var b bytes.Buffer
+	status := resp.Status
+	if status == "" {
+		status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+	b.WriteString("HTTP/1.1 " + status + "\r\n")
+	writeSortedHeader(&b, resp.Header)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// requestHead renders the request line and headers of req. Bodies are not
+// recorded; the crawlers only send GET and HEAD.
+func requestHead(req *http.Request) []byte {
+	var b bytes.Buffer
+	b.WriteString(req.Method + " " + req.URL.RequestURI() + " HTTP/1.1\r\n")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	b.WriteString("Host: " + host + "\r\n")
+	writeSortedHeader(&b, req.Header)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+func writeSortedHeader(b *bytes.Buffer, h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			b.WriteString(k + ": " + strings.NewReplacer("\r", " ", "\n", " ").Replace(v) + "\r\n")
+		}
+	}
+}
+
+// newRecordID returns a random urn:uuid record ID.
+func newRecordID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // Version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+func sha1Label(h hash.Hash) string {
+	return "sha1:" + base32.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func sha1Of(b []byte) string {
+	h := sha1.New()
+	h.Write(b)
+	return sha1Label(h)
+}
+
+// hostOnly strips the port from a host:port address.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
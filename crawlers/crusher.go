@@ -1,50 +1,109 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"net/url"
 	"os"
 	"strings"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
-	"github.com/willf/bloom"
 )
 
-const (
-	filterSize = 100000 // The size of the Bloom filter
-)
+// canon turns URLs into dedup keys; main applies the url_rules config
+var canon = crawlkit.DefaultCanonicalizer
 
 func main() {
-	// Initialize the Bloom filter
-	filter := bloom.New(filterSize, 5)
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{})
+	if err != nil {
+		fmt.Println("Error loading configuration:", err)
+		return
+	}
+	canon = cfg.Canonicalizer()
+
+	// Load the Bloom filter from the last run, or size a new one from
+	// -expected-urls and -bloom-fp
+	filter, err := cfg.LoadBloom()
+	if err != nil {
+		fmt.Println("Error loading Bloom filter:", err)
+		return
+	}
+
+	// Archive every page exchange as WARC/1.1 when -warc is set
+	archive, err := cfg.OpenWARC("crusher")
+	if err != nil {
+		fmt.Println("Error opening WARC output:", err)
+		return
+	}
+
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget := cfg.Budget()
+
+	// Requests go through the -proxy pool, or the proxy of the scope rule
+	// they match
+	proxies, err := cfg.Proxies()
+	if err != nil {
+		fmt.Println("Error setting up proxies:", err)
+		return
+	}
 
 	// Create a new collector
-	c := colly.NewCollector()
-
-	// On every a element which has href attribute call callback
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-		// Preprocess the URL to handle variations
-		link = preprocessURL(link)
-		if link == "" {
-			return
-		}
+	c := colly.NewCollector(colly.MaxDepth(cfg.MaxDepth))
+	c.WithTransport(budget.Transport(archive.Transport(proxies.Transport(cfg.TLS.Transport()))))
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
+	}
+
+	// Ctrl+C stops new requests so the filter is still saved; a second
+	// Ctrl+C exits at once
+	shutdown := crawlkit.NewShutdown()
+	shutdown.Attach(c)
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
 
-		// Check if the URL is already visited
-		if !filter.TestAndAdd([]byte(link)) {
-			fmt.Printf("Visiting: %s\n", link)
-			// Visit the link
-			e.Request.Visit(link)
+	// Space requests to each host and slow down for hosts that answer
+	// 429/503 or reset connections
+	polite := cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+
+	// Links are followed only where the scope rules (excluded_domains,
+	// scope_file) allow; the scope is built once the start URL is known
+	var scope *crawlkit.Scope
+
+	// On every page, follow the links in anchors, frames, embeds, refreshes, srcset and scripts
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+		for _, found := range crawlkit.ExtractLinks(e) {
+			// Preprocess the URL to handle variations
+			link := preprocessURL(found.URL)
+			if link == "" || !found.Page() || !scope.Allows(link, e.Request.Depth+1) {
+				continue
+			}
+
+			// Check if the URL is already visited
+			if !filter.TestAndAdd([]byte(link)) {
+				fmt.Printf("Visiting: %s (from %s)\n", link, found.Source)
+				// Visit the link
+				e.Request.Visit(link)
+			}
 		}
 	})
 
-	// Read the starting URL from the user
-	fmt.Print("Enter the starting URL: ")
-	reader := bufio.NewReader(os.Stdin)
-	startURL, _ := reader.ReadString('\n')
-	startURL = strings.TrimSpace(startURL)
-	startURL = preprocessURL(startURL)
+	// Take the starting URL from -url, or ask for it on a terminal
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		fmt.Println("Error reading starting URL:", err)
+		return
+	}
+	startURL := preprocessURL(startURLs[0])
+	scope, err = cfg.Scope([]string{startURL})
+	if err != nil {
+		fmt.Println("Error loading crawl scope:", err)
+		return
+	}
+	proxies.Route(scope) // Scope rules may name their own proxy
 
 	// Start the crawler
 	fmt.Printf("Starting crawl at: %s\n", startURL)
@@ -52,31 +111,31 @@ func main() {
 
 	// Wait until the crawling is finished
 	c.Wait()
-}
 
-// preprocessURL preprocesses the input URL to handle variations
-func preprocessURL(inputURL string) string {
-	parsedURL, err := url.Parse(inputURL)
-	if err != nil {
-		return ""
+	fmt.Printf("Bloom filter: %d URLs in %d stage(s), estimated FP rate %.4g\n",
+		filter.Count(), filter.Stages(), filter.EstimatedFPRate())
+	fmt.Printf("Out of scope: %s\n", scope.Summary())
+	fmt.Printf("Budget: %s\n", budget.Summary())
+	fmt.Printf("Proxies: %s\n", proxies.Summary())
+	fmt.Printf("TLS: %s\n", cfg.TLS.Report().Summary())
+	fmt.Printf("Politeness: %s\n", polite.Summary(10))
+	if err := archive.Close(); err != nil {
+		fmt.Println("Error closing WARC output:", err)
 	}
+	fmt.Printf("WARC archive: %s\n", archive.Summary())
 
-	// If the scheme is missing, assume http
-	if parsedURL.Scheme == "" {
-		parsedURL.Scheme = "http"
+	// Keep the filter so the next run skips these URLs
+	if err := filter.Save(cfg.BloomFile); err != nil {
+		fmt.Println("Error saving Bloom filter:", err)
 	}
+}
 
-	// If the host is missing, the URL is invalid
-	if parsedURL.Host == "" {
+// preprocessURL returns the canonical form of an http(s) URL, which is also
+// its dedup key, or "" if the URL cannot be crawled
+func preprocessURL(inputURL string) string {
+	key, err := canon.Canonicalize(inputURL)
+	if err != nil || !(strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")) {
 		return ""
 	}
-
-	// Normalize the URL by converting it to lowercase and removing www. if present
-	hostname := strings.ToLower(parsedURL.Hostname())
-	if strings.HasPrefix(hostname, "www.") {
-		hostname = strings.TrimPrefix(hostname, "www.")
-	}
-	parsedURL.Host = hostname
-
-	return parsedURL.String()
+	return key
 }
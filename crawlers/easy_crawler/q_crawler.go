@@ -4,14 +4,13 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/queue"
 	"golang.org/x/time/rate"
@@ -20,7 +19,7 @@ import (
 // Configuration holds the settings for the crawler
 type Configuration struct {
 	StartingURL     string
-	FileType        string
+	FileType        string // Comma-separated document sets, e.g. "pdf,epub,csv"
 	RateLimit       float64
 	ExcludedDomains []string
 	MaxDepth        int
@@ -31,6 +30,9 @@ var (
 	visitedURLsMap = make(map[string]bool)
 	mapMutex       = &sync.Mutex{}
 	config         Configuration
+	polite         *crawlkit.Politeness // Per-host rate limits, shared with downloads
+	classifier     *crawlkit.Classifier // Decides which links are documents, and of which set
+	scope          *crawlkit.Scope      // Skips the excluded domains and their subdomains
 )
 
 func main() {
@@ -47,8 +49,28 @@ func main() {
 	// Get user input
 	getUserInput()
 
-	// Initialize rate limiter
-	limiter := rate.NewLimiter(rate.Limit(config.RateLimit), 1)
+	// Initialize the per-host scheduler: each host gets its own token bucket
+	// and is slowed down when it answers 429/503
+	polite = crawlkit.NewPoliteness(rate.Limit(config.RateLimit), 1)
+
+	// Each requested document set is recognised by its MIME types and saved
+	// to a subfolder of the same name
+	sets, err := crawlkit.NamedDocSets(strings.Split(config.FileType, ",")...)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	classifier = crawlkit.NewClassifier("", &http.Client{Transport: polite.Transport(nil)}, sets)
+
+	// A dotless entry such as "facebook" matches that registered domain under
+	// any suffix (facebook.com, m.facebook.com, facebook.co.uk)
+	scope, err = crawlkit.NewScope("", []crawlkit.ScopeRule{
+		{Name: "excluded_domains", Action: "deny", Domains: config.ExcludedDomains},
+	}, nil)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
 	// Initialize the collector
 	c := colly.NewCollector(
@@ -59,16 +81,13 @@ func main() {
 	q, _ := queue.New(15, &queue.InMemoryQueueStorage{MaxSize: 10000})
 
 	// Set up the request handler
+	polite.Attach(c)
 	c.OnRequest(func(r *colly.Request) {
-		limiter.Wait(context.Background())
 		fmt.Println("Visiting", r.URL.String())
 	})
 
-	// Set up the HTML link handler
-	c.OnHTML("a[href]", handleLink(q, c))
-
-	// Set up the file download handler
-	c.OnHTML(fmt.Sprintf("a[href$='.%s']", config.FileType), handleFileDownload)
+	// Set up the HTML link handler, which also downloads the documents
+	c.OnHTML(crawlkit.LinkSelector, handleLink(q, c))
 
 	// Start crawling from the starting URL with initial depth 1
 	ctx := colly.NewContext()
@@ -82,6 +101,8 @@ func main() {
 	// Wait for the collector to finish
 	c.Wait()
 	fmt.Println("Crawling finished.")
+	fmt.Println("Per-host rate limits:", polite.Summary(10))
+	fmt.Println("Out of scope:", scope.Summary())
 }
 
 // getUserInput prompts the user for input and sets the configuration values
@@ -89,61 +110,57 @@ func getUserInput() {
 	fmt.Println("Enter the starting URL to crawl: ")
 	fmt.Scanln(&config.StartingURL)
 
-	fmt.Println("Enter the type of file to download (options: txt, html, pdf): ")
+	fmt.Println("Enter the types of file to download, comma-separated (e.g. pdf,epub,docx,csv,zip,txt): ")
 	fmt.Scanln(&config.FileType)
 
-	fmt.Println("Enter the rate limit (requests per second): ")
+	fmt.Println("Enter the rate limit per host (requests per second): ")
 	fmt.Scanln(&config.RateLimit)
 }
 
-// handleLink processes discovered links and adds them to the queue if they have not been visited
+// handleLink downloads the documents a page links to, and adds its other links to the queue if they have not been visited
 func handleLink(q *queue.Queue, c *colly.Collector) func(*colly.HTMLElement) {
 	return func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-		u, err := url.Parse(link)
+		// Get the depth from the request context
+		depthStr := e.Request.Ctx.Get("depth")
+		depth, err := strconv.Atoi(depthStr)
 		if err != nil {
 			return
 		}
 
-		for _, domain := range config.ExcludedDomains {
-			if strings.Contains(u.Host, domain) {
-				return
+		for _, link := range crawlkit.ExtractLinks(e) {
+			if !scope.Allows(link.URL, depth+1) {
+				continue
 			}
-		}
-
-		absoluteURL := e.Request.AbsoluteURL(link)
-		if !hasVisited(absoluteURL) {
-			// Get the depth from the request context
-			depthStr := e.Request.Ctx.Get("depth")
-			depth, err := strconv.Atoi(depthStr)
-			if err != nil {
-				return
+			// Documents are downloaded wherever they were found; other links
+			// are pages to follow only when Link.Page says so
+			if classifier.IsDocument(link.URL) {
+				fmt.Println("Found file to download:", link.URL, "from:", link.Source)
+				if err := downloadFile(link.URL); err != nil {
+					fmt.Printf("Error downloading file: %s\n", err)
+				}
+				continue
+			}
+			if !link.Page() {
+				continue
+			}
+			if hasVisited(link.URL) {
+				continue
 			}
 
 			// Check if the depth is within the allowed limit
 			if depth < config.MaxDepth {
 				newDepth := depth + 1
-				ctx := colly.NewContext()
+				ctx := crawlkit.LinkContext(link.Source)
 				ctx.Put("depth", strconv.Itoa(newDepth))
 
-				fmt.Println("Found new URL:", absoluteURL, "at depth:", newDepth)
-				saveVisitedURL(absoluteURL, config.VisitedFile)
-				c.Request("GET", absoluteURL, nil, ctx, nil)
+				fmt.Println("Found new URL:", link.URL, "at depth:", newDepth, "from:", link.Source)
+				saveVisitedURL(link.URL, config.VisitedFile)
+				c.Request("GET", link.URL, nil, ctx, nil)
 			}
 		}
 	}
 }
 
-// handleFileDownload processes and downloads the file
-func handleFileDownload(e *colly.HTMLElement) {
-	fileURL := e.Request.AbsoluteURL(e.Attr("href"))
-	fmt.Println("Found file to download:", fileURL)
-	err := downloadFile(fileURL)
-	if err != nil {
-		fmt.Printf("Error downloading file: %s\n", err)
-	}
-}
-
 // loadVisitedURLs loads visited URLs from the specified file into a map
 func loadVisitedURLs(filePath string) {
 	file, err := os.Open(filePath)
@@ -191,21 +208,14 @@ func saveVisitedURL(url, filePath string) {
 
 // downloadFile downloads a file from the specified URL
 func downloadFile(URL string) error {
-	resp, err := http.Get(URL)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	segments := strings.Split(URL, "/")
-	filePath := segments[len(segments)-1]
-
-	out, err := os.Create(filePath)
+	client := &http.Client{Transport: polite.Transport(nil)}
+	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	// The file streams into a .part file and is renamed once complete; a
+	// failed download is resumed with Range/If-Range the next time
+	_, _, err = crawlkit.DownloadFile(context.Background(), client, req, classifier.Dir(".", URL), nil, nil)
 	return err
 }
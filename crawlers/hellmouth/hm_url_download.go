@@ -1,9 +1,10 @@
 package main
 
 import (
-	"context"
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -17,26 +18,19 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/extensions"
-	"golang.org/x/time/rate"
 )
 
 // MULTI-NIC BEAST MODE CONFIGURATION
 const (
-	maxDepth          = 13                     // Max crawl depth
-	requestTimeout    = 60 * time.Second       // Longer timeout for large files
-	concurrentWorkers = 256                    // 8x your core count for crawling
-	politeDelay       = 10 * time.Millisecond  // INSANELY aggressive crawling
-	userAgent         = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0 Safari/537.36"
-	
 	// MULTI-NIC download configuration
-	initialDownloadWorkers = 1000              // Start with 1000 workers!
 	maxDownloadWorkers     = 8000              // Scale up to 8000 concurrent downloads!
 	queueGrowthThreshold   = 0.4               // Scale at 40% full
 	scaleCheckInterval     = 500 * time.Millisecond // Check twice per second
 	scaleUpAmount          = 300               // Add 300 workers at a time
-	maxQueueSize           = 5000000           // 5 MILLION item queue!
+	maxQueueSize           = 5000000           // Frontier size treated as "full" when scaling workers
 	
 	// Multi-NIC network beast mode
 	maxConnectionsTotal    = 20000             // 20K total connections across all NICs
@@ -52,6 +46,22 @@ const (
 	// Memory settings for your beast
 	targetMemoryUsageGB    = 100               // Use up to 100GB of your 128GB
 	gcTargetPercent        = 500               // Even less frequent GC
+	
+	// Checkpointing for -resume
+	checkpointInterval     = 30 * time.Second  // Save crawl state twice a minute
+	checkpointFile         = "checkpoint.json" // Written into the run directory
+	checkpointVersion      = 2
+)
+
+// Run-time tunables, overridable with flags or a config file (see crawlkit)
+var (
+	maxDepth               = 13               // Max crawl depth
+	requestTimeout         = 60 * time.Second // Longer timeout for large files
+	concurrentWorkers      = 256              // 8x your core count for crawling
+	initialDownloadWorkers = 1000             // Start with 1000 workers!
+	userAgent              = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0 Safari/537.36"
+	tlsPolicy              crawlkit.TLSPolicy
+	cfg                    *crawlkit.Config
 )
 
 // Network interface configuration
@@ -68,36 +78,56 @@ type NetworkInterface struct {
 var (
 	visitedURLsMap   = make(map[string]bool)
 	downloadedFiles  = make(map[string]bool)
-	pendingDownloads = make(map[string]bool)
-	failedDownloads  = make(map[string]int)
+	pendingDownloads = make(map[string]downloadTask)
+	failedDownloads  = make(map[string]downloadTask) // Kept whole, so -resume re-queues them as they were
+	pendingPages     = make(map[string]pageTask) // Queued but not yet scraped, keyed like visitedURLsMap
 	mapMutex         = &sync.RWMutex{}
 	targetDir        string
 	logFilePath      string
 	downloadLogPath  string
+	checkpointPath   string
+	checkpointMu     sync.Mutex
 	firstRequestOnce sync.Once
 	startURL         string
 
 	// Multi-NIC system
 	networkInterfaces []NetworkInterface
-	downloadQueues    []chan downloadTask      // One queue per interface
+	downloadFrontier  *crawlkit.DiskQueueStorage // Pending downloads, kept on disk across restarts
 	priorityQueue     = make(chan downloadTask, 50000)
-	downloadLimiter   *rate.Limiter
+	polite            *crawlkit.Politeness // Per-host token buckets with adaptive backoff
+	classifier        *crawlkit.Classifier // Decides which links are documents (doc_types)
+	namer             *crawlkit.Namer      // Names saved files (name_template, on_collision)
+	manifest          *crawlkit.Manifest   // One JSONL record per download attempt
+	scope             *crawlkit.Scope      // Which pages may be crawled (excluded_domains, scope_file)
+	archive           *crawlkit.WARCWriter // Archives pages and downloads as WARC (warc_dir)
+	metrics           *crawlkit.Metrics    // Prometheus /metrics endpoint (metrics_addr)
+	budget            *crawlkit.Budget     // Page, byte and time limits (max_pages, max_mb, max_time, host_max_*)
+	proxies           *crawlkit.Proxies    // Rotating proxy pool and per-rule proxies (proxies, scope rule proxy)
+	dashboard         *crawlkit.Dashboard  // Full-screen progress view; nil when not on a terminal
 	downloadWG        sync.WaitGroup
 	activeWorkers     int64
+	interfaceWorkers  []int64 // Active workers per interface, indexed like networkInterfaces
+	interfaceBytes    []int64 // Bytes downloaded per interface, indexed like networkInterfaces
 	shutdownChan      = make(chan struct{})
 	scalerWG          sync.WaitGroup
+	retryWG           sync.WaitGroup // Retries waiting out their backoff
+	pendingRetries    int64          // Retries not yet back in priorityQueue; workers wait for them
+	logWG             sync.WaitGroup // Async log writes still in flight
+	shutdown          *crawlkit.Shutdown
+	canon             = crawlkit.DefaultCanonicalizer // Page and document dedup keys
 	
 	// Performance counters
 	stats struct {
+		pagesCrawled     int64
 		downloadAttempts int64
 		downloadSuccess  int64
 		downloadFailed   int64
 		bytesDownloaded  int64
 		startTime        time.Time
 	}
-	
-	// Interface load balancing
-	currentInterfaceIndex int64
+
+	// robots.txt cache; nil when run with -ignore-robots
+	robots *crawlkit.Robots
 )
 
 type downloadTask struct {
@@ -105,11 +135,78 @@ type downloadTask struct {
 	depth       int
 	retry       int
 	priority    bool
-	interfaceID int // Which network interface to use
+	interfaceID int    // Which network interface to use
+	referrer    string // Page (or sitemap) the document was found on
 }
 
 func main() {
 	stats.startTime = time.Now()
+
+	var err error
+	cfg, err = crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+		MaxDepth:        maxDepth,
+		Workers:         concurrentWorkers,
+		DownloadWorkers: initialDownloadWorkers,
+		RequestTimeout:  crawlkit.Duration{Duration: requestTimeout},
+		UserAgent:       userAgent,
+		HostFair:        true,
+	})
+	if err != nil {
+		fmt.Printf("❌ Failed to load configuration: %v\n", err)
+		return
+	}
+	maxDepth = cfg.MaxDepth
+	concurrentWorkers = cfg.Workers
+	initialDownloadWorkers = cfg.DownloadWorkers
+	requestTimeout = cfg.RequestTimeout.Duration
+	tlsPolicy = cfg.TLS
+	userAgent = cfg.UserAgent
+	canon = cfg.Canonicalizer()
+
+	// Ctrl+C stops crawling, cancels downloads in flight and saves a final
+	// checkpoint; a second Ctrl+C exits at once
+	shutdown = crawlkit.NewShutdown()
+
+	// One token bucket per host, shared by the crawler and the download
+	// clients; 429/503 and connection resets slow a host down
+	polite = cfg.Politeness()
+	polite.Context = shutdown.Context()
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget = cfg.Budget()
+	budget.Enforce(shutdown)
+
+	// Every client goes through the -proxy pool, or the proxy of the scope
+	// rule a URL matches once the scope is loaded
+	proxies, err = cfg.Proxies()
+	if err != nil {
+		fmt.Printf("❌ Failed to set up proxies: %v\n", err)
+		return
+	}
+
+	// Links are downloaded when a HEAD (or ranged GET) says they serve a
+	// wanted type (collect, doc_sets, doc_types), not because their URL
+	// contains .pdf; each document set is saved to its own subfolder
+	classifier, err = cfg.Classifier(userAgent, &http.Client{
+		Transport: budget.Transport(polite.Transport(proxies.Transport(tlsPolicy.Apply(&http.Transport{})))),
+		Timeout:   requestTimeout,
+	})
+	if err != nil {
+		fmt.Printf("❌ Failed to configure document sets: %v\n", err)
+		return
+	}
+	classifier.Context = shutdown.Context()
+	classifier.Budget = budget
+
+	// Saved files are laid out by name_template and never overwrite each
+	// other unless on_collision says so; each document is stored once in
+	// store_dir and linked under every name it is saved as
+	namer, err = cfg.Namer()
+	if err != nil {
+		fmt.Printf("❌ Failed to configure file names: %v\n", err)
+		return
+	}
 	
 	// BEAST MODE SYSTEM CONFIGURATION
 	setupBeastMode()
@@ -120,7 +217,7 @@ func main() {
 	fmt.Printf("💾 Memory target: %dGB\n", targetMemoryUsageGB)
 	
 	// Detect and configure network interfaces
-	err := detectNetworkInterfaces()
+	err = detectNetworkInterfaces()
 	if err != nil {
 		fmt.Printf("❌ Failed to detect network interfaces: %v\n", err)
 		return
@@ -144,44 +241,121 @@ func main() {
 	increaseFileDescriptorLimit()
 	optimizeNetworkSettings()
 	
-	// Get user input
-	fmt.Println("\nEnter the starting URL to crawl:")
-	fmt.Scanln(&startURL)
-
-	fmt.Println("Enter the target directory to save files:")
-	fmt.Scanln(&targetDir)
+	// Resuming reuses the interrupted run's directory and, unless new ones
+	// are given, its starting URLs
+	var resumed *checkpoint
+	if cfg.Resume != "" {
+		resumed, err = loadCheckpoint(cfg.Resume)
+		if err != nil {
+			fmt.Printf("❌ Failed to resume: %v\n", err)
+			return
+		}
+		cfg.OutputDir = cfg.Resume
+		if len(cfg.StartURLs) == 0 {
+			cfg.StartURLs = resumed.StartURLs
+		}
+	}
 
-	// URL validation
-	parsedStart, err := url.Parse(startURL)
-	if err != nil || parsedStart.Scheme == "" || parsedStart.Host == "" {
-		fmt.Printf("❌ Invalid URL: %s\n", startURL)
+	// Starting URLs and target directory come from flags/config, or prompts on a terminal
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
 		return
 	}
-	if parsedStart.Scheme != "http" && parsedStart.Scheme != "https" {
-		parsedStart.Scheme = "https"
-		startURL = parsedStart.String()
+
+	if cfg.OutputDir == "" && crawlkit.Interactive() {
+		cfg.OutputDir = crawlkit.Prompt("Enter the target directory to save files: ")
+	}
+	targetDir, err = cfg.ResolveOutputDir("hellmouth")
+	if err != nil {
+		fmt.Printf("❌ Failed to create directory: %v\n", err)
+		return
 	}
 
-	// Create target directory
-	if _, err := os.Stat(targetDir); os.IsNotExist(err) {
-		fmt.Printf("📁 Creating directory: %s\n", targetDir)
-		err = os.MkdirAll(targetDir, 0755)
-		if err != nil {
-			fmt.Printf("❌ Failed to create directory: %v\n", err)
+	// URL validation
+	for i, rawURL := range startURLs {
+		parsedStart, err := url.Parse(rawURL)
+		if err != nil || parsedStart.Scheme == "" || parsedStart.Host == "" {
+			fmt.Printf("❌ Invalid URL: %s\n", rawURL)
 			return
 		}
+		if parsedStart.Scheme != "http" && parsedStart.Scheme != "https" {
+			parsedStart.Scheme = "https"
+		}
+		startURLs[i] = parsedStart.String()
+	}
+	startURL = startURLs[0]
+
+	// Pages are crawled only where the scope rules allow; excluded_domains
+	// match their subdomains too
+	scope, err = cfg.Scope(startURLs)
+	if err != nil {
+		fmt.Printf("❌ Failed to load crawl scope: %v\n", err)
+		return
 	}
+	proxies.Route(scope) // Scope rules may name their own proxy
 
-	// Initialize log files
+	// Initialize log files; a resumed run keeps appending to its old ones,
+	// except a plain downloads_*.txt, which is replaced by a manifest
+	checkpointPath = filepath.Join(targetDir, checkpointFile)
 	timestamp := time.Now().Format("20060102_150405")
 	logFilePath = fmt.Sprintf("visitedURLs_%s.txt", timestamp)
-	downloadLogPath = fmt.Sprintf("downloads_%s.txt", timestamp)
+	downloadLogPath = fmt.Sprintf("downloads_%s.jsonl", timestamp)
+	if resumed != nil {
+		logFilePath = resumed.VisitedLog
+		if strings.HasSuffix(resumed.DownloadLog, ".jsonl") {
+			downloadLogPath = resumed.DownloadLog
+		}
+	}
+	if cfg.Manifest != "" {
+		downloadLogPath = cfg.Manifest
+	}
+	manifest, err = crawlkit.OpenManifest(downloadLogPath)
+	if err != nil {
+		fmt.Printf("❌ Failed to open download manifest: %v\n", err)
+		return
+	}
 
-	// Initialize queues and HTTP clients for each interface
-	initializeMultiNICSystem()
+	// Archive every page and document exchange as WARC/1.1 when -warc is set
+	archive, err = cfg.OpenWARC("hellmouth")
+	if err != nil {
+		fmt.Printf("❌ Failed to open WARC output: %v\n", err)
+		return
+	}
 
-	// Ultra-permissive rate limiting
-	downloadLimiter = rate.NewLimiter(rate.Every(10*time.Microsecond), maxDownloadWorkers*3)
+	// Serve counters, queue depths and per-host latency for Prometheus
+	// when -metrics is set
+	metrics, err = cfg.Metrics("hellmouth")
+	if err != nil {
+		fmt.Printf("❌ Failed to start metrics endpoint: %v\n", err)
+		return
+	}
+
+	// Initialize the download frontier and HTTP clients for each interface
+	if err := initializeMultiNICSystem(); err != nil {
+		fmt.Printf("❌ Failed to open download frontier: %v\n", err)
+		return
+	}
+
+	if resumed != nil {
+		if err := restoreCheckpoint(resumed); err != nil {
+			fmt.Printf("❌ Failed to resume: %v\n", err)
+			return
+		}
+	}
+
+	// Show progress full-screen on a terminal, with p/r/q to pause, resume
+	// and stop; everything printed from here on goes to its log pane
+	dashboard = cfg.Dashboard("hellmouth", dashboardStats)
+	if dashboard != nil {
+		dashboard.Polite = polite
+		dashboard.Shutdown = shutdown
+		if err := dashboard.Start(); err != nil {
+			fmt.Printf("⚠️ Failed to start dashboard: %v\n", err)
+			dashboard = nil
+		}
+		defer dashboard.Stop()
+	}
 
 	// Start massive number of workers distributed across interfaces
 	startMultiNICWorkers()
@@ -201,6 +375,9 @@ func main() {
 	scalerWG.Add(1)
 	go networkMonitor()
 
+	scalerWG.Add(1)
+	go checkpointMonitor()
+
 	// Create ultra-aggressive collector
 	c := createBeastCollector()
 	
@@ -210,24 +387,69 @@ func main() {
 	// UNLEASH THE MULTI-NIC BEAST!
 	printStartupInfo()
 
-	err = c.Visit(startURL)
-	if err != nil {
-		fmt.Printf("❌ Failed to start crawl: %v\n", err)
-		return
+	for _, u := range startURLs {
+		parsed, _ := url.Parse(u)
+		cleanURL := normalizeParsedURL(parsed)
+		if hasVisited(cleanURL) {
+			continue // Already crawled before the interruption
+		}
+		saveVisitedURL(cleanURL)
+		if err := visitPage(c, u, cleanURL, 0, nil); err != nil {
+			fmt.Printf("❌ Failed to start crawl: %v\n", err)
+			return
+		}
+	}
+
+	// Pages that were queued but not scraped when the last run stopped
+	if resumed != nil {
+		for _, p := range resumed.PendingPages {
+			parsed, err := url.Parse(p.URL)
+			if err != nil {
+				continue
+			}
+			visitPage(c, p.URL, normalizeParsedURL(parsed), p.Depth, nil)
+		}
+		fmt.Printf("♻️ Resumed %d pending pages\n", len(resumed.PendingPages))
+	}
+
+	if !cfg.NoSitemaps {
+		seedFromSitemaps(c, startURLs)
 	}
 
 	c.Wait()
 	
-	// Shutdown sequence
+	// Shutdown sequence: stop the monitors and scalers, let the workers
+	// finish (or abandon, when interrupted) their downloads, then flush
 	close(shutdownChan)
 	scalerWG.Wait()
+	downloadWG.Wait()
+	retryWG.Wait()
 	close(priorityQueue)
-	for _, queue := range downloadQueues {
-		close(queue)
+	for task := range priorityQueue {
+		// Left by workers that stopped on Ctrl+C: kept for -resume
+		pushDownloadTask(task)
 	}
-	downloadWG.Wait()
+	logWG.Wait()
+	if err := saveCheckpoint(); err != nil {
+		fmt.Printf("⚠️ Failed to save checkpoint: %v\n", err)
+	}
+	downloadFrontier.Close()
+	if err := manifest.Close(); err != nil {
+		fmt.Printf("⚠️ Failed to write download manifest: %v\n", err)
+	}
+	if err := archive.Close(); err != nil {
+		fmt.Printf("⚠️ Failed to write WARC output: %v\n", err)
+	}
+	metrics.Close()
+	if err := namer.Store.Close(); err != nil {
+		fmt.Printf("⚠️ Failed to close document store: %v\n", err)
+	}
+	dashboard.Stop()
 
 	printFinalStats()
+	if shutdown.Stopping() {
+		fmt.Printf("💾 Interrupted; continue with -resume %s\n", targetDir)
+	}
 }
 
 // detectNetworkInterfaces discovers available network interfaces
@@ -341,11 +563,16 @@ func selectNetworkInterfaces() []int {
 		return nil
 	}
 	
-	fmt.Printf("\nRecommendation: Use all active high-speed interfaces for maximum performance\n")
-	fmt.Printf("Enter interface numbers (comma-separated, e.g., 1,2,3) or 'all' for all active: ")
+	// -iface / interface: names, IPs or CIDRs (comma-separated), or "all"
+	if cfg.Interface != "" {
+		return matchNetworkInterfaces(cfg.Interface)
+	}
+	if !crawlkit.Interactive() {
+		return matchNetworkInterfaces("all")
+	}
 	
-	var input string
-	fmt.Scanln(&input)
+	fmt.Printf("\nRecommendation: Use all active high-speed interfaces for maximum performance\n")
+	input := crawlkit.Prompt("Enter interface numbers (comma-separated, e.g., 1,2,3) or 'all' for all active: ")
 	
 	if input == "all" {
 		var selected []int
@@ -376,6 +603,28 @@ func selectNetworkInterfaces() []int {
 	return selected
 }
 
+// matchNetworkInterfaces selects the active interfaces named by spec, a
+// comma-separated list of names, IPs or CIDRs, or "all"
+func matchNetworkInterfaces(spec string) []int {
+	var selected []int
+	for i, iface := range networkInterfaces {
+		if !iface.IsActive {
+			continue
+		}
+		if spec == "all" {
+			selected = append(selected, i)
+			continue
+		}
+		for _, part := range strings.Split(spec, ",") {
+			if crawlkit.MatchInterface(part, iface.Name, net.ParseIP(iface.IP)) {
+				selected = append(selected, i)
+				break
+			}
+		}
+	}
+	return selected
+}
+
 // configureSelectedInterfaces sets up the selected network interfaces
 func configureSelectedInterfaces(selected []int) error {
 	fmt.Println("\n⚙️ Configuring selected interfaces...")
@@ -414,17 +663,32 @@ func configureSelectedInterfaces(selected []int) error {
 	return nil
 }
 
-// initializeMultiNICSystem sets up queues and HTTP clients for each interface
-func initializeMultiNICSystem() {
+// initializeMultiNICSystem opens the download frontier and sets up HTTP
+// clients for each interface
+func initializeMultiNICSystem() error {
 	fmt.Println("\n🔧 Initializing multi-NIC system...")
 	
-	downloadQueues = make([]chan downloadTask, len(networkInterfaces))
+	// One host-fair frontier shared by every interface; downloads left over
+	// from an interrupted run are picked up again
+	if cfg.FrontierDir == "" {
+		cfg.FrontierDir = filepath.Join(targetDir, ".frontier")
+	}
+	downloadFrontier = cfg.QueueStorage()
+	if cfg.Resume != "" {
+		// The checkpoint is authoritative on -resume: restoreCheckpoint
+		// re-queues its pending downloads, so start from an empty frontier
+		if err := os.RemoveAll(cfg.FrontierDir); err != nil {
+			return err
+		}
+	}
+	if err := downloadFrontier.Init(); err != nil {
+		return err
+	}
+	if pending := downloadFrontier.Len(); pending > 0 {
+		fmt.Printf("📦 Resuming %d pending downloads from %s\n", pending, cfg.FrontierDir)
+	}
 	
 	for i, iface := range networkInterfaces {
-		// Create queue for this interface
-		queueSize := maxQueueSize / len(networkInterfaces)
-		downloadQueues[i] = make(chan downloadTask, queueSize)
-		
 		// Create HTTP clients for this interface
 		clientCount := 64 // 64 clients per interface
 		clients := make([]*http.Client, clientCount)
@@ -435,8 +699,36 @@ func initializeMultiNICSystem() {
 		
 		networkInterfaces[i].Clients = clients
 		
-		fmt.Printf("🌐 Interface %s: %d queue slots, %d HTTP clients\n", 
-			iface.Name, queueSize, clientCount)
+		fmt.Printf("🌐 Interface %s: %d HTTP clients\n", 
+			iface.Name, clientCount)
+	}
+	interfaceWorkers = make([]int64, len(networkInterfaces))
+	interfaceBytes = make([]int64, len(networkInterfaces))
+	registerMetrics()
+	return nil
+}
+
+// registerMetrics adds the download queues and workers to /metrics. Every
+// interface pulls from the same frontier and priority queue, so queue
+// depths are per queue and worker counts per interface.
+func registerMetrics() {
+	gauge := func(name, help string, labels map[string]string, fn func() float64) {
+		if err := metrics.GaugeFunc(name, help, labels, fn); err != nil {
+			fmt.Printf("⚠️ Failed to add metric %s: %v\n", name, err)
+		}
+	}
+	gauge("crawl_queue_depth", "Downloads waiting, by queue.", map[string]string{"queue": "frontier"},
+		func() float64 { return float64(downloadFrontier.Len()) })
+	gauge("crawl_queue_depth", "Downloads waiting, by queue.", map[string]string{"queue": "priority"},
+		func() float64 { return float64(len(priorityQueue)) })
+	gauge("crawl_frontier_hosts", "Hosts with downloads waiting in the frontier.", nil,
+		func() float64 { return float64(downloadFrontier.Hosts()) })
+	for i, iface := range networkInterfaces {
+		gauge("crawl_active_workers", "Download workers running, by interface.", map[string]string{"interface": iface.Name},
+			func() float64 { return float64(atomic.LoadInt64(&interfaceWorkers[i])) })
+	}
+	if err := metrics.AddProxies(proxies); err != nil {
+		fmt.Printf("⚠️ Failed to add proxy metrics: %v\n", err)
 	}
 }
 
@@ -459,7 +751,7 @@ func createInterfaceClient(iface NetworkInterface) *http.Client {
 		dialer.LocalAddr = &net.TCPAddr{IP: localAddr.IP}
 	}
 	
-	transport := &http.Transport{
+	transport := tlsPolicy.Apply(&http.Transport{
 		DialContext:           dialer.DialContext,
 		MaxIdleConns:          maxConnectionsTotal / len(networkInterfaces) / 64,
 		MaxIdleConnsPerHost:   maxConnectionsPerHost / len(networkInterfaces) / 64,
@@ -470,7 +762,8 @@ func createInterfaceClient(iface NetworkInterface) *http.Client {
 		ExpectContinueTimeout: 1 * time.Second,
 		DisableCompression:    false,
 		ForceAttemptHTTP2:     true,
-	}
+		TLSClientConfig:       tlsPolicy.ClientConfig(),
+	})
 	
 	// Enable TCP optimizations for high-bandwidth interfaces
 	if strings.Contains(iface.Speed, "10G") {
@@ -480,7 +773,7 @@ func createInterfaceClient(iface NetworkInterface) *http.Client {
 	
 	return &http.Client{
 		Timeout:   requestTimeout,
-		Transport: transport,
+		Transport: budget.Transport(polite.Transport(metrics.Transport(archive.Transport(proxies.Transport(transport))))),
 	}
 }
 
@@ -509,6 +802,9 @@ func multiNICDownloadWorker(interfaceID, clientIndex int) {
 	defer downloadWG.Done()
 	defer atomic.AddInt64(&activeWorkers, -1)
 	
+	atomic.AddInt64(&interfaceWorkers[interfaceID], 1)
+	defer atomic.AddInt64(&interfaceWorkers[interfaceID], -1)
+	
 	iface := networkInterfaces[interfaceID]
 	client := iface.Clients[clientIndex]
 	workerName := fmt.Sprintf("%s-W%d", iface.Name, clientIndex)
@@ -517,6 +813,10 @@ func multiNICDownloadWorker(interfaceID, clientIndex int) {
 		var task downloadTask
 		var ok bool
 		
+		if shutdown.Stopping() {
+			return
+		}
+		
 		// Check priority queue first
 		select {
 		case task, ok = <-priorityQueue:
@@ -529,28 +829,39 @@ func multiNICDownloadWorker(interfaceID, clientIndex int) {
 			// Priority queue empty
 		}
 		
-		// Check interface-specific queue
-		select {
-		case task, ok = <-downloadQueues[interfaceID]:
-			if !ok {
-				// Interface queue closed
-				return
+		// Then the shared on-disk frontier
+		task, ok = popDownloadTask()
+		if !ok {
+			select {
+			case <-shutdownChan:
+				// Crawl finished and nothing left to download, unless a
+				// retry is still waiting out its backoff. The count is read
+				// first: a retry is in priorityQueue before it stops counting
+				if atomic.LoadInt64(&pendingRetries) == 0 && len(priorityQueue) == 0 {
+					return
+				}
+			default:
 			}
-		default:
 			// No work available, sleep briefly
 			time.Sleep(1 * time.Millisecond)
 			continue
 		}
 		
 	processTask:
-		// Rate limiting
-		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
-		downloadLimiter.Wait(ctx)
-		cancel()
-		
 		atomic.AddInt64(&stats.downloadAttempts, 1)
 		
-		err := downloadDocumentMultiNIC(task.url, client, workerName)
+		err := downloadDocumentMultiNIC(task, client, interfaceID, workerName)
+		if err != nil && shutdown.Stopping() {
+			// Interrupted rather than failed: keep it for the next run
+			pushDownloadTask(task)
+			return
+		}
+		if errors.Is(err, crawlkit.ErrBudget) {
+			// The host is out of budget: retrying cannot help
+			atomic.AddInt64(&stats.downloadFailed, 1)
+			markDownloadFailed(task)
+			continue
+		}
 		if err != nil {
 			atomic.AddInt64(&stats.downloadFailed, 1)
 			
@@ -558,18 +869,26 @@ func multiNICDownloadWorker(interfaceID, clientIndex int) {
 				task.retry++
 				task.priority = true
 				task.interfaceID = interfaceID
+				markPendingDownload(task)
 				
+				retryWG.Add(1)
+				atomic.AddInt64(&pendingRetries, 1)
 				go func(t downloadTask) {
-					time.Sleep(retryBackoff * time.Duration(t.retry))
+					defer retryWG.Done()
+					defer atomic.AddInt64(&pendingRetries, -1)
+					if !shutdown.Sleep(retryBackoff * time.Duration(t.retry)) {
+						pushDownloadTask(t)
+						return
+					}
 					select {
 					case priorityQueue <- t:
 						// Successfully re-queued
 					default:
-						markDownloadFailed(t.url)
+						markDownloadFailed(t)
 					}
 				}(task)
 			} else {
-				markDownloadFailed(task.url)
+				markDownloadFailed(task)
 			}
 		} else {
 			atomic.AddInt64(&stats.downloadSuccess, 1)
@@ -638,22 +957,39 @@ func createBeastCollector() *colly.Collector {
 		colly.Async(true),
 		colly.IgnoreRobotsTxt(),
 	)
+	c.WithTransport(budget.Transport(metrics.Transport(archive.Transport(proxies.Transport(tlsPolicy.Transport())))))
 
 	extensions.RandomUserAgent(c)
 	extensions.Referer(c)
 	c.SetRequestTimeout(requestTimeout)
+	shutdown.Attach(c)
+	budget.Attach(c)
 
 	err := c.Limit(&colly.LimitRule{
 		DomainGlob:  "*",
 		Parallelism: concurrentWorkers,
-		Delay:       politeDelay,
-		RandomDelay: 5 * time.Millisecond,
 	})
 	
 	if err != nil {
 		fmt.Printf("❌ Failed to set crawl limits: %v\n", err)
 	}
 
+	// Obey robots.txt Allow/Disallow and Crawl-delay for our own user agent
+	if !cfg.IgnoreRobots {
+		robots = crawlkit.NewRobots(userAgent, &http.Client{
+			Transport: proxies.Transport(tlsPolicy.Apply(&http.Transport{})),
+			Timeout:   requestTimeout,
+		})
+		robots.Context = shutdown.Context()
+		robots.Attach(c)
+		classifier.Robots = robots
+	}
+
+	// Politeness comes after the callbacks that may abort a request, so
+	// that only requests that are sent take a host token
+	polite.Attach(c)
+	metrics.Attach(c)
+
 	cacheDir := ".colly_cache"
 	os.RemoveAll(cacheDir)
 	c.CacheDir = cacheDir
@@ -666,15 +1002,19 @@ func setupCrawlingCallbacks(c *colly.Collector) {
 	c.OnRequest(func(r *colly.Request) {
 		if r.URL.String() == startURL {
 			firstRequestOnce.Do(func() {
-				ctx := colly.NewContext()
-				ctx.Put("depth", "0")
-				r.Ctx = ctx
 				fmt.Printf("🚀 [0] Multi-NIC crawl started: %s\n", r.URL)
 			})
 		}
 	})
 
+	// A page stops being pending once it has been scraped or has failed
+	c.OnScraped(func(r *colly.Response) {
+		markPageDone(r.Ctx.Get("page"))
+	})
+
 	c.OnResponse(func(r *colly.Response) {
+		atomic.AddInt64(&stats.pagesCrawled, 1)
+
 		// Minimal logging for performance
 		if atomic.LoadInt64(&stats.downloadAttempts) < 50 {
 			depth := 0
@@ -688,92 +1028,380 @@ func setupCrawlingCallbacks(c *colly.Collector) {
 	})
 
 	c.OnError(func(r *colly.Response, err error) {
+		markPageDone(r.Ctx.Get("page"))
 		if atomic.LoadInt64(&stats.downloadFailed) < 20 {
 			fmt.Printf("❌ Crawl error: %v\n", err)
 		}
 	})
 
-	// Link discovery
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		href := e.Attr("href")
-		absURL := e.Request.AbsoluteURL(href)
-
-		parsed, err := url.Parse(absURL)
-		if err != nil || parsed.Host == "" {
-			return
-		}
-
+	// Link discovery: anchors, frames, embeds, alternates, meta refresh,
+	// srcset and inline scripts, resolved against <base href>
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
 		currentDepth := 0
 		if d := e.Request.Ctx.Get("depth"); d != "" {
 			fmt.Sscanf(d, "%d", &currentDepth)
 		}
 
-		if currentDepth >= maxDepth {
-			return
+		for _, link := range crawlkit.ExtractLinks(e) {
+			parsed, err := url.Parse(link.URL)
+			if err != nil || parsed.Host == "" {
+				continue
+			}
+
+			// Out-of-scope links are neither downloaded nor crawled
+			if ok, _ := scope.Check(parsed, currentDepth+1); !ok {
+				continue
+			}
+
+			// Document detection and queuing; only anchors, frames,
+			// alternates and refreshes are crawled as pages
+			if classifier.IsDocument(link.URL) {
+				queueDocument(link.URL, currentDepth, e.Request.URL.String())
+				continue
+			}
+			if !link.Page() {
+				continue
+			}
+
+			if maxDepth > 0 && currentDepth >= maxDepth {
+				continue
+			}
+
+			cleanURL := normalizeParsedURL(parsed)
+			if hasVisited(cleanURL) {
+				metrics.Link(false)
+				continue
+			}
+
+			metrics.Link(true)
+			saveVisitedURL(cleanURL)
+			visitPage(c, link.URL, cleanURL, currentDepth+1, crawlkit.LinkContext(link.Source))
 		}
+	})
+}
+
+// visitPage queues a page at depth, remembering it as pending until it has
+// been scraped so that a checkpoint can hand it to a resumed run
+func visitPage(c *colly.Collector, pageURL, cleanURL string, depth int, ctx *colly.Context) error {
+	if ctx == nil {
+		ctx = colly.NewContext()
+	}
+	ctx.Put("depth", strconv.Itoa(depth))
+	ctx.Put("page", cleanURL)
+
+	markPagePending(cleanURL, pageTask{URL: pageURL, Depth: depth})
+	if err := c.Request("GET", pageURL, nil, ctx, nil); err != nil {
+		markPageDone(cleanURL)
+		return err
+	}
+	return nil
+}
 
+// queueDocument hands a document URL found by a link or a sitemap to the
+// download workers
+func queueDocument(docURL string, depth int, referrer string) {
+	if key, err := canon.Canonicalize(docURL); err == nil {
+		docURL = key
+	}
+	if parsed, err := url.Parse(docURL); err == nil && (!robots.Check(parsed) || !budget.Allowed(parsed.Hostname())) {
+		return
+	}
+
+	// Every interface's workers pull from the frontier, which balances the load
+	task := downloadTask{url: docURL, depth: depth, referrer: referrer}
+	if !claimDownload(task) {
+		return
+	}
+	if err := pushDownloadTask(task); err != nil {
+		releaseDownload(docURL)
+		fmt.Printf("❌ [%d] Failed to queue %s: %v\n", depth, docURL, err)
+	}
+}
+
+// frontierTask is the on-disk form of a downloadTask
+type frontierTask struct {
+	URL      string `json:"url"`
+	Depth    int    `json:"depth"`
+	Retry    int    `json:"retry"`
+	Referrer string `json:"referrer,omitempty"`
+}
+
+func (t downloadTask) frontier() frontierTask {
+	return frontierTask{URL: t.url, Depth: t.depth, Retry: t.retry, Referrer: t.referrer}
+}
+
+func (t frontierTask) task() downloadTask {
+	return downloadTask{url: t.URL, depth: t.Depth, retry: t.Retry, referrer: t.Referrer}
+}
+
+// pushDownloadTask appends a task to the download frontier, keyed by host so
+// dequeues rotate between sites
+func pushDownloadTask(task downloadTask) error {
+	data, err := json.Marshal(task.frontier())
+	if err != nil {
+		return err
+	}
+	host := ""
+	if parsed, err := url.Parse(task.url); err == nil {
+		host = parsed.Host
+	}
+	return downloadFrontier.Push(host, data)
+}
+
+// popDownloadTask takes the next task off the download frontier
+func popDownloadTask() (downloadTask, bool) {
+	_, data, err := downloadFrontier.Pop()
+	if err != nil {
+		return downloadTask{}, false
+	}
+	var ft frontierTask
+	if err := json.Unmarshal(data, &ft); err != nil {
+		return downloadTask{}, false
+	}
+	return ft.task(), true
+}
+
+// seedFromSitemaps walks the start sites' sitemaps: listed documents go
+// straight to the download queues, pages are crawled at depth 1
+func seedFromSitemaps(c *colly.Collector, startURLs []string) {
+	sitemaps := crawlkit.NewSitemaps(userAgent, &http.Client{
+		Transport: proxies.Transport(tlsPolicy.Apply(&http.Transport{})),
+		Timeout:   requestTimeout,
+	}, robots)
+	sitemaps.Scope = scope
+
+	docs := sitemaps.Seed(startURLs, classifier.IsDocument, func(e crawlkit.SitemapEntry) {
+		parsed, err := url.Parse(e.Loc)
+		if err != nil {
+			return
+		}
 		cleanURL := normalizeParsedURL(parsed)
 		if hasVisited(cleanURL) {
 			return
 		}
-
 		saveVisitedURL(cleanURL)
+		visitPage(c, e.Loc, cleanURL, 1, crawlkit.SitemapContext(e))
+	})
+	for _, doc := range docs {
+		queueDocument(doc.Loc, 1, "sitemap")
+	}
+	fmt.Printf("🗺️ Sitemaps: %d documents queued\n", len(docs))
+}
 
-		newCtx := colly.NewContext()
-		newCtx.Put("depth", fmt.Sprintf("%d", currentDepth+1))
+// pageTask is a page queued for crawling
+type pageTask struct {
+	URL   string `json:"url"`
+	Depth int    `json:"depth"`
+}
 
-		e.Request.Visit(absURL)
-	})
+// checkpoint is the crawl state saved in <run-dir>/checkpoint.json. Pending
+// pages and downloads are what a -resume run queues again.
+type checkpoint struct {
+	Version          int            `json:"version"`
+	SavedAt          time.Time      `json:"saved_at"`
+	StartURLs        []string       `json:"start_urls"`
+	VisitedLog       string         `json:"visited_log"`
+	DownloadLog      string         `json:"download_log"`
+	Visited          []string       `json:"visited"`
+	PendingPages     []pageTask     `json:"pending_pages"`
+	Downloaded       []string       `json:"downloaded"`
+	PendingDownloads []frontierTask `json:"pending_downloads"`
+	FailedDownloads  []frontierTask `json:"failed_downloads"`
+}
+
+// saveCheckpoint snapshots the crawl maps and atomically replaces the run
+// directory's checkpoint
+func saveCheckpoint() error {
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
 
-	// Document detection and queuing
-	docExtensions := []string{
-		".pdf", 
+	cp := checkpoint{
+		Version:   checkpointVersion,
+		SavedAt:   time.Now(),
+		StartURLs: cfg.StartURLs,
 	}
-	
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		href := e.Attr("href")
-		docURL := e.Request.AbsoluteURL(href)
-		
-		if !isDocumentURL(docURL, docExtensions) {
-			return
-		}
+	cp.VisitedLog, _ = filepath.Abs(logFilePath)
+	cp.DownloadLog, _ = filepath.Abs(downloadLogPath)
 
-		depth := 0
-		if d := e.Request.Ctx.Get("depth"); d != "" {
-			fmt.Sscanf(d, "%d", &depth)
+	mapMutex.RLock()
+	cp.Visited = make([]string, 0, len(visitedURLsMap))
+	for u := range visitedURLsMap {
+		cp.Visited = append(cp.Visited, u)
+	}
+	cp.PendingPages = make([]pageTask, 0, len(pendingPages))
+	for _, p := range pendingPages {
+		cp.PendingPages = append(cp.PendingPages, p)
+	}
+	cp.Downloaded = make([]string, 0, len(downloadedFiles))
+	for u := range downloadedFiles {
+		cp.Downloaded = append(cp.Downloaded, u)
+	}
+	cp.PendingDownloads = make([]frontierTask, 0, len(pendingDownloads))
+	for _, t := range pendingDownloads {
+		cp.PendingDownloads = append(cp.PendingDownloads, t.frontier())
+	}
+	cp.FailedDownloads = make([]frontierTask, 0, len(failedDownloads))
+	for _, t := range failedDownloads {
+		cp.FailedDownloads = append(cp.FailedDownloads, t.frontier())
+	}
+	mapMutex.RUnlock()
+
+	tmpPath := checkpointPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 1024*1024)
+	if err := json.NewEncoder(w).Encode(&cp); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, checkpointPath)
+}
+
+// loadCheckpoint reads the checkpoint left in runDir by an earlier run
+func loadCheckpoint(runDir string) (*checkpoint, error) {
+	data, err := os.ReadFile(filepath.Join(runDir, checkpointFile))
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint: %w", err)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("checkpoint version %d, expected %d", cp.Version, checkpointVersion)
+	}
+	return &cp, nil
+}
+
+// restoreCheckpoint rebuilds the crawl maps from cp and re-queues its pending
+// and failed downloads. Pending pages are revisited once the collector exists.
+func restoreCheckpoint(cp *checkpoint) error {
+	mapMutex.Lock()
+	for _, u := range cp.Visited {
+		visitedURLsMap[u] = true
+	}
+	for _, u := range cp.Downloaded {
+		downloadedFiles[u] = true
+	}
+	mapMutex.Unlock()
+
+	// Downloads that finished after the checkpoint was written are only in the log
+	logged, err := replayDownloadLog(cp.DownloadLog)
+	if err != nil {
+		return err
+	}
+
+	requeued := 0
+	requeue := func(task downloadTask) error {
+		if !claimDownload(task) {
+			return nil
 		}
-		
-		if isDownloadedOrPending(docURL) {
-			return
+		if err := pushDownloadTask(task); err != nil {
+			releaseDownload(task.url)
+			return err
+		}
+		requeued++
+		return nil
+	}
+	for _, t := range cp.PendingDownloads {
+		if err := requeue(t.task()); err != nil {
+			return err
+		}
+	}
+	// Failed downloads are re-queued as they were, with their depth,
+	// referrer and retry count; one that used up its retries gets one
+	// more attempt
+	for _, t := range cp.FailedDownloads {
+		if err := requeue(t.task()); err != nil {
+			return err
 		}
+	}
 
-		// Load-balanced interface selection
-		interfaceID := int(atomic.AddInt64(&currentInterfaceIndex, 1)) % len(networkInterfaces)
-		
-		task := downloadTask{
-			url:         docURL, 
-			depth:       depth, 
-			retry:       0, 
-			priority:    false,
-			interfaceID: interfaceID,
+	fmt.Printf("♻️ Resuming from %s (saved %s): %d visited, %d downloaded (%d since checkpoint), %d downloads re-queued\n",
+		cfg.Resume, cp.SavedAt.Format(time.RFC3339), len(cp.Visited), len(cp.Downloaded)+logged, logged, requeued)
+	return nil
+}
+
+// replayDownloadLog marks every URL in the download log as downloaded and
+// returns how many the checkpoint did not know about. The log is either the
+// manifest, where only successful attempts count, or a plain URL list from
+// before there was one.
+func replayDownloadLog(path string) (int, error) {
+	if strings.HasSuffix(path, ".jsonl") {
+		added := 0
+		err := crawlkit.ReadManifest(path, func(rec crawlkit.ManifestRecord) error {
+			if rec.ErrorClass != "" || rec.Path == "" {
+				return nil
+			}
+			mapMutex.Lock()
+			if !downloadedFiles[rec.URL] {
+				downloadedFiles[rec.URL] = true
+				delete(pendingDownloads, rec.URL)
+				added++
+			}
+			mapMutex.Unlock()
+			return nil
+		})
+		if os.IsNotExist(err) {
+			return 0, nil
 		}
-		
-		// Try interface-specific queue
+		return added, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	added := 0
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		u := strings.TrimSpace(scanner.Text())
+		if u == "" || downloadedFiles[u] {
+			continue
+		}
+		downloadedFiles[u] = true
+		delete(pendingDownloads, u)
+		added++
+	}
+	return added, scanner.Err()
+}
+
+// checkpointMonitor saves a checkpoint every checkpointInterval
+func checkpointMonitor() {
+	defer scalerWG.Done()
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	
+	for {
 		select {
-		case downloadQueues[interfaceID] <- task:
-			markPendingDownload(docURL)
-		default:
-			// Queue full, try priority queue
-			select {
-			case priorityQueue <- task:
-				markPendingDownload(docURL)
-			default:
-				// Both queues full - force scaling
-				go forceScaleUp()
-				go persistentEnqueue(task)
+		case <-shutdownChan:
+			return
+		case <-ticker.C:
+			if err := saveCheckpoint(); err != nil {
+				fmt.Printf("⚠️ Failed to save checkpoint: %v\n", err)
 			}
 		}
-	})
+	}
 }
 
 // Network and performance monitoring functions
@@ -794,13 +1422,11 @@ func networkMonitor() {
 
 func printNetworkStats() {
 	fmt.Printf("🌐 Network Status:\n")
-	for i, iface := range networkInterfaces {
-		queueLen := len(downloadQueues[i])
-		queueCap := cap(downloadQueues[i])
-		utilization := float64(queueLen) / float64(queueCap) * 100
-		
-		fmt.Printf("   %s (%s): Queue %d/%d (%.1f%%), %d clients\n", 
-			iface.Name, iface.Speed, queueLen, queueCap, utilization, len(iface.Clients))
+	fmt.Printf("   Frontier: %d queued across %d hosts, %d priority\n",
+		downloadFrontier.Len(), downloadFrontier.Hosts(), len(priorityQueue))
+	for _, iface := range networkInterfaces {
+		fmt.Printf("   %s (%s): %d clients\n", 
+			iface.Name, iface.Speed, len(iface.Clients))
 	}
 }
 
@@ -814,9 +1440,22 @@ func printStartupInfo() {
 		fmt.Printf("   • %s (%s) - %s - %d workers\n", 
 			iface.Name, iface.IP, iface.Speed, iface.WorkerCount)
 	}
-	fmt.Printf("⚡ Crawl delay: %v (INSANE MODE)\n", politeDelay)
+	fmt.Printf("⚡ Per-host rate: %g req/s, burst %d (raise with -host-rate; backs off on 429/503)\n", float64(polite.Rate), polite.Burst)
+	if robots != nil {
+		fmt.Printf("🤖 robots.txt: obeyed as %q\n", userAgent)
+	} else {
+		fmt.Printf("🤖 robots.txt: ignored\n")
+	}
 	fmt.Printf("💾 Buffer size: %dMB per download\n", downloadBufferSize/1024/1024)
-	fmt.Printf("📦 Total queue capacity: %d items\n\n", maxQueueSize)
+	fmt.Printf("📦 Download frontier: %s (on disk)\n", cfg.FrontierDir)
+	fmt.Printf("📒 Download manifest: %s\n", downloadLogPath)
+	if archive != nil {
+		fmt.Printf("📼 WARC archive: %s\n", archive.Dir)
+	}
+	if metrics != nil {
+		fmt.Printf("📈 Metrics: %s/metrics\n", metrics.Addr)
+	}
+	fmt.Printf("💾 Checkpoint: %s every %v\n\n", checkpointPath, checkpointInterval)
 }
 
 // Continue with remaining functions...
@@ -836,13 +1475,8 @@ func downloadScaler() {
 }
 
 func checkAndScaleMultiNIC() {
-	totalQueued := len(priorityQueue)
-	totalCapacity := cap(priorityQueue)
-	
-	for _, queue := range downloadQueues {
-		totalQueued += len(queue)
-		totalCapacity += cap(queue)
-	}
+	totalQueued := len(priorityQueue) + downloadFrontier.Len()
+	totalCapacity := cap(priorityQueue) + maxQueueSize
 	
 	utilization := float64(totalQueued) / float64(totalCapacity)
 	currentWorkers := atomic.LoadInt64(&activeWorkers)
@@ -881,51 +1515,6 @@ func checkAndScaleMultiNIC() {
 	}
 }
 
-func forceScaleUp() {
-	currentWorkers := atomic.LoadInt64(&activeWorkers)
-	if currentWorkers < maxDownloadWorkers {
-		newWorkersTotal := min(scaleUpAmount*3, maxDownloadWorkers-int(currentWorkers))
-		workersPerInterface := newWorkersTotal / len(networkInterfaces)
-		
-		for i, iface := range networkInterfaces {
-			for j := 0; j < workersPerInterface; j++ {
-				downloadWG.Add(1)
-				go multiNICDownloadWorker(i, j%len(iface.Clients))
-				atomic.AddInt64(&activeWorkers, 1)
-			}
-		}
-		
-		fmt.Printf("🚀 EMERGENCY Multi-NIC scale: +%d workers (now %d)\n", 
-			newWorkersTotal, currentWorkers+int64(newWorkersTotal))
-	}
-}
-
-func persistentEnqueue(task downloadTask) {
-	maxAttempts := 50
-	for attempt := 0; attempt < maxAttempts; attempt++ {
-		time.Sleep(time.Duration(attempt*50) * time.Millisecond)
-		
-		// Try priority queue first
-		select {
-		case priorityQueue <- task:
-			markPendingDownload(task.url)
-			return
-		default:
-			// Try interface-specific queues
-			for i := range downloadQueues {
-				select {
-				case downloadQueues[i] <- task:
-					markPendingDownload(task.url)
-					return
-				default:
-					continue
-				}
-			}
-		}
-	}
-	fmt.Printf("❌ [%d] Multi-NIC dropped after %d attempts: %s\n", task.depth, maxAttempts, task.url)
-}
-
 func performanceMonitor() {
 	defer scalerWG.Done()
 	ticker := time.NewTicker(3 * time.Second) // Very frequent updates
@@ -949,19 +1538,17 @@ func printPerformanceStats() {
 	elapsed := time.Since(stats.startTime)
 	workers := atomic.LoadInt64(&activeWorkers)
 	
-	totalQueued := len(priorityQueue)
-	for _, queue := range downloadQueues {
-		totalQueued += len(queue)
-	}
+	totalQueued := len(priorityQueue) + downloadFrontier.Len()
 	
 	if attempts > 0 {
 		successRate := float64(success) / float64(attempts) * 100
 		throughput := float64(success) / elapsed.Seconds()
 		mbps := float64(bytes) * 8 / elapsed.Seconds() / 1024 / 1024 // Mbps
 		
-		fmt.Printf("🔥 MULTI-NIC: %d workers, %d queued | %d attempts, %d success, %d failed (%.1f%%) | %.1f dl/s, %.1f Mbps | %s\n",
-			workers, totalQueued, attempts, success, failed, successRate, throughput, mbps, formatBytes(bytes))
+		fmt.Printf("🔥 MULTI-NIC: %d workers, %d queued | %d attempts, %d success, %d failed (%.1f%%) | %.1f dl/s, %.1f Mbps | %s | %d robots-blocked\n",
+			workers, totalQueued, attempts, success, failed, successRate, throughput, mbps, formatBytes(bytes), robots.Blocked())
 	}
+	fmt.Printf("🚦 Politeness: %s\n", polite.Summary(3))
 }
 
 func memoryMonitor() {
@@ -991,6 +1578,30 @@ func memoryMonitor() {
 	}
 }
 
+// dashboardStats reads the counters the performance monitor prints, for
+// the dashboard
+func dashboardStats() crawlkit.DashboardStats {
+	st := crawlkit.DashboardStats{
+		Pages:     atomic.LoadInt64(&stats.pagesCrawled),
+		Downloads: atomic.LoadInt64(&stats.downloadSuccess),
+		Failed:    atomic.LoadInt64(&stats.downloadFailed),
+		Bytes:     atomic.LoadInt64(&stats.bytesDownloaded),
+		Workers:   atomic.LoadInt64(&activeWorkers),
+		Remaining: int64(len(priorityQueue) + downloadFrontier.Len()),
+		Queues: []crawlkit.QueueFill{
+			{Name: "frontier", Len: downloadFrontier.Len(), Cap: maxQueueSize},
+			{Name: "priority", Len: len(priorityQueue), Cap: cap(priorityQueue)},
+		},
+	}
+	for i, iface := range networkInterfaces {
+		st.Interfaces = append(st.Interfaces, crawlkit.InterfaceTraffic{
+			Name:  iface.Name,
+			Bytes: atomic.LoadInt64(&interfaceBytes[i]),
+		})
+	}
+	return st
+}
+
 func printFinalStats() {
 	attempts := atomic.LoadInt64(&stats.downloadAttempts)
 	success := atomic.LoadInt64(&stats.downloadSuccess)
@@ -1002,11 +1613,20 @@ func printFinalStats() {
 	fmt.Printf("⏱️ Total time: %v\n", elapsed)
 	fmt.Printf("📊 Downloads: %d attempts, %d success, %d failed\n", attempts, success, failed)
 	fmt.Printf("💾 Data downloaded: %s\n", formatBytes(bytes))
+	fmt.Printf("🤖 Blocked by robots.txt: %d\n", robots.Blocked())
+	fmt.Printf("🎯 Out of scope: %s\n", scope.Summary())
+	fmt.Printf("💰 Budget: %s\n", budget.Summary())
+	fmt.Printf("🧦 Proxies: %s\n", proxies.Summary())
+	fmt.Printf("🔒 TLS: %s\n", tlsPolicy.Report().Summary())
 	fmt.Printf("⚡ Average throughput: %.2f downloads/sec\n", float64(success)/elapsed.Seconds())
 	fmt.Printf("🌐 Average bandwidth: %.2f Mbps\n", float64(bytes)*8/elapsed.Seconds()/1024/1024)
 	fmt.Printf("💪 Peak workers: %d across %d interfaces\n", atomic.LoadInt64(&activeWorkers), len(networkInterfaces))
 	fmt.Printf("🧠 Final memory: %s\n", formatMemory(getMemStats()))
 	
+	fmt.Printf("🚦 Politeness: %s\n", polite.Summary(10))
+	fmt.Printf("🗄️ Document store: %s\n", namer.Store.Summary())
+	fmt.Printf("📼 WARC archive: %s\n", archive.Summary())
+
 	fmt.Printf("\n🌐 Per-Interface Stats:\n")
 	for _, iface := range networkInterfaces {
 		fmt.Printf("   %s (%s): %s - %d workers configured\n", 
@@ -1014,63 +1634,56 @@ func printFinalStats() {
 	}
 }
 
-func downloadDocumentMultiNIC(docURL string, client *http.Client, workerName string) error {
-	req, err := http.NewRequestWithContext(context.Background(), "GET", docURL, nil)
+// downloadDocumentMultiNIC downloads task through client, which is bound
+// to interface interfaceID, and records the attempt in the manifest
+func downloadDocumentMultiNIC(task downloadTask, client *http.Client, interfaceID int, workerName string) error {
+	iface := networkInterfaces[interfaceID]
+	rec := crawlkit.ManifestRecord{
+		Time:      time.Now().UTC(),
+		URL:       task.url,
+		Referrer:  task.referrer,
+		Depth:     task.depth,
+		Attempt:   task.retry + 1,
+		Interface: iface.Name,
+		LocalIP:   iface.IP,
+		Worker:    workerName,
+	}
+	req, err := http.NewRequestWithContext(shutdown.Context(), "GET", task.url, nil)
 	if err != nil {
+		rec.SetResult(nil, err)
+		manifest.Record(rec)
 		return err
 	}
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Accept", "*/*")
-	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
 	req.Header.Set("Connection", "keep-alive")
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
-
-	filename := extractFilename(docURL, resp.Header)
-	path := filepath.Join(targetDir, filename)
-
-	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Use massive buffer optimized for 10GbE
+	// Stream into a .part file with massive buffer optimized for 10GbE; a
+	// retry resumes it with Range/If-Range instead of starting over
 	buf := make([]byte, downloadBufferSize)
-	written, err := io.CopyBuffer(out, resp.Body, buf)
-	
-	if err == nil {
-		atomic.AddInt64(&stats.bytesDownloaded, written)
+	res, err := crawlkit.Download(shutdown.Context(), client, req, classifier.Dir(targetDir, task.url), namer, buf)
+	atomic.AddInt64(&stats.bytesDownloaded, res.Received)
+	atomic.AddInt64(&interfaceBytes[interfaceID], res.Received)
+	metrics.Download(res.Received, err)
+	rec.SetResult(res, err)
+	manifest.Record(rec)
+
+	var statusErr *crawlkit.StatusError
+	if errors.As(err, &statusErr) {
+		return fmt.Errorf("HTTP %d", statusErr.Code)
 	}
-	
 	return err
 }
 
 // Utility functions
-func isDocumentURL(docURL string, extensions []string) bool {
-	lowerURL := strings.ToLower(docURL)
-	for _, ext := range extensions {
-		if strings.HasSuffix(lowerURL, ext) || 
-		   strings.Contains(lowerURL, ext+"?") ||
-		   strings.Contains(lowerURL, ext+"&") {
-			return true
-		}
-	}
-	return false
-}
-
+// normalizeParsedURL returns the dedup key for u, its canonical form under
+// the url_rules config
 func normalizeParsedURL(u *url.URL) string {
-	u.Fragment = ""
-	u.RawQuery = ""
-	return strings.ToLower(u.String())
+	key, err := canon.CanonicalizeURL(u)
+	if err != nil {
+		return u.String()
+	}
+	return key
 }
 
 func hasVisited(url string) bool {
@@ -1080,41 +1693,65 @@ func hasVisited(url string) bool {
 	return exists
 }
 
-func isDownloadedOrPending(url string) bool {
-	mapMutex.RLock()
-	defer mapMutex.RUnlock()
-	_, downloaded := downloadedFiles[url]
-	_, pending := pendingDownloads[url]
-	return downloaded || pending
+// claimDownload records task as pending unless its URL is already
+// downloaded or pending, and reports whether it did. Checking and recording
+// under one lock keeps two pages from queueing the same document, and a
+// worker that finishes it from being undone; the caller queues the task
+// only after claiming it.
+func claimDownload(task downloadTask) bool {
+	mapMutex.Lock()
+	defer mapMutex.Unlock()
+	if _, downloaded := downloadedFiles[task.url]; downloaded {
+		return false
+	}
+	if _, pending := pendingDownloads[task.url]; pending {
+		return false
+	}
+	pendingDownloads[task.url] = task
+	return true
+}
+
+// releaseDownload undoes claimDownload for a task that could not be queued
+func releaseDownload(url string) {
+	mapMutex.Lock()
+	delete(pendingDownloads, url)
+	mapMutex.Unlock()
 }
 
-func markPendingDownload(url string) {
+// markPendingDownload records task, and its retry count, as not yet downloaded
+func markPendingDownload(task downloadTask) {
 	mapMutex.Lock()
-	pendingDownloads[url] = true
+	pendingDownloads[task.url] = task
 	mapMutex.Unlock()
 }
 
 func markDownloadCompleted(url string) {
 	mapMutex.Lock()
 	delete(pendingDownloads, url)
+	delete(failedDownloads, url)
 	downloadedFiles[url] = true
 	mapMutex.Unlock()
-	
-	// Async logging to avoid blocking worker
-	go func() {
-		f, err := os.OpenFile(downloadLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return
-		}
-		defer f.Close()
-		f.WriteString(url + "\n")
-	}()
 }
 
-func markDownloadFailed(url string) {
+func markDownloadFailed(task downloadTask) {
 	mapMutex.Lock()
-	delete(pendingDownloads, url)
-	failedDownloads[url]++
+	delete(pendingDownloads, task.url)
+	failedDownloads[task.url] = task
+	mapMutex.Unlock()
+}
+
+func markPagePending(key string, page pageTask) {
+	mapMutex.Lock()
+	pendingPages[key] = page
+	mapMutex.Unlock()
+}
+
+func markPageDone(key string) {
+	if key == "" {
+		return
+	}
+	mapMutex.Lock()
+	delete(pendingPages, key)
 	mapMutex.Unlock()
 }
 
@@ -1124,7 +1761,9 @@ func saveVisitedURL(url string) {
 	mapMutex.Unlock()
 
 	// Async logging for performance
+	logWG.Add(1)
 	go func() {
+		defer logWG.Done()
 		f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			return
@@ -1134,42 +1773,6 @@ func saveVisitedURL(url string) {
 	}()
 }
 
-func extractFilename(docURL string, headers http.Header) string {
-	if cd := headers.Get("Content-Disposition"); cd != "" {
-		if strings.HasPrefix(cd, "attachment; filename=") {
-			filename := strings.TrimPrefix(cd, "attachment; filename=")
-			filename = strings.Trim(filename, `"`)
-			if filename != "" {
-				return sanitizeFilename(filename)
-			}
-		}
-	}
-
-	segments := strings.Split(docURL, "/")
-	filename := segments[len(segments)-1]
-	
-	if idx := strings.Index(filename, "?"); idx != -1 {
-		filename = filename[:idx]
-	}
-	
-	if filename == "" || !strings.Contains(filename, ".") {
-		filename = fmt.Sprintf("download_%d", time.Now().UnixNano())
-	}
-	
-	return sanitizeFilename(filename)
-}
-
-func sanitizeFilename(name string) string {
-	for _, ch := range []string{"\\", "/", ":", "*", "?", "\"", "<", ">", "|", "\x00"} {
-		name = strings.ReplaceAll(name, ch, "_")
-	}
-	if len(name) > 200 {
-		ext := filepath.Ext(name)
-		name = name[:200-len(ext)] + ext
-	}
-	return name
-}
-
 func getMemStats() runtime.MemStats {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -2,7 +2,6 @@ package main
 
 import (
     "bufio"
-    "crypto/tls"
     "fmt"
     "log"
     "net/http"
@@ -31,7 +30,6 @@ func main() {
         MaxIdleConnsPerHost: 100,
         IdleConnTimeout:     90 * time.Second,
         TLSHandshakeTimeout: 10 * time.Second,
-        TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
     }
 
     // Create a new collector with debugging enabled
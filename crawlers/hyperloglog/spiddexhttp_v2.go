@@ -2,7 +2,6 @@ package main
 
 import (
     "bufio"
-    "crypto/tls"
     "fmt"
     "log"
     "net/http"
@@ -27,7 +26,6 @@ func main() {
         MaxIdleConns:        100,
         IdleConnTimeout:     90 * time.Second,
         TLSHandshakeTimeout: 10 * time.Second,
-        TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
     }
 
     c := colly.NewCollector(
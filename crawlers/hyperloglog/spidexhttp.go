@@ -1,12 +1,9 @@
 package main
 
 import (
-    "bufio"
-    "crypto/tls"
     "fmt"
     "log"
     "net/http"
-    "net/url"
     "os"
     "runtime"
     "strings"
@@ -14,9 +11,13 @@ import (
     "time"
 
     "github.com/axiomhq/hyperloglog"
+    "github.com/danindiana/gpt_go/crawlers/crawlkit"
     "github.com/gocolly/colly"
 )
 
+// canon turns URLs into dedup keys; main applies the url_rules config
+var canon = crawlkit.DefaultCanonicalizer
+
 func main() {
     // Initialize the HyperLogLog Sketch with 2^14 registers (precision 14)
     hll := hyperloglog.New14()
@@ -25,36 +26,96 @@ func main() {
     var linksProcessed int64
     var memStats runtime.MemStats
 
+    cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{MaxDepth: 5, Workers: 5})
+    if err != nil {
+        log.Fatalf("Error loading configuration: %v", err)
+    }
+    canon = cfg.Canonicalizer()
+
+    // Requests go through the -proxy pool, or the proxy of the scope rule
+    // they match
+    proxies, err := cfg.Proxies()
+    if err != nil {
+        log.Fatalf("Error setting up proxies: %v", err)
+    }
+
     // Create a custom HTTP transport
-    customTransport := &http.Transport{
+    customTransport := proxies.Transport(cfg.TLS.Apply(&http.Transport{
         MaxIdleConns:        100,
         IdleConnTimeout:     90 * time.Second,
         TLSHandshakeTimeout: 10 * time.Second,
-        TLSClientConfig:     &tls.Config{InsecureSkipVerify: true}, // For demonstration; be cautious in production
+        TLSClientConfig:     cfg.TLS.ClientConfig(), // Verified unless -insecure or -insecure-host says otherwise
+    }))
+
+    // Archive every page exchange as WARC/1.1 when -warc is set
+    archive, err := cfg.OpenWARC("spidexhttp")
+    if err != nil {
+        log.Fatalf("Error opening WARC output: %v", err)
     }
 
+    // Limits on pages, bytes and time, for the crawl and for each host
+    budget := cfg.Budget()
+
     // Create a new collector and apply the custom transport
     c := colly.NewCollector(
-        colly.MaxDepth(5), // Adjusted depth
+        colly.MaxDepth(cfg.MaxDepth), // Adjusted depth
         colly.Async(true),
     )
-    c.WithTransport(customTransport) // Set the custom HTTP transport
+    c.WithTransport(budget.Transport(archive.Transport(customTransport))) // Set the custom HTTP transport
+    if cfg.UserAgent != "" {
+        c.UserAgent = cfg.UserAgent
+    }
+
+    // Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+    var robots *crawlkit.Robots
+    if !cfg.IgnoreRobots {
+        robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: customTransport, Timeout: 30 * time.Second})
+    }
+
+    // Ctrl+C stops new requests so the final telemetry is still written; a
+    // second Ctrl+C exits at once
+    shutdown := crawlkit.NewShutdown()
+    shutdown.Attach(c)
+
+    // max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+    // host_max_pages and host_max_mb only skip the host
+    budget.Enforce(shutdown)
+    budget.Attach(c)
+
+    // robots.txt is consulted after the callbacks that may abort a
+    // request and before politeness, so that only requests that are sent
+    // wait out Crawl-delay or take a host token
+    if robots != nil {
+        robots.Context = shutdown.Context()
+        robots.Attach(c)
+    }
+
+    // Space requests to each host and slow down for hosts that answer
+    // 429/503 or reset connections
+    polite := cfg.Politeness()
+    polite.Context = shutdown.Context()
+    polite.Attach(c)
 
-    // Limit the maximum parallelism to 5 to reduce server load and potential blocking
-    err := c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 5})
+    // Limit the maximum parallelism (5 by default) to reduce server load and potential blocking
+    err = c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Workers})
     if err != nil {
         log.Fatalf("Error setting limit: %v", err)
     }
 
-    // Read the starting URL from the user
-    fmt.Print("Enter the starting URL: ")
-    reader := bufio.NewReader(os.Stdin)
-    startURL, err := reader.ReadString('\n')
+    // Take the starting URL from -url, or ask for it on a terminal
+    startURLs, err := cfg.ResolveStartURLs()
     if err != nil {
         log.Fatalf("Error reading URL: %v", err)
     }
-    startURL = strings.TrimSpace(startURL)
-    startURL = preprocessURL(startURL)
+    startURL := preprocessURL(startURLs[0])
+
+    // Links are followed only where the scope rules (excluded_domains,
+    // scope_file) allow
+    scope, err := cfg.Scope([]string{startURL})
+    if err != nil {
+        log.Fatalf("Error loading crawl scope: %v", err)
+    }
+    proxies.Route(scope) // Scope rules may name their own proxy
 
     // Generate a file name based on the current system date/time and the initial URL
     fileName := fmt.Sprintf("%s_%s_HyperLogLog.txt", time.Now().Format("2006-01-02T150405"), urlToFileName(startURL))
@@ -76,33 +137,34 @@ func main() {
     go func() {
         for range ticker.C {
             runtime.ReadMemStats(&memStats)
-            fmt.Printf("Links processed: %d, Unique links (estimate): %d, Cache misses: %d, Goroutines: %d\n",
-                linksProcessed, hll.Estimate(), memStats.Mallocs-memStats.Frees, runtime.NumGoroutine())
+            fmt.Printf("Links processed: %d, Unique links (estimate): %d, Cache misses: %d, Goroutines: %d, Blocked by robots.txt: %d, Politeness: %s\n",
+                linksProcessed, hll.Estimate(), memStats.Mallocs-memStats.Frees, runtime.NumGoroutine(), robots.Blocked(), polite.Summary(3))
         }
     }()
 
-    // On every <a> element which has href attribute call callback
-    c.OnHTML("a[href]", func(e *colly.HTMLElement) {
+    // On every page, follow the links in anchors, frames, embeds, refreshes, srcset and scripts
+    c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
         wg.Add(1)
         defer wg.Done()
 
-        link := e.Attr("href")
-        link = preprocessURL(link)
-        if link == "" {
-            return
-        }
+        for _, found := range crawlkit.ExtractLinks(e) {
+            link := preprocessURL(found.URL)
+            if link == "" || !found.Page() || !scope.Allows(link, e.Request.Depth+1) {
+                continue
+            }
 
-        linksProcessed++
-        hll.Insert([]byte(link))
+            linksProcessed++
+            hll.Insert([]byte(link))
 
-        output := fmt.Sprintf("Visiting: %s\n", link)
-        fmt.Print(output)
-        file.WriteString(output + "\n") // Ensure new line for each link
+            output := fmt.Sprintf("Visiting: %s (from %s)\n", link, found.Source)
+            fmt.Print(output)
+            file.WriteString(output + "\n") // Ensure new line for each link
 
-        // Visit the link
-        err := e.Request.Visit(link)
-        if err != nil {
-            log.Printf("Error visiting link: %s, error: %v\n", link, err)
+            // Visit the link
+            err := e.Request.Visit(link)
+            if err != nil {
+                log.Printf("Error visiting link: %s, error: %v\n", link, err)
+            }
         }
     })
 
@@ -114,33 +176,35 @@ func main() {
     ticker.Stop()
 
     // Log the telemetry data
-    telemetryOutput := fmt.Sprintf("Crawl finished.\nTotal links processed: %d\nUnique links found (estimate): %d\n",
-        linksProcessed, hll.Estimate())
+    status := "Crawl finished."
+    if reason := budget.Exhausted(); reason != "" {
+        status = fmt.Sprintf("Crawl stopped: %s budget ran out.", reason)
+    } else if shutdown.Stopping() {
+        status = "Crawl interrupted."
+    }
+    telemetryOutput := fmt.Sprintf("%s\nTotal links processed: %d\nUnique links found (estimate): %d\nBlocked by robots.txt: %d\nOut of scope: %s\nBudget: %s\nProxies: %s\nTLS: %s\nPoliteness: %s\n",
+        status, linksProcessed, hll.Estimate(), robots.Blocked(), scope.Summary(), budget.Summary(), proxies.Summary(), cfg.TLS.Report().Summary(), polite.Summary(10))
     fmt.Print(telemetryOutput)
     file.WriteString(telemetryOutput)
-}
 
-func preprocessURL(inputURL string) string {
-    parsedURL, err := url.Parse(inputURL)
-    if err != nil {
-        return ""
+    // Keep the final telemetry with the crawl's WARC records
+    if err := archive.WriteMetadata(startURL, "text/plain", []byte(telemetryOutput)); err != nil {
+        log.Printf("Error writing WARC metadata: %v", err)
     }
-
-    if parsedURL.Scheme == "" {
-        parsedURL.Scheme = "http"
+    if err := archive.Close(); err != nil {
+        log.Printf("Error closing WARC output: %v", err)
     }
+    fmt.Printf("WARC archive: %s\n", archive.Summary())
+}
 
-    if parsedURL.Host == "" {
+// preprocessURL returns the canonical form of an http(s) URL, which is also
+// its dedup key, or "" if the URL cannot be crawled
+func preprocessURL(inputURL string) string {
+    key, err := canon.Canonicalize(inputURL)
+    if err != nil || !(strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")) {
         return ""
     }
-
-    hostname := strings.ToLower(parsedURL.Hostname())
-    if strings.HasPrefix(hostname, "www.") {
-        hostname = strings.TrimPrefix(hostname, "www.")
-    }
-    parsedURL.Host = hostname
-
-    return parsedURL.String()
+    return key
 }
 
 func urlToFileName(url string) string {
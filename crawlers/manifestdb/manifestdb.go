@@ -0,0 +1,211 @@
+// manifestdb loads download manifests (the JSONL files hellmouth writes,
+// see crawlkit's readme) into a SQLite database and runs queries on it.
+//
+//	manifestdb -db downloads.db downloads_20250301_120000.jsonl
+//	manifestdb -db downloads.db -q "SELECT error_class, count(*) FROM downloads GROUP BY 1"
+//
+// Loading a manifest again replaces its rows, so a manifest that is still
+// growing can be reloaded at any time.
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS downloads (
+	id            INTEGER PRIMARY KEY,
+	manifest      TEXT NOT NULL,
+	time          TEXT NOT NULL,
+	url           TEXT NOT NULL,
+	final_url     TEXT,
+	referrer      TEXT,
+	depth         INTEGER,
+	attempt       INTEGER,
+	interface     TEXT,
+	local_ip      TEXT,
+	worker        TEXT,
+	status        INTEGER,
+	content_type  TEXT,
+	proto         TEXT,
+	proxy         TEXT,
+	size          INTEGER,
+	received      INTEGER,
+	resumed       INTEGER,
+	sha256        TEXT,
+	path          TEXT,
+	stored        INTEGER,
+	dns_ms        INTEGER,
+	connect_ms    INTEGER,
+	tls_ms        INTEGER,
+	first_byte_ms INTEGER,
+	total_ms      INTEGER,
+	error_class   TEXT,
+	error         TEXT,
+	cert          TEXT
+);
+CREATE INDEX IF NOT EXISTS downloads_url ON downloads(url);
+CREATE INDEX IF NOT EXISTS downloads_sha256 ON downloads(sha256);
+CREATE INDEX IF NOT EXISTS downloads_error_class ON downloads(error_class);
+CREATE INDEX IF NOT EXISTS downloads_manifest ON downloads(manifest);
+`
+
+// addedColumns are the columns added to the schema since its first
+// version; databases created before them get them with ALTER TABLE.
+var addedColumns = []struct{ name, typ string }{
+	{"proto", "TEXT"},
+	{"proxy", "TEXT"},
+	{"cert", "TEXT"}, // The certificate of "tls" errors, as JSON
+}
+
+const insert = `INSERT INTO downloads (
+	manifest, time, url, final_url, referrer, depth, attempt, interface, local_ip, worker,
+	status, content_type, proto, proxy, size, received, resumed, sha256, path, stored,
+	dns_ms, connect_ms, tls_ms, first_byte_ms, total_ms, error_class, error, cert
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+func main() {
+	dbPath := flag.String("db", "downloads.db", "SQLite database to load into and query")
+	query := flag.String("q", "", "SQL query to run after loading; rows are printed tab-separated")
+	flag.Parse()
+
+	db, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		log.Fatalf("Error opening database: %s", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schema); err != nil {
+		log.Fatalf("Error creating schema: %s", err)
+	}
+	if err := migrate(db); err != nil {
+		log.Fatalf("Error updating schema: %s", err)
+	}
+
+	for _, path := range flag.Args() {
+		n, err := load(db, path)
+		if err != nil {
+			log.Fatalf("Error loading %s: %s", path, err)
+		}
+		log.Printf("Loaded %d records from %s", n, path)
+	}
+
+	if *query != "" {
+		if err := run(db, *query); err != nil {
+			log.Fatalf("Error running query: %s", err)
+		}
+	}
+}
+
+// migrate adds the columns of addedColumns that the downloads table lacks.
+func migrate(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('downloads')`)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, col := range addedColumns {
+		if have[col.name] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE downloads ADD COLUMN ` + col.name + ` ` + col.typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load replaces the rows of the manifest at path in one transaction.
+func load(db *sql.DB, path string) (int, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM downloads WHERE manifest = ?`, abs); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(insert)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	n := 0
+	err = crawlkit.ReadManifest(path, func(r crawlkit.ManifestRecord) error {
+		var cert sql.NullString
+		if r.Cert != nil {
+			data, err := json.Marshal(r.Cert)
+			if err != nil {
+				return err
+			}
+			cert = sql.NullString{String: string(data), Valid: true}
+		}
+		_, err := stmt.Exec(abs, r.Time.Format(time.RFC3339Nano), r.URL, r.FinalURL, r.Referrer,
+			r.Depth, r.Attempt, r.Interface, r.LocalIP, r.Worker,
+			r.Status, r.ContentType, r.Proto, r.Proxy, r.Size, r.Received, r.Resumed, r.SHA256, r.Path, r.Stored,
+			r.DNSMs, r.ConnectMs, r.TLSMs, r.FirstByteMs, r.TotalMs, r.ErrorClass, r.Error, cert)
+		n++
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// run prints the rows of query, with a header line.
+func run(db *sql.DB, query string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.Join(cols, "\t"))
+
+	values := make([]sql.NullString, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	fields := make([]string, len(cols))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			fields[i] = v.String
+		}
+		fmt.Println(strings.Join(fields, "\t"))
+	}
+	return rows.Err()
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -59,7 +58,6 @@ func main() {
 				IP: getInterfaceIP(selectedInterface),
 			},
 		}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
 		MaxIdleConns:    100,                                   // Increase max idle connections
 		MaxIdleConnsPerHost: 50,                                // Increase max idle connections per host
 		IdleConnTimeout: 90 * time.Second,                      // Set idle connection timeout
@@ -68,7 +66,6 @@ func main() {
 	// Set up QUIC transport
 	quicTransport := &http3.RoundTripper{
 		QUICConfig:      &quic.Config{}, // Correct field name
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
 	}
 
 	// Prompt for download directory
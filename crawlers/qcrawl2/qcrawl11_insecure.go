@@ -1,26 +1,21 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 	"github.com/gocolly/colly/queue"
 )
 
 const (
-	visitedFilePath = "visitedURLs.txt"
-	downloadTimeout = 10 * time.Second // Timeout for downloading PDFs
+	legacyVisitedFile = "visitedURLs.txt" // Imported into the visited journal on first run
 )
 
 var (
@@ -28,198 +23,303 @@ var (
 		"facebook.com", "youtube.com", "reddit.com", "linkedin.com",
 		"wikipedia.org", "twitter.com", "pubchem.ncbi.nlm.nih.gov", "ncbi.nlm.nih.gov",
 	}
-	visitedURLsMap = &sync.Map{}
-	delayedQueue   = make(chan string, 1000) // Increased channel size
+	visited      *crawlkit.VisitedJournal  // URLs already seen, kept across runs
+	delayedQueue = make(chan string, 1000) // Increased channel size
+
+	downloadTimeout = 10 * time.Second // Timeout for downloading PDFs
+	tlsPolicy       = crawlkit.TLSPolicy{}
+	shutdown        *crawlkit.Shutdown      // Cancels downloads on Ctrl+C
+	canon           *crawlkit.Canonicalizer // Turns URLs into dedup keys (url_rules)
+	polite          *crawlkit.Politeness    // Per-host rate limits with adaptive backoff
+	classifier      *crawlkit.Classifier    // Decides which links are documents
+	namer           *crawlkit.Namer         // Names saved files (name_template, on_collision)
+	scope           *crawlkit.Scope         // Which pages may be crawled (excluded_domains, scope_file)
+	archive         *crawlkit.WARCWriter    // Archives pages and downloads as WARC (warc_dir)
+	budget          *crawlkit.Budget        // Page, byte and time limits (max_pages, max_mb, max_time, host_max_*)
+	ftpClient       *crawlkit.FTPClient     // Passive-mode FTP for ftp:// documents and directories
+	proxies         *crawlkit.Proxies       // Rotating proxy pool and per-rule proxies (proxies, scope rule proxy)
 )
 
 func main() {
-	// Prompt for network interface
-	interfaces, err := net.Interfaces()
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+		Workers:         32,
+		DownloadTimeout: crawlkit.Duration{Duration: downloadTimeout},
+		ExcludedDomains: excludedDomains,
+		TLS:             tlsPolicy,
+	})
 	if err != nil {
-		log.Fatalf("Error listing network interfaces: %s", err)
+		log.Fatalf("Error loading configuration: %s", err)
 	}
+	downloadTimeout = cfg.DownloadTimeout.Duration
+	tlsPolicy = cfg.TLS
 
-	fmt.Println("Available network interfaces:")
-	for i, iface := range interfaces {
-		fmt.Printf("%d: %s\n", i+1, iface.Name)
+	// Resolve the network interface (prompts only when run from a terminal)
+	localIP, err := cfg.ResolveLocalIP()
+	if err != nil {
+		log.Fatalf("Error selecting network interface: %s", err)
 	}
 
-	var selectedIndex int
-	fmt.Println("Select the network interface to use (enter the number): ")
-	fmt.Scanln(&selectedIndex)
+	// Route requests through the -proxy pool and the scope rules' proxies
+	proxies, err = cfg.Proxies()
+	if err != nil {
+		log.Fatalf("Error setting up proxies: %s", err)
+	}
 
-	if selectedIndex < 1 || selectedIndex > len(interfaces) {
-		log.Fatalf("Invalid network interface selection")
+	// Set up HTTP transport to use the selected interface
+	transport := proxies.Transport(tlsPolicy.Apply(&http.Transport{
+		Dial:                crawlkit.Dialer(localIP).Dial,
+		TLSClientConfig:     tlsPolicy.ClientConfig(),
+		MaxIdleConns:        100,              // Increase max idle connections
+		MaxIdleConnsPerHost: 50,               // Increase max idle connections per host
+		IdleConnTimeout:     90 * time.Second, // Set idle connection timeout
+	}))
+
+	selectedDir, err := cfg.ResolveOutputDir("pdf-scrape")
+	if err != nil {
+		log.Fatalf("Error selecting download directory: %s", err)
 	}
 
-	selectedInterface := interfaces[selectedIndex-1]
+	// Open the visited-URL journal, importing visitedURLs.txt the first time
+	visited, err = cfg.OpenVisited(legacyVisitedFile)
+	if err != nil {
+		log.Fatalf("Error opening visited journal: %s", err)
+	}
 
-	// Set up HTTP transport to use the selected interface
-	transport := &http.Transport{
-		Dial: (&net.Dialer{
-			LocalAddr: &net.TCPAddr{
-				IP: getInterfaceIP(selectedInterface),
-			},
-		}).Dial,
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
-		MaxIdleConns:    100,                                   // Increase max idle connections
-		MaxIdleConnsPerHost: 50,                                // Increase max idle connections per host
-		IdleConnTimeout: 90 * time.Second,                      // Set idle connection timeout
-	}
-
-	// Prompt for download directory
-	dirs, err := os.ReadDir(".")
+	startURLs, err := cfg.ResolveStartURLs()
 	if err != nil {
-		log.Fatalf("Error reading current directory: %s", err)
+		log.Fatalf("Error reading starting URL: %s", err)
 	}
 
-	dirList := []os.DirEntry{}
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			dirList = append(dirList, dir)
+	// Canonical URLs are the dedup keys for the visited journal and colly
+	canon = cfg.Canonicalizer()
+
+	var startingURLs []string
+	for _, startingURL := range startURLs {
+		startingURL, err = canon.Canonicalize(startingURL)
+		if err != nil {
+			log.Fatalf("Error canonicalizing starting URL: %s", err)
 		}
+		if err := validateURL(startingURL); err != nil {
+			log.Fatalf("Error validating starting URL: %s", err)
+		}
+		startingURLs = append(startingURLs, startingURL)
 	}
 
-	fmt.Println("Available directories:")
-	for i, dir := range dirList {
-		fmt.Printf("%d: %s\n", i+1, dir.Name())
+	// Links are followed only where the scope rules allow; excluded_domains
+	// match their subdomains too
+	scope, err = cfg.Scope(startingURLs)
+	if err != nil {
+		log.Fatalf("Error loading crawl scope: %s", err)
 	}
+	proxies.Route(scope) // Scope rules may name their own proxy
 
-	fmt.Println("0: Create a new directory named 'pdf-scrape-<timestamp>'")
+	// Archive every page and document exchange as WARC/1.1 when -warc is set
+	archive, err = cfg.OpenWARC("qcrawl11_insecure")
+	if err != nil {
+		log.Fatalf("Error opening WARC output: %s", err)
+	}
 
-	var selectedDirIndex int
-	fmt.Println("Select the directory to store downloaded PDFs (enter the number or hit enter for default): ")
-	_, err = fmt.Scanln(&selectedDirIndex)
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget = cfg.Budget()
 
-	var selectedDir string
-	if err != nil || selectedDirIndex == 0 {
-		// Create a new directory with timestamp
-		timestamp := time.Now().Format("20060102150405")
-		selectedDir = fmt.Sprintf("pdf-scrape-%s", timestamp)
-		if err := os.Mkdir(selectedDir, 0755); err != nil {
-			log.Fatalf("Error creating directory: %s", err)
-		}
-		fmt.Printf("Created new directory: %s\n", selectedDir)
-	} else if selectedDirIndex < 1 || selectedDirIndex > len(dirList) {
-		log.Fatalf("Invalid directory selection")
-	} else {
-		selectedDir = dirList[selectedDirIndex-1].Name()
+	// ftp:// links leave from the same interface and count against the budget
+	ftpClient = &crawlkit.FTPClient{
+		Dialer:   crawlkit.Dialer(localIP),
+		Timeout:  downloadTimeout,
+		Budget:   budget,
+		MaxDepth: cfg.MaxDepth,
 	}
 
-	// Load visited URLs
-	loadVisitedURLs()
+	c := colly.NewCollector(colly.MaxDepth(cfg.MaxDepth))
+	c.WithTransport(budget.Transport(archive.Transport(transport))) // Set the transport directly on the collector
 
-	// Prompt for starting URL
-	var startingURL string
-	fmt.Println("Enter the starting URL to crawl: ")
-	fmt.Scanln(&startingURL)
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
+	}
 
-	// Lazy evaluation of the initial URL
-	startingURL = normalizeURL(startingURL)
+	// Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+	var robots *crawlkit.Robots
+	if !cfg.IgnoreRobots {
+		robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+	}
 
-	// Sanitize and validate the starting URL
-	startingURL, err = sanitizeURL(startingURL)
+	// Create a request queue with one consumer thread per configured worker,
+	// backed by an on-disk frontier that survives restarts
+	frontier := cfg.QueueStorage()
+	q, err := queue.New(cfg.Workers, frontier)
 	if err != nil {
-		log.Fatalf("Error sanitizing starting URL: %s", err)
+		log.Fatalf("Error creating queue: %s", err)
 	}
 
-	err = validateURL(startingURL)
+	// Ctrl+C stops taking requests off the frontier and cancels downloads in
+	// flight; a second Ctrl+C exits at once
+	shutdown = crawlkit.NewShutdown()
+	go func() {
+		<-shutdown.Done()
+		frontier.Stop()
+	}()
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
+
+	// robots.txt is consulted after the callbacks that may abort a
+	// request and before politeness, so that only requests that are sent
+	// wait out Crawl-delay or take a host token
+	if robots != nil {
+		robots.Context = shutdown.Context()
+		robots.Attach(c)
+	}
+
+	// Space requests to each host and slow down for hosts that answer
+	// 429/503 or reset connections; downloads share the same buckets
+	polite = cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+
+	// Links are downloaded when the server says they serve a document
+	// (collect, doc_sets, doc_types), not because they end in .pdf
+	classifier, err = cfg.Classifier(c.UserAgent, &http.Client{Transport: budget.Transport(polite.Transport(transport)), Timeout: 30 * time.Second})
 	if err != nil {
-		log.Fatalf("Error validating starting URL: %s", err)
+		log.Fatalf("Error configuring document sets: %s", err)
 	}
+	classifier.Context = shutdown.Context()
+	classifier.Robots = robots
+	classifier.Budget = budget
 
-	c := colly.NewCollector()
-	c.WithTransport(transport) // Set the transport directly on the collector
-
-	// Create a request queue with 32 consumer threads (to utilize the 16-core CPU)
-	q, err := queue.New(32, &queue.InMemoryQueueStorage{MaxSize: 20000})
+	// Saved files are laid out by name_template and never overwrite each
+	// other unless on_collision says so; each document is stored once in
+	// store_dir and linked under every name it is saved as
+	namer, err = cfg.Namer()
 	if err != nil {
-		log.Fatalf("Error creating queue: %s", err)
+		log.Fatalf("Error configuring file names: %s", err)
 	}
 
 	c.OnRequest(func(r *colly.Request) {
-		log.Println("Visiting", r.URL.String())
+		log.Printf("Visiting %s (%d queued)", r.URL.String(), frontier.Len())
 	})
 
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-
-		u, err := url.Parse(link)
-		if err != nil {
-			log.Printf("Error parsing URL %s: %s", link, err)
+	// downloadPDF fetches one document; anchors and sitemap entries both feed it
+	downloadPDF := func(pdfURL string) {
+		if u, err := url.Parse(pdfURL); err == nil && !robots.Check(u) {
+			log.Printf("Skipping %s: disallowed by robots.txt", pdfURL)
 			return
 		}
-
-		if isExcludedDomain(u.Host) {
-			return
-		}
-
-		absoluteURL := e.Request.AbsoluteURL(link)
-		if !hasVisited(absoluteURL) {
-			saveVisitedURL(absoluteURL)
-			q.AddURL(absoluteURL)
-		}
-	})
-
-	c.OnHTML("a[href$='.pdf']", func(e *colly.HTMLElement) {
-		pdfURL := e.Request.AbsoluteURL(e.Attr("href"))
 		log.Printf("Found PDF URL: %s", pdfURL)
 		err := downloadFileWithTimeout(pdfURL, selectedDir)
 		if err != nil {
 			log.Printf("Error downloading file: %s", err)
 		}
-	})
+	}
 
-	log.Printf("Adding starting URL to queue: %s", startingURL)
-	q.AddURL(startingURL)
-	go processDelayedQueue(selectedDir)
-	log.Println("Starting the crawler...")
-	q.Run(c)
-	log.Println("Crawler finished.")
-}
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+		for _, link := range crawlkit.ExtractLinks(e) {
+			u, err := url.Parse(link.URL)
+			if err != nil {
+				log.Printf("Error parsing URL %s: %s", link.URL, err)
+				continue
+			}
 
-func loadVisitedURLs() {
-	log.Println("Loading visited URLs...")
-	data, err := os.ReadFile(visitedFilePath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("Error reading visited URLs file: %s", err)
+			if ok, _ := scope.Check(u, e.Request.Depth+1); !ok {
+				continue
+			}
+			// Documents are downloaded wherever they were found; other links
+			// are pages to queue only when Link.Page says so
+			if classifier.IsDocument(link.URL) || crawlkit.IsFTPDirectory(link.URL) {
+				downloadPDF(link.URL)
+				continue
+			}
+			if !link.Page() {
+				continue
+			}
+
+			absoluteURL, err := canon.Canonicalize(link.URL)
+			if err != nil {
+				continue
+			}
+			if !hasVisited(absoluteURL) {
+				saveVisitedURL(absoluteURL)
+				crawlkit.EnqueueLink(q, e.Request, crawlkit.Link{URL: absoluteURL, Source: link.Source})
+			}
 		}
-		return
+	})
+
+	for _, startingURL := range startingURLs {
+		log.Printf("Adding starting URL to queue: %s", startingURL)
+		q.AddURL(startingURL)
 	}
 
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		if line != "" {
-			visitedURLsMap.Store(line, true)
+	// Seed from sitemaps: listed PDFs go straight to download, pages join the queue
+	var sitemapDocs []crawlkit.SitemapEntry
+	if !cfg.NoSitemaps {
+		sitemaps := crawlkit.NewSitemaps(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second}, robots)
+		sitemaps.Scope = scope
+		sitemapDocs = sitemaps.Seed(startingURLs, classifier.IsDocument, func(e crawlkit.SitemapEntry) {
+			u, err := url.Parse(e.Loc)
+			if err != nil {
+				return
+			}
+			loc, err := canon.CanonicalizeURL(u)
+			if err != nil {
+				return
+			}
+			e.Loc = loc
+			if !hasVisited(e.Loc) {
+				saveVisitedURL(e.Loc)
+				crawlkit.EnqueueSitemapEntry(q, e)
+			}
+		})
+	}
+	sitemapDone := make(chan struct{})
+	go func() {
+		defer close(sitemapDone)
+		for _, doc := range sitemapDocs {
+			if shutdown.Stopping() {
+				return
+			}
+			downloadPDF(doc.Loc)
 		}
-	}
-	log.Println("Visited URLs loaded.")
+	}()
+
+	go processDelayedQueue(selectedDir)
+	log.Println("Starting the crawler...")
+	q.Run(c)
+	<-sitemapDone
+	frontier.Close()
+	if err := visited.Close(); err != nil {
+		log.Printf("Error closing visited journal: %s", err)
+	}
+	if shutdown.Stopping() {
+		log.Printf("Interrupted: %d requests left in %s for the next run.", frontier.Len(), frontier.Dir)
+	}
+	log.Printf("Crawler finished. %d URLs blocked by robots.txt.", robots.Blocked())
+	log.Printf("Budget: %s", budget.Summary())
+	log.Printf("Proxies: %s", proxies.Summary())
+	log.Printf("TLS: %s", tlsPolicy.Report().Summary())
+	log.Printf("Out of scope: %s", scope.Summary())
+	log.Printf("Per-host politeness: %s", polite.Summary(10))
+	if err := namer.Store.Close(); err != nil {
+		log.Printf("Error closing document store: %s", err)
+	}
+	log.Printf("Document store: %s", namer.Store.Summary())
+	if err := archive.Close(); err != nil {
+		log.Printf("Error closing WARC output: %s", err)
+	}
+	log.Printf("WARC archive: %s", archive.Summary())
 }
 
 func hasVisited(url string) bool {
-	_, found := visitedURLsMap.Load(url)
-	return found
+	return visited.Seen(url)
 }
 
 func saveVisitedURL(url string) {
-	visitedURLsMap.Store(url, true)
-
-	f, err := os.OpenFile(visitedFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Error saving URL to file: %s", err)
-		return
-	}
-	defer f.Close()
-
-	_, err = f.WriteString(url + "\n")
-	if err != nil {
-		log.Printf("Error writing to file: %s", err)
-	}
+	visited.Mark(url)
 }
 
 func downloadFileWithTimeout(URL, dir string) error {
 	log.Printf("Downloading file from URL: %s", URL)
+	dir = classifier.Dir(dir, URL) // Each document set has its own subfolder
 	u, err := url.Parse(URL)
 	if err != nil {
 		return err
@@ -238,34 +338,27 @@ func downloadFileWithTimeout(URL, dir string) error {
 func downloadHTTPFileWithTimeout(URL, dir string) error {
 	client := &http.Client{
 		Timeout: downloadTimeout,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
-		},
+		Transport: budget.Transport(polite.Transport(archive.Transport(proxies.Transport(tlsPolicy.Apply(&http.Transport{
+			TLSClientConfig: tlsPolicy.ClientConfig(),
+		}))))),
 	}
-	resp, err := client.Get(URL)
+	req, err := http.NewRequestWithContext(shutdown.Context(), "GET", URL, nil)
 	if err != nil {
-		log.Printf("HTTP request failed for URL %s: %s", URL, err)
-		delayedQueue <- URL // Store the delayed request in the queue
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Unexpected status code: %d for URL: %s", resp.StatusCode, URL)
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	// Resumes the .part file of an earlier attempt with Range/If-Range
+	_, _, err = crawlkit.DownloadFile(shutdown.Context(), client, req, dir, namer, nil)
+	var statusErr *crawlkit.StatusError
+	if errors.As(err, &statusErr) {
+		log.Printf("Unexpected status code: %d for URL: %s", statusErr.Code, URL)
+		return fmt.Errorf("unexpected status code: %d", statusErr.Code)
 	}
-
-	segments := strings.Split(URL, "/")
-	fileName := segments[len(segments)-1]
-	filePath := filepath.Join(dir, fileName)
-
-	out, err := os.Create(filePath)
 	if err != nil {
-		return err
+		log.Printf("HTTP request failed for URL %s: %s", URL, err)
+		if !shutdown.Stopping() && !errors.Is(err, crawlkit.ErrBudget) {
+			delayedQueue <- URL // Store the delayed request in the queue
+		}
 	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
 	return err
 }
 
@@ -275,39 +368,37 @@ func downloadFTPFile(URL, dir string) error {
 		return err
 	}
 
-	segments := strings.Split(u.Path, "/")
-	fileName := segments[len(segments)-1]
-	filePath := filepath.Join(dir, fileName)
-
-	out, err := os.Create(filePath)
-	if err != nil {
+	// Directories are mirrored, keeping the documents the classifier wants
+	if crawlkit.IsFTPDirectory(URL) {
+		n, err := ftpClient.Mirror(shutdown.Context(), u, namer, func(link string) string {
+			if !classifier.IsDocument(link) {
+				return ""
+			}
+			return classifier.Dir(dir, link)
+		})
+		log.Printf("Mirrored %d files from %s", n, URL)
 		return err
 	}
-	defer out.Close()
 
-	conn, err := net.DialTimeout("tcp", u.Host, downloadTimeout)
+	_, err = ftpClient.Download(shutdown.Context(), u, dir, namer, nil)
 	if err != nil {
-		log.Printf("FTP connection failed for URL %s: %s", URL, err)
-		delayedQueue <- URL // Store the delayed request in the queue
+		log.Printf("FTP download failed for URL %s: %s", URL, err)
+		if !shutdown.Stopping() && retryFTP(err) {
+			delayedQueue <- URL // Store the delayed request in the queue
+		}
 		return err
 	}
-	defer conn.Close()
+	return nil
+}
 
-	_, err = conn.Write([]byte(fmt.Sprintf("USER anonymous\r\n")))
-	if err != nil {
-		return err
+// retryFTP reports whether an FTP download that failed with err may work
+// later: not when the server refused for good or the budget ran out
+func retryFTP(err error) bool {
+	var ftpErr *crawlkit.FTPError
+	if errors.As(err, &ftpErr) {
+		return ftpErr.Temporary()
 	}
-	_, err = conn.Write([]byte(fmt.Sprintf("PASS \r\n")))
-	if err != nil {
-		return err
-	}
-	_, err = conn.Write([]byte(fmt.Sprintf("RETR %s\r\n", u.Path)))
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copy(out, conn)
-	return err
+	return !errors.Is(err, crawlkit.ErrBudget)
 }
 
 func processDelayedQueue(selectedDir string) {
@@ -319,71 +410,14 @@ func processDelayedQueue(selectedDir string) {
 			if err != nil {
 				log.Printf("Error retrying download for URL %s: %s", url, err)
 			}
+		case <-shutdown.Done():
+			return
 		case <-time.After(1 * time.Minute):
 			log.Println("No delayed requests to process")
 		}
 	}
 }
 
-func isExcludedDomain(host string) bool {
-	for _, domain := range excludedDomains {
-		if host == domain {
-			return true
-		}
-	}
-	return false
-}
-
-func getInterfaceIP(iface net.Interface) net.IP {
-	addrs, err := iface.Addrs()
-	if err != nil {
-		log.Fatalf("Error getting addresses for interface %s: %s", iface.Name, err)
-	}
-
-	for _, addr := range addrs {
-		var ip net.IP
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
-		}
-		if ip == nil || ip.IsLoopback() {
-			continue
-		}
-		if ip.To4() != nil {
-			return ip
-		}
-	}
-
-	log.Fatalf("No valid IP address found for interface %s", iface.Name)
-	return nil
-}
-
-func normalizeURL(urlStr string) string {
-	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
-		urlStr = "https://" + urlStr
-	}
-
-	if !strings.HasPrefix(urlStr, "https://www.") {
-		urlStr = strings.Replace(urlStr, "https://", "https://www.", 1)
-	}
-
-	return urlStr
-}
-
-func sanitizeURL(urlStr string) (string, error) {
-	u, err := url.Parse(urlStr)
-	if err != nil {
-		return "", err
-	}
-
-	// Encode the path to handle invalid characters
-	u.Path = strings.ReplaceAll(u.Path, ":", "%3A")
-
-	return u.String(), nil
-}
-
 func validateURL(urlStr string) error {
 	u, err := url.Parse(urlStr)
 	if err != nil {
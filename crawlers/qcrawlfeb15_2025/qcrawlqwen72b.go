@@ -1,7 +1,6 @@
 package main
 
 import (
-    "crypto/tls"
     "fmt"
     "io"
     "log"
@@ -32,9 +31,7 @@ func main() {
     // Set up shared HTTP client
     httpClient = &http.Client{
         Timeout: downloadTimeout,
-        Transport: &http.Transport{
-            TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // Skip certificate verification
-        },
+        Transport: &http.Transport{},
     }
 
     // Prompt for starting URL
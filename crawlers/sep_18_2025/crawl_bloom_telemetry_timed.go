@@ -1,8 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -10,56 +10,98 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
-	"github.com/willf/bloom"
 )
 
-const (
-	filterSize = 1000000
-)
+// canon turns URLs into dedup keys; main applies the url_rules config
+var canon = crawlkit.DefaultCanonicalizer
 
 func main() {
-	// Initialize the Bloom filter
-	filter := bloom.New(filterSize, 5)
-	
 	// Variables for telemetry (using atomic for thread safety)
-	var linksProcessed, uniqueLinks int64
+	var linksProcessed, uniqueLinks, pagesVisited int64
 	var mu sync.Mutex // Mutex to protect shared variables
 
-	// Read the starting URL from the user
-	fmt.Print("Enter the starting URL: ")
-	reader := bufio.NewReader(os.Stdin)
-	startURL, _ := reader.ReadString('\n')
-	startURL = strings.TrimSpace(startURL)
-	startURL = preprocessURL(startURL)
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+		MaxDepth: 3, Workers: 2, HostRate: 1, HostBurst: 1,
+		// Stay on the starting site, subdomains included, unless -scope says otherwise
+		ScopeRules: []crawlkit.ScopeRule{{Name: "same-site", Action: "allow", Domains: []string{"$start"}}},
+	})
+	if err != nil {
+		fmt.Println("Error loading configuration:", err)
+		return
+	}
+	canon = cfg.Canonicalizer()
+
+	// Load the Bloom filter from the last run, or size a new one from
+	// -expected-urls and -bloom-fp
+	filter, err := cfg.LoadBloom()
+	if err != nil {
+		fmt.Println("Error loading Bloom filter:", err)
+		return
+	}
+	fmt.Printf("Bloom filter %s: %d URLs in %d stage(s), estimated FP rate %.4g\n",
+		cfg.BloomFile, filter.Count(), filter.Stages(), filter.EstimatedFPRate())
+
+	// Take the starting URL from -url, or ask for it on a terminal
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		fmt.Println("Error reading starting URL:", err)
+		return
+	}
+	startURL := preprocessURL(startURLs[0])
 	
 	if startURL == "" {
 		fmt.Println("Invalid starting URL")
 		return
 	}
 
-	// Parse the starting URL to get the domain for restriction
-	parsedStart, err := url.Parse(startURL)
+	// Links are followed only where the scope rules allow, by default
+	// within the starting URL's registered domain
+	scope, err := cfg.Scope([]string{startURL})
+	if err != nil {
+		fmt.Println("Error loading crawl scope:", err)
+		return
+	}
+
+	// Archive every page exchange as WARC/1.1 when -warc is set
+	archive, err := cfg.OpenWARC("crawl_bloom_telemetry_timed")
 	if err != nil {
-		fmt.Println("Error parsing starting URL:", err)
+		fmt.Println("Error opening WARC output:", err)
 		return
 	}
-	baseDomain := parsedStart.Hostname()
-	// Remove www. for domain matching
-	if strings.HasPrefix(baseDomain, "www.") {
-		baseDomain = strings.TrimPrefix(baseDomain, "www.")
+
+	// Serve pages, links and per-host latency for Prometheus when -metrics is set
+	metrics, err := cfg.Metrics("crawl_bloom_telemetry_timed")
+	if err != nil {
+		fmt.Println("Error starting metrics endpoint:", err)
+		return
 	}
 
-	fmt.Printf("Crawling domain: %s\n", baseDomain)
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget := cfg.Budget()
+
+	// Requests go through the -proxy pool, or the proxy of the scope rule
+	// they match
+	proxies, err := cfg.Proxies()
+	if err != nil {
+		fmt.Println("Error setting up proxies:", err)
+		return
+	}
+	proxies.Route(scope)
+	if err := metrics.AddProxies(proxies); err != nil {
+		fmt.Println("Error adding proxy metrics:", err)
+	}
 
 	// Create a new collector
 	c := colly.NewCollector(
-		colly.MaxDepth(3),
+		colly.MaxDepth(cfg.MaxDepth),
 		colly.Async(true),
 	)
-
-	// Restrict to the same domain
-	c.AllowedDomains = []string{baseDomain, "www." + baseDomain}
+	c.WithTransport(budget.Transport(metrics.Transport(archive.Transport(proxies.Transport(cfg.TLS.Transport())))))
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
+	}
 
 	// Set reasonable timeouts
 	c.SetRequestTimeout(30 * time.Second)
@@ -67,10 +109,40 @@ func main() {
 	// Limit the maximum parallelism
 	c.Limit(&colly.LimitRule{
 		DomainGlob:  "*",
-		Parallelism: 2,
-		Delay:       1 * time.Second,
+		Parallelism: cfg.Workers,
 	})
 
+	// Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+	var robots *crawlkit.Robots
+	if !cfg.IgnoreRobots {
+		robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: proxies.Transport(cfg.TLS.Transport()), Timeout: 30 * time.Second})
+	}
+
+	// Ctrl+C stops new requests so the final telemetry is still written; a
+	// second Ctrl+C exits at once
+	shutdown := crawlkit.NewShutdown()
+	shutdown.Attach(c)
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
+
+	// robots.txt is consulted after the callbacks that may abort a
+	// request and before politeness, so that only requests that are sent
+	// wait out Crawl-delay or take a host token
+	if robots != nil {
+		robots.Context = shutdown.Context()
+		robots.Attach(c)
+	}
+
+	// One request per second per host by default, slowing down when a host
+	// answers 429/503 or resets connections
+	polite := cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+	metrics.Attach(c)
+
 	// Generate a file name based on the current system date/time and the initial URL
 	fileName := fmt.Sprintf("%s_%s.txt", time.Now().Format("2006-01-02T150405"), urlToFileName(startURL))
 	file, err := os.Create(fileName)
@@ -80,6 +152,25 @@ func main() {
 	}
 	defer file.Close()
 
+	// On a terminal, show the telemetry full-screen instead, with p/r/q to
+	// pause, resume and stop; everything printed goes to its log pane
+	dashboard := cfg.Dashboard("crawl_bloom_telemetry_timed", func() crawlkit.DashboardStats {
+		return crawlkit.DashboardStats{
+			Pages:  atomic.LoadInt64(&pagesVisited),
+			Links:  atomic.LoadInt64(&linksProcessed),
+			Unique: atomic.LoadInt64(&uniqueLinks),
+		}
+	})
+	if dashboard != nil {
+		dashboard.Polite = polite
+		dashboard.Shutdown = shutdown
+		if err := dashboard.Start(); err != nil {
+			fmt.Println("Error starting dashboard:", err)
+			return
+		}
+		defer dashboard.Stop()
+	}
+
 	// Set up a ticker to report telemetry at regular intervals
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
@@ -92,64 +183,52 @@ func main() {
 			case <-ticker.C:
 				processed := atomic.LoadInt64(&linksProcessed)
 				unique := atomic.LoadInt64(&uniqueLinks)
-				fmt.Printf("Links processed: %d, Unique links: %d\n", processed, unique)
+				fmt.Printf("Links processed: %d, Unique links: %d, Blocked by robots.txt: %d, Bloom FP rate: %.4g (%d stages), Politeness: %s\n",
+					processed, unique, robots.Blocked(), filter.EstimatedFPRate(), filter.Stages(), polite.Summary(3))
 			case <-done:
 				return
 			}
 		}
 	}()
 
-	// On every a element which has href attribute call callback
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		link := e.Attr("href")
-		
-		// Skip empty links
-		if strings.TrimSpace(link) == "" {
-			return
-		}
-
-		// Get absolute URL
-		absLink := e.Request.AbsoluteURL(link)
-		processedLink := preprocessURL(absLink)
-
-		if processedLink == "" {
-			return
-		}
+	// On every page, follow the links in anchors, frames, embeds, refreshes, srcset and scripts
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+		for _, found := range crawlkit.ExtractLinks(e) {
+			processedLink := preprocessURL(found.URL)
 
-		// Parse URL to check domain
-		parsedURL, err := url.Parse(processedLink)
-		if err != nil {
-			return
-		}
-		
-		linkDomain := parsedURL.Hostname()
-		if strings.HasPrefix(linkDomain, "www.") {
-			linkDomain = strings.TrimPrefix(linkDomain, "www.")
-		}
+			// Images, scripts and embedded objects are not pages to crawl
+			if processedLink == "" || !found.Page() {
+				continue
+			}
 
-		// Skip if not the same domain
-		if linkDomain != baseDomain {
-			return
-		}
+			// Skip links outside the crawl scope
+			parsedURL, err := url.Parse(processedLink)
+			if err != nil {
+				continue
+			}
+			if ok, _ := scope.Check(parsedURL, e.Request.Depth+1); !ok {
+				continue
+			}
 
-		atomic.AddInt64(&linksProcessed, 1)
+			atomic.AddInt64(&linksProcessed, 1)
 
-		// Check if the URL is already visited using Bloom filter
-		mu.Lock()
-		isNew := !filter.TestAndAdd([]byte(processedLink))
-		mu.Unlock()
+			// Check if the URL is already visited using Bloom filter
+			isNew := !filter.TestAndAdd([]byte(processedLink))
+			metrics.Link(isNew)
 
-		if isNew {
-			atomic.AddInt64(&uniqueLinks, 1)
-			output := fmt.Sprintf("Found: %s\n", processedLink)
-			fmt.Print(output)
+			if isNew {
+				atomic.AddInt64(&uniqueLinks, 1)
+				output := fmt.Sprintf("Found: %s (from %s)\n", processedLink, found.Source)
+				fmt.Print(output)
 			
-			mu.Lock()
-			file.WriteString(output)
-			mu.Unlock()
+				mu.Lock()
+				file.WriteString(output)
+				mu.Unlock()
 
-			// Visit the link (Colly will handle the queuing in async mode)
-			c.Visit(processedLink)
+				// Visit the link (Colly will handle the queuing in async mode),
+				// tagged with where it was found
+				c.Request("GET", processedLink, nil, crawlkit.LinkContext(found.Source), nil)
+			}
 		}
 	})
 
@@ -160,6 +239,7 @@ func main() {
 
 	// Log successful requests
 	c.OnResponse(func(r *colly.Response) {
+		atomic.AddInt64(&pagesVisited, 1)
 		fmt.Printf("Visited: %s\n", r.Request.URL)
 	})
 
@@ -167,9 +247,7 @@ func main() {
 	fmt.Printf("Starting crawl at: %s\n", startURL)
 
 	// Add the initial URL to the filter
-	mu.Lock()
 	filter.Add([]byte(startURL))
-	mu.Unlock()
 
 	// Start crawling
 	err = c.Visit(startURL)
@@ -183,50 +261,49 @@ func main() {
 
 	// Stop the telemetry goroutine
 	close(done)
+	dashboard.Stop()
 
 	// Log the final telemetry data
 	finalProcessed := atomic.LoadInt64(&linksProcessed)
 	finalUnique := atomic.LoadInt64(&uniqueLinks)
-	telemetryOutput := fmt.Sprintf("Crawl finished.\nTotal links processed: %d\nUnique links found: %d\n",
-		finalProcessed, finalUnique)
+	status := "Crawl finished."
+	if reason := budget.Exhausted(); reason != "" {
+		status = fmt.Sprintf("Crawl stopped: %s budget ran out.", reason)
+	} else if shutdown.Stopping() {
+		status = "Crawl interrupted."
+	}
+	telemetryOutput := fmt.Sprintf("%s\nTotal links processed: %d\nUnique links found: %d\nBlocked by robots.txt: %d\nOut of scope: %s\nBudget: %s\nProxies: %s\nTLS: %s\nBloom filter: %d URLs in %d stage(s), estimated FP rate %.4g\nPoliteness: %s\n",
+		status, finalProcessed, finalUnique, robots.Blocked(), scope.Summary(), budget.Summary(), proxies.Summary(), cfg.TLS.Report().Summary(), filter.Count(), filter.Stages(), filter.EstimatedFPRate(), polite.Summary(10))
 	fmt.Print(telemetryOutput)
 	
 	mu.Lock()
 	file.WriteString(telemetryOutput)
 	mu.Unlock()
-}
 
-// preprocessURL preprocesses the input URL to handle variations
-func preprocessURL(inputURL string) string {
-	if inputURL == "" {
-		return ""
+	// Keep the final telemetry with the crawl's WARC records
+	if err := archive.WriteMetadata(startURL, "text/plain", []byte(telemetryOutput)); err != nil {
+		fmt.Println("Error writing WARC metadata:", err)
 	}
-
-	// Handle fragment identifiers
-	if idx := strings.Index(inputURL, "#"); idx != -1 {
-		inputURL = inputURL[:idx]
+	if err := archive.Close(); err != nil {
+		fmt.Println("Error closing WARC output:", err)
 	}
+	fmt.Printf("WARC archive: %s\n", archive.Summary())
+	metrics.Close()
 
-	parsedURL, err := url.Parse(inputURL)
-	if err != nil {
-		return ""
-	}
-
-	// Skip non-http(s) URLs
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return ""
+	// Keep the filter so the next run skips these URLs
+	if err := filter.Save(cfg.BloomFile); err != nil {
+		fmt.Println("Error saving Bloom filter:", err)
 	}
+}
 
-	if parsedURL.Host == "" {
+// preprocessURL returns the canonical form of an http(s) URL, which is also
+// its dedup key, or "" if the URL cannot be crawled
+func preprocessURL(inputURL string) string {
+	key, err := canon.Canonicalize(inputURL)
+	if err != nil || !(strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")) {
 		return ""
 	}
-
-	// Clean the path (remove trailing slash)
-	if parsedURL.Path != "/" {
-		parsedURL.Path = strings.TrimSuffix(parsedURL.Path, "/")
-	}
-
-	return parsedURL.String()
+	return key
 }
 
 // urlToFileName sanitizes the URL to be used in a file name
@@ -1,273 +1,329 @@
 package main
 
 import (
-        "crypto/tls"
-        "encoding/xml"
+        "errors"
         "fmt"
-        "io"
         "log"
-        "net"
         "net/http"
         "net/url"
         "os"
-        "path/filepath"
         "strings"
         "sync"
         "time"
 
+        "github.com/danindiana/gpt_go/crawlers/crawlkit"
         "github.com/gocolly/colly"
         "github.com/gocolly/colly/queue"
 )
 
 const (
-        visitedFilePath = "visitedURLs.xml"
-        downloadTimeout = 90 * time.Second
-        maxRetries      = 3 // Maximum number of retries for failed downloads
+        legacyVisitedFile = "visitedURLs.xml" // Imported into the visited journal on first run
+        maxRetries        = 3                 // Maximum number of retries for failed downloads
 )
 
 var (
-        visitedURLsMap   = &sync.Map{} // Thread-safe map for visited URLs
-        visitedURLsMutex sync.Mutex    // Mutex to protect file access
-        delayedQueue     = make(chan string, 3400)
-        retryCountMap    = &sync.Map{} // Track retry counts for each URL
-)
+        visited       *crawlkit.VisitedJournal // URLs already seen, kept across runs
+        delayedQueue  = make(chan string, 3400)
+        retryCountMap = &sync.Map{} // Track retry counts for each URL
 
-type VisitedURLs struct {
-        XMLName xml.Name `xml:"visitedURLs"`
-        URLs    []string `xml:"url"`
-}
+        downloadTimeout = 90 * time.Second
+        tlsPolicy       = crawlkit.TLSPolicy{}
+        shutdown        *crawlkit.Shutdown      // Cancels downloads on Ctrl+C
+        canon           *crawlkit.Canonicalizer // Turns URLs into dedup keys (url_rules)
+        polite          *crawlkit.Politeness    // Per-host rate limits with adaptive backoff
+        classifier      *crawlkit.Classifier    // Decides which links are documents
+        namer           *crawlkit.Namer         // Names saved files (name_template, on_collision)
+        scope           *crawlkit.Scope         // Which pages may be crawled (excluded_domains, scope_file)
+        archive         *crawlkit.WARCWriter    // Archives pages and downloads as WARC (warc_dir)
+        budget          *crawlkit.Budget        // Page, byte and time limits (max_pages, max_mb, max_time, host_max_*)
+        proxies         *crawlkit.Proxies       // Rotating proxy pool and per-rule proxies (proxies, scope rule proxy)
+)
 
 func main() {
-        interfaces, err := net.Interfaces()
+        cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+                Workers:         12,
+                DownloadTimeout: crawlkit.Duration{Duration: downloadTimeout},
+                TLS:             tlsPolicy,
+        })
         if err != nil {
-                log.Fatalf("Error listing network interfaces: %s", err)
+                log.Fatalf("Error loading configuration: %s", err)
         }
+        downloadTimeout = cfg.DownloadTimeout.Duration
+        tlsPolicy = cfg.TLS
 
-        fmt.Println("Available network interfaces:")
-        for i, iface := range interfaces {
-                fmt.Printf("%d: %s\n", i+1, iface.Name)
+        // Resolve the network interface (prompts only when run from a terminal)
+        localIP, err := cfg.ResolveLocalIP()
+        if err != nil {
+                log.Fatalf("Error selecting network interface: %s", err)
         }
 
-        var selectedIndex int
-        fmt.Print("Select the network interface to use (enter the number): ")
-        fmt.Scanln(&selectedIndex)
-
-        if selectedIndex < 1 || selectedIndex > len(interfaces) {
-                log.Fatalf("Invalid network interface selection")
+        // Route requests through the -proxy pool and the scope rules' proxies
+        proxies, err = cfg.Proxies()
+        if err != nil {
+                log.Fatalf("Error setting up proxies: %s", err)
         }
 
-        selectedInterface := interfaces[selectedIndex-1]
+        // Set up HTTP transport to use the selected interface
+        transport := proxies.Transport(tlsPolicy.Apply(&http.Transport{
+                Dial:            crawlkit.Dialer(localIP).Dial,
+                TLSClientConfig: tlsPolicy.ClientConfig(),
+        }))
 
-        dirs, err := os.ReadDir(".")
+        selectedDir, err := cfg.ResolveOutputDir("pdf-scrape")
         if err != nil {
-                log.Fatalf("Error reading current directory: %s", err)
+                log.Fatalf("Error selecting download directory: %s", err)
         }
 
-        dirList := []os.DirEntry{}
-        for _, dir := range dirs {
-                if dir.IsDir() {
-                        dirList = append(dirList, dir)
-                }
+        // Open the visited-URL journal, importing visitedURLs.xml the first time
+        visited, err = cfg.OpenVisited(legacyVisitedFile)
+        if err != nil {
+                log.Fatalf("Error opening visited journal: %s", err)
         }
 
-        fmt.Println("Available directories:")
-        for i, dir := range dirList {
-                fmt.Printf("%d: %s\n", i+1, dir.Name())
+        startURLs, err := cfg.ResolveStartURLs()
+        if err != nil {
+                log.Fatalf("Error reading starting URL: %s", err)
         }
 
-        fmt.Println("0: Create a new directory named 'pdf-scrape-<timestamp>'")
+        // Canonical URLs are the dedup keys for the visited journal and colly
+        canon = cfg.Canonicalizer()
 
-        var selectedDirIndex int
-        fmt.Print("Select the directory to store downloaded PDFs (enter the number or hit enter for default): ")
-        _, err = fmt.Scanln(&selectedDirIndex)
-
-        var selectedDir string
-        if err != nil || selectedDirIndex == 0 {
-                timestamp := time.Now().Format("20060102150405")
-                selectedDir = fmt.Sprintf("pdf-scrape-%s", timestamp)
-                if err := os.Mkdir(selectedDir, 0755); err != nil {
-                        log.Fatalf("Error creating directory: %s", err)
+        var startingURLs []string
+        for _, startingURL := range startURLs {
+                startingURL, err = canon.Canonicalize(startingURL)
+                if err != nil {
+                        log.Fatalf("Error canonicalizing starting URL: %s", err)
+                }
+                if err := validateURL(startingURL); err != nil {
+                        log.Fatalf("Error validating starting URL: %s", err)
                 }
-                fmt.Printf("Created new directory: %s\n", selectedDir)
-        } else if selectedDirIndex < 1 || selectedDirIndex > len(dirList) {
-                log.Fatalf("Invalid directory selection")
-        } else {
-                selectedDir = dirList[selectedDirIndex-1].Name()
+                startingURLs = append(startingURLs, startingURL)
         }
 
-        loadVisitedURLs()
-
-        var startingURL string
-        fmt.Print("Enter the starting URL to crawl: ")
-        fmt.Scanln(&startingURL)
-
-        startingURL = normalizeURL(startingURL)
+        // Links are followed only where the scope rules (excluded_domains,
+        // scope_file) allow
+        scope, err = cfg.Scope(startingURLs)
+        if err != nil {
+                log.Fatalf("Error loading crawl scope: %s", err)
+        }
+        proxies.Route(scope) // Scope rules may name their own proxy
 
-        startingURL, err = sanitizeURL(startingURL)
+        // Archive every page and document exchange as WARC/1.1 when -warc is set
+        archive, err = cfg.OpenWARC("qcrawl_feb21_syncxml")
         if err != nil {
-                log.Fatalf("Error sanitizing starting URL: %s", err)
+                log.Fatalf("Error opening WARC output: %s", err)
         }
 
-        if err := validateURL(startingURL); err != nil {
-                log.Fatalf("Error validating starting URL: %s", err)
+        // Limits on pages, bytes and time, for the crawl and for each host
+        budget = cfg.Budget()
+
+        c := colly.NewCollector(colly.MaxDepth(cfg.MaxDepth))
+        c.WithTransport(budget.Transport(archive.Transport(transport)))
+
+        if cfg.UserAgent != "" {
+                c.UserAgent = cfg.UserAgent
         }
 
-        c := colly.NewCollector()
-        c.WithTransport(&http.Transport{
-                Dial: (&net.Dialer{
-                        LocalAddr: &net.TCPAddr{
-                                IP: getInterfaceIP(selectedInterface),
-                        },
-                }).Dial,
-                TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-        })
+        // Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+        var robots *crawlkit.Robots
+        if !cfg.IgnoreRobots {
+                robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+        }
 
-        q, err := queue.New(12, &queue.InMemoryQueueStorage{MaxSize: 10000})
+        // Create a request queue with one consumer thread per configured worker,
+        // backed by an on-disk frontier that survives restarts
+        frontier := cfg.QueueStorage()
+        q, err := queue.New(cfg.Workers, frontier)
         if err != nil {
                 log.Fatalf("Error creating queue: %s", err)
         }
 
+        // Ctrl+C stops taking requests off the frontier and cancels downloads in
+        // flight; a second Ctrl+C exits at once
+        shutdown = crawlkit.NewShutdown()
+        go func() {
+                <-shutdown.Done()
+                frontier.Stop()
+        }()
+
+        // max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+        // host_max_pages and host_max_mb only skip the host
+        budget.Enforce(shutdown)
+        budget.Attach(c)
+
+        // robots.txt is consulted after the callbacks that may abort a
+        // request and before politeness, so that only requests that are sent
+        // wait out Crawl-delay or take a host token
+        if robots != nil {
+                robots.Context = shutdown.Context()
+                robots.Attach(c)
+        }
+
+        // Space requests to each host and slow down for hosts that answer
+        // 429/503 or reset connections; downloads share the same buckets
+        polite = cfg.Politeness()
+        polite.Context = shutdown.Context()
+        polite.Attach(c)
+
+        // Links are downloaded when the server says they serve a document
+        // (collect, doc_sets, doc_types), not because they end in .pdf
+        classifier, err = cfg.Classifier(c.UserAgent, &http.Client{Transport: budget.Transport(polite.Transport(transport)), Timeout: 30 * time.Second})
+        if err != nil {
+                log.Fatalf("Error configuring document sets: %s", err)
+        }
+        classifier.Context = shutdown.Context()
+        classifier.Robots = robots
+        classifier.Budget = budget
+
+        // Saved files are laid out by name_template and never overwrite each
+        // other unless on_collision says so; each document is stored once in
+        // store_dir and linked under every name it is saved as
+        namer, err = cfg.Namer()
+        if err != nil {
+                log.Fatalf("Error configuring file names: %s", err)
+        }
+
         c.OnRequest(func(r *colly.Request) {
-                log.Println("Visiting", r.URL.String())
+                log.Printf("Visiting %s (%d queued)", r.URL.String(), frontier.Len())
         })
 
-        c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-                absoluteURL := e.Request.AbsoluteURL(e.Attr("href"))
-                if !hasVisited(absoluteURL) {
-                        saveVisitedURL(absoluteURL)
-                        q.AddURL(absoluteURL)
+        // downloadPDF fetches one document; anchors and sitemap entries both feed it
+        downloadPDF := func(pdfURL string) {
+                if u, err := url.Parse(pdfURL); err == nil && !robots.Check(u) {
+                        log.Printf("Skipping %s: disallowed by robots.txt", pdfURL)
+                        return
                 }
-        })
-
-        c.OnHTML("a[href$='.pdf']", func(e *colly.HTMLElement) {
-                pdfURL := e.Request.AbsoluteURL(e.Attr("href"))
                 log.Printf("Found PDF URL: %s", pdfURL)
                 if err := downloadFileWithTimeout(pdfURL, selectedDir); err != nil {
                         log.Printf("Error downloading file: %s", err)
                 }
-        })
-
-        q.AddURL(startingURL)
-        go processDelayedQueue(selectedDir)
-        log.Println("Starting the crawler...")
-        q.Run(c)
-        log.Println("Crawler finished.")
-}
-
-func loadVisitedURLs() {
-        log.Println("Loading visited URLs...")
-
-        visitedURLsMutex.Lock()
-        defer visitedURLsMutex.Unlock()
+        }
 
-        data, err := os.ReadFile(visitedFilePath)
-        if err != nil {
-                if !os.IsNotExist(err) {
-                        log.Printf("Error reading visited URLs file: %s", err)
+        c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+                for _, link := range crawlkit.ExtractLinks(e) {
+                        u, err := url.Parse(link.URL)
+                        if err != nil {
+                                continue
+                        }
+                        if ok, _ := scope.Check(u, e.Request.Depth+1); !ok {
+                                continue
+                        }
+                        // Documents are downloaded wherever they were found; other links
+                        // are pages to queue only when Link.Page says so
+                        if classifier.IsDocument(link.URL) {
+                                downloadPDF(link.URL)
+                                continue
+                        }
+                        if !link.Page() {
+                                continue
+                        }
+                        absoluteURL, err := canon.CanonicalizeURL(u)
+                        if err != nil {
+                                continue
+                        }
+                        if !hasVisited(absoluteURL) {
+                                saveVisitedURL(absoluteURL)
+                                crawlkit.EnqueueLink(q, e.Request, crawlkit.Link{URL: absoluteURL, Source: link.Source})
+                        }
                 }
-                return
-        }
+        })
 
-        var visitedURLs VisitedURLs
-        if err := xml.Unmarshal(data, &visitedURLs); err != nil {
-                log.Printf("Error unmarshalling visited URLs: %s", err)
-                return
+        for _, startingURL := range startingURLs {
+                q.AddURL(startingURL)
         }
 
-        for _, url := range visitedURLs.URLs {
-                visitedURLsMap.Store(url, true)
-        }
-        log.Println("Visited URLs loaded.")
+        // Seed from sitemaps: listed PDFs go straight to download, pages join the queue
+        var sitemapDocs []crawlkit.SitemapEntry
+        if !cfg.NoSitemaps {
+                sitemaps := crawlkit.NewSitemaps(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second}, robots)
+                sitemaps.Scope = scope
+                sitemapDocs = sitemaps.Seed(startingURLs, classifier.IsDocument, func(e crawlkit.SitemapEntry) {
+                        u, err := url.Parse(e.Loc)
+                        if err != nil {
+                                return
+                        }
+                        loc, err := canon.CanonicalizeURL(u)
+                        if err != nil {
+                                return
+                        }
+                        e.Loc = loc
+                        if !hasVisited(e.Loc) {
+                                saveVisitedURL(e.Loc)
+                                crawlkit.EnqueueSitemapEntry(q, e)
+                        }
+                })
+        }
+        sitemapDone := make(chan struct{})
+        go func() {
+                defer close(sitemapDone)
+                for _, doc := range sitemapDocs {
+                        if shutdown.Stopping() {
+                                return
+                        }
+                        downloadPDF(doc.Loc)
+                }
+        }()
+
+        go processDelayedQueue(selectedDir)
+        log.Println("Starting the crawler...")
+        q.Run(c)
+        <-sitemapDone
+        frontier.Close()
+        if err := visited.Close(); err != nil {
+                log.Printf("Error closing visited journal: %s", err)
+        }
+        if shutdown.Stopping() {
+                log.Printf("Interrupted: %d requests left in %s for the next run.", frontier.Len(), frontier.Dir)
+        }
+        log.Printf("Crawler finished. %d URLs blocked by robots.txt.", robots.Blocked())
+        log.Printf("Budget: %s", budget.Summary())
+        log.Printf("Proxies: %s", proxies.Summary())
+        log.Printf("TLS: %s", tlsPolicy.Report().Summary())
+        log.Printf("Out of scope: %s", scope.Summary())
+        log.Printf("Per-host politeness: %s", polite.Summary(10))
+        if err := namer.Store.Close(); err != nil {
+                log.Printf("Error closing document store: %s", err)
+        }
+        log.Printf("Document store: %s", namer.Store.Summary())
+        if err := archive.Close(); err != nil {
+                log.Printf("Error closing WARC output: %s", err)
+        }
+        log.Printf("WARC archive: %s", archive.Summary())
 }
 
 func hasVisited(url string) bool {
-        _, found := visitedURLsMap.Load(url)
-        return found
+        return visited.Seen(url)
 }
 
 func saveVisitedURL(url string) {
-        visitedURLsMap.Store(url, true)
-
-        visitedURLsMutex.Lock()
-        defer visitedURLsMutex.Unlock()
-
-        var visitedURLs VisitedURLs
-
-        // Read the existing file (if it exists)
-        data, err := os.ReadFile(visitedFilePath)
-        if err == nil {
-                if err := xml.Unmarshal(data, &visitedURLs); err != nil {
-                        log.Printf("Error unmarshalling visited URLs: %s", err)
-                        return
-                }
-        }
-
-        // Append the new URL
-        visitedURLs.URLs = append(visitedURLs.URLs, url)
-
-        // Marshal the updated data
-        xmlData, err := xml.MarshalIndent(visitedURLs, "", "  ")
-        if err != nil {
-                log.Printf("Error marshalling visited URLs: %s", err)
-                return
-        }
-
-        // Log the file size before writing
-        if fi, err := os.Stat(visitedFilePath); err == nil {
-                log.Printf("File size before write: %d bytes", fi.Size())
-        }
-
-        // Write the updated data to the file
-        if err := os.WriteFile(visitedFilePath, xmlData, 0644); err != nil {
-                log.Printf("Error writing to file: %s", err)
-                return
-        }
-
-        // Log the file size after writing
-        if fi, err := os.Stat(visitedFilePath); err == nil {
-                log.Printf("File size after write: %d bytes", fi.Size())
-        }
-
-        // Optional: Sync the file to ensure it's written to disk
-        if f, err := os.OpenFile(visitedFilePath, os.O_WRONLY|os.O_SYNC, 0644); err == nil {
-                if err := f.Sync(); err != nil {
-                        log.Printf("Error syncing file: %v", err)
-                }
-                f.Close()
-        }
+        visited.Mark(url)
 }
 
 func downloadHTTPFile(URL, dir string) error {
         client := &http.Client{
                 Timeout: downloadTimeout,
-                Transport: &http.Transport{
-                        TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-                },
+                Transport: budget.Transport(polite.Transport(archive.Transport(proxies.Transport(tlsPolicy.Apply(&http.Transport{
+                        TLSClientConfig: tlsPolicy.ClientConfig(),
+                }))))),
         }
 
-        resp, err := client.Get(URL)
+        req, err := http.NewRequestWithContext(shutdown.Context(), "GET", URL, nil)
         if err != nil {
-                log.Printf("HTTP GET error for %s: %v", URL, err)
-                delayedQueue <- URL
                 return err
         }
-        defer resp.Body.Close()
-
-        if resp.StatusCode != http.StatusOK {
-                log.Printf("HTTP status %d for %s", resp.StatusCode, URL)
-                return fmt.Errorf("HTTP status %d", resp.StatusCode)
+        // Resumes the .part file of an earlier attempt with Range/If-Range
+        _, _, err = crawlkit.DownloadFile(shutdown.Context(), client, req, dir, namer, nil)
+        var statusErr *crawlkit.StatusError
+        if errors.As(err, &statusErr) {
+                log.Printf("HTTP status %d for %s", statusErr.Code, URL)
+                return err
         }
-
-        filename := filepath.Base(URL)
-        filepath := filepath.Join(dir, filename)
-
-        out, err := os.Create(filepath)
         if err != nil {
-                return err
+                log.Printf("HTTP GET error for %s: %v", URL, err)
+                if !shutdown.Stopping() && !errors.Is(err, crawlkit.ErrBudget) {
+                        delayedQueue <- URL
+                }
         }
-        defer out.Close()
-
-        _, err = io.Copy(out, resp.Body)
         return err
 }
 
@@ -293,82 +349,29 @@ func processDelayedQueue(selectedDir string) {
                                 // Reset the retry count on success
                                 retryCountMap.Delete(url)
                         }
+                case <-shutdown.Done():
+                        return
                 case <-time.After(1 * time.Minute):
                         log.Println("No delayed requests to process")
                 }
         }
 }
 
-func getInterfaceIP(iface net.Interface) net.IP {
-        addrs, err := iface.Addrs()
-        if err != nil {
-                log.Fatalf("Error getting addresses for interface %s: %s", iface.Name, err)
-        }
-
-        for _, addr := range addrs {
-                var ip net.IP
-                switch v := addr.(type) {
-                case *net.IPNet:
-                        ip = v.IP
-                case *net.IPAddr:
-                        ip = v.IP
-                }
-                if ip == nil || ip.IsLoopback() {
-                        continue
-                }
-                if ip.To4() != nil {
-                        return ip
-                }
-        }
-
-        log.Fatalf("No valid IP address found for interface %s", iface.Name)
-        return nil
-}
-
-func normalizeURL(urlStr string) string {
-        if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
-                urlStr = "https://" + urlStr
-        }
-
-        if !strings.HasPrefix(urlStr, "https://www.") {
-                urlStr = strings.Replace(urlStr, "https://", "https://www.", 1)
-        }
-
-        return urlStr
-}
-
-func sanitizeURL(urlStr string) (string, error) {
-        u, err := url.Parse(urlStr)
-        if err != nil {
-                return "", err
-        }
-
-        // Remove invalid prefixes like "chrome-extension//"
-        if strings.HasPrefix(u.Path, "//") {
-                u.Path = strings.TrimPrefix(u.Path, "//")
-        }
-
-        // Replace colons in the path with URL-encoded equivalent
-        u.Path = strings.ReplaceAll(u.Path, ":", "%3A")
-
-        // Rebuild the URL
-        return u.String(), nil
-}
-
 func downloadFileWithTimeout(URL, dir string) error {
         log.Printf("Downloading %s", URL)
+        dir = classifier.Dir(dir, URL) // Each document set has its own subfolder
 
-        // Sanitize the URL before processing
-        sanitizedURL, err := sanitizeURL(URL)
+        // Canonicalize the URL before processing
+        canonicalURL, err := canon.Canonicalize(URL)
         if err != nil {
-                return fmt.Errorf("error sanitizing URL: %s", err)
+                return fmt.Errorf("error canonicalizing URL: %s", err)
         }
 
-        if strings.HasPrefix(sanitizedURL, "http://") || strings.HasPrefix(sanitizedURL, "https://") {
-                return downloadHTTPFile(sanitizedURL, dir)
+        if strings.HasPrefix(canonicalURL, "http://") || strings.HasPrefix(canonicalURL, "https://") {
+                return downloadHTTPFile(canonicalURL, dir)
         }
 
-        return fmt.Errorf("unsupported protocol: %s", sanitizedURL)
+        return fmt.Errorf("unsupported protocol: %s", canonicalURL)
 }
 
 func validateURL(urlStr string) error {
@@ -1,134 +1,192 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/xml"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 )
 
 const (
-	visitedFilePath = "visitedURLs.xml"
-	downloadTimeout = 90 * time.Second
-	maxRetries      = 3                // Maximum number of retries for failed downloads
-	batchInterval   = 100 * time.Second // Interval for batching visited URL writes
+	legacyVisitedFile = "visitedURLs.xml" // Imported into the visited journal on first run
+	maxRetries        = 3                 // Maximum number of retries for failed downloads
 )
 
 var (
-	visitedURLsMap = &sync.Map{}             // Thread-safe map for visited URLs
-	visitedQueue   = make(chan string, 1000) // Channel for batching visited URLs
-)
+	visited *crawlkit.VisitedJournal // URLs already seen, kept across runs
+	retryWG sync.WaitGroup           // Retries still waiting or downloading
 
-type VisitedURLs struct {
-	XMLName xml.Name `xml:"visitedURLs"`
-	URLs    []string `xml:"url"`
-}
+	downloadTimeout = 90 * time.Second
+	tlsPolicy       = crawlkit.TLSPolicy{}
+	shutdown        *crawlkit.Shutdown      // Stops the crawl and cancels downloads on Ctrl+C
+	canon           *crawlkit.Canonicalizer // Turns URLs into dedup keys (url_rules)
+	polite          *crawlkit.Politeness    // Per-host rate limits with adaptive backoff
+	classifier      *crawlkit.Classifier    // Decides which links are documents
+	namer           *crawlkit.Namer         // Names saved files (name_template, on_collision)
+	scope           *crawlkit.Scope         // Which pages may be crawled (excluded_domains, scope_file)
+	archive         *crawlkit.WARCWriter    // Archives pages and downloads as WARC (warc_dir)
+	budget          *crawlkit.Budget        // Page, byte and time limits (max_pages, max_mb, max_time, host_max_*)
+	proxies         *crawlkit.Proxies       // Rotating proxy pool and per-rule proxies (proxies, scope rule proxy)
+)
 
 func main() {
-	// --- Network Interface Selection ---
-	interfaces, err := net.Interfaces()
+	cfg, err := crawlkit.Load(os.Args[0], os.Args[1:], crawlkit.Config{
+		MaxDepth:        12,
+		DownloadTimeout: crawlkit.Duration{Duration: downloadTimeout},
+		TLS:             tlsPolicy,
+	})
 	if err != nil {
-		log.Fatalf("Error listing network interfaces: %s", err)
+		log.Fatalf("Error loading configuration: %s", err)
 	}
-	fmt.Println("Available network interfaces:")
-	for i, iface := range interfaces {
-		fmt.Printf("%d: %s\n", i+1, iface.Name)
-	}
-	var selectedIndex int
-	fmt.Print("Select the network interface to use (enter the number): ")
-	fmt.Scanln(&selectedIndex)
-	if selectedIndex < 1 || selectedIndex > len(interfaces) {
-		log.Fatalf("Invalid network interface selection")
+	downloadTimeout = cfg.DownloadTimeout.Duration
+	tlsPolicy = cfg.TLS
+
+	// --- Network Interface Selection (prompts only when run from a terminal) ---
+	localIP, err := cfg.ResolveLocalIP()
+	if err != nil {
+		log.Fatalf("Error selecting network interface: %s", err)
 	}
-	selectedInterface := interfaces[selectedIndex-1]
 
 	// --- Directory Selection ---
-	dirs, err := os.ReadDir(".")
+	selectedDir, err := cfg.ResolveOutputDir("pdf-scrape")
 	if err != nil {
-		log.Fatalf("Error reading current directory: %s", err)
+		log.Fatalf("Error selecting download directory: %s", err)
 	}
-	var dirList []os.DirEntry
-	for _, dir := range dirs {
-		if dir.IsDir() {
-			dirList = append(dirList, dir)
-		}
+
+	// --- Load Previously Visited URLs ---
+	visited, err = cfg.OpenVisited(legacyVisitedFile)
+	if err != nil {
+		log.Fatalf("Error opening visited journal: %s", err)
 	}
-	fmt.Println("Available directories:")
-	for i, dir := range dirList {
-		fmt.Printf("%d: %s\n", i+1, dir.Name())
-	}
-	fmt.Println("0: Create a new directory named 'pdf-scrape-<timestamp>'")
-	var selectedDirIndex int
-	fmt.Print("Select the directory to store downloaded PDFs (enter the number or hit enter for default): ")
-	_, err = fmt.Scanln(&selectedDirIndex)
-	var selectedDir string
-	if err != nil || selectedDirIndex == 0 {
-		timestamp := time.Now().Format("20060102150405")
-		selectedDir = fmt.Sprintf("pdf-scrape-%s", timestamp)
-		if err := os.Mkdir(selectedDir, 0755); err != nil {
-			log.Fatalf("Error creating directory: %s", err)
+
+	// --- Get and Prepare the Starting URLs ---
+	startURLs, err := cfg.ResolveStartURLs()
+	if err != nil {
+		log.Fatalf("Error reading starting URL: %s", err)
+	}
+	// Canonical URLs are the dedup keys for the visited journal and colly
+	canon = cfg.Canonicalizer()
+
+	var startingURLs []string
+	for _, startingURL := range startURLs {
+		startingURL, err = canon.Canonicalize(startingURL)
+		if err != nil {
+			log.Fatalf("Error canonicalizing starting URL: %s", err)
 		}
-		fmt.Printf("Created new directory: %s\n", selectedDir)
-	} else if selectedDirIndex < 1 || selectedDirIndex > len(dirList) {
-		log.Fatalf("Invalid directory selection")
-	} else {
-		selectedDir = dirList[selectedDirIndex-1].Name()
+		if err := validateURL(startingURL); err != nil {
+			log.Fatalf("Error validating starting URL: %s", err)
+		}
+		startingURLs = append(startingURLs, startingURL)
 	}
 
-	// --- Load Previously Visited URLs ---
-	loadVisitedURLs()
-	go visitedURLSaver()
-
-	// --- Get and Prepare the Starting URL ---
-	var startingURL string
-	fmt.Print("Enter the starting URL to crawl: ")
-	fmt.Scanln(&startingURL)
-	startingURL = normalizeURL(startingURL)
-	startingURL, err = sanitizeURL(startingURL)
+	// Links are followed only where the scope rules (excluded_domains,
+	// scope_file) allow
+	scope, err = cfg.Scope(startingURLs)
+	if err != nil {
+		log.Fatalf("Error loading crawl scope: %s", err)
+	}
+	proxies.Route(scope) // Scope rules may name their own proxy
+
+	// Route requests through the -proxy pool and the scope rules' proxies
+	proxies, err = cfg.Proxies()
 	if err != nil {
-		log.Fatalf("Error sanitizing starting URL: %s", err)
+		log.Fatalf("Error setting up proxies: %s", err)
 	}
-	if err := validateURL(startingURL); err != nil {
-		log.Fatalf("Error validating starting URL: %s", err)
+
+	// Archive every page and document exchange as WARC/1.1 when -warc is set
+	archive, err = cfg.OpenWARC("qcrawl_maxdepth")
+	if err != nil {
+		log.Fatalf("Error opening WARC output: %s", err)
 	}
 
-	// --- Create the Collector with a MaxDepth (set to 5 here, use 0 for unlimited) ---
+	// --- Create the Collector with the configured MaxDepth (0 for unlimited) ---
+	// Limits on pages, bytes and time, for the crawl and for each host
+	budget = cfg.Budget()
+
 	c := colly.NewCollector(
 		colly.Async(true),
-		colly.MaxDepth(12),
+		colly.MaxDepth(cfg.MaxDepth),
 	)
+	if cfg.Workers > 0 {
+		c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Workers})
+	}
 
 	// Configure HTTP transport with connection pooling and selected interface.
-	transport := &http.Transport{
-		Dial: (&net.Dialer{
-			LocalAddr: &net.TCPAddr{
-				IP: getInterfaceIP(selectedInterface),
-			},
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			// Force HTTP/1.1 by setting NextProtos:
-			NextProtos: []string{"http/1.1"},
-		},
+	dialer := crawlkit.Dialer(localIP)
+	dialer.Timeout = 30 * time.Second
+	dialer.KeepAlive = 30 * time.Second
+	tlsConfig := tlsPolicy.ClientConfig()
+	// Force HTTP/1.1 by setting NextProtos:
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	transport := proxies.Transport(tlsPolicy.Apply(&http.Transport{
+		Dial:                dialer.Dial,
+		TLSClientConfig:     tlsConfig,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 		IdleConnTimeout:     90 * time.Second,
+	}))
+
+	c.WithTransport(budget.Transport(archive.Transport(transport)))
+
+	if cfg.UserAgent != "" {
+		c.UserAgent = cfg.UserAgent
 	}
 
-	c.WithTransport(transport)
+	// Obey robots.txt Allow/Disallow and Crawl-delay unless -ignore-robots is set
+	var robots *crawlkit.Robots
+	if !cfg.IgnoreRobots {
+		robots = crawlkit.NewRobots(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+	}
+
+	// Ctrl+C stops new requests and cancels downloads in flight, then the
+	// visited URLs are flushed as usual; a second Ctrl+C exits at once
+	shutdown = crawlkit.NewShutdown()
+	shutdown.Attach(c)
+
+	// max_pages, max_mb and max_time stop the crawl as Ctrl+C would;
+	// host_max_pages and host_max_mb only skip the host
+	budget.Enforce(shutdown)
+	budget.Attach(c)
+
+	// robots.txt is consulted after the callbacks that may abort a
+	// request and before politeness, so that only requests that are sent
+	// wait out Crawl-delay or take a host token
+	if robots != nil {
+		robots.Context = shutdown.Context()
+		robots.Attach(c)
+	}
+
+	// Space requests to each host and slow down for hosts that answer
+	// 429/503 or reset connections; downloads share the same buckets
+	polite = cfg.Politeness()
+	polite.Context = shutdown.Context()
+	polite.Attach(c)
+
+	// Links are downloaded when the server says they serve a document
+	// (collect, doc_sets, doc_types), not because they end in .pdf
+	classifier, err = cfg.Classifier(c.UserAgent, &http.Client{Transport: budget.Transport(polite.Transport(transport)), Timeout: 30 * time.Second})
+	if err != nil {
+		log.Fatalf("Error configuring document sets: %s", err)
+	}
+	classifier.Context = shutdown.Context()
+	classifier.Robots = robots
+	classifier.Budget = budget
+
+	// Saved files are laid out by name_template and never overwrite each
+	// other unless on_collision says so; each document is stored once in
+	// store_dir and linked under every name it is saved as
+	namer, err = cfg.Namer()
+	if err != nil {
+		log.Fatalf("Error configuring file names: %s", err)
+	}
 
 	// --- Callbacks ---
 	c.OnError(func(r *colly.Response, err error) {
@@ -141,132 +199,129 @@ func main() {
 		log.Printf("Fetched %d bytes from %s (Depth: %d)", len(r.Body), r.Request.URL, r.Request.Depth)
 	})
 
-	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
-		absoluteURL := e.Request.AbsoluteURL(e.Attr("href"))
-		// Skip empty or fragment-only URLs.
-		if absoluteURL == "" || strings.HasPrefix(absoluteURL, "#") {
+	// downloadPDF fetches one document; anchors and sitemap entries both feed it
+	downloadPDF := func(pdfURL string, depth int) {
+		if u, err := url.Parse(pdfURL); err == nil && !robots.Check(u) {
+			log.Printf("Skipping %s: disallowed by robots.txt", pdfURL)
 			return
 		}
-		log.Printf("Discovered link (Parent Depth: %d): %s", e.Request.Depth, absoluteURL)
-		if !hasVisited(absoluteURL) {
-			log.Printf("Enqueuing new URL: %s", absoluteURL)
-			markVisited(absoluteURL)
-			// Use e.Request.Visit to enqueue the URL with inherited depth.
-			if err := e.Request.Visit(absoluteURL); err != nil {
-				log.Printf("Error visiting %s: %s", absoluteURL, err)
+		log.Printf("Found PDF URL: %s (Depth: %d)", pdfURL, depth)
+		if err := downloadFileWithTimeout(pdfURL, selectedDir); err != nil {
+			log.Printf("Error downloading file: %s", err)
+			if !shutdown.Stopping() && !errors.Is(err, crawlkit.ErrBudget) {
+				retryWG.Add(1)
+				go func() {
+					defer retryWG.Done()
+					enqueueRetry(pdfURL, selectedDir, 1)
+				}()
 			}
 		}
-	})
+	}
 
-	c.OnHTML("a[href$='.pdf']", func(e *colly.HTMLElement) {
-		pdfURL := e.Request.AbsoluteURL(e.Attr("href"))
-		log.Printf("Found PDF URL: %s (Depth: %d)", pdfURL, e.Request.Depth)
-		if err := downloadFileWithTimeout(pdfURL, selectedDir); err != nil {
-			log.Printf("Error downloading file: %s", err)
-			go enqueueRetry(pdfURL, selectedDir, 1)
+	c.OnHTML(crawlkit.LinkSelector, func(e *colly.HTMLElement) {
+		for _, link := range crawlkit.ExtractLinks(e) {
+			u, err := url.Parse(link.URL)
+			if err != nil {
+				continue
+			}
+			if ok, _ := scope.Check(u, e.Request.Depth+1); !ok {
+				continue
+			}
+			// Documents are downloaded wherever they were found; other links
+			// are pages to queue only when Link.Page says so
+			if classifier.IsDocument(link.URL) {
+				downloadPDF(link.URL, e.Request.Depth)
+				continue
+			}
+			if !link.Page() {
+				continue
+			}
+			absoluteURL, err := canon.CanonicalizeURL(u)
+			if err != nil {
+				continue
+			}
+			log.Printf("Discovered link (Parent Depth: %d): %s", e.Request.Depth, absoluteURL)
+			if !hasVisited(absoluteURL) {
+				log.Printf("Enqueuing new URL: %s (from %s)", absoluteURL, link.Source)
+				markVisited(absoluteURL)
+				// Use e.Request.Visit to enqueue the URL with inherited depth.
+				if err := e.Request.Visit(absoluteURL); err != nil {
+					log.Printf("Error visiting %s: %s", absoluteURL, err)
+				}
+			}
 		}
 	})
 
 	// --- Start the Crawl ---
-	if err := c.Visit(startingURL); err != nil {
-		log.Fatalf("Error visiting starting URL: %s", err)
-	}
-
-	c.Wait() // Wait for all asynchronous tasks to finish
-	log.Println("Crawler finished.")
-	time.Sleep(2 * batchInterval)
-}
-
-func loadVisitedURLs() {
-	log.Println("Loading visited URLs...")
-	data, err := os.ReadFile(visitedFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("Visited URLs file not found, starting fresh.")
-			return
+	for _, startingURL := range startingURLs {
+		if err := c.Visit(startingURL); err != nil {
+			log.Fatalf("Error visiting starting URL: %s", err)
 		}
-		log.Printf("Error reading visited URLs file: %s", err)
-		return
-	}
-	if len(data) == 0 {
-		log.Println("Visited URLs file is empty.")
-		return
-	}
-	var visited VisitedURLs
-	if err := xml.Unmarshal(data, &visited); err != nil {
-		log.Printf("Error unmarshalling visited URLs: %s", err)
-		return
-	}
-	for _, url := range visited.URLs {
-		visitedURLsMap.Store(url, true)
 	}
-	log.Println("Visited URLs loaded.")
-}
 
-func visitedURLSaver() {
-	ticker := time.NewTicker(batchInterval)
-	defer ticker.Stop()
-	var urls []string
-	for {
-		select {
-		case url, ok := <-visitedQueue:
-			if !ok {
+	// Seed from sitemaps: listed PDFs go straight to download, pages are visited at depth 1
+	var sitemapDocs []crawlkit.SitemapEntry
+	if !cfg.NoSitemaps {
+		sitemaps := crawlkit.NewSitemaps(c.UserAgent, &http.Client{Transport: transport, Timeout: 30 * time.Second}, robots)
+		sitemaps.Scope = scope
+		sitemapDocs = sitemaps.Seed(startingURLs, classifier.IsDocument, func(e crawlkit.SitemapEntry) {
+			u, err := url.Parse(e.Loc)
+			if err != nil {
+				return
+			}
+			loc, err := canon.CanonicalizeURL(u)
+			if err != nil {
 				return
 			}
-			urls = append(urls, url)
-		case <-ticker.C:
-			if len(urls) > 0 {
-				flushVisitedURLs(urls)
-				urls = nil
+			e.Loc = loc
+			if !hasVisited(e.Loc) {
+				markVisited(e.Loc)
+				if err := c.Request("GET", e.Loc, nil, crawlkit.SitemapContext(e), nil); err != nil {
+					log.Printf("Error visiting %s: %s", e.Loc, err)
+				}
 			}
+		})
+	}
+	for _, doc := range sitemapDocs {
+		if shutdown.Stopping() {
+			break
 		}
+		downloadPDF(doc.Loc, 1)
 	}
-}
 
-func flushVisitedURLs(urls []string) {
-	var visited VisitedURLs
-	data, err := os.ReadFile(visitedFilePath)
-	if err == nil {
-		xml.Unmarshal(data, &visited)
-	}
-	visited.URLs = append(visited.URLs, urls...)
-	xmlData, err := xml.MarshalIndent(visited, "", "  ")
-	if err != nil {
-		log.Printf("Error marshalling visited URLs: %s", err)
-		return
-	}
-	tempFile, err := os.CreateTemp(".", "visitedURLs*.tmp")
-	if err != nil {
-		log.Printf("Error creating temp file: %s", err)
-		return
-	}
-	defer tempFile.Close()
-	if _, err := tempFile.Write(xmlData); err != nil {
-		log.Printf("Error writing to temp file: %s", err)
-		return
-	}
-	if err := tempFile.Sync(); err != nil {
-		log.Printf("Error syncing temp file: %s", err)
-		return
-	}
-	if err := os.Rename(tempFile.Name(), visitedFilePath); err != nil {
-		log.Printf("Error renaming temp file: %s", err)
-		return
+	c.Wait()       // Wait for all asynchronous tasks to finish
+	retryWG.Wait() // Retries give up early once shutdown starts
+
+	// Flush the visited-URL journal
+	if err := visited.Close(); err != nil {
+		log.Printf("Error closing visited journal: %s", err)
 	}
+
+	if shutdown.Stopping() {
+		log.Println("Crawl interrupted.")
+	}
+	log.Printf("Crawler finished. %d URLs blocked by robots.txt.", robots.Blocked())
+	log.Printf("Budget: %s", budget.Summary())
+	log.Printf("Proxies: %s", proxies.Summary())
+	log.Printf("TLS: %s", tlsPolicy.Report().Summary())
+	log.Printf("Out of scope: %s", scope.Summary())
+	log.Printf("Per-host politeness: %s", polite.Summary(10))
+	if err := namer.Store.Close(); err != nil {
+		log.Printf("Error closing document store: %s", err)
+	}
+	log.Printf("Document store: %s", namer.Store.Summary())
+	if err := archive.Close(); err != nil {
+		log.Printf("Error closing WARC output: %s", err)
+	}
+	log.Printf("WARC archive: %s", archive.Summary())
 }
 
 func hasVisited(url string) bool {
-	_, found := visitedURLsMap.Load(url)
-	return found
+	return visited.Seen(url)
 }
 
 func markVisited(url string) {
-	visitedURLsMap.Store(url, true)
-	select {
-	case visitedQueue <- url:
-	default:
-		// Skip if channel is full.
-	}
+	visited.Mark(url)
 }
 
 func enqueueRetry(URL, dir string, attempt int) {
@@ -275,105 +330,54 @@ func enqueueRetry(URL, dir string, attempt int) {
 		return
 	}
 	backoffDuration := time.Duration(1<<attempt) * time.Second
-	time.Sleep(backoffDuration)
+	if !shutdown.Sleep(backoffDuration) {
+		return
+	}
 	log.Printf("Retrying download for %s (attempt %d)", URL, attempt)
 	err := downloadFileWithTimeout(URL, dir)
 	if err != nil {
 		log.Printf("Retry %d failed for %s: %s", attempt, URL, err)
-		enqueueRetry(URL, dir, attempt+1)
+		if !shutdown.Stopping() && !errors.Is(err, crawlkit.ErrBudget) {
+			enqueueRetry(URL, dir, attempt+1)
+		}
 	}
 }
 
 func downloadHTTPFile(URL, dir string) error {
-	transport := &http.Transport{
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+	transport := tlsPolicy.Apply(&http.Transport{
+		TLSClientConfig:     tlsPolicy.ClientConfig(),
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 100,
 		IdleConnTimeout:     90 * time.Second,
-	}
+	})
 	client := &http.Client{
 		Timeout:   downloadTimeout,
-		Transport: transport,
-	}
-	resp, err := client.Get(URL)
-	if err != nil {
-		return fmt.Errorf("HTTP GET error for %s: %w", URL, err)
+		Transport: budget.Transport(polite.Transport(archive.Transport(proxies.Transport(transport)))),
 	}
-	if resp == nil {
-		return fmt.Errorf("HTTP GET returned nil response for %s", URL)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP status %d for %s", resp.StatusCode, URL)
-	}
-	filename := filepath.Base(URL)
-	filePath := filepath.Join(dir, filename)
-	out, err := os.Create(filePath)
+	req, err := http.NewRequestWithContext(shutdown.Context(), "GET", URL, nil)
 	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", filePath, err)
+		return err
 	}
-	defer out.Close()
-	n, err := io.Copy(out, resp.Body)
+	// Resumes the .part file of an earlier attempt with Range/If-Range
+	filePath, n, err := crawlkit.DownloadFile(shutdown.Context(), client, req, dir, namer, nil)
 	if err != nil {
-		return fmt.Errorf("error copying data for %s: %w", URL, err)
+		return fmt.Errorf("HTTP GET error for %s: %w", URL, err)
 	}
-	log.Printf("Downloaded %s: %d bytes", URL, n)
+	log.Printf("Downloaded %s to %s: %d bytes", URL, filePath, n)
 	return nil
 }
 
 func downloadFileWithTimeout(URL, dir string) error {
 	log.Printf("Downloading %s", URL)
-	sanitizedURL, err := sanitizeURL(URL)
-	if err != nil {
-		return fmt.Errorf("error sanitizing URL: %s", err)
-	}
-	if strings.HasPrefix(sanitizedURL, "http://") || strings.HasPrefix(sanitizedURL, "https://") {
-		return downloadHTTPFile(sanitizedURL, dir)
-	}
-	return fmt.Errorf("unsupported protocol: %s", sanitizedURL)
-}
-
-func getInterfaceIP(iface net.Interface) net.IP {
-	addrs, err := iface.Addrs()
-	if err != nil {
-		log.Fatalf("Error getting addresses for interface %s: %s", iface.Name, err)
-	}
-	for _, addr := range addrs {
-		var ip net.IP
-		switch v := addr.(type) {
-		case *net.IPNet:
-			ip = v.IP
-		case *net.IPAddr:
-			ip = v.IP
-		}
-		if ip == nil || ip.IsLoopback() {
-			continue
-		}
-		if ip.To4() != nil {
-			return ip
-		}
-	}
-	log.Fatalf("No valid IP address found for interface %s", iface.Name)
-	return nil
-}
-
-func normalizeURL(urlStr string) string {
-	if !strings.HasPrefix(urlStr, "http://") && !strings.HasPrefix(urlStr, "https://") {
-		urlStr = "https://" + urlStr
-	}
-	return urlStr
-}
-
-func sanitizeURL(urlStr string) (string, error) {
-	u, err := url.Parse(urlStr)
+	dir = classifier.Dir(dir, URL) // Each document set has its own subfolder
+	canonicalURL, err := canon.Canonicalize(URL)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("error canonicalizing URL: %s", err)
 	}
-	if strings.HasPrefix(u.Path, "//") {
-		u.Path = strings.TrimPrefix(u.Path, "//")
+	if strings.HasPrefix(canonicalURL, "http://") || strings.HasPrefix(canonicalURL, "https://") {
+		return downloadHTTPFile(canonicalURL, dir)
 	}
-	u.Path = strings.ReplaceAll(u.Path, ":", "%3A")
-	return u.String(), nil
+	return fmt.Errorf("unsupported protocol: %s", canonicalURL)
 }
 
 func validateURL(urlStr string) error {
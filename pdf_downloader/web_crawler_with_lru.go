@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 	"strings"
 	"sync"
 
+	"github.com/danindiana/gpt_go/crawlers/crawlkit"
 	"github.com/gocolly/colly"
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -18,6 +18,7 @@ var (
 	cacheCapacity     = 1000 // Setting the capacity of LRU cache to 1000
 	visitedURLsMutex  = &sync.Mutex{}
 	excludedDomains   = []string{"facebook", "youtube", "reddit", "linkedin"}
+	scope             *crawlkit.Scope // Skips the excluded domains and their subdomains
 )
 
 func main() {
@@ -43,21 +44,24 @@ func main() {
 		return
 	}
 
+	// "facebook" matches facebook.com, m.facebook.com and facebook.co.uk,
+	// but not every host that happens to contain the word
+	scope, err = crawlkit.NewScope("", []crawlkit.ScopeRule{
+		{Name: "excluded_domains", Action: "deny", Domains: excludedDomains},
+	}, nil)
+	if err != nil {
+		fmt.Println("Error configuring excluded domains:", err)
+		return
+	}
+
 	c.OnHTML("a[href]", func(e *colly.HTMLElement) {
 		link := e.Attr("href")
 
-		u, err := url.Parse(link)
-		if err != nil {
+		absoluteURL := e.Request.AbsoluteURL(link)
+		if absoluteURL == "" || !scope.Allows(absoluteURL, e.Request.Depth+1) {
 			return
 		}
 
-		for _, domain := range excludedDomains {
-			if strings.Contains(u.Host, domain) {
-				return
-			}
-		}
-
-		absoluteURL := e.Request.AbsoluteURL(link)
 		visitedURLsMutex.Lock()
 		if !visitedURLsCache.Contains(absoluteURL) {
 			visitedURLsCache.Add(absoluteURL, nil)
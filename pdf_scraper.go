@@ -5,11 +5,11 @@ import (
     "fmt"
     "io"
     "net/http"
-    "net/url"
     "os"
     "strings"
     "sync"
 
+    "github.com/danindiana/gpt_go/crawlers/crawlkit"
     "github.com/gocolly/colly"
 )
 
@@ -17,6 +17,7 @@ var (
     visitedURLs      = make(map[string]bool)
     visitedURLsMutex = &sync.Mutex{}
     excludedDomains  = []string{"facebook", "youtube", "reddit"}
+    scope            *crawlkit.Scope // Skips the excluded domains and their subdomains
 )
 
 func main() {
@@ -31,6 +32,16 @@ func main() {
         os.Exit(1)
     }
 
+    // "facebook" matches facebook.com, m.facebook.com and facebook.co.uk,
+    // but not every host that happens to contain the word
+    scope, err = crawlkit.NewScope("", []crawlkit.ScopeRule{
+        {Name: "excluded_domains", Action: "deny", Domains: excludedDomains},
+    }, nil)
+    if err != nil {
+        fmt.Printf("Error configuring excluded domains: %s\n", err)
+        os.Exit(1)
+    }
+
     // Instantiate default collector
     c := colly.NewCollector(
         colly.Async(true),
@@ -46,18 +57,11 @@ func main() {
     c.OnHTML("a[href]", func(e *colly.HTMLElement) {
         link := e.Attr("href")
 
-        u, err := url.Parse(link)
-        if err != nil {
+        absoluteURL := e.Request.AbsoluteURL(link)
+        if absoluteURL == "" || !scope.Allows(absoluteURL, e.Request.Depth+1) {
             return
         }
 
-        for _, domain := range excludedDomains {
-            if strings.Contains(u.Host, domain) {
-                return
-            }
-        }
-
-        absoluteURL := e.Request.AbsoluteURL(link)
         visitedURLsMutex.Lock()
         if _, found := visitedURLs[absoluteURL]; !found {
             visitedURLs[absoluteURL] = true